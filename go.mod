@@ -1,17 +1,36 @@
 module github.com/srcabl/users
 
-go 1.15
+go 1.16
 
-replace github.com/srcabl/services => /home/kero/automata/srcabl/services
+// The users rpcs added since protos v0.1.0, and the services packages they
+// need, are not tagged upstream yet. Build against checkouts of both next to
+// this repo until they are, then require the tags and drop these replaces.
+replace github.com/srcabl/services => ../services
 
-replace github.com/srcabl/protos => /home/kero/automata/srcabl/protos
+replace github.com/srcabl/protos => ../protos
 
 require (
+	github.com/coreos/go-oidc/v3 v3.5.0
+	github.com/go-sql-driver/mysql v1.5.0
 	github.com/gofrs/uuid v4.0.0+incompatible
+	github.com/golang-jwt/jwt/v4 v4.5.2
+	github.com/lib/pq v1.10.0
+	github.com/mattn/go-sqlite3 v1.14.15
+	github.com/nats-io/nats.go v1.11.0
 	github.com/pkg/errors v0.9.1
+	github.com/prometheus/client_golang v1.8.0
+	github.com/segmentio/kafka-go v0.3.5
 	github.com/srcabl/protos v0.1.0
 	github.com/srcabl/services v0.1.1
-	golang.org/x/crypto v0.0.0-20190605123033-f99c8df09eb5
-	google.golang.org/grpc v1.32.0
-	google.golang.org/protobuf v1.25.0
+	go.opentelemetry.io/otel v1.14.0
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc v1.14.0
+	go.opentelemetry.io/otel/exporters/stdout/stdouttrace v1.14.0
+	go.opentelemetry.io/otel/sdk v1.14.0
+	go.opentelemetry.io/otel/trace v1.14.0
+	go.uber.org/zap v1.16.0
+	golang.org/x/crypto v0.0.0-20211108221036-ceb1ce70b4fa
+	golang.org/x/oauth2 v0.4.0
+	google.golang.org/grpc v1.53.0
+	google.golang.org/protobuf v1.28.1
+	gopkg.in/yaml.v2 v2.3.0
 )
@@ -0,0 +1,117 @@
+package auth
+
+import (
+	"context"
+	"crypto/x509"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/srcabl/users/internal/token"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// TokenVerifier verifies end user access tokens
+type TokenVerifier interface {
+	Verify(string) (*token.Claims, error)
+}
+
+// SessionChecker checks the session an access token was issued for is still
+// active, and returns the roles the user holds now. A token only proves it
+// was signed, so without the check it would outlive its session being
+// revoked, and the roles it was issued with being revoked, until it expires.
+type SessionChecker interface {
+	CheckSession(ctx context.Context, userUUID, sessionUUID string) ([]string, error)
+}
+
+// Authenticator works out who is calling an rpc
+type Authenticator struct {
+	tokens   TokenVerifier
+	sessions SessionChecker
+}
+
+// NewAuthenticator news up an authenticator
+func NewAuthenticator(tokens TokenVerifier, sessions SessionChecker) *Authenticator {
+	return &Authenticator{
+		tokens:   tokens,
+		sessions: sessions,
+	}
+}
+
+// Authenticate builds the principal from the peer's verified client
+// certificate and the bearer token in the metadata. A bearer token that
+// does not verify, or whose session is no longer active, is an error rather
+// than an anonymous call. The roles of the principal are the ones the
+// session checker returns, not the ones the token was issued with.
+func (a *Authenticator) Authenticate(ctx context.Context) (*Principal, error) {
+	principal := &Principal{
+		ServiceName: serviceIdentity(ctx),
+	}
+	bearer, err := bearerToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if bearer != "" {
+		claims, err := a.tokens.Verify(bearer)
+		if err != nil {
+			return nil, errors.Wrap(err, "bearer token is not valid")
+		}
+		if claims.SessionUUID == "" {
+			return nil, errors.New("bearer token carries no session")
+		}
+		roles, err := a.sessions.CheckSession(ctx, claims.Subject, claims.SessionUUID)
+		if err != nil {
+			return nil, err
+		}
+		principal.UserUUID = claims.Subject
+		principal.SessionUUID = claims.SessionUUID
+		principal.Roles = roles
+	}
+	return principal, nil
+}
+
+func bearerToken(ctx context.Context) (string, error) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return "", nil
+	}
+	values := md.Get("authorization")
+	if len(values) == 0 {
+		return "", nil
+	}
+	if len(values) > 1 {
+		return "", errors.New("more than one authorization header was sent")
+	}
+	const prefix = "bearer "
+	if len(values[0]) <= len(prefix) || !strings.EqualFold(values[0][:len(prefix)], prefix) {
+		return "", errors.New("authorization header is not a bearer token")
+	}
+	return strings.TrimSpace(values[0][len(prefix):]), nil
+}
+
+// serviceIdentity is the identity of the client certificate the peer
+// presented, if the tls handshake verified one
+func serviceIdentity(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.AuthInfo == nil {
+		return ""
+	}
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.VerifiedChains) == 0 || len(tlsInfo.State.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return CertificateIdentity(tlsInfo.State.VerifiedChains[0][0])
+}
+
+// CertificateIdentity names the holder of a certificate by its first URI
+// SAN, then its first DNS SAN, then its common name
+func CertificateIdentity(cert *x509.Certificate) string {
+	if len(cert.URIs) > 0 {
+		return cert.URIs[0].String()
+	}
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames[0]
+	}
+	return cert.Subject.CommonName
+}
@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// UnaryServerInterceptor authenticates unary rpcs and checks them against
+// their policy. Methods without a policy are denied.
+func UnaryServerInterceptor(authn *Authenticator, policies Policies) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, err := authorize(ctx, authn, policies, info.FullMethod, req)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor authenticates stream rpcs and checks them against
+// their policy. Methods without a policy are denied.
+func StreamServerInterceptor(authn *Authenticator, policies Policies) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := authorize(ss.Context(), authn, policies, info.FullMethod, nil)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &principalStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+func authorize(ctx context.Context, authn *Authenticator, policies Policies, method string, req interface{}) (context.Context, error) {
+	principal, err := authn.Authenticate(ctx)
+	if err != nil {
+		if s, ok := status.FromError(err); ok {
+			// the session could not be checked, which says nothing of the caller
+			return nil, s.Err()
+		}
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+	policy, ok := policies[method]
+	if !ok {
+		return nil, status.Errorf(codes.PermissionDenied, "no policy allows calling %s", method)
+	}
+	if err := policy(principal, req); err != nil {
+		if errors.Cause(err) == ErrPermissionDenied && principal.IsAnonymous() {
+			return nil, status.Error(codes.Unauthenticated, err.Error())
+		}
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	}
+	return NewContext(ctx, principal), nil
+}
+
+// principalStream carries the principal in the stream's context
+type principalStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *principalStream) Context() context.Context {
+	return s.ctx
+}
@@ -0,0 +1,98 @@
+package auth
+
+import (
+	"github.com/gofrs/uuid"
+	"github.com/pkg/errors"
+)
+
+// ErrPermissionDenied is returned by policies that reject the caller
+var ErrPermissionDenied = errors.New("permission denied")
+
+// Policy decides whether the principal may make the request. Stream rpcs
+// are checked before any message is read, so their request is nil.
+type Policy func(p *Principal, req interface{}) error
+
+// Policies maps full grpc method names to the policy guarding them
+type Policies map[string]Policy
+
+// Public lets anyone call the rpc
+func Public(p *Principal, req interface{}) error {
+	return nil
+}
+
+// Authenticated lets any authenticated service or user call the rpc
+func Authenticated(p *Principal, req interface{}) error {
+	if p.IsAnonymous() {
+		return errors.Wrap(ErrPermissionDenied, "caller must be authenticated")
+	}
+	return nil
+}
+
+// ServiceOnly lets only internal services call the rpc
+func ServiceOnly(p *Principal, req interface{}) error {
+	if !p.IsService() {
+		return errors.Wrap(ErrPermissionDenied, "caller must be an internal service")
+	}
+	return nil
+}
+
+// RoleOrService lets internal services and users holding any of the roles call the rpc
+func RoleOrService(roles ...string) Policy {
+	return func(p *Principal, req interface{}) error {
+		if p.IsService() {
+			return nil
+		}
+		for _, role := range roles {
+			if p.HasRole(role) {
+				return nil
+			}
+		}
+		if !p.IsUser() {
+			return errors.Wrap(ErrPermissionDenied, "caller must be authenticated")
+		}
+		return errors.Wrapf(ErrPermissionDenied, "caller must hold one of the roles %v", roles)
+	}
+}
+
+// AnyOf lets the caller through when any of the policies does
+func AnyOf(policies ...Policy) Policy {
+	return func(p *Principal, req interface{}) error {
+		var err error
+		for _, policy := range policies {
+			if err = policy(p, req); err == nil {
+				return nil
+			}
+		}
+		return err
+	}
+}
+
+// SelfOrService lets internal services call the rpc, and users when the
+// request is about themselves. userUUID pulls the uuid of the user the
+// request acts for out of the request.
+func SelfOrService(userUUID func(req interface{}) []byte) Policy {
+	return func(p *Principal, req interface{}) error {
+		if p.IsService() {
+			return nil
+		}
+		if !p.IsUser() {
+			return errors.Wrap(ErrPermissionDenied, "caller must be authenticated")
+		}
+		if req == nil {
+			return errors.Wrap(ErrPermissionDenied, "request cannot be checked")
+		}
+		if !IsUser(p, userUUID(req)) {
+			return errors.Wrap(ErrPermissionDenied, "users may only act for themselves")
+		}
+		return nil
+	}
+}
+
+// IsUser reports whether the principal is the user with the uuid bytes
+func IsUser(p *Principal, userUUID []byte) bool {
+	id, err := uuid.FromBytes(userUUID)
+	if err != nil || !p.IsUser() {
+		return false
+	}
+	return id == uuid.FromStringOrNil(p.UserUUID)
+}
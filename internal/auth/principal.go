@@ -0,0 +1,62 @@
+package auth
+
+import (
+	"context"
+)
+
+// Principal is the authenticated caller of an rpc. A caller can be an
+// internal service, an end user, both when a service forwards a user's
+// token, or neither.
+type Principal struct {
+	ServiceName string
+	UserUUID    string
+	SessionUUID string
+	Roles       []string
+}
+
+// IsService reports whether an internal service is calling
+func (p *Principal) IsService() bool {
+	return p != nil && (p.ServiceName != "" || p.HasRole(RoleService))
+}
+
+// HasRole reports whether the calling user holds the role
+func (p *Principal) HasRole(role string) bool {
+	if !p.IsUser() {
+		return false
+	}
+	if role == RoleUser {
+		return true
+	}
+	for _, held := range p.Roles {
+		if held == role {
+			return true
+		}
+	}
+	return false
+}
+
+// IsUser reports whether an end user's token came with the call
+func (p *Principal) IsUser() bool {
+	return p != nil && p.UserUUID != ""
+}
+
+// IsAnonymous reports whether nothing about the caller could be authenticated
+func (p *Principal) IsAnonymous() bool {
+	return !p.IsService() && !p.IsUser()
+}
+
+type principalKey struct{}
+
+// NewContext returns a context carrying the principal
+func NewContext(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// FromContext returns the principal of the rpc, which is anonymous when the
+// call was not authenticated
+func FromContext(ctx context.Context) *Principal {
+	if p, ok := ctx.Value(principalKey{}).(*Principal); ok && p != nil {
+		return p
+	}
+	return &Principal{}
+}
@@ -0,0 +1,19 @@
+package auth
+
+// The roles a user can hold. Every user implicitly holds RoleUser, and a
+// user holding RoleService is treated as an internal service.
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+	RoleService   = "service"
+)
+
+// IsRole reports whether the role is one of the known roles
+func IsRole(role string) bool {
+	switch role {
+	case RoleUser, RoleModerator, RoleAdmin, RoleService:
+		return true
+	}
+	return false
+}
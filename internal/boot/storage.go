@@ -0,0 +1,124 @@
+package boot
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/pkg/errors"
+	"github.com/srcabl/services/pkg/db/mysql"
+	"github.com/srcabl/users/internal/config"
+	"github.com/srcabl/users/internal/db/postgres"
+	"github.com/srcabl/users/internal/db/sqlite"
+	"github.com/srcabl/users/internal/migrate"
+	"github.com/srcabl/users/internal/service"
+	"go.uber.org/zap"
+)
+
+// storage is the database the storage config picked and the data repo on it
+type storage struct {
+	driver   string
+	datarepo service.DataRepository
+	db       func() *sql.DB
+	connect  func() (func() error, error)
+}
+
+func newStorage(cfg *config.Config) (*storage, error) {
+	switch cfg.Storage.Driver {
+	case config.StorageMySQL:
+		db, err := mysql.New(cfg.Service)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed new db client")
+		}
+		datarepo, err := service.NewDataRepository(db)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to new data repo")
+		}
+		return &storage{driver: cfg.Storage.Driver, datarepo: datarepo, db: func() *sql.DB { return db.DB }, connect: db.Connect}, nil
+	case config.StorageSQLite:
+		db, err := sqlite.New(cfg.Storage)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed new sqlite client")
+		}
+		datarepo, err := service.NewSQLiteDataRepository(db)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to new data repo")
+		}
+		return &storage{driver: cfg.Storage.Driver, datarepo: datarepo, db: func() *sql.DB { return db.DB }, connect: db.Connect}, nil
+	case config.StoragePostgres:
+		db, err := postgres.New(cfg.Storage)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed new postgres client")
+		}
+		datarepo, err := service.NewPostgresDataRepository(db)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to new data repo")
+		}
+		return &storage{driver: cfg.Storage.Driver, datarepo: datarepo, db: func() *sql.DB { return db.DB }, connect: db.Connect}, nil
+	}
+	return nil, errors.Errorf("storage driver %q is not supported", cfg.Storage.Driver)
+}
+
+// newSearchIndex news up the search index the search config picked, along
+// with the step keeping it fresh when it needs one
+func newSearchIndex(cfg *config.Config, store *storage, logger *zap.Logger) (service.SearchIndex, func() (func() error, error)) {
+	if cfg.Search.Index == config.SearchFullText {
+		return service.NewFullTextSearchIndex(cfg.Search, store.db), nil
+	}
+	index := service.NewTrieSearchIndex(cfg.Search, store.datarepo, logger)
+	return index, index.Run
+}
+
+// migrate applies the pending migrations. It runs once the database is
+// connected and has nothing to shut down.
+func (s *storage) migrate(logger *zap.Logger) func() (func() error, error) {
+	return func() (func() error, error) {
+		migrator, err := migrate.New(s.driver, s.db())
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to new migrator")
+		}
+		applied, err := migrator.Up(context.Background())
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to migrate the database")
+		}
+		logger.Info("migrated the database", zap.Int("applied", applied))
+		return func() error { return nil }, nil
+	}
+}
+
+// NewMigrator connects to the configured database and returns a migrator
+// for it, along with the func that closes the connection
+func NewMigrator(cfg *config.Config) (*migrate.Migrator, func() error, error) {
+	store, disconnect, err := connectStorage(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	migrator, err := migrate.New(store.driver, store.db())
+	if err != nil {
+		_ = disconnect()
+		return nil, nil, errors.Wrap(err, "failed to new migrator")
+	}
+	return migrator, disconnect, nil
+}
+
+// NewDataRepository connects to the configured database and returns the data
+// repo on it, along with the func that closes the connection
+func NewDataRepository(cfg *config.Config) (service.DataRepository, func() error, error) {
+	store, disconnect, err := connectStorage(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	return store.datarepo, disconnect, nil
+}
+
+// connectStorage connects to the configured database outside of a strap
+func connectStorage(cfg *config.Config) (*storage, func() error, error) {
+	store, err := newStorage(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	disconnect, err := store.connect()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to connect to the database")
+	}
+	return store, disconnect, nil
+}
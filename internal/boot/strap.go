@@ -1,79 +1,238 @@
 package boot
 
 import (
+	"crypto/tls"
+	"net/http"
+	"os"
+	"os/signal"
+
 	"github.com/pkg/errors"
 	pb "github.com/srcabl/protos/users"
-	"github.com/srcabl/services/pkg/config"
-	"github.com/srcabl/services/pkg/db/mysql"
+	"github.com/srcabl/users/internal/auth"
+	"github.com/srcabl/users/internal/config"
+	"github.com/srcabl/users/internal/export"
+	"github.com/srcabl/users/internal/identity"
+	"github.com/srcabl/users/internal/keys"
+	"github.com/srcabl/users/internal/logging"
+	"github.com/srcabl/users/internal/metrics"
+	"github.com/srcabl/users/internal/outbox"
 	"github.com/srcabl/users/internal/server"
 	"github.com/srcabl/users/internal/service"
+	"github.com/srcabl/users/internal/timeout"
+	"github.com/srcabl/users/internal/token"
+	"github.com/srcabl/users/internal/tracing"
+	"github.com/srcabl/users/internal/webhook"
+	"go.uber.org/zap"
 	"google.golang.org/grpc"
 )
 
 // Strap initializes the user service
 type Strap struct {
-	Config     *config.Service
-	Middleware grpc.ServerOption
+	Config     *config.Config
+	Logger     *zap.Logger
+	Middleware []grpc.ServerOption
 	Service    pb.UsersServiceServer
 	Server     server.GRPC
 
-	onconnect  map[string](func() (func() error, error))
-	onshutdown map[string](func() error)
+	onconnect  []step
+	onshutdown []shutdown
+}
+
+// step is a named part of the application lifecycle. Connecting it returns
+// the func that shuts it down again.
+type step struct {
+	name    string
+	connect func() (func() error, error)
+}
+
+type shutdown struct {
+	name     string
+	shutdown func() error
 }
 
 // New news up boot and all application services
-func New(cfg *config.Service) (*Strap, error) {
-	db, err := mysql.New(cfg)
+func New(cfg *config.Config, logger *zap.Logger) (*Strap, error) {
+	tracer, err := tracing.New(cfg.Tracing)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to new tracing")
+	}
+
+	store, err := newStorage(cfg)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed new db client")
+		return nil, err
 	}
 
-	middleware := grpc.EmptyServerOption{}
+	keyManager, err := keys.NewManager(cfg.Keys)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to new key manager")
+	}
 
-	srvc, err := service.New(db)
+	tokens, err := token.NewIssuer(cfg.Tokens, keyManager)
 	if err != nil {
+		return nil, errors.Wrap(err, "failed to new token issuer")
+	}
+
+	identities, err := identity.NewProviders(cfg.IdentityProviders)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to new identity providers")
+	}
+
+	m, err := metrics.New()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to new metrics")
+	}
+	if err := m.RegisterDB("users", store.db); err != nil {
 		return nil, err
 	}
 
-	srv, err := server.New(cfg, middleware, srvc)
+	publisher, err := outbox.NewPublisher(cfg.Outbox)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to new outbox publisher")
+	}
+	relay, err := outbox.NewRelay(cfg.Outbox, store.datarepo, publisher, m, logger)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to new outbox relay")
+	}
+	dispatcher := webhook.NewDispatcher(cfg.Webhooks, store.datarepo, m, logger)
+	exports := export.NewRunner(cfg.Exports, store.datarepo, m, logger)
+	search, searchRun := newSearchIndex(cfg, store, logger)
+
+	// tracing, metrics and logging come first so rpcs turned away by auth are
+	// seen too, and the caller is added to the logs once auth knows it
+	authn := auth.NewAuthenticator(tokens, service.NewSessionChecker(store.datarepo))
+	middleware := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(
+			tracing.UnaryServerInterceptor(),
+			m.UnaryServerInterceptor(),
+			logging.UnaryServerInterceptor(logger),
+			timeout.UnaryServerInterceptor(cfg.Timeouts),
+			auth.UnaryServerInterceptor(authn, service.Policies()),
+			logging.CallerUnaryServerInterceptor(),
+		),
+		grpc.ChainStreamInterceptor(
+			tracing.StreamServerInterceptor(),
+			m.StreamServerInterceptor(),
+			logging.StreamServerInterceptor(logger),
+			timeout.StreamServerInterceptor(cfg.Timeouts),
+			auth.StreamServerInterceptor(authn, service.Policies()),
+			logging.CallerStreamServerInterceptor(),
+		),
+	}
+
+	srvc, err := service.New(cfg, store.datarepo, search, tokens, keyManager, identities, m)
+	if err != nil {
+		return nil, err
+	}
+
+	var tlsConfig *tls.Config
+	var tlsReload func() (func() error, error)
+	if cfg.TLS.CertFile != "" {
+		serverTLS, err := server.NewTLS(cfg.TLS)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to new server tls")
+		}
+		tlsConfig = serverTLS.Config()
+		tlsReload = serverTLS.Run
+	}
+
+	health := server.NewHealth(cfg.Health, srvc.Ready, logger)
+
+	srv, err := server.New(cfg.Service, tlsConfig, cfg.ShutdownTimeout, health, middleware, srvc, logger)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to new server")
 	}
 
+	// steps connect in this order and shut down in reverse, so the database
+	// is up, and migrated when asked to, before anything is served and closed
+	// only after serving stopped, and readiness drops and watches end before
+	// the server starts draining
+	onconnect := []step{
+		{"tracing", tracer.Run},
+		{"database connection", store.connect},
+	}
+	if cfg.Storage.MigrateOnBoot {
+		onconnect = append(onconnect, step{"database migrations", store.migrate(logger)})
+	}
+	onconnect = append(onconnect,
+		step{"outbox relay", relay.Run},
+		step{"webhook dispatcher", dispatcher.Run},
+		step{"data export runner", exports.Run},
+		step{"key rotation", keyManager.Run},
+	)
+	if searchRun != nil {
+		onconnect = append(onconnect, step{"search index refresh", searchRun})
+	}
+	if tlsReload != nil {
+		onconnect = append(onconnect, step{"tls reload", tlsReload})
+	}
+	if cfg.JWKS.Address != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/.well-known/jwks.json", keyManager)
+		onconnect = append(onconnect, step{"jwks run", server.NewHTTP("jwks", cfg.JWKS.Address, mux, logger).Run})
+	}
+	if cfg.Metrics.Address != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", m.Handler())
+		onconnect = append(onconnect, step{"metrics run", server.NewHTTP("metrics", cfg.Metrics.Address, mux, logger).Run})
+	}
+	onconnect = append(onconnect,
+		step{"service run", srv.Run},
+		step{"watch streams", srvc.RunWatches},
+		step{"health checks", health.Run},
+	)
+
 	return &Strap{
 		Config:     cfg,
+		Logger:     logger,
 		Middleware: middleware,
 		Service:    srvc,
 		Server:     srv,
 
-		onconnect: map[string](func() (func() error, error)){
-			"database connection": db.Connect,
-			"service run":         srv.Run,
-		},
-		onshutdown: map[string](func() error){},
+		onconnect: onconnect,
 	}, nil
 }
 
-// Connect connects all application services
+// Connect connects all application services in order. If one fails the
+// ones already connected are shut down again.
 func (s *Strap) Connect() error {
-	for name, connect := range s.onconnect {
-		os, err := connect()
+	for _, step := range s.onconnect {
+		stop, err := step.connect()
 		if err != nil {
-			return errors.Wrapf(err, "%s failed", name)
+			for _, serr := range s.Shutdown() {
+				s.Logger.Error("shutdown after failed connect", zap.Error(serr))
+			}
+			return errors.Wrapf(err, "%s failed", step.name)
 		}
-		s.onshutdown[name] = os
+		s.onshutdown = append(s.onshutdown, shutdown{step.name, stop})
+		s.Logger.Debug("connected", zap.String("step", step.name))
 	}
 	return nil
 }
 
-// Shutdown shuts down all application srvices
+// Wait blocks until one of the signals arrives or the server fails
+func (s *Strap) Wait(signals ...os.Signal) error {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, signals...)
+	defer signal.Stop(sig)
+	select {
+	case received := <-sig:
+		s.Logger.Info("shutting down", zap.Stringer("signal", received))
+		return nil
+	case err := <-s.Server.Err():
+		return err
+	}
+}
+
+// Shutdown shuts down all application services in the reverse order they
+// connected in, carrying on past failures so everything gets a chance to stop
 func (s *Strap) Shutdown() []error {
 	var errs []error
-	for name, shutdown := range s.onshutdown {
-		err := shutdown()
-		if err != nil {
-			errs = append(errs, errors.Wrapf(err, "%s failed", name))
+	for i := len(s.onshutdown) - 1; i >= 0; i-- {
+		sd := s.onshutdown[i]
+		if err := sd.shutdown(); err != nil {
+			errs = append(errs, errors.Wrapf(err, "%s shutdown failed", sd.name))
 		}
 	}
+	s.onshutdown = nil
 	return errs
 }
@@ -0,0 +1,253 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	"github.com/srcabl/users/internal/config"
+)
+
+// configEnv names the environment variable the --config flag defaults to
+const configEnv = "USERS_CONFIG"
+
+// defaultConfigPath is the config read when neither --config nor the
+// environment names one, relative to the working directory
+const defaultConfigPath = "config.yml"
+
+// CLI runs the users commands. Commands read input from Stdin, write their
+// output to Stdout and report problems on Stderr.
+type CLI struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+	Getenv func(string) string
+
+	configPath string
+}
+
+// New news up a cli on the process's standard streams and environment
+func New() *CLI {
+	return &CLI{
+		Stdin:  os.Stdin,
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+		Getenv: os.Getenv,
+	}
+}
+
+// command is a cli command. Commands with subcommands dispatch on their first
+// argument, and the others run with a flag set already carrying --config.
+type command struct {
+	name     string
+	args     string
+	summary  string
+	run      func(c *CLI, flags *flag.FlagSet, args []string) error
+	commands []*command
+}
+
+func commands() []*command {
+	return []*command{
+		{name: "serve", summary: "serve the users service until interrupted", run: (*CLI).serve},
+		{name: "migrate", summary: "manage the database schema", commands: []*command{
+			{name: "up", summary: "apply every pending migration", run: (*CLI).migrateUp},
+			{name: "down", args: "[steps]", summary: "revert the newest migrations, one unless steps are given", run: (*CLI).migrateDown},
+			{name: "status", summary: "show which migrations are applied", run: (*CLI).migrateStatus},
+			{name: "force", args: "<version>", summary: "set the schema version after fixing a failed migration by hand", run: (*CLI).migrateForce},
+		}},
+		{name: "user", summary: "manage user accounts", commands: []*command{
+			{name: "create", summary: "create a user with the password read from stdin", run: (*CLI).userCreate},
+			{name: "get", summary: "show a user", run: (*CLI).userGet},
+			{name: "delete", summary: "delete a user", run: (*CLI).userDelete},
+			{name: "set-password", summary: "set a user's password read from stdin and revoke their sessions", run: (*CLI).userSetPassword},
+			{name: "export", summary: "export everything stored about a user as json or a zip archive", run: (*CLI).userExport},
+			{name: "erase", summary: "erase everything stored about a user for good, deleted or not", run: (*CLI).userErase},
+		}},
+		{name: "follows", summary: "inspect follows", commands: []*command{
+			{name: "list", summary: "list who and what a user follows, or their followers", run: (*CLI).followsList},
+		}},
+		{name: "config", summary: "inspect the config", commands: []*command{
+			{name: "validate", summary: "check the config, and optionally the database it points at", run: (*CLI).configValidate},
+			{name: "dump", summary: "print the effective config with secrets masked", run: (*CLI).configDump},
+		}},
+	}
+}
+
+// usageError is a command run with arguments it cannot make sense of. An
+// empty message means the flag set already reported the problem.
+type usageError struct {
+	message string
+}
+
+func (e *usageError) Error() string {
+	return e.message
+}
+
+func usageErrorf(format string, args ...interface{}) error {
+	return &usageError{message: fmt.Sprintf(format, args...)}
+}
+
+// Run runs the command the arguments name and returns the exit code: zero on
+// success, one when the command failed and two when it was misused. Without
+// a command the service is served, as the binary always did.
+func (c *CLI) Run(args []string) int {
+	if c.configPath == "" {
+		c.configPath = defaultConfigPath
+		if c.Getenv != nil && c.Getenv(configEnv) != "" {
+			c.configPath = c.Getenv(configEnv)
+		}
+	}
+	root := &command{name: "users", args: "<command>", commands: commands()}
+	flags := c.flagSet("users")
+	if err := flags.Parse(args); err != nil {
+		c.usage(root, "users", flags)
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+	args = flags.Args()
+	if len(args) == 0 {
+		args = []string{"serve"}
+	}
+	return c.dispatch(root, "users", args)
+}
+
+func (c *CLI) dispatch(cmd *command, path string, args []string) int {
+	if cmd.run != nil {
+		flags := c.flagSet(path)
+		err := cmd.run(c, flags, args)
+		if err == nil {
+			return 0
+		}
+		if err == flag.ErrHelp {
+			c.usage(cmd, path, flags)
+			return 0
+		}
+		if uerr, ok := err.(*usageError); ok {
+			if uerr.message != "" {
+				fmt.Fprintf(c.Stderr, "%s: %s\n", path, uerr.message)
+			}
+			c.usage(cmd, path, flags)
+			return 2
+		}
+		fmt.Fprintf(c.Stderr, "%s: %v\n", path, err)
+		return 1
+	}
+	if len(args) == 0 {
+		c.usage(cmd, path, nil)
+		return 2
+	}
+	if args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		c.usage(cmd, path, nil)
+		return 0
+	}
+	for _, sub := range cmd.commands {
+		if sub.name == args[0] {
+			return c.dispatch(sub, path+" "+sub.name, args[1:])
+		}
+	}
+	fmt.Fprintf(c.Stderr, "%s: unknown command %q\n", path, args[0])
+	c.usage(cmd, path, nil)
+	return 2
+}
+
+// flagSet returns a flag set that leaves reporting usage to dispatch and
+// takes --config wherever it is given
+func (c *CLI) flagSet(path string) *flag.FlagSet {
+	flags := flag.NewFlagSet(path, flag.ContinueOnError)
+	flags.SetOutput(c.Stderr)
+	flags.Usage = func() {}
+	flags.StringVar(&c.configPath, "config", c.configPath, fmt.Sprintf("config file, defaults to $%s or %s", configEnv, defaultConfigPath))
+	return flags
+}
+
+func (c *CLI) usage(cmd *command, path string, flags *flag.FlagSet) {
+	usage := path
+	switch {
+	case cmd.args != "":
+		usage += " " + cmd.args
+	case len(cmd.commands) > 0:
+		usage += " <command>"
+	}
+	if cmd.run != nil {
+		usage += " [flags]"
+	}
+	fmt.Fprintf(c.Stderr, "usage: %s\n", usage)
+	if cmd.summary != "" {
+		fmt.Fprintf(c.Stderr, "\n%s\n", cmd.summary)
+	}
+	if len(cmd.commands) > 0 {
+		fmt.Fprintf(c.Stderr, "\ncommands:\n")
+		w := tabwriter.NewWriter(c.Stderr, 0, 4, 2, ' ', 0)
+		for _, sub := range cmd.commands {
+			fmt.Fprintf(w, "  %s\t%s\n", sub.name, sub.summary)
+		}
+		_ = w.Flush()
+	}
+	if flags != nil {
+		fmt.Fprintf(c.Stderr, "\nflags:\n")
+		flags.PrintDefaults()
+	}
+}
+
+// parse parses the flags, turning everything but a request for help into a
+// usage error since the flag set already reported it
+func parse(flags *flag.FlagSet, args []string) error {
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return err
+		}
+		return &usageError{}
+	}
+	return nil
+}
+
+// noArgs parses the flags of commands that take no arguments
+func noArgs(flags *flag.FlagSet, args []string) error {
+	if err := parse(flags, args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return usageErrorf("unexpected argument %q", flags.Arg(0))
+	}
+	return nil
+}
+
+// config loads the config the --config flag names with the environment and
+// secret files layered over it, and validates the result
+func (c *CLI) config() (*config.Config, error) {
+	getenv := c.Getenv
+	if getenv == nil {
+		getenv = os.Getenv
+	}
+	cfg, err := config.LoadWithEnv(c.configPath, getenv)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, errors.Wrap(err, c.configPath)
+	}
+	return cfg, nil
+}
+
+// table writes aligned columns to stdout until flushed
+func (c *CLI) table() *tabwriter.Writer {
+	return tabwriter.NewWriter(c.Stdout, 0, 4, 2, ' ', 0)
+}
+
+// stringList is a flag that may be given more than once
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
@@ -0,0 +1,250 @@
+package cli_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/srcabl/users/internal/boot"
+	"github.com/srcabl/users/internal/cli"
+	"github.com/srcabl/users/internal/config"
+	"github.com/srcabl/users/internal/service"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// harness runs the cli against a config backed by a sqlite file of its own
+type harness struct {
+	t          *testing.T
+	configPath string
+	env        map[string]string
+}
+
+func newHarness(t *testing.T) *harness {
+	t.Helper()
+	dir := t.TempDir()
+	return &harness{
+		t:          t,
+		configPath: writeConfig(t, dir, fmt.Sprintf("storage:\n  driver: sqlite\n  path: %s\nkeys:\n  secret: test-secret\n", filepath.Join(dir, "users.db"))),
+		env:        map[string]string{config.SecretsDirEnv: t.TempDir()},
+	}
+}
+
+func writeConfig(t *testing.T, dir, contents string) string {
+	t.Helper()
+	path := filepath.Join(dir, "config.yml")
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	return path
+}
+
+type result struct {
+	code   int
+	stdout string
+	stderr string
+}
+
+// run runs the cli with the harness config and the stdin given
+func (h *harness) run(stdin string, args ...string) result {
+	h.t.Helper()
+	return h.runRaw(stdin, append([]string{"--config", h.configPath}, args...)...)
+}
+
+func (h *harness) runRaw(stdin string, args ...string) result {
+	h.t.Helper()
+	var stdout, stderr bytes.Buffer
+	c := &cli.CLI{
+		Stdin:  strings.NewReader(stdin),
+		Stdout: &stdout,
+		Stderr: &stderr,
+		Getenv: func(key string) string { return h.env[key] },
+	}
+	code := c.Run(args)
+	return result{code: code, stdout: stdout.String(), stderr: stderr.String()}
+}
+
+func (h *harness) expect(res result, code int, contains string) {
+	h.t.Helper()
+	if res.code != code {
+		h.t.Fatalf("expected exit code %d, got %d\nstdout: %s\nstderr: %s", code, res.code, res.stdout, res.stderr)
+	}
+	if !strings.Contains(res.stdout+res.stderr, contains) {
+		h.t.Fatalf("expected output to contain %q\nstdout: %s\nstderr: %s", contains, res.stdout, res.stderr)
+	}
+}
+
+func (h *harness) datarepo() service.DataRepository {
+	h.t.Helper()
+	cfg, err := config.Load(h.configPath)
+	if err != nil {
+		h.t.Fatalf("failed to load config: %v", err)
+	}
+	datarepo, disconnect, err := boot.NewDataRepository(cfg)
+	if err != nil {
+		h.t.Fatalf("failed to new data repo: %v", err)
+	}
+	h.t.Cleanup(func() { _ = disconnect() })
+	return datarepo
+}
+
+// field returns the value of the named row of a user printout
+func field(t *testing.T, out, name string) string {
+	t.Helper()
+	for _, line := range strings.Split(out, "\n") {
+		if strings.HasPrefix(line, name+" ") {
+			return strings.TrimSpace(strings.TrimPrefix(line, name))
+		}
+	}
+	t.Fatalf("expected a %s row in %s", name, out)
+	return ""
+}
+
+func TestUsage(t *testing.T) {
+	h := newHarness(t)
+	h.expect(h.run("", "nope"), 2, `unknown command "nope"`)
+	h.expect(h.run("", "user"), 2, "set-password")
+	h.expect(h.run("", "help"), 0, "migrate")
+	h.expect(h.run("", "user", "get", "--bogus"), 2, "flag provided but not defined")
+	h.expect(h.run("", "user", "get", "-h"), 0, "-username")
+	h.expect(h.run("", "migrate", "down", "zero"), 2, "not a positive number")
+	h.expect(h.run("", "migrate", "force"), 2, "a version is required")
+}
+
+func TestConfigValidate(t *testing.T) {
+	h := newHarness(t)
+	h.expect(h.run("", "config", "validate"), 0, "is valid")
+	h.expect(h.run("", "config", "validate", "--connect"), 1, "run migrate up")
+	h.expect(h.run("", "migrate", "up"), 0, "applied")
+	h.expect(h.run("", "config", "validate", "--connect"), 0, "at the latest version")
+
+	bad := writeConfig(t, t.TempDir(), "storage:\n  driver: oracle\nlogging:\n  level: loud\n")
+	res := h.runRaw("", "config", "validate", "--config", bad)
+	h.expect(res, 1, "storage.driver")
+	h.expect(res, 1, "logging.level")
+
+	h.expect(h.runRaw("", "config", "validate", "--config", filepath.Join(t.TempDir(), "missing.yml")), 1, "missing.yml")
+}
+
+func TestConfigDump(t *testing.T) {
+	h := newHarness(t)
+	h.env["USERS_LOGGING_LEVEL"] = "debug"
+	res := h.run("", "config", "dump")
+	h.expect(res, 0, "level: debug")
+	h.expect(res, 0, "secret: '******'")
+	if strings.Contains(res.stdout, "test-secret") {
+		t.Fatalf("expected the key secret to be masked in\n%s", res.stdout)
+	}
+	h.env["USERS_LOGGING_LEVEL"] = "loud"
+	h.expect(h.run("", "config", "dump"), 1, `logging.level "loud"`)
+}
+
+func TestConfigFromEnvironment(t *testing.T) {
+	h := newHarness(t)
+	h.env["USERS_CONFIG"] = h.configPath
+	h.expect(h.runRaw("", "config", "validate"), 0, h.configPath)
+}
+
+func TestMigrate(t *testing.T) {
+	h := newHarness(t)
+	h.expect(h.run("", "migrate", "status"), 0, "pending")
+	h.expect(h.run("", "migrate", "up"), 0, "applied 13 migrations")
+	h.expect(h.run("", "migrate", "up"), 0, "applied 0 migrations")
+	if res := h.run("", "migrate", "status"); strings.Contains(res.stdout, "pending") {
+		t.Fatalf("expected every migration applied, got %s", res.stdout)
+	}
+	h.expect(h.run("", "migrate", "down"), 0, "reverted 1 migrations")
+	h.expect(h.run("", "migrate", "status"), 0, "12-active-user-uniqueness")
+	h.expect(h.run("", "migrate", "down", "9"), 0, "reverted 9 migrations")
+	h.expect(h.run("", "migrate", "force", "1"), 1, "not a known migration")
+	h.expect(h.run("", "migrate", "force", "20210207175633"), 0, "forced version 20210207175633")
+	h.expect(h.run("", "migrate", "force", "0"), 0, "forced version 0")
+	h.expect(h.run("", "migrate", "up"), 0, "applied 13 migrations")
+}
+
+func TestUserCommands(t *testing.T) {
+	h := newHarness(t)
+	h.expect(h.run("", "migrate", "up"), 0, "applied")
+
+	h.expect(h.run("", "user", "create", "--username", "alice", "--email", "alice@example.com"), 2, "password is required")
+	h.expect(h.run("pw\n", "user", "create", "--username", "alice"), 2, "--email are required")
+	h.expect(h.run("pw\n", "user", "create", "--username", "alice", "--email", "alice@example.com", "--role", "king"), 2, `"king" is not a role`)
+
+	res := h.run("first password\n", "user", "create", "--username", "alice", "--email", "alice@example.com", "--role", "admin")
+	h.expect(res, 0, "alice@example.com")
+	if roles := field(t, res.stdout, "roles"); roles != "admin" {
+		t.Fatalf("expected the admin role, got %q", roles)
+	}
+	aliceUUID := field(t, res.stdout, "uuid")
+	h.expect(h.run("pw\n", "user", "create", "--username", "alice", "--email", "other@example.com"), 1, "already exists")
+
+	h.expect(h.run("", "user", "get", "--username", "alice"), 0, aliceUUID)
+	h.expect(h.run("", "user", "get", "--email", "alice@example.com"), 0, aliceUUID)
+	h.expect(h.run("", "user", "get", "--uuid", aliceUUID), 0, "alice")
+	h.expect(h.run("", "user", "get", "--uuid", "not-a-uuid"), 2, "not well formed")
+	h.expect(h.run("", "user", "get", "--username", "alice", "--email", "alice@example.com"), 2, "exactly one of")
+	h.expect(h.run("", "user", "get", "--username", "bob"), 1, "user does not exist")
+
+	h.expect(h.run("second password\n", "user", "set-password", "--email", "alice@example.com"), 0, "revoked their sessions")
+	dbUser, err := h.datarepo().GetUserByID(context.Background(), aliceUUID)
+	if err != nil {
+		t.Fatalf("failed to get user: %v", err)
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(dbUser.HashedPassword), []byte("second password")); err != nil {
+		t.Fatalf("expected the new password to be set: %v", err)
+	}
+
+	h.expect(h.run("", "user", "export", "--username", "alice"), 0, aliceUUID)
+	h.expect(h.run("", "user", "export", "--username", "alice", "--format", "xml"), 2, `"xml" is not an export format`)
+	h.expect(h.run("", "user", "export", "--username", "alice", "--format", "zip"), 2, "--output is required")
+	archive := filepath.Join(t.TempDir(), "alice.zip")
+	h.expect(h.run("", "user", "export", "--username", "alice", "--format", "zip", "--output", archive), 0, "exported user "+aliceUUID)
+	written, err := zip.OpenReader(archive)
+	if err != nil {
+		t.Fatalf("expected a zip archive written: %v", err)
+	}
+	_ = written.Close()
+
+	h.expect(h.run("", "user", "delete", "--username", "alice"), 0, "deleted user "+aliceUUID)
+	h.expect(h.run("", "user", "get", "--username", "alice"), 1, "user does not exist")
+
+	h.expect(h.run("", "user", "erase", "--username", "alice"), 1, "user does not exist")
+	res = h.run("", "user", "erase", "--uuid", aliceUUID)
+	h.expect(res, 0, "completed")
+	if erased := field(t, res.stdout, "erased users"); erased != "1" {
+		t.Fatalf("expected the account erased, got %q", erased)
+	}
+	h.expect(h.run("", "user", "erase", "--uuid", aliceUUID), 0, field(t, res.stdout, "tombstone"))
+	h.expect(h.run("", "user", "erase", "--uuid", "9d2bd2b4-3ef7-4a8e-8a0c-6a2c5f7e1e43"), 1, "user does not exist")
+}
+
+func TestFollowsList(t *testing.T) {
+	h := newHarness(t)
+	h.expect(h.run("", "migrate", "up"), 0, "applied")
+	aliceUUID := field(t, h.run("pw\n", "user", "create", "--username", "alice", "--email", "alice@example.com").stdout, "uuid")
+	bobUUID := field(t, h.run("pw\n", "user", "create", "--username", "bob", "--email", "bob@example.com").stdout, "uuid")
+
+	if res := h.run("", "follows", "list", "--username", "alice"); res.code != 0 || res.stdout != "" {
+		t.Fatalf("expected no follows, got %d %q %q", res.code, res.stdout, res.stderr)
+	}
+
+	ctx := context.Background()
+	datarepo := h.datarepo()
+	source := "1b4e28ba-2fa1-11d2-883f-0016d3cca427"
+	if err := datarepo.AddUserFollower(ctx, aliceUUID, bobUUID); err != nil {
+		t.Fatalf("failed to follow user: %v", err)
+	}
+	if err := datarepo.AddSourceFollower(ctx, aliceUUID, source); err != nil {
+		t.Fatalf("failed to follow source: %v", err)
+	}
+
+	res := h.run("", "follows", "list", "--username", "alice")
+	h.expect(res, 0, bobUUID)
+	h.expect(res, 0, "bob")
+	h.expect(res, 0, source)
+	h.expect(h.run("", "follows", "list", "--uuid", bobUUID, "--followers"), 0, aliceUUID)
+}
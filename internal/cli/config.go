@@ -0,0 +1,59 @@
+package cli
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/srcabl/users/internal/boot"
+)
+
+func (c *CLI) configValidate(flags *flag.FlagSet, args []string) error {
+	var connect bool
+	flags.BoolVar(&connect, "connect", false, "also connect to the database and check its schema is up to date")
+	if err := noArgs(flags, args); err != nil {
+		return err
+	}
+	cfg, err := c.config()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.Stdout, "%s is valid\n", c.configPath)
+	if !connect {
+		return nil
+	}
+	migrator, disconnect, err := boot.NewMigrator(cfg)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = disconnect() }()
+	status, err := migrator.Status(context.Background())
+	if err != nil {
+		return err
+	}
+	switch {
+	case status.Dirty:
+		return errors.Errorf("the %s database is dirty at version %d", cfg.Storage.Driver, status.Version)
+	case status.Version < status.Latest:
+		return errors.Errorf("the %s database is at version %d, run migrate up to reach %d", cfg.Storage.Driver, status.Version, status.Latest)
+	}
+	fmt.Fprintf(c.Stdout, "the %s database is reachable and at the latest version %d\n", cfg.Storage.Driver, status.Version)
+	return nil
+}
+
+func (c *CLI) configDump(flags *flag.FlagSet, args []string) error {
+	if err := noArgs(flags, args); err != nil {
+		return err
+	}
+	cfg, err := c.config()
+	if err != nil {
+		return err
+	}
+	dump, err := cfg.Dump()
+	if err != nil {
+		return err
+	}
+	_, err = c.Stdout.Write(dump)
+	return err
+}
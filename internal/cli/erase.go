@@ -0,0 +1,66 @@
+package cli
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/srcabl/users/internal/service"
+)
+
+func (c *CLI) userErase(flags *flag.FlagSet, args []string) error {
+	var who userFlags
+	who.register(flags)
+	if err := noArgs(flags, args); err != nil {
+		return err
+	}
+	if err := who.check(); err != nil {
+		return err
+	}
+	return c.withDataRepository(func(ctx context.Context, datarepo service.DataRepository) error {
+		// deleted users are only found by uuid, which also resumes an
+		// erasure that was interrupted after the account was erased
+		userUUID := who.uuid
+		if userUUID == "" {
+			dbUser, err := who.find(ctx, datarepo)
+			if err != nil {
+				return err
+			}
+			userUUID = dbUser.UUID
+		}
+		erasure, err := service.Erase(ctx, datarepo, userUUID, operatorUUID, time.Now().Unix())
+		if errors.Cause(err) == sql.ErrNoRows {
+			return errors.New("user does not exist")
+		}
+		if err != nil {
+			return errors.Wrap(err, "failed to erase user")
+		}
+		return c.printErasure(erasure)
+	})
+}
+
+func (c *CLI) printErasure(erasure *service.DBErasure) error {
+	w := c.table()
+	fmt.Fprintf(w, "erasure\t%s\n", erasure.UUID)
+	fmt.Fprintf(w, "user\t%s\n", erasure.UserUUID)
+	fmt.Fprintf(w, "tombstone\t%s\n", erasure.TombstoneUUID)
+	fmt.Fprintf(w, "status\t%s\n", erasure.Status)
+	if erasure.CompletedAt.Valid {
+		fmt.Fprintf(w, "completed\t%s by %s\n", formatUnix(erasure.CompletedAt.Int64), erasure.RequestedByUUID)
+	}
+	keys := make([]string, 0, len(erasure.Erased))
+	for key, n := range erasure.Erased {
+		if n > 0 {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "erased %s\t%d\n", key, erasure.Erased[key])
+	}
+	return w.Flush()
+}
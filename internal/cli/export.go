@@ -0,0 +1,59 @@
+package cli
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/srcabl/users/internal/export"
+	"github.com/srcabl/users/internal/service"
+)
+
+func (c *CLI) userExport(flags *flag.FlagSet, args []string) error {
+	var who userFlags
+	who.register(flags)
+	var format, output string
+	flags.StringVar(&format, "format", service.ExportJSON, "format of the export, json or zip")
+	flags.StringVar(&output, "output", "", "file to write the export to instead of stdout")
+	if err := noArgs(flags, args); err != nil {
+		return err
+	}
+	if err := who.check(); err != nil {
+		return err
+	}
+	if format != service.ExportJSON && format != service.ExportZip {
+		return usageErrorf("%q is not an export format", format)
+	}
+	if format == service.ExportZip && output == "" {
+		return usageErrorf("--output is required for zip exports")
+	}
+	return c.withDataRepository(func(ctx context.Context, datarepo service.DataRepository) error {
+		dbUser, err := who.find(ctx, datarepo)
+		if err != nil {
+			return err
+		}
+		built, err := export.Build(ctx, datarepo, dbUser.UUID, time.Now().Unix())
+		if err != nil {
+			return errors.Wrap(err, "failed to build export")
+		}
+		if output == "" {
+			return built.Write(c.Stdout, format)
+		}
+		f, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return errors.Wrap(err, "failed to create export file")
+		}
+		if err := built.Write(f, format); err != nil {
+			_ = f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return errors.Wrap(err, "failed to write export file")
+		}
+		fmt.Fprintf(c.Stdout, "exported user %s to %s\n", dbUser.UUID, output)
+		return nil
+	})
+}
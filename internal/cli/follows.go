@@ -0,0 +1,65 @@
+package cli
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/srcabl/users/internal/service"
+)
+
+func (c *CLI) followsList(flags *flag.FlagSet, args []string) error {
+	var who userFlags
+	who.register(flags)
+	var followers bool
+	flags.BoolVar(&followers, "followers", false, "list the users following the user instead")
+	if err := noArgs(flags, args); err != nil {
+		return err
+	}
+	if err := who.check(); err != nil {
+		return err
+	}
+	return c.withDataRepository(func(ctx context.Context, datarepo service.DataRepository) error {
+		dbUser, err := who.find(ctx, datarepo)
+		if err != nil {
+			return err
+		}
+		w := c.table()
+		if followers {
+			uuids, err := datarepo.ListUserFollowers(ctx, dbUser.UUID)
+			if err != nil {
+				return errors.Wrap(err, "failed to list followers")
+			}
+			for _, id := range uuids {
+				fmt.Fprintf(w, "follower\t%s\t%s\n", id, username(ctx, datarepo, id))
+			}
+			return w.Flush()
+		}
+		users, err := datarepo.ListUserFollows(ctx, dbUser.UUID)
+		if err != nil {
+			return errors.Wrap(err, "failed to list followed users")
+		}
+		sources, err := datarepo.ListSourceFollows(ctx, dbUser.UUID)
+		if err != nil {
+			return errors.Wrap(err, "failed to list followed sources")
+		}
+		for _, id := range users {
+			fmt.Fprintf(w, "user\t%s\t%s\n", id, username(ctx, datarepo, id))
+		}
+		for _, id := range sources {
+			fmt.Fprintf(w, "source\t%s\t\n", id)
+		}
+		return w.Flush()
+	})
+}
+
+// username looks up the username of the user for display, which is empty
+// for users since deleted
+func username(ctx context.Context, datarepo service.DataRepository, userUUID string) string {
+	dbUser, err := datarepo.GetUserByID(ctx, userUUID)
+	if err != nil {
+		return ""
+	}
+	return dbUser.Username
+}
@@ -0,0 +1,109 @@
+package cli
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strconv"
+
+	"github.com/srcabl/users/internal/boot"
+	"github.com/srcabl/users/internal/migrate"
+)
+
+func (c *CLI) migrateUp(flags *flag.FlagSet, args []string) error {
+	if err := noArgs(flags, args); err != nil {
+		return err
+	}
+	return c.withMigrator(func(migrator *migrate.Migrator) error {
+		applied, err := migrator.Up(context.Background())
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(c.Stdout, "applied %d migrations\n", applied)
+		return nil
+	})
+}
+
+func (c *CLI) migrateDown(flags *flag.FlagSet, args []string) error {
+	if err := parse(flags, args); err != nil {
+		return err
+	}
+	steps := 1
+	switch flags.NArg() {
+	case 0:
+	case 1:
+		n, err := strconv.Atoi(flags.Arg(0))
+		if err != nil || n < 1 {
+			return usageErrorf("steps %q is not a positive number", flags.Arg(0))
+		}
+		steps = n
+	default:
+		return usageErrorf("unexpected argument %q", flags.Arg(1))
+	}
+	return c.withMigrator(func(migrator *migrate.Migrator) error {
+		reverted, err := migrator.Down(context.Background(), steps)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(c.Stdout, "reverted %d migrations\n", reverted)
+		return nil
+	})
+}
+
+func (c *CLI) migrateStatus(flags *flag.FlagSet, args []string) error {
+	if err := noArgs(flags, args); err != nil {
+		return err
+	}
+	return c.withMigrator(func(migrator *migrate.Migrator) error {
+		status, err := migrator.Status(context.Background())
+		if err != nil {
+			return err
+		}
+		w := c.table()
+		for _, migration := range migrator.Migrations() {
+			state := "pending"
+			switch {
+			case status.Dirty && migration.Version == status.Version:
+				state = "dirty"
+			case migration.Version <= status.Version:
+				state = "applied"
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\n", migration.Version, migration.Name, state)
+		}
+		return w.Flush()
+	})
+}
+
+func (c *CLI) migrateForce(flags *flag.FlagSet, args []string) error {
+	if err := parse(flags, args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return usageErrorf("a version is required")
+	}
+	version, err := strconv.ParseUint(flags.Arg(0), 10, 64)
+	if err != nil {
+		return usageErrorf("version %q is not a number", flags.Arg(0))
+	}
+	return c.withMigrator(func(migrator *migrate.Migrator) error {
+		if err := migrator.Force(context.Background(), version); err != nil {
+			return err
+		}
+		fmt.Fprintf(c.Stdout, "forced version %d\n", version)
+		return nil
+	})
+}
+
+// withMigrator runs the func with a migrator on the configured database
+func (c *CLI) withMigrator(fn func(*migrate.Migrator) error) error {
+	cfg, err := c.config()
+	if err != nil {
+		return err
+	}
+	migrator, disconnect, err := boot.NewMigrator(cfg)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = disconnect() }()
+	return fn(migrator)
+}
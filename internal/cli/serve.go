@@ -0,0 +1,51 @@
+package cli
+
+import (
+	"flag"
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/srcabl/users/internal/boot"
+	"github.com/srcabl/users/internal/logging"
+	"go.uber.org/zap"
+)
+
+// serve boots the service and serves until SIGINT or SIGTERM arrives
+func (c *CLI) serve(flags *flag.FlagSet, args []string) error {
+	if err := noArgs(flags, args); err != nil {
+		return err
+	}
+	cfg, err := c.config()
+	if err != nil {
+		return err
+	}
+	logger, err := logging.New(cfg.Logging)
+	if err != nil {
+		return errors.Wrap(err, "failed to new logger")
+	}
+	defer func() { _ = logger.Sync() }()
+
+	strap, err := boot.New(cfg, logger)
+	if err != nil {
+		logger.Error("failed to boot", zap.Error(err))
+		return errors.Wrap(err, "failed to boot")
+	}
+	if err := strap.Connect(); err != nil {
+		logger.Error("failed to connect", zap.Error(err))
+		return errors.Wrap(err, "failed to connect")
+	}
+	failed := false
+	if err := strap.Wait(os.Interrupt, syscall.SIGTERM); err != nil {
+		logger.Error("server failed", zap.Error(err))
+		failed = true
+	}
+	for _, err := range strap.Shutdown() {
+		logger.Error("failed to shut down", zap.Error(err))
+		failed = true
+	}
+	if failed {
+		return errors.New("the service did not stop cleanly")
+	}
+	return nil
+}
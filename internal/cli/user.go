@@ -0,0 +1,244 @@
+package cli
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/pkg/errors"
+	"github.com/srcabl/users/internal/auth"
+	"github.com/srcabl/users/internal/boot"
+	"github.com/srcabl/users/internal/service"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// operatorUUID is recorded as the author of changes made from the cli. Like
+// internal services acting on their own, operators have no uuid of their own.
+var operatorUUID = uuid.Nil.String()
+
+// userFlags picks a user by exactly one of its uuid, username or email
+type userFlags struct {
+	uuid     string
+	username string
+	email    string
+}
+
+func (u *userFlags) register(flags *flag.FlagSet) {
+	flags.StringVar(&u.uuid, "uuid", "", "uuid of the user")
+	flags.StringVar(&u.username, "username", "", "username of the user")
+	flags.StringVar(&u.email, "email", "", "email of the user")
+}
+
+func (u *userFlags) check() error {
+	set := 0
+	for _, value := range []string{u.uuid, u.username, u.email} {
+		if value != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		return usageErrorf("exactly one of --uuid, --username or --email is required")
+	}
+	if u.uuid != "" {
+		if _, err := uuid.FromString(u.uuid); err != nil {
+			return usageErrorf("uuid %q is not well formed", u.uuid)
+		}
+	}
+	return nil
+}
+
+func (u *userFlags) find(ctx context.Context, datarepo service.DataRepository) (*service.DBUser, error) {
+	var dbUser *service.DBUser
+	var err error
+	switch {
+	case u.uuid != "":
+		dbUser, err = datarepo.GetUserByID(ctx, u.uuid)
+	case u.username != "":
+		dbUser, err = datarepo.GetUserByUsername(ctx, u.username)
+	default:
+		dbUser, err = datarepo.GetUserByEmail(ctx, u.email)
+	}
+	if errors.Cause(err) == sql.ErrNoRows {
+		return nil, errors.New("user does not exist")
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get user")
+	}
+	return dbUser, nil
+}
+
+func (c *CLI) userCreate(flags *flag.FlagSet, args []string) error {
+	var username, email string
+	var roles stringList
+	flags.StringVar(&username, "username", "", "username of the new user")
+	flags.StringVar(&email, "email", "", "email of the new user")
+	flags.Var(&roles, "role", "role to grant the new user, may be repeated")
+	if err := noArgs(flags, args); err != nil {
+		return err
+	}
+	if username == "" || email == "" {
+		return usageErrorf("--username and --email are required")
+	}
+	for _, role := range roles {
+		if !auth.IsRole(role) {
+			return usageErrorf("%q is not a role", role)
+		}
+	}
+	hashedPassword, err := c.readPassword()
+	if err != nil {
+		return err
+	}
+	return c.withDataRepository(func(ctx context.Context, datarepo service.DataRepository) error {
+		dbUser, err := service.NewDBUser(username, email, hashedPassword, operatorUUID)
+		if err != nil {
+			return err
+		}
+		if !datarepo.ValidateUserForCreate(ctx, dbUser) {
+			return errors.New("a user with that username or email already exists")
+		}
+		if err := datarepo.CreateUser(ctx, dbUser); err != nil {
+			return errors.Wrap(err, "failed to create user")
+		}
+		for _, role := range roles {
+			err := datarepo.GrantRole(ctx, &service.DBRole{
+				UserUUID:      dbUser.UUID,
+				Role:          role,
+				CreatedAt:     time.Now().Unix(),
+				CreatedByUUID: operatorUUID,
+			})
+			if err != nil {
+				return errors.Wrapf(err, "created user %s but failed to grant role %s", dbUser.UUID, role)
+			}
+		}
+		created, err := datarepo.GetUserByID(ctx, dbUser.UUID)
+		if err != nil {
+			return errors.Wrap(err, "failed to reload user")
+		}
+		return c.printUser(created)
+	})
+}
+
+func (c *CLI) userGet(flags *flag.FlagSet, args []string) error {
+	var who userFlags
+	who.register(flags)
+	if err := noArgs(flags, args); err != nil {
+		return err
+	}
+	if err := who.check(); err != nil {
+		return err
+	}
+	return c.withDataRepository(func(ctx context.Context, datarepo service.DataRepository) error {
+		dbUser, err := who.find(ctx, datarepo)
+		if err != nil {
+			return err
+		}
+		return c.printUser(dbUser)
+	})
+}
+
+func (c *CLI) userDelete(flags *flag.FlagSet, args []string) error {
+	var who userFlags
+	who.register(flags)
+	if err := noArgs(flags, args); err != nil {
+		return err
+	}
+	if err := who.check(); err != nil {
+		return err
+	}
+	return c.withDataRepository(func(ctx context.Context, datarepo service.DataRepository) error {
+		dbUser, err := who.find(ctx, datarepo)
+		if err != nil {
+			return err
+		}
+		if err := datarepo.DeleteUser(ctx, dbUser.UUID, operatorUUID, time.Now().Unix()); err != nil {
+			return errors.Wrap(err, "failed to delete user")
+		}
+		fmt.Fprintf(c.Stdout, "deleted user %s\n", dbUser.UUID)
+		return nil
+	})
+}
+
+func (c *CLI) userSetPassword(flags *flag.FlagSet, args []string) error {
+	var who userFlags
+	who.register(flags)
+	if err := noArgs(flags, args); err != nil {
+		return err
+	}
+	if err := who.check(); err != nil {
+		return err
+	}
+	hashedPassword, err := c.readPassword()
+	if err != nil {
+		return err
+	}
+	return c.withDataRepository(func(ctx context.Context, datarepo service.DataRepository) error {
+		dbUser, err := who.find(ctx, datarepo)
+		if err != nil {
+			return err
+		}
+		if err := datarepo.UpdateUserPassword(ctx, dbUser.UUID, hashedPassword, operatorUUID, time.Now().Unix()); err != nil {
+			return errors.Wrap(err, "failed to set password")
+		}
+		fmt.Fprintf(c.Stdout, "set the password of user %s and revoked their sessions\n", dbUser.UUID)
+		return nil
+	})
+}
+
+// readPassword reads a password from the first line of stdin, which keeps it
+// out of the shell history and the process list, and returns its hash
+func (c *CLI) readPassword() (string, error) {
+	line, err := bufio.NewReader(c.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", errors.Wrap(err, "failed to read password from stdin")
+	}
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		return "", usageErrorf("a password is required on stdin")
+	}
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to hash password")
+	}
+	return string(hashed), nil
+}
+
+func (c *CLI) printUser(dbUser *service.DBUser) error {
+	w := c.table()
+	fmt.Fprintf(w, "uuid\t%s\n", dbUser.UUID)
+	fmt.Fprintf(w, "username\t%s\n", dbUser.Username)
+	fmt.Fprintf(w, "email\t%s\n", dbUser.Email)
+	fmt.Fprintf(w, "roles\t%s\n", strings.Join(dbUser.Roles, ", "))
+	fmt.Fprintf(w, "created\t%s by %s\n", formatUnix(dbUser.CreatedAt), dbUser.CreatedByUUID)
+	if dbUser.UpdatedAt.Valid {
+		fmt.Fprintf(w, "updated\t%s by %s\n", formatUnix(dbUser.UpdatedAt.Int64), dbUser.UpdatedByUUID.String)
+	}
+	fmt.Fprintf(w, "failed logins\t%d\n", dbUser.FailedLoginAttempts)
+	if dbUser.IsLocked(time.Now().Unix()) {
+		fmt.Fprintf(w, "locked until\t%s\n", formatUnix(dbUser.LockedUntil.Int64))
+	}
+	return w.Flush()
+}
+
+func formatUnix(unix int64) string {
+	return time.Unix(unix, 0).UTC().Format(time.RFC3339)
+}
+
+// withDataRepository runs the func with the data repo on the configured database
+func (c *CLI) withDataRepository(fn func(context.Context, service.DataRepository) error) error {
+	cfg, err := c.config()
+	if err != nil {
+		return err
+	}
+	datarepo, disconnect, err := boot.NewDataRepository(cfg)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = disconnect() }()
+	return fn(context.Background(), datarepo)
+}
@@ -0,0 +1,621 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/srcabl/services/pkg/config"
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the users service configuration. It wraps the shared service
+// config and adds the sections only the users service cares about, which are
+// read from the same file.
+type Config struct {
+	Service  *config.Service `yaml:"-"`
+	Storage  Storage         `yaml:"storage"`
+	Logging  Logging         `yaml:"logging"`
+	TLS      TLS             `yaml:"tls"`
+	Tokens   Tokens          `yaml:"tokens"`
+	Keys     Keys            `yaml:"keys"`
+	JWKS     JWKS            `yaml:"jwks"`
+	Metrics  Metrics         `yaml:"metrics"`
+	Tracing  Tracing         `yaml:"tracing"`
+	Lockout  Lockout         `yaml:"lockout"`
+	Health   Health          `yaml:"health"`
+	Timeouts Timeouts        `yaml:"timeouts"`
+	Outbox   Outbox          `yaml:"outbox"`
+	Watch    Watch           `yaml:"watch"`
+	Webhooks Webhooks        `yaml:"webhooks"`
+	Exports  Exports         `yaml:"exports"`
+	Search   Search          `yaml:"search"`
+
+	// ShutdownTimeout bounds how long in flight rpcs get to finish on shutdown
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+
+	IdentityProviders []IdentityProvider `yaml:"identity_providers"`
+}
+
+// The storage drivers the data repository can be backed by
+const (
+	StorageMySQL    = "mysql"
+	StorageSQLite   = "sqlite"
+	StoragePostgres = "postgres"
+)
+
+// Storage picks the database the data repository is backed by. MySQL is
+// reached through the shared service's db section. SQLite keeps everything
+// in the single file at Path, or in memory when the path is ":memory:".
+// Postgres is reached at the connection URL in DSN. MigrateOnBoot applies
+// pending migrations before the service starts serving.
+type Storage struct {
+	Driver        string `yaml:"driver"`
+	Path          string `yaml:"path"`
+	DSN           string `yaml:"dsn" secret:"true"`
+	MigrateOnBoot bool   `yaml:"migrate_on_boot"`
+}
+
+// Logging configures the service logger. Level is one of debug, info, warn
+// or error and format is json or console.
+type Logging struct {
+	Level  string `yaml:"level"`
+	Format string `yaml:"format"`
+}
+
+// TLS configures the grpc listener's TLS. TLS is off unless a certificate is
+// set. Setting a client CA turns on mutual TLS: client certificates are
+// verified against it when given, and required when RequireClientCert is set.
+// When AllowedSANs is set a client certificate must carry one of them as a
+// URI or DNS SAN. The files are reloaded on the reload interval when they change.
+type TLS struct {
+	CertFile          string        `yaml:"cert_file"`
+	KeyFile           string        `yaml:"key_file"`
+	ClientCAFile      string        `yaml:"client_ca_file"`
+	RequireClientCert bool          `yaml:"require_client_cert"`
+	AllowedSANs       []string      `yaml:"allowed_sans"`
+	ReloadInterval    time.Duration `yaml:"reload_interval"`
+}
+
+// Tokens configures the issuing of session tokens. Access tokens are checked
+// against their session on every call, so revoking a session ends its access
+// tokens at once rather than when they expire.
+type Tokens struct {
+	Issuer          string        `yaml:"issuer"`
+	Audience        string        `yaml:"audience"`
+	AccessTokenTTL  time.Duration `yaml:"access_token_ttl"`
+	RefreshTokenTTL time.Duration `yaml:"refresh_token_ttl"`
+}
+
+// Keys configures the keys tokens are signed with. Keys are read from PEM
+// files, either listed one by one or dropped into a directory, and the file
+// name without its extension is used as the key ID. When a rotation interval
+// is set new keys are generated on that schedule and written to the key
+// directory, which replicas must share so they all verify every key and keys
+// outlive restarts. Replicas pick up each other's keys on the reload
+// interval, which has to be shorter than the pre publish period so a new key
+// is loaded everywhere before it signs.
+type Keys struct {
+	Dir              string        `yaml:"dir"`
+	Files            []string      `yaml:"files"`
+	Secret           string        `yaml:"secret"`
+	Algorithm        string        `yaml:"algorithm"`
+	RotationInterval time.Duration `yaml:"rotation_interval"`
+	PrePublish       time.Duration `yaml:"pre_publish"`
+	GracePeriod      time.Duration `yaml:"grace_period"`
+	ReloadInterval   time.Duration `yaml:"reload_interval"`
+}
+
+// JWKS configures the optional http listener publishing the public keys
+type JWKS struct {
+	Address string `yaml:"address"`
+}
+
+// Metrics configures the optional http listener exposing prometheus metrics
+type Metrics struct {
+	Address string `yaml:"address"`
+}
+
+// Tracing configures where spans are exported. The exporter is one of otlp,
+// which sends spans over grpc to the endpoint, stdout, or file, which appends
+// them as json to the file for local debugging. Tracing is off when no
+// exporter is set.
+type Tracing struct {
+	Exporter    string  `yaml:"exporter"`
+	Endpoint    string  `yaml:"endpoint"`
+	Insecure    bool    `yaml:"insecure"`
+	File        string  `yaml:"file"`
+	ServiceName string  `yaml:"service_name"`
+	SampleRatio float64 `yaml:"sample_ratio"`
+}
+
+// Lockout configures locking accounts after repeated failed logins. A
+// threshold of zero disables locking.
+type Lockout struct {
+	Threshold int           `yaml:"threshold"`
+	Duration  time.Duration `yaml:"duration"`
+}
+
+// Timeouts bounds how long rpcs may run. The default applies to every unary
+// rpc unless the caller asked for a sooner deadline, and methods overrides it
+// by full method name, streaming ones included. Zero means no bound.
+type Timeouts struct {
+	Default time.Duration            `yaml:"default"`
+	Methods map[string]time.Duration `yaml:"methods"`
+}
+
+// Health configures the readiness check behind the grpc health service
+type Health struct {
+	Interval time.Duration `yaml:"interval"`
+	Timeout  time.Duration `yaml:"timeout"`
+}
+
+// The publishers the outbox relay can publish events through
+const (
+	PublisherNATS    = "nats"
+	PublisherKafka   = "kafka"
+	PublisherWebhook = "webhook"
+	PublisherFile    = "file"
+)
+
+// Outbox configures the relay publishing the events the data repo records
+// in the outbox. The publisher is one of nats, kafka, webhook or file, which
+// appends json lines to the file for local development. Without one events
+// are marked published as they come in and only kept for the retention.
+// Relays on every replica contend for a lease that lasts the lease TTL, and
+// only the one holding it publishes, in the order the events were written.
+// An event that fails to publish holds back the later events of its user
+// until it goes out on a later poll.
+type Outbox struct {
+	Publisher      string        `yaml:"publisher"`
+	File           string        `yaml:"file"`
+	PollInterval   time.Duration `yaml:"poll_interval"`
+	BatchSize      int           `yaml:"batch_size"`
+	PublishTimeout time.Duration `yaml:"publish_timeout"`
+	LeaseTTL       time.Duration `yaml:"lease_ttl"`
+	Retention      time.Duration `yaml:"retention"`
+	NATS           OutboxNATS    `yaml:"nats"`
+	Kafka          OutboxKafka   `yaml:"kafka"`
+	Webhook        OutboxWebhook `yaml:"webhook"`
+}
+
+// OutboxNATS publishes events to JetStream on the subject prefix with the
+// event type appended, as in srcabl.users.user.created. A stream has to take
+// in the subjects for publishes to be acknowledged.
+type OutboxNATS struct {
+	URL           string `yaml:"url"`
+	SubjectPrefix string `yaml:"subject_prefix"`
+}
+
+// OutboxKafka publishes events to the topic, keyed by the user they belong
+// to so each user's events keep their order on one partition
+type OutboxKafka struct {
+	Brokers []string `yaml:"brokers"`
+	Topic   string   `yaml:"topic"`
+}
+
+// OutboxWebhook posts events to the URL. With a secret the body is signed
+// with HMAC-SHA256 and the signature sent in the X-Srcabl-Signature header.
+type OutboxWebhook struct {
+	URL    string `yaml:"url"`
+	Secret string `yaml:"secret"`
+}
+
+// Watch configures the WatchUser and WatchFollows streams, which poll the
+// outbox on the poll interval. An id missing below ones already written
+// belongs to a transaction still in flight, so streams wait up to the gap
+// timeout for it to commit before moving past it. Streams with nothing to
+// send get a checkpoint carrying their resume token every checkpoint
+// interval, so the token of a quiet stream does not fall behind the outbox
+// retention.
+type Watch struct {
+	PollInterval       time.Duration `yaml:"poll_interval"`
+	BatchSize          int           `yaml:"batch_size"`
+	GapTimeout         time.Duration `yaml:"gap_timeout"`
+	CheckpointInterval time.Duration `yaml:"checkpoint_interval"`
+}
+
+// Webhooks configures the dispatcher delivering events to the webhooks
+// subscribed through the API. Every poll interval it attempts up to the
+// batch size of the due deliveries, the concurrency of them at a time, each
+// bounded by the timeout. A failed delivery is attempted again after a
+// backoff that doubles from the initial backoff up to the max backoff, and
+// is given up on as dead after max attempts. Delivered deliveries are kept
+// for the retention.
+type Webhooks struct {
+	PollInterval   time.Duration `yaml:"poll_interval"`
+	BatchSize      int           `yaml:"batch_size"`
+	Concurrency    int           `yaml:"concurrency"`
+	Timeout        time.Duration `yaml:"timeout"`
+	MaxAttempts    int           `yaml:"max_attempts"`
+	InitialBackoff time.Duration `yaml:"initial_backoff"`
+	MaxBackoff     time.Duration `yaml:"max_backoff"`
+	Retention      time.Duration `yaml:"retention"`
+}
+
+// Exports configures the runner building the data exports requested through
+// the API. Every poll interval it builds up to the batch size of the pending
+// exports one at a time, each bounded by the timeout. Completed exports are
+// kept for download for the retention.
+type Exports struct {
+	PollInterval time.Duration `yaml:"poll_interval"`
+	BatchSize    int           `yaml:"batch_size"`
+	Timeout      time.Duration `yaml:"timeout"`
+	Retention    time.Duration `yaml:"retention"`
+}
+
+// The indexes user searches can run on
+const (
+	SearchTrie     = "trie"
+	SearchFullText = "fulltext"
+)
+
+// Search configures the index user searches run on. The trie index keeps
+// every user in memory. It polls the outbox on the poll interval and updates
+// the users changed, and is rebuilt every refresh interval in case it missed
+// a change. The fulltext index queries the FULLTEXT index on the users table
+// directly and needs the mysql driver. Searches rank and page through at
+// most max candidates of the users matched.
+type Search struct {
+	Index           string        `yaml:"index"`
+	PollInterval    time.Duration `yaml:"poll_interval"`
+	RefreshInterval time.Duration `yaml:"refresh_interval"`
+	MaxCandidates   int           `yaml:"max_candidates"`
+}
+
+// IdentityProvider configures an external OIDC identity provider. Its
+// endpoints and keys are found through OIDC discovery on the issuer URL.
+// Codes are exchanged with RedirectURL unless the client asks for one of
+// RedirectURLs, no other redirect is accepted.
+type IdentityProvider struct {
+	Name         string   `yaml:"name"`
+	IssuerURL    string   `yaml:"issuer_url"`
+	ClientID     string   `yaml:"client_id"`
+	ClientSecret string   `yaml:"client_secret"`
+	RedirectURL  string   `yaml:"redirect_url"`
+	RedirectURLs []string `yaml:"redirect_urls"`
+	Scopes       []string `yaml:"scopes"`
+}
+
+// Load reads the config file at the given path and layers the process
+// environment and secret files over it
+func Load(path string) (*Config, error) {
+	return LoadWithEnv(path, os.Getenv)
+}
+
+// LoadWithEnv reads the config in layers: the defaults, then the file at the
+// given path, then environment variables looked up with getenv, then secret
+// files. Later layers override single values of earlier ones.
+func LoadWithEnv(path string, getenv func(string) string) (*Config, error) {
+	svc, err := config.NewService(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read service config %s", path)
+	}
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read config %s", path)
+	}
+	cfg := Default()
+	if err := yaml.Unmarshal(raw, cfg); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse config %s", path)
+	}
+	overrides, err := overlay(getenv)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read config overrides")
+	}
+	if overrides != nil {
+		if err := yaml.Unmarshal(overrides, cfg); err != nil {
+			return nil, errors.Wrap(err, "failed to apply config overrides")
+		}
+		if err := yaml.Unmarshal(overrides, svc); err != nil {
+			return nil, errors.Wrap(err, "failed to apply service config overrides")
+		}
+	}
+	cfg.Service = svc
+	return cfg, nil
+}
+
+// Validate checks the config for values the service cannot run with and
+// reports every problem it finds at once
+func (c *Config) Validate() error {
+	var problems []string
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	switch c.Storage.Driver {
+	case StorageMySQL:
+	case StorageSQLite:
+		if c.Storage.Path == "" {
+			problem("storage.path is required for the sqlite driver")
+		}
+	case StoragePostgres:
+		if c.Storage.DSN == "" {
+			problem("storage.dsn is required for the postgres driver")
+		}
+	default:
+		problem("storage.driver %q is not one of mysql, sqlite or postgres", c.Storage.Driver)
+	}
+
+	switch c.Logging.Level {
+	case "debug", "info", "warn", "error":
+	default:
+		problem("logging.level %q is not one of debug, info, warn or error", c.Logging.Level)
+	}
+	switch c.Logging.Format {
+	case "json", "console":
+	default:
+		problem("logging.format %q is not one of json or console", c.Logging.Format)
+	}
+
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		problem("tls.cert_file and tls.key_file must be set together")
+	}
+	if c.TLS.CertFile == "" && (c.TLS.ClientCAFile != "" || c.TLS.RequireClientCert) {
+		problem("tls.client_ca_file and tls.require_client_cert need tls.cert_file")
+	}
+
+	if c.Tokens.AccessTokenTTL <= 0 {
+		problem("tokens.access_token_ttl must be positive")
+	}
+	if c.Tokens.RefreshTokenTTL <= 0 {
+		problem("tokens.refresh_token_ttl must be positive")
+	}
+
+	switch c.Keys.Algorithm {
+	case "RS256", "ES256", "EdDSA":
+	default:
+		problem("keys.algorithm %q is not one of RS256, ES256 or EdDSA", c.Keys.Algorithm)
+	}
+	if c.Keys.Dir == "" && len(c.Keys.Files) == 0 && c.Keys.Secret == "" {
+		problem("keys needs a dir, files or a secret to sign tokens with")
+	}
+	if c.Keys.RotationInterval > 0 {
+		if c.Keys.Dir == "" {
+			problem("keys.rotation_interval needs a keys.dir shared by every replica")
+		}
+		if c.Keys.ReloadInterval <= 0 || c.Keys.ReloadInterval >= c.Keys.PrePublish {
+			problem("keys.reload_interval must be positive and shorter than keys.pre_publish when keys rotate")
+		}
+	}
+
+	switch c.Tracing.Exporter {
+	case "", "stdout":
+	case "otlp":
+		if c.Tracing.Endpoint == "" {
+			problem("tracing.endpoint is required for the otlp exporter")
+		}
+	case "file":
+		if c.Tracing.File == "" {
+			problem("tracing.file is required for the file exporter")
+		}
+	default:
+		problem("tracing.exporter %q is not one of otlp, stdout or file", c.Tracing.Exporter)
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		problem("tracing.sample_ratio %v is not between 0 and 1", c.Tracing.SampleRatio)
+	}
+
+	if c.Lockout.Threshold < 0 {
+		problem("lockout.threshold must not be negative")
+	}
+	if c.Lockout.Threshold > 0 && c.Lockout.Duration <= 0 {
+		problem("lockout.duration must be positive when lockout.threshold is set")
+	}
+
+	switch c.Outbox.Publisher {
+	case "":
+	case PublisherNATS:
+		if c.Outbox.NATS.URL == "" {
+			problem("outbox.nats.url is required for the nats publisher")
+		}
+		if c.Outbox.NATS.SubjectPrefix == "" {
+			problem("outbox.nats.subject_prefix is required for the nats publisher")
+		}
+	case PublisherKafka:
+		if len(c.Outbox.Kafka.Brokers) == 0 {
+			problem("outbox.kafka.brokers is required for the kafka publisher")
+		}
+		if c.Outbox.Kafka.Topic == "" {
+			problem("outbox.kafka.topic is required for the kafka publisher")
+		}
+	case PublisherWebhook:
+		if u, err := url.Parse(c.Outbox.Webhook.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problem("outbox.webhook.url %q is not an http or https url", c.Outbox.Webhook.URL)
+		}
+	case PublisherFile:
+		if c.Outbox.File == "" {
+			problem("outbox.file is required for the file publisher")
+		}
+	default:
+		problem("outbox.publisher %q is not one of nats, kafka, webhook or file", c.Outbox.Publisher)
+	}
+	if c.Outbox.PollInterval <= 0 {
+		problem("outbox.poll_interval must be positive")
+	}
+	if c.Outbox.BatchSize <= 0 {
+		problem("outbox.batch_size must be positive")
+	}
+	if c.Outbox.PublishTimeout <= 0 {
+		problem("outbox.publish_timeout must be positive")
+	}
+	if c.Outbox.LeaseTTL <= c.Outbox.PollInterval {
+		problem("outbox.lease_ttl must be longer than outbox.poll_interval")
+	}
+	if c.Outbox.Retention <= 0 {
+		problem("outbox.retention must be positive")
+	}
+	if c.Watch.PollInterval <= 0 {
+		problem("watch.poll_interval must be positive")
+	}
+	if c.Watch.BatchSize <= 0 {
+		problem("watch.batch_size must be positive")
+	}
+	if c.Watch.GapTimeout <= 0 {
+		problem("watch.gap_timeout must be positive")
+	}
+	if c.Watch.CheckpointInterval <= 0 || c.Watch.CheckpointInterval >= c.Outbox.Retention {
+		problem("watch.checkpoint_interval must be positive and shorter than outbox.retention")
+	}
+	if c.Webhooks.PollInterval <= 0 {
+		problem("webhooks.poll_interval must be positive")
+	}
+	if c.Webhooks.BatchSize <= 0 {
+		problem("webhooks.batch_size must be positive")
+	}
+	if c.Webhooks.Concurrency <= 0 {
+		problem("webhooks.concurrency must be positive")
+	}
+	if c.Webhooks.Timeout <= 0 {
+		problem("webhooks.timeout must be positive")
+	}
+	if c.Webhooks.MaxAttempts <= 0 {
+		problem("webhooks.max_attempts must be positive")
+	}
+	if c.Webhooks.InitialBackoff <= 0 || c.Webhooks.MaxBackoff < c.Webhooks.InitialBackoff {
+		problem("webhooks.initial_backoff must be positive and no longer than webhooks.max_backoff")
+	}
+	if c.Webhooks.Retention <= 0 {
+		problem("webhooks.retention must be positive")
+	}
+	if c.Exports.PollInterval <= 0 {
+		problem("exports.poll_interval must be positive")
+	}
+	if c.Exports.BatchSize <= 0 {
+		problem("exports.batch_size must be positive")
+	}
+	if c.Exports.Timeout <= 0 {
+		problem("exports.timeout must be positive")
+	}
+	if c.Exports.Retention <= 0 {
+		problem("exports.retention must be positive")
+	}
+	switch c.Search.Index {
+	case SearchTrie:
+		if c.Search.PollInterval <= 0 {
+			problem("search.poll_interval must be positive")
+		}
+		if c.Search.RefreshInterval <= 0 {
+			problem("search.refresh_interval must be positive")
+		}
+	case SearchFullText:
+		if c.Storage.Driver != StorageMySQL {
+			problem("search.index %q needs the mysql driver", c.Search.Index)
+		}
+	default:
+		problem("search.index %q is not one of trie or fulltext", c.Search.Index)
+	}
+	if c.Search.MaxCandidates <= 0 {
+		problem("search.max_candidates must be positive")
+	}
+
+	names := map[string]bool{}
+	for i, provider := range c.IdentityProviders {
+		if provider.Name == "" {
+			problem("identity_providers[%d].name is required", i)
+		} else if names[provider.Name] {
+			problem("identity_providers[%d].name %q is used twice", i, provider.Name)
+		}
+		names[provider.Name] = true
+		if provider.IssuerURL == "" {
+			problem("identity_providers[%d].issuer_url is required", i)
+		}
+		if provider.ClientID == "" {
+			problem("identity_providers[%d].client_id is required", i)
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.Errorf("config is not valid:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// Default returns the config with all defaults filled in
+func Default() *Config {
+	return &Config{
+		Storage: Storage{
+			Driver: StorageMySQL,
+		},
+		Logging: Logging{
+			Level:  "info",
+			Format: "json",
+		},
+		TLS: TLS{
+			ReloadInterval: time.Minute,
+		},
+		Tokens: Tokens{
+			Issuer:          "srcabl-users",
+			Audience:        "srcabl",
+			AccessTokenTTL:  15 * time.Minute,
+			RefreshTokenTTL: 30 * 24 * time.Hour,
+		},
+		Keys: Keys{
+			Algorithm:      "RS256",
+			PrePublish:     time.Hour,
+			GracePeriod:    24 * time.Hour,
+			ReloadInterval: time.Minute,
+		},
+		Tracing: Tracing{
+			ServiceName: "users",
+			SampleRatio: 1,
+		},
+		Lockout: Lockout{
+			Threshold: 5,
+			Duration:  15 * time.Minute,
+		},
+		Timeouts: Timeouts{
+			Default: 10 * time.Second,
+		},
+		Health: Health{
+			Interval: 10 * time.Second,
+			Timeout:  2 * time.Second,
+		},
+		Outbox: Outbox{
+			PollInterval:   time.Second,
+			BatchSize:      100,
+			PublishTimeout: 10 * time.Second,
+			LeaseTTL:       30 * time.Second,
+			Retention:      7 * 24 * time.Hour,
+			NATS: OutboxNATS{
+				SubjectPrefix: "srcabl.users",
+			},
+			Kafka: OutboxKafka{
+				Topic: "srcabl.users.events",
+			},
+		},
+		Watch: Watch{
+			PollInterval:       time.Second,
+			BatchSize:          100,
+			GapTimeout:         10 * time.Second,
+			CheckpointInterval: 30 * time.Second,
+		},
+		Webhooks: Webhooks{
+			PollInterval:   time.Second,
+			BatchSize:      50,
+			Concurrency:    4,
+			Timeout:        10 * time.Second,
+			MaxAttempts:    10,
+			InitialBackoff: 10 * time.Second,
+			MaxBackoff:     time.Hour,
+			Retention:      7 * 24 * time.Hour,
+		},
+		Exports: Exports{
+			PollInterval: 5 * time.Second,
+			BatchSize:    10,
+			Timeout:      5 * time.Minute,
+			Retention:    7 * 24 * time.Hour,
+		},
+		Search: Search{
+			Index:           SearchTrie,
+			PollInterval:    time.Second,
+			RefreshInterval: 10 * time.Minute,
+			MaxCandidates:   1000,
+		},
+		ShutdownTimeout: 15 * time.Second,
+	}
+}
@@ -0,0 +1,215 @@
+package config_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/srcabl/users/internal/config"
+)
+
+func writeFile(t *testing.T, dir, name, contents string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatalf("failed to write %s: %v", name, err)
+	}
+	return path
+}
+
+// env returns a getenv over the map that points the secrets directory at an
+// empty one, so secrets on the machine running the tests stay out of them
+func env(t *testing.T, vars map[string]string) func(string) string {
+	if _, ok := vars[config.SecretsDirEnv]; !ok {
+		vars[config.SecretsDirEnv] = t.TempDir()
+	}
+	return func(key string) string { return vars[key] }
+}
+
+const fileConfig = `
+storage:
+  driver: sqlite
+  path: users.db
+logging:
+  level: warn
+tokens:
+  access_token_ttl: 1m
+keys:
+  secret: file-secret
+`
+
+func TestLoadLayers(t *testing.T) {
+	dir := t.TempDir()
+	path := writeFile(t, dir, "config.yml", fileConfig)
+	secrets := t.TempDir()
+	writeFile(t, secrets, "keys_secret", "mounted-secret\n")
+	dsnFile := writeFile(t, dir, "dsn", "postgres://users:pw@db/users\n")
+
+	cfg, err := config.LoadWithEnv(path, env(t, map[string]string{
+		config.SecretsDirEnv:              secrets,
+		"USERS_LOGGING_LEVEL":             "debug",
+		"USERS_TOKENS_ACCESS_TOKEN_TTL":   "2m",
+		"USERS_TLS_ALLOWED_SANS":          "spiffe://a, spiffe://b",
+		"USERS_STORAGE_MIGRATE_ON_BOOT":   "true",
+		"USERS_LOCKOUT_THRESHOLD":         "7",
+		"USERS_TRACING_SAMPLE_RATIO":      "0.5",
+		"USERS_KEYS_SECRET":               "env-secret",
+		"USERS_STORAGE_DSN_FILE":          dsnFile,
+		"USERS_IDENTITY_PROVIDERS":        "ignored",
+		"USERS_TIMEOUTS_METHODS_ANYTHING": "ignored",
+	}))
+	if err != nil {
+		t.Fatalf("failed to load: %v", err)
+	}
+
+	if cfg.Storage.Path != "users.db" || cfg.Storage.Driver != config.StorageSQLite {
+		t.Errorf("expected the file's storage, got %+v", cfg.Storage)
+	}
+	if cfg.Logging.Level != "debug" {
+		t.Errorf("expected the environment to override the file's log level, got %s", cfg.Logging.Level)
+	}
+	if cfg.Logging.Format != "json" {
+		t.Errorf("expected the default log format, got %s", cfg.Logging.Format)
+	}
+	if cfg.Tokens.AccessTokenTTL != 2*time.Minute {
+		t.Errorf("expected an access token ttl of 2m, got %s", cfg.Tokens.AccessTokenTTL)
+	}
+	if cfg.Tokens.RefreshTokenTTL != 30*24*time.Hour {
+		t.Errorf("expected the default refresh token ttl, got %s", cfg.Tokens.RefreshTokenTTL)
+	}
+	if len(cfg.TLS.AllowedSANs) != 2 || cfg.TLS.AllowedSANs[1] != "spiffe://b" {
+		t.Errorf("expected two allowed sans, got %v", cfg.TLS.AllowedSANs)
+	}
+	if !cfg.Storage.MigrateOnBoot || cfg.Lockout.Threshold != 7 || cfg.Tracing.SampleRatio != 0.5 {
+		t.Errorf("expected typed overrides, got %v %d %v", cfg.Storage.MigrateOnBoot, cfg.Lockout.Threshold, cfg.Tracing.SampleRatio)
+	}
+	if cfg.Keys.Secret != "mounted-secret" {
+		t.Errorf("expected the secrets directory to win, got %s", cfg.Keys.Secret)
+	}
+	if cfg.Storage.DSN != "postgres://users:pw@db/users" {
+		t.Errorf("expected the dsn from its _FILE, got %s", cfg.Storage.DSN)
+	}
+	if cfg.Service == nil {
+		t.Error("expected the shared service config")
+	}
+}
+
+func TestLoadReportsBadOverrides(t *testing.T) {
+	path := writeFile(t, t.TempDir(), "config.yml", fileConfig)
+	for name, tc := range map[string]struct {
+		vars    map[string]string
+		contain []string
+	}{
+		"number": {
+			vars:    map[string]string{"USERS_LOCKOUT_THRESHOLD": "many"},
+			contain: []string{"lockout.threshold", "USERS_LOCKOUT_THRESHOLD", "not a whole number"},
+		},
+		"duration": {
+			vars:    map[string]string{"USERS_HEALTH_INTERVAL": "soon"},
+			contain: []string{"health.interval", "not a duration"},
+		},
+		"bool": {
+			vars:    map[string]string{"USERS_TLS_REQUIRE_CLIENT_CERT": "sure"},
+			contain: []string{"tls.require_client_cert", "not true or false"},
+		},
+		"missing file": {
+			vars:    map[string]string{"USERS_KEYS_SECRET_FILE": "/nonexistent/secret"},
+			contain: []string{"USERS_KEYS_SECRET_FILE", "/nonexistent/secret"},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := config.LoadWithEnv(path, env(t, tc.vars))
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			for _, want := range tc.contain {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("expected %q in %v", want, err)
+				}
+			}
+		})
+	}
+}
+
+func TestDumpMasksSecrets(t *testing.T) {
+	path := writeFile(t, t.TempDir(), "config.yml", fileConfig+`
+identity_providers:
+  - name: google
+    issuer_url: https://accounts.google.com
+    client_id: client
+    client_secret: very-secret
+`)
+	cfg, err := config.LoadWithEnv(path, env(t, map[string]string{
+		"USERS_STORAGE_DSN": "postgres://users:pw@db/users",
+	}))
+	if err != nil {
+		t.Fatalf("failed to load: %v", err)
+	}
+	raw, err := cfg.Dump()
+	if err != nil {
+		t.Fatalf("failed to dump: %v", err)
+	}
+	dump := string(raw)
+	for _, secret := range []string{"file-secret", "very-secret", "postgres://"} {
+		if strings.Contains(dump, secret) {
+			t.Errorf("expected %q to be masked in\n%s", secret, dump)
+		}
+	}
+	for _, want := range []string{"client_id: client", "access_token_ttl: 1m0s", "level: warn", "path: users.db", "secret: '******'"} {
+		if !strings.Contains(dump, want) {
+			t.Errorf("expected %q in\n%s", want, dump)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cfg := config.Default()
+	cfg.Keys.Secret = "secret"
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("expected the defaults with a key to be valid: %v", err)
+	}
+
+	cfg.Storage.Driver = config.StoragePostgres
+	cfg.Logging.Format = "xml"
+	cfg.TLS.CertFile = "cert.pem"
+	cfg.Tracing.Exporter = "otlp"
+	cfg.IdentityProviders = []config.IdentityProvider{{Name: "a", IssuerURL: "https://a", ClientID: "a"}, {Name: "a"}}
+	cfg.Outbox.Publisher = config.PublisherWebhook
+	cfg.Outbox.Webhook.URL = "ftp://hooks"
+	cfg.Outbox.LeaseTTL = cfg.Outbox.PollInterval
+	cfg.Webhooks.MaxBackoff = cfg.Webhooks.InitialBackoff / 2
+	cfg.Exports.Timeout = 0
+	cfg.Keys.RotationInterval = time.Hour
+	cfg.Keys.ReloadInterval = cfg.Keys.PrePublish
+	cfg.Search.Index = config.SearchFullText
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("expected the config to be invalid")
+	}
+	for _, want := range []string{
+		"storage.dsn is required",
+		`logging.format "xml"`,
+		"tls.cert_file and tls.key_file",
+		"tracing.endpoint is required",
+		`identity_providers[1].name "a" is used twice`,
+		"identity_providers[1].issuer_url is required",
+		`outbox.webhook.url "ftp://hooks"`,
+		"outbox.lease_ttl must be longer",
+		"webhooks.initial_backoff must be positive and no longer",
+		"exports.timeout must be positive",
+		"keys.rotation_interval needs a keys.dir",
+		"keys.reload_interval must be positive and shorter",
+		`search.index "fulltext" needs the mysql driver`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q in %v", want, err)
+		}
+	}
+
+	cfg = config.Default()
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "keys needs") {
+		t.Errorf("expected a config without keys to be invalid, got %v", err)
+	}
+}
@@ -0,0 +1,288 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/srcabl/services/pkg/config"
+	"gopkg.in/yaml.v2"
+)
+
+// EnvPrefix prefixes the environment variables that override config values.
+// A value at storage.dsn is overridden by USERS_STORAGE_DSN.
+const EnvPrefix = "USERS_"
+
+// SecretsDirEnv names the environment variable pointing at the directory
+// secret files are read from, DefaultSecretsDir unless it is set
+const SecretsDirEnv = EnvPrefix + "SECRETS_DIR"
+
+// DefaultSecretsDir is where secret files are looked for by default. A value
+// at db.password is read from the file db_password in it.
+const DefaultSecretsDir = "/run/secrets"
+
+// masked stands in for secret values in config dumps
+const masked = "******"
+
+// leaf is a config value that can be overridden, found at its yaml path
+type leaf struct {
+	path []string
+	typ  reflect.Type
+}
+
+func (l leaf) env() string {
+	return EnvPrefix + strings.ToUpper(strings.Join(l.path, "_"))
+}
+
+func (l leaf) file() string {
+	return strings.Join(l.path, "_")
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// leaves lists the values of the struct type that can be overridden. Lists
+// of sections and maps are left to the file.
+func leaves(t reflect.Type, path []string) []leaf {
+	var found []leaf
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := yamlName(field)
+		if name == "" {
+			continue
+		}
+		fieldPath := append(append([]string{}, path...), name)
+		ft := field.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		switch {
+		case ft.Kind() == reflect.Struct:
+			found = append(found, leaves(ft, fieldPath)...)
+		case ft.Kind() == reflect.Slice && ft.Elem().Kind() != reflect.String:
+		case ft.Kind() == reflect.Map:
+		default:
+			found = append(found, leaf{path: fieldPath, typ: ft})
+		}
+	}
+	return found
+}
+
+// yamlName returns the key the field is read from, or empty when it is not
+// read from yaml
+func yamlName(field reflect.StructField) string {
+	if field.PkgPath != "" {
+		return ""
+	}
+	name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+	switch name {
+	case "-":
+		return ""
+	case "":
+		return strings.ToLower(field.Name)
+	}
+	return name
+}
+
+// overlay collects the values the environment and secret files set, as a
+// yaml document to decode over the file's values. Secret files come last so
+// they win over the environment.
+func overlay(getenv func(string) string) ([]byte, error) {
+	secretsDir := getenv(SecretsDirEnv)
+	if secretsDir == "" {
+		secretsDir = DefaultSecretsDir
+	}
+	all := append(leaves(reflect.TypeOf(Config{}), nil), leaves(reflect.TypeOf(config.Service{}), nil)...)
+	doc := map[string]interface{}{}
+	for _, l := range all {
+		raw, from, err := lookup(l, getenv, secretsDir)
+		if err != nil {
+			return nil, err
+		}
+		if from == "" {
+			continue
+		}
+		value, err := parseValue(l.typ, raw)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s from %s", strings.Join(l.path, "."), from)
+		}
+		setPath(doc, l.path, value)
+	}
+	if len(doc) == 0 {
+		return nil, nil
+	}
+	return yaml.Marshal(doc)
+}
+
+// lookup finds the value overriding the leaf and where it came from, which
+// is empty when nothing overrides it. A secret file named by a _FILE
+// variable wins over the variable itself, and a file in the secrets
+// directory wins over both.
+func lookup(l leaf, getenv func(string) string, secretsDir string) (raw, from string, err error) {
+	if raw = getenv(l.env()); raw != "" {
+		from = l.env()
+	}
+	if file := getenv(l.env() + "_FILE"); file != "" {
+		if raw, err = readSecret(file); err != nil {
+			return "", "", errors.Wrapf(err, "%s_FILE", l.env())
+		}
+		from = file
+	}
+	secretFile := filepath.Join(secretsDir, l.file())
+	value, err := readSecret(secretFile)
+	switch {
+	case err == nil:
+		return value, secretFile, nil
+	case os.IsNotExist(errors.Cause(err)):
+		return raw, from, nil
+	}
+	return "", "", err
+}
+
+// readSecret reads a secret file, dropping the trailing newline editors and
+// echo leave behind
+func readSecret(path string) (string, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to read secret file %s", path)
+	}
+	return strings.TrimRight(string(raw), "\r\n"), nil
+}
+
+// parseValue parses the raw value as the type it overrides, so a bad value is
+// reported against the variable or file it came from
+func parseValue(t reflect.Type, raw string) (interface{}, error) {
+	switch {
+	case t == durationType:
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return nil, errors.Errorf("%q is not a duration such as 30s or 15m", raw)
+		}
+		return d.String(), nil
+	case t.Kind() == reflect.String:
+		return raw, nil
+	case t.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return nil, errors.Errorf("%q is not true or false", raw)
+		}
+		return b, nil
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Int64:
+		i, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return nil, errors.Errorf("%q is not a whole number", raw)
+		}
+		return i, nil
+	case t.Kind() >= reflect.Uint && t.Kind() <= reflect.Uint64:
+		u, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil {
+			return nil, errors.Errorf("%q is not a positive whole number", raw)
+		}
+		return u, nil
+	case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return nil, errors.Errorf("%q is not a number", raw)
+		}
+		return f, nil
+	case t.Kind() == reflect.Slice:
+		var list []string
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		return list, nil
+	}
+	return nil, errors.Errorf("values of type %s cannot be overridden", t)
+}
+
+func setPath(doc map[string]interface{}, path []string, value interface{}) {
+	for _, key := range path[:len(path)-1] {
+		next, ok := doc[key].(map[string]interface{})
+		if !ok {
+			next = map[string]interface{}{}
+			doc[key] = next
+		}
+		doc = next
+	}
+	doc[path[len(path)-1]] = value
+}
+
+// Dump renders the effective config as yaml, the shared service sections
+// included, with every secret masked
+func (c *Config) Dump() ([]byte, error) {
+	doc := yaml.MapSlice{}
+	if c.Service != nil {
+		doc = append(doc, dumpStruct(reflect.ValueOf(*c.Service))...)
+	}
+	doc = append(doc, dumpStruct(reflect.ValueOf(*c))...)
+	out, err := yaml.Marshal(doc)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to render config")
+	}
+	return out, nil
+}
+
+func dumpStruct(v reflect.Value) yaml.MapSlice {
+	doc := yaml.MapSlice{}
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		name := yamlName(field)
+		if name == "" {
+			continue
+		}
+		doc = append(doc, yaml.MapItem{Key: name, Value: dumpValue(v.Field(i), isSecret(field, name))})
+	}
+	return doc
+}
+
+func dumpValue(v reflect.Value, secret bool) interface{} {
+	switch {
+	case v.Kind() == reflect.Ptr:
+		if v.IsNil() {
+			return nil
+		}
+		return dumpValue(v.Elem(), secret)
+	case v.Type() == durationType:
+		return time.Duration(v.Int()).String()
+	case v.Kind() == reflect.Struct:
+		return dumpStruct(v)
+	case v.Kind() == reflect.String:
+		if secret && v.String() != "" {
+			return masked
+		}
+		return v.String()
+	case v.Kind() == reflect.Slice:
+		list := make([]interface{}, 0, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			list = append(list, dumpValue(v.Index(i), secret))
+		}
+		return list
+	case v.Kind() == reflect.Map:
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool {
+			return keys[i].String() < keys[j].String()
+		})
+		doc := yaml.MapSlice{}
+		for _, key := range keys {
+			doc = append(doc, yaml.MapItem{Key: key.Interface(), Value: dumpValue(v.MapIndex(key), secret)})
+		}
+		return doc
+	}
+	return v.Interface()
+}
+
+// isSecret reports whether the field holds a secret, either because it is
+// tagged as one or, for the shared service config, by its name
+func isSecret(field reflect.StructField, name string) bool {
+	if field.Tag.Get("secret") == "true" {
+		return true
+	}
+	return strings.Contains(name, "password") || strings.Contains(name, "secret")
+}
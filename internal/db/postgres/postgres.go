@@ -0,0 +1,38 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/pkg/errors"
+	// registers the postgres driver
+	_ "github.com/lib/pq"
+	"github.com/srcabl/users/internal/config"
+)
+
+// Client is a postgres client
+type Client struct {
+	DB *sql.DB
+}
+
+// New news up a postgres client for the connection url in the storage config
+func New(cfg config.Storage) (*Client, error) {
+	if cfg.DSN == "" {
+		return nil, errors.New("postgres storage needs a dsn")
+	}
+	db, err := sql.Open("postgres", cfg.DSN)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open postgres database")
+	}
+	return &Client{
+		DB: db,
+	}, nil
+}
+
+// Connect checks the database can be reached and returns the func that closes the pool
+func (c *Client) Connect() (func() error, error) {
+	if err := c.DB.PingContext(context.Background()); err != nil {
+		return nil, errors.Wrap(err, "failed to connect to postgres database")
+	}
+	return c.DB.Close, nil
+}
@@ -0,0 +1,44 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	// registers the sqlite3 driver
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/pkg/errors"
+	"github.com/srcabl/users/internal/config"
+)
+
+// Client is a sqlite client. The pool holds a single connection, which
+// serializes writers instead of failing them with SQLITE_BUSY and lets an
+// in memory database be shared by every statement.
+type Client struct {
+	DB   *sql.DB
+	path string
+}
+
+// New news up a sqlite client for the database file in the storage config
+func New(cfg config.Storage) (*Client, error) {
+	if cfg.Path == "" {
+		return nil, errors.New("sqlite storage needs a path")
+	}
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?_foreign_keys=on&_busy_timeout=5000", cfg.Path))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open sqlite database %s", cfg.Path)
+	}
+	db.SetMaxOpenConns(1)
+	return &Client{
+		DB:   db,
+		path: cfg.Path,
+	}, nil
+}
+
+// Connect checks the database file can be opened and returns the func that closes it
+func (c *Client) Connect() (func() error, error) {
+	if err := c.DB.PingContext(context.Background()); err != nil {
+		return nil, errors.Wrapf(err, "failed to connect to sqlite database %s", c.path)
+	}
+	return c.DB.Close, nil
+}
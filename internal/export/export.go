@@ -0,0 +1,244 @@
+package export
+
+import (
+	"archive/zip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/srcabl/users/internal/service"
+)
+
+// auditPage is how many audit entries are read at a time
+const auditPage = 500
+
+// Export is everything stored about a user, in the shape it is handed to
+// them. Secrets, such as the password and refresh token hashes, are left out.
+type Export struct {
+	ExportedAt int64        `json:"exported_at"`
+	User       User         `json:"user"`
+	Follows    Follows      `json:"follows"`
+	Blocks     []string     `json:"blocks"`
+	Sessions   []Session    `json:"sessions"`
+	Identities []Identity   `json:"identities"`
+	AuditLog   []AuditEntry `json:"audit_log"`
+}
+
+// User is the user's profile
+type User struct {
+	UUID                string   `json:"uuid"`
+	Username            string   `json:"username"`
+	Email               string   `json:"email"`
+	DisplayName         string   `json:"display_name,omitempty"`
+	Roles               []string `json:"roles"`
+	CreatedAt           int64    `json:"created_at"`
+	CreatedByUUID       string   `json:"created_by_uuid"`
+	UpdatedAt           *int64   `json:"updated_at,omitempty"`
+	UpdatedByUUID       string   `json:"updated_by_uuid,omitempty"`
+	FailedLoginAttempts int      `json:"failed_login_attempts"`
+	LockedUntil         *int64   `json:"locked_until,omitempty"`
+}
+
+// Follows are the users and sources the user follows and the users who
+// follow them
+type Follows struct {
+	Users     []string `json:"users"`
+	Sources   []string `json:"sources"`
+	Followers []string `json:"followers"`
+}
+
+// Session is a session the user signed in with, revoked and expired ones
+// included
+type Session struct {
+	UUID       string `json:"uuid"`
+	Device     string `json:"device"`
+	UserAgent  string `json:"user_agent"`
+	CreatedAt  int64  `json:"created_at"`
+	LastUsedAt int64  `json:"last_used_at"`
+	ExpiresAt  int64  `json:"expires_at"`
+	RevokedAt  *int64 `json:"revoked_at,omitempty"`
+}
+
+// Identity is an external identity linked to the user
+type Identity struct {
+	Provider      string `json:"provider"`
+	Subject       string `json:"subject"`
+	Email         string `json:"email,omitempty"`
+	CreatedAt     int64  `json:"created_at"`
+	CreatedByUUID string `json:"created_by_uuid"`
+}
+
+// AuditEntry is an entry of the audit log on the user
+type AuditEntry struct {
+	UUID      string          `json:"uuid"`
+	ActorUUID string          `json:"actor_uuid"`
+	Action    string          `json:"action"`
+	Changes   json.RawMessage `json:"changes"`
+	ClientIP  string          `json:"client_ip,omitempty"`
+	RequestID string          `json:"request_id,omitempty"`
+	CreatedAt int64           `json:"created_at"`
+}
+
+// Build reads everything stored about the user into an export. The user
+// must exist, otherwise the error wraps sql.ErrNoRows.
+func Build(ctx context.Context, datarepo service.DataRepository, userUUID string, now int64) (*Export, error) {
+	dbUser, err := datarepo.GetUserByID(ctx, userUUID)
+	if err != nil {
+		return nil, err
+	}
+	export := &Export{
+		ExportedAt: now,
+		User: User{
+			UUID:                dbUser.UUID,
+			Username:            dbUser.Username,
+			Email:               dbUser.Email,
+			DisplayName:         dbUser.DisplayName.String,
+			Roles:               nonNil(dbUser.Roles),
+			CreatedAt:           dbUser.CreatedAt,
+			CreatedByUUID:       dbUser.CreatedByUUID,
+			UpdatedAt:           optional(dbUser.UpdatedAt),
+			UpdatedByUUID:       dbUser.UpdatedByUUID.String,
+			FailedLoginAttempts: dbUser.FailedLoginAttempts,
+			LockedUntil:         optional(dbUser.LockedUntil),
+		},
+		Sessions:   []Session{},
+		Identities: []Identity{},
+		AuditLog:   []AuditEntry{},
+	}
+
+	if export.Follows.Users, err = datarepo.ListUserFollows(ctx, userUUID); err != nil {
+		return nil, err
+	}
+	if export.Follows.Sources, err = datarepo.ListSourceFollows(ctx, userUUID); err != nil {
+		return nil, err
+	}
+	if export.Follows.Followers, err = datarepo.ListUserFollowers(ctx, userUUID); err != nil {
+		return nil, err
+	}
+	export.Follows.Users = nonNil(export.Follows.Users)
+	export.Follows.Sources = nonNil(export.Follows.Sources)
+	export.Follows.Followers = nonNil(export.Follows.Followers)
+
+	// who blocked the user is theirs to know, not the user's
+	blocks, err := datarepo.ListUserBlocks(ctx, userUUID)
+	if err != nil {
+		return nil, err
+	}
+	export.Blocks = nonNil(blocks)
+
+	sessions, err := datarepo.ListSessionsForUser(ctx, userUUID)
+	if err != nil {
+		return nil, err
+	}
+	for _, session := range sessions {
+		export.Sessions = append(export.Sessions, Session{
+			UUID:       session.UUID,
+			Device:     session.Device,
+			UserAgent:  session.UserAgent,
+			CreatedAt:  session.CreatedAt,
+			LastUsedAt: session.LastUsedAt,
+			ExpiresAt:  session.ExpiresAt,
+			RevokedAt:  optional(session.RevokedAt),
+		})
+	}
+
+	identities, err := datarepo.ListIdentitiesForUser(ctx, userUUID)
+	if err != nil {
+		return nil, err
+	}
+	for _, identity := range identities {
+		export.Identities = append(export.Identities, Identity{
+			Provider:      identity.Provider,
+			Subject:       identity.Subject,
+			Email:         identity.Email.String,
+			CreatedAt:     identity.CreatedAt,
+			CreatedByUUID: identity.CreatedByUUID,
+		})
+	}
+
+	// the log is read newest first a page at a time and handed over oldest first
+	var beforeID int64
+	for {
+		entries, err := datarepo.ListAuditEntries(ctx, userUUID, "", beforeID, auditPage)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			export.AuditLog = append(export.AuditLog, AuditEntry{
+				UUID:      entry.UUID,
+				ActorUUID: entry.ActorUUID,
+				Action:    entry.Action,
+				Changes:   json.RawMessage(entry.Changes),
+				ClientIP:  entry.ClientIP,
+				RequestID: entry.RequestID,
+				CreatedAt: entry.CreatedAt,
+			})
+			beforeID = entry.ID
+		}
+		if len(entries) < auditPage {
+			break
+		}
+	}
+	for i, j := 0, len(export.AuditLog)-1; i < j; i, j = i+1, j-1 {
+		export.AuditLog[i], export.AuditLog[j] = export.AuditLog[j], export.AuditLog[i]
+	}
+	return export, nil
+}
+
+// Write writes the export in the format: a single JSON document, or a zip
+// archive holding a JSON file for each part of the export
+func (e *Export) Write(w io.Writer, format string) error {
+	switch format {
+	case service.ExportJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return errors.Wrap(enc.Encode(e), "failed to write export")
+	case service.ExportZip:
+		archive := zip.NewWriter(w)
+		parts := []struct {
+			name  string
+			value interface{}
+		}{
+			{"user.json", e.User},
+			{"follows.json", e.Follows},
+			{"sessions.json", e.Sessions},
+			{"identities.json", e.Identities},
+			{"audit_log.json", e.AuditLog},
+		}
+		for _, part := range parts {
+			f, err := archive.CreateHeader(&zip.FileHeader{
+				Name:     part.name,
+				Method:   zip.Deflate,
+				Modified: time.Unix(e.ExportedAt, 0).UTC(),
+			})
+			if err != nil {
+				return errors.Wrapf(err, "failed to add %s to export", part.name)
+			}
+			enc := json.NewEncoder(f)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(part.value); err != nil {
+				return errors.Wrapf(err, "failed to write %s of export", part.name)
+			}
+		}
+		return errors.Wrap(archive.Close(), "failed to write export")
+	default:
+		return errors.Errorf("%q is not an export format", format)
+	}
+}
+
+func optional(value sql.NullInt64) *int64 {
+	if !value.Valid {
+		return nil
+	}
+	return &value.Int64
+}
+
+func nonNil(values []string) []string {
+	if values == nil {
+		return []string{}
+	}
+	return values
+}
@@ -0,0 +1,246 @@
+package export_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/srcabl/users/internal/config"
+	"github.com/srcabl/users/internal/export"
+	"github.com/srcabl/users/internal/metrics"
+	"github.com/srcabl/users/internal/service"
+	"go.uber.org/zap"
+)
+
+func newUUID(t *testing.T) string {
+	t.Helper()
+	id, err := uuid.NewV4()
+	if err != nil {
+		t.Fatalf("failed to generate uuid: %v", err)
+	}
+	return id.String()
+}
+
+func newRunner(t *testing.T, datarepo service.DataRepository) *export.Runner {
+	t.Helper()
+	m, err := metrics.New()
+	if err != nil {
+		t.Fatalf("failed to new metrics: %v", err)
+	}
+	return export.NewRunner(config.Default().Exports, datarepo, m, zap.NewNop())
+}
+
+func createUser(t *testing.T, datarepo service.DataRepository) *service.DBUser {
+	t.Helper()
+	user, err := service.NewDBUser("user-"+newUUID(t), newUUID(t)+"@example.com", "secret-hash", uuid.Nil.String())
+	if err != nil {
+		t.Fatalf("failed to new user: %v", err)
+	}
+	if err := datarepo.CreateUser(context.Background(), user); err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	return user
+}
+
+// createAccount creates a user with something stored in every part of an
+// export: follows both ways, a source follow, blocks both ways, a session
+// and an identity
+func createAccount(t *testing.T, datarepo service.DataRepository) *service.DBUser {
+	t.Helper()
+	ctx := context.Background()
+	user, friend, foe := createUser(t, datarepo), createUser(t, datarepo), createUser(t, datarepo)
+	for _, err := range []error{
+		datarepo.BlockUser(ctx, user.UUID, foe.UUID, 1000),
+		datarepo.BlockUser(ctx, foe.UUID, user.UUID, 1000),
+		datarepo.AddUserFollower(ctx, user.UUID, friend.UUID),
+		datarepo.AddUserFollower(ctx, friend.UUID, user.UUID),
+		datarepo.AddSourceFollower(ctx, user.UUID, newUUID(t)),
+		datarepo.CreateSession(ctx, &service.DBSession{
+			UUID:             newUUID(t),
+			UserUUID:         user.UUID,
+			RefreshTokenHash: "secret-refresh-hash",
+			Device:           "laptop",
+			CreatedAt:        1000,
+			LastUsedAt:       1000,
+			ExpiresAt:        2000,
+		}),
+		datarepo.CreateIdentity(ctx, &service.DBIdentity{
+			Provider:      "github",
+			Subject:       "octocat",
+			UserUUID:      user.UUID,
+			Email:         sql.NullString{Valid: true, String: user.Email},
+			CreatedAt:     1000,
+			CreatedByUUID: user.UUID,
+		}),
+	} {
+		if err != nil {
+			t.Fatalf("failed to set up account: %v", err)
+		}
+	}
+	return user
+}
+
+func requestExport(t *testing.T, datarepo service.DataRepository, userUUID, format string) *service.DBDataExport {
+	t.Helper()
+	dbExport := &service.DBDataExport{
+		UUID:            newUUID(t),
+		UserUUID:        userUUID,
+		RequestedByUUID: userUUID,
+		Format:          format,
+		Status:          service.ExportPending,
+		CreatedAt:       time.Now().Unix(),
+	}
+	if err := datarepo.CreateDataExport(context.Background(), dbExport); err != nil {
+		t.Fatalf("failed to create data export: %v", err)
+	}
+	return dbExport
+}
+
+func runOnce(t *testing.T, runner *export.Runner) int {
+	t.Helper()
+	n, err := runner.RunOnce(context.Background())
+	if err != nil {
+		t.Fatalf("failed to run: %v", err)
+	}
+	return n
+}
+
+func readyData(t *testing.T, datarepo service.DataRepository, exportUUID string) []byte {
+	t.Helper()
+	got, err := datarepo.GetDataExport(context.Background(), exportUUID)
+	if err != nil {
+		t.Fatalf("failed to get data export: %v", err)
+	}
+	if got.Status != service.ExportReady || !got.CompletedAt.Valid || got.Error != "" {
+		t.Fatalf("expected the export ready, got %+v", got)
+	}
+	data, err := datarepo.GetDataExportData(context.Background(), exportUUID)
+	if err != nil {
+		t.Fatalf("failed to read data export: %v", err)
+	}
+	if int64(len(data)) != got.Size {
+		t.Fatalf("expected the size of the data recorded, got %d for %d bytes", got.Size, len(data))
+	}
+	return data
+}
+
+func TestRunnerBuildsJSON(t *testing.T) {
+	datarepo := service.NewMemoryDataRepository()
+	user := createAccount(t, datarepo)
+	dbExport := requestExport(t, datarepo, user.UUID, service.ExportJSON)
+
+	if n := runOnce(t, newRunner(t, datarepo)); n != 1 {
+		t.Fatalf("expected the export built, got %d", n)
+	}
+	data := readyData(t, datarepo, dbExport.UUID)
+	for _, secret := range []string{"secret-hash", "secret-refresh-hash"} {
+		if bytes.Contains(data, []byte(secret)) {
+			t.Fatalf("expected %s left out of the export", secret)
+		}
+	}
+	var got export.Export
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("failed to unmarshal export: %v", err)
+	}
+	if got.User.UUID != user.UUID || got.User.Email != user.Email {
+		t.Fatalf("expected the user's profile, got %+v", got.User)
+	}
+	if len(got.Follows.Users) != 1 || len(got.Follows.Followers) != 1 || len(got.Follows.Sources) != 1 {
+		t.Fatalf("expected follows both ways and the source follow, got %+v", got.Follows)
+	}
+	if len(got.Blocks) != 1 {
+		t.Fatalf("expected only the user's own block, got %v", got.Blocks)
+	}
+	if len(got.Sessions) != 1 || got.Sessions[0].Device != "laptop" {
+		t.Fatalf("expected the session, got %+v", got.Sessions)
+	}
+	if len(got.Identities) != 1 || got.Identities[0].Subject != "octocat" {
+		t.Fatalf("expected the identity, got %+v", got.Identities)
+	}
+	var actions []string
+	for _, entry := range got.AuditLog {
+		actions = append(actions, entry.Action)
+	}
+	if strings.Join(actions, ",") != "user.created,follow.added,follow.added" {
+		t.Fatalf("expected the audit log oldest first, got %v", actions)
+	}
+}
+
+func TestRunnerBuildsZip(t *testing.T) {
+	datarepo := service.NewMemoryDataRepository()
+	user := createAccount(t, datarepo)
+	dbExport := requestExport(t, datarepo, user.UUID, service.ExportZip)
+	runOnce(t, newRunner(t, datarepo))
+
+	data := readyData(t, datarepo, dbExport.UUID)
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("failed to open archive: %v", err)
+	}
+	var names []string
+	for _, f := range archive.File {
+		names = append(names, f.Name)
+	}
+	if strings.Join(names, ",") != "user.json,follows.json,sessions.json,identities.json,audit_log.json" {
+		t.Fatalf("expected a file per part of the export, got %v", names)
+	}
+	f, err := archive.File[0].Open()
+	if err != nil {
+		t.Fatalf("failed to open user.json: %v", err)
+	}
+	defer f.Close()
+	raw, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatalf("failed to read user.json: %v", err)
+	}
+	var got export.User
+	if err := json.Unmarshal(raw, &got); err != nil || got.UUID != user.UUID {
+		t.Fatalf("expected the user's profile in user.json, got %s", raw)
+	}
+}
+
+func TestRunnerFailsMissingUser(t *testing.T) {
+	datarepo := service.NewMemoryDataRepository()
+	user := createUser(t, datarepo)
+	dbExport := requestExport(t, datarepo, user.UUID, service.ExportJSON)
+	if err := datarepo.DeleteUser(context.Background(), user.UUID, user.UUID, time.Now().Unix()); err != nil {
+		t.Fatalf("failed to delete user: %v", err)
+	}
+
+	if n := runOnce(t, newRunner(t, datarepo)); n != 1 {
+		t.Fatalf("expected the export completed, got %d", n)
+	}
+	got, err := datarepo.GetDataExport(context.Background(), dbExport.UUID)
+	if err != nil {
+		t.Fatalf("failed to get data export: %v", err)
+	}
+	if got.Status != service.ExportFailed || got.Error == "" || got.Size != 0 {
+		t.Fatalf("expected the export failed, got %+v", got)
+	}
+	if _, err := datarepo.GetDataExportData(context.Background(), dbExport.UUID); err == nil {
+		t.Fatal("expected no data for a failed export")
+	}
+}
+
+func TestRunnerSkipsClaimed(t *testing.T) {
+	datarepo := service.NewMemoryDataRepository()
+	user := createUser(t, datarepo)
+	dbExport := requestExport(t, datarepo, user.UUID, service.ExportJSON)
+	claimed, err := datarepo.ClaimDataExport(context.Background(), dbExport.UUID, 0, time.Now().Unix()+60)
+	if err != nil || !claimed {
+		t.Fatalf("failed to claim data export: %v", err)
+	}
+	if n := runOnce(t, newRunner(t, datarepo)); n != 0 {
+		t.Fatalf("expected an export claimed elsewhere left alone, got %d", n)
+	}
+	if got, _ := datarepo.GetDataExport(context.Background(), dbExport.UUID); got.Status != service.ExportPending {
+		t.Fatalf("expected the export still pending, got %+v", got)
+	}
+}
@@ -0,0 +1,156 @@
+package export
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/srcabl/users/internal/config"
+	"github.com/srcabl/users/internal/metrics"
+	"github.com/srcabl/users/internal/service"
+	"go.uber.org/zap"
+)
+
+// maxErrorLength bounds the error kept on a failed export to its column
+const maxErrorLength = 1024
+
+// Runner builds the pending data exports and stores them for download.
+// Exports are claimed before they are built, so runners on every replica can
+// run side by side, and an export whose runner went away is picked up again
+// once its claim runs out.
+type Runner struct {
+	cfg      config.Exports
+	datarepo service.DataRepository
+	metrics  *metrics.Metrics
+	logger   *zap.Logger
+	now      func() time.Time
+}
+
+// NewRunner news up a runner
+func NewRunner(cfg config.Exports, datarepo service.DataRepository, m *metrics.Metrics, logger *zap.Logger) *Runner {
+	return &Runner{
+		cfg:      cfg,
+		datarepo: datarepo,
+		metrics:  m,
+		logger:   logger,
+		now:      time.Now,
+	}
+}
+
+// Run builds on the poll interval until the returned func is called, which
+// waits for the pass in flight
+func (r *Runner) Run() (func() error, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	ticker := time.NewTicker(r.cfg.PollInterval)
+	go func() {
+		defer close(done)
+		for {
+			if _, err := r.RunOnce(ctx); err != nil && ctx.Err() == nil {
+				r.logger.Warn("data export run failed", zap.Error(err))
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return func() error {
+		ticker.Stop()
+		cancel()
+		<-done
+		return nil
+	}, nil
+}
+
+// RunOnce builds the pending exports batch by batch until none are left,
+// then prunes the exports completed longer ago than the retention. It
+// returns how many it completed. An export that cannot be built is completed
+// as failed rather than failing the pass, only failing to read or record
+// exports does.
+func (r *Runner) RunOnce(ctx context.Context) (int, error) {
+	total := 0
+	for {
+		pending, err := r.datarepo.ListPendingDataExports(ctx, r.now().Unix(), r.cfg.BatchSize)
+		if err != nil {
+			return total, err
+		}
+		for _, export := range pending {
+			completed, err := r.build(ctx, export)
+			if completed {
+				total++
+			}
+			if err != nil {
+				return total, err
+			}
+		}
+		if len(pending) < r.cfg.BatchSize || ctx.Err() != nil {
+			break
+		}
+	}
+	if _, err := r.datarepo.PruneDataExports(ctx, r.now().Add(-r.cfg.Retention).Unix()); err != nil {
+		return total, err
+	}
+	return total, nil
+}
+
+// build claims the export, builds it and records how it went. It reports
+// whether it completed the export. An export claimed by another runner since
+// it was listed is left to them.
+func (r *Runner) build(ctx context.Context, export *service.DBDataExport) (bool, error) {
+	// the claim outlasts the build, so it is not picked up again meanwhile
+	claimedUntil := r.now().Add(r.cfg.Timeout).Unix() + 1
+	claimed, err := r.datarepo.ClaimDataExport(ctx, export.UUID, export.ClaimedUntil, claimedUntil)
+	if err != nil || !claimed {
+		return false, err
+	}
+
+	data, buildErr := r.write(ctx, export)
+	if buildErr != nil && ctx.Err() != nil {
+		// shutting down, the export is built again once the claim runs out
+		return false, nil
+	}
+	export.CompletedAt = sql.NullInt64{Valid: true, Int64: r.now().Unix()}
+	if buildErr == nil {
+		export.Status = service.ExportReady
+		export.Data = data
+		export.Size = int64(len(data))
+	} else {
+		export.Status = service.ExportFailed
+		export.Error = truncate(buildErr.Error())
+		r.logger.Warn("data export failed",
+			zap.String("export", export.UUID),
+			zap.String("user", export.UserUUID),
+			zap.Error(buildErr),
+		)
+	}
+	r.metrics.DataExport(export.Format, export.Status)
+	if err := r.datarepo.CompleteDataExport(ctx, export); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// write builds the export of the user in its format, bounded by the timeout
+func (r *Runner) write(ctx context.Context, export *service.DBDataExport) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.cfg.Timeout)
+	defer cancel()
+	built, err := Build(ctx, r.datarepo, export.UserUUID, r.now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := built.Write(&buf, export.Format); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func truncate(s string) string {
+	if len(s) > maxErrorLength {
+		return s[:maxErrorLength]
+	}
+	return s
+}
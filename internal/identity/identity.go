@@ -0,0 +1,158 @@
+package identity
+
+import (
+	"context"
+	"sync"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/pkg/errors"
+	"github.com/srcabl/users/internal/config"
+	"golang.org/x/oauth2"
+)
+
+// ErrUnknownProvider is returned when an identity provider is not configured
+var ErrUnknownProvider = errors.New("identity provider is not configured")
+
+// ErrRedirectNotAllowed is returned when a proof asks for a redirect URL the
+// provider is not configured with
+var ErrRedirectNotAllowed = errors.New("redirect url is not allowed")
+
+// Identity is a verified external identity
+type Identity struct {
+	Provider          string
+	Subject           string
+	Email             string
+	EmailVerified     bool
+	PreferredUsername string
+	Name              string
+}
+
+// Proof is what a client presents to prove an external identity, either an
+// authorization code to exchange or an id token it already holds
+type Proof struct {
+	Code        string
+	RedirectURL string
+	IDToken     string
+}
+
+// Providers verifies identities against the configured OIDC providers
+type Providers struct {
+	providers map[string]*provider
+}
+
+type provider struct {
+	cfg config.IdentityProvider
+
+	mu       sync.Mutex
+	oauth2   *oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+// NewProviders news up the configured identity providers. Discovery happens
+// on first use so an unreachable provider does not stop the service booting.
+func NewProviders(cfgs []config.IdentityProvider) (*Providers, error) {
+	providers := map[string]*provider{}
+	for _, cfg := range cfgs {
+		if cfg.Name == "" || cfg.IssuerURL == "" || cfg.ClientID == "" {
+			return nil, errors.Errorf("identity provider %q needs a name, issuer url and client id", cfg.Name)
+		}
+		if _, ok := providers[cfg.Name]; ok {
+			return nil, errors.Errorf("identity provider %q is configured twice", cfg.Name)
+		}
+		providers[cfg.Name] = &provider{cfg: cfg}
+	}
+	return &Providers{providers: providers}, nil
+}
+
+// Verify checks the proof with the provider and returns the identity it proves
+func (p *Providers) Verify(ctx context.Context, providerName string, proof Proof) (*Identity, error) {
+	prov, ok := p.providers[providerName]
+	if !ok {
+		return nil, errors.Wrapf(ErrUnknownProvider, "provider %q", providerName)
+	}
+	if proof.RedirectURL != "" && !prov.allowsRedirect(proof.RedirectURL) {
+		return nil, errors.Wrapf(ErrRedirectNotAllowed, "provider %q, redirect url %q", providerName, proof.RedirectURL)
+	}
+	if err := prov.discover(ctx); err != nil {
+		return nil, err
+	}
+	rawIDToken := proof.IDToken
+	if proof.Code != "" {
+		exchange := *prov.oauth2
+		if proof.RedirectURL != "" {
+			exchange.RedirectURL = proof.RedirectURL
+		}
+		tok, err := exchange.Exchange(ctx, proof.Code)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to exchange code with %s", providerName)
+		}
+		idToken, ok := tok.Extra("id_token").(string)
+		if !ok {
+			return nil, errors.Errorf("%s did not return an id token", providerName)
+		}
+		rawIDToken = idToken
+	}
+	if rawIDToken == "" {
+		return nil, errors.New("either a code or an id token is required")
+	}
+	idToken, err := prov.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to verify id token from %s", providerName)
+	}
+	var claims struct {
+		Email             string `json:"email"`
+		EmailVerified     bool   `json:"email_verified"`
+		PreferredUsername string `json:"preferred_username"`
+		Name              string `json:"name"`
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, errors.Wrapf(err, "failed to read id token claims from %s", providerName)
+	}
+	return &Identity{
+		Provider:          providerName,
+		Subject:           idToken.Subject,
+		Email:             claims.Email,
+		EmailVerified:     claims.EmailVerified,
+		PreferredUsername: claims.PreferredUsername,
+		Name:              claims.Name,
+	}, nil
+}
+
+// allowsRedirect reports whether the redirect url exactly matches one the
+// provider is configured with
+func (p *provider) allowsRedirect(redirectURL string) bool {
+	if redirectURL == p.cfg.RedirectURL {
+		return true
+	}
+	for _, allowed := range p.cfg.RedirectURLs {
+		if redirectURL == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *provider) discover(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.verifier != nil {
+		return nil
+	}
+	discovered, err := oidc.NewProvider(ctx, p.cfg.IssuerURL)
+	if err != nil {
+		return errors.Wrapf(err, "failed to discover identity provider %s", p.cfg.Name)
+	}
+	scopes := p.cfg.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{oidc.ScopeOpenID, "email", "profile"}
+	}
+	p.oauth2 = &oauth2.Config{
+		ClientID:     p.cfg.ClientID,
+		ClientSecret: p.cfg.ClientSecret,
+		RedirectURL:  p.cfg.RedirectURL,
+		Endpoint:     discovered.Endpoint(),
+		Scopes:       scopes,
+	}
+	p.verifier = discovered.Verifier(&oidc.Config{ClientID: p.cfg.ClientID})
+	return nil
+}
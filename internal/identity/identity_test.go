@@ -0,0 +1,167 @@
+package identity_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/pkg/errors"
+	"github.com/srcabl/users/internal/config"
+	"github.com/srcabl/users/internal/identity"
+)
+
+// mockIdP is a minimal OIDC provider serving discovery, keys and a token endpoint
+type mockIdP struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	idp := &mockIdP{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                idp.URL,
+			"authorization_endpoint":                idp.URL + "/authorize",
+			"token_endpoint":                        idp.URL + "/token",
+			"jwks_uri":                              idp.URL + "/keys",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "mock",
+				"alg": "RS256",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil || r.Form.Get("code") != "good-code" {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "mock-access-token",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     idp.idToken(t, "subject-from-code", "client"),
+		})
+	})
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+func (idp *mockIdP) idToken(t *testing.T, subject, audience string) string {
+	now := time.Now()
+	tok := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":                idp.URL,
+		"sub":                subject,
+		"aud":                audience,
+		"iat":                now.Unix(),
+		"exp":                now.Add(time.Hour).Unix(),
+		"email":              subject + "@example.com",
+		"email_verified":     true,
+		"preferred_username": subject,
+	})
+	tok.Header["kid"] = "mock"
+	signed, err := tok.SignedString(idp.key)
+	if err != nil {
+		t.Fatalf("failed to sign id token: %v", err)
+	}
+	return signed
+}
+
+func newProviders(t *testing.T, idp *mockIdP) *identity.Providers {
+	providers, err := identity.NewProviders([]config.IdentityProvider{{
+		Name:         "mock",
+		IssuerURL:    idp.URL,
+		ClientID:     "client",
+		RedirectURL:  "http://localhost/callback",
+		RedirectURLs: []string{"http://localhost/mobile-callback"},
+	}})
+	if err != nil {
+		t.Fatalf("failed to new providers: %v", err)
+	}
+	return providers
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	idp := newMockIdP(t)
+	providers := newProviders(t, idp)
+
+	ident, err := providers.Verify(context.Background(), "mock", identity.Proof{IDToken: idp.idToken(t, "alice", "client")})
+	if err != nil {
+		t.Fatalf("failed to verify id token: %v", err)
+	}
+	if ident.Provider != "mock" || ident.Subject != "alice" || ident.Email != "alice@example.com" || !ident.EmailVerified {
+		t.Errorf("unexpected identity %+v", ident)
+	}
+}
+
+func TestVerifyCode(t *testing.T) {
+	idp := newMockIdP(t)
+	providers := newProviders(t, idp)
+
+	ident, err := providers.Verify(context.Background(), "mock", identity.Proof{Code: "good-code"})
+	if err != nil {
+		t.Fatalf("failed to verify code: %v", err)
+	}
+	if ident.Subject != "subject-from-code" {
+		t.Errorf("unexpected subject %s", ident.Subject)
+	}
+	if _, err := providers.Verify(context.Background(), "mock", identity.Proof{Code: "bad-code"}); err == nil {
+		t.Error("expected a bad code to fail")
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	idp := newMockIdP(t)
+	providers := newProviders(t, idp)
+
+	if _, err := providers.Verify(context.Background(), "mock", identity.Proof{IDToken: idp.idToken(t, "alice", "someone-else")}); err == nil {
+		t.Error("expected a token for another audience to fail")
+	}
+	if _, err := providers.Verify(context.Background(), "unknown", identity.Proof{IDToken: "x"}); err == nil {
+		t.Error("expected an unknown provider to fail")
+	}
+	if _, err := providers.Verify(context.Background(), "mock", identity.Proof{}); err == nil {
+		t.Error("expected a missing proof to fail")
+	}
+}
+
+func TestVerifyRedirectURL(t *testing.T) {
+	idp := newMockIdP(t)
+	providers := newProviders(t, idp)
+
+	for _, redirectURL := range []string{"http://localhost/callback", "http://localhost/mobile-callback"} {
+		if _, err := providers.Verify(context.Background(), "mock", identity.Proof{Code: "good-code", RedirectURL: redirectURL}); err != nil {
+			t.Errorf("expected configured redirect url %s to be allowed: %v", redirectURL, err)
+		}
+	}
+	for _, redirectURL := range []string{"https://evil.example/callback", "http://localhost/callback/", "http://localhost/mobile-callback?next=x"} {
+		_, err := providers.Verify(context.Background(), "mock", identity.Proof{Code: "good-code", RedirectURL: redirectURL})
+		if errors.Cause(err) != identity.ErrRedirectNotAllowed {
+			t.Errorf("expected redirect url %s to be refused, got %v", redirectURL, err)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package keys
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+)
+
+// JSONWebKey is the public half of a signing key in JWK form
+type JSONWebKey struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid,omitempty"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+	Y         string `json:"y,omitempty"`
+}
+
+// JSONWebKeySet is a set of public keys in JWKS form
+type JSONWebKeySet struct {
+	Keys []*JSONWebKey `json:"keys"`
+}
+
+// JWK returns the public key in JWK form. Symmetric keys are never published
+// and report false.
+func (k *Key) JWK() (*JSONWebKey, bool) {
+	jwk := &JSONWebKey{
+		KeyID:     k.ID,
+		Use:       "sig",
+		Algorithm: k.Method.Alg(),
+	}
+	switch public := k.Public.(type) {
+	case *rsa.PublicKey:
+		jwk.KeyType = "RSA"
+		jwk.N = encode(public.N.Bytes())
+		jwk.E = encode(big.NewInt(int64(public.E)).Bytes())
+	case *ecdsa.PublicKey:
+		size := (public.Curve.Params().BitSize + 7) / 8
+		jwk.KeyType = "EC"
+		jwk.Curve = public.Curve.Params().Name
+		jwk.X = encode(pad(public.X.Bytes(), size))
+		jwk.Y = encode(pad(public.Y.Bytes(), size))
+	case ed25519.PublicKey:
+		jwk.KeyType = "OKP"
+		jwk.Curve = "Ed25519"
+		jwk.X = encode(public)
+	default:
+		return nil, false
+	}
+	return jwk, true
+}
+
+// JWKS returns the published public keys
+func (m *Manager) JWKS() *JSONWebKeySet {
+	set := &JSONWebKeySet{Keys: []*JSONWebKey{}}
+	for _, key := range m.Published() {
+		if jwk, ok := key.JWK(); ok {
+			set.Keys = append(set.Keys, jwk)
+		}
+	}
+	return set
+}
+
+// ServeHTTP serves the published public keys as a JWKS document
+func (m *Manager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/jwk-set+json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	_ = json.NewEncoder(w).Encode(m.JWKS())
+}
+
+func encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func pad(b []byte, size int) []byte {
+	if len(b) >= size {
+		return b
+	}
+	padded := make([]byte, size)
+	copy(padded[size-len(b):], b)
+	return padded
+}
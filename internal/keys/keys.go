@@ -0,0 +1,366 @@
+package keys
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/pkg/errors"
+	"github.com/srcabl/users/internal/config"
+)
+
+// ErrKeyNotFound is returned when no published key has the requested ID
+var ErrKeyNotFound = errors.New("key not found")
+
+// Key is a token signing key
+type Key struct {
+	ID       string
+	Method   jwt.SigningMethod
+	Private  interface{}
+	Public   interface{}
+	ActiveAt time.Time
+	path     string
+	modTime  time.Time
+}
+
+// Manager holds the signing keys. The newest key that is active signs new
+// tokens, keys are published before they become active, and superseded keys
+// stay published for the grace period so tokens they signed can still be
+// verified.
+type Manager struct {
+	cfg config.Keys
+	now func() time.Time
+
+	mu   sync.RWMutex
+	keys []*Key
+}
+
+// NewManager news up a key manager and loads the configured keys
+func NewManager(cfg config.Keys) (*Manager, error) {
+	if cfg.RotationInterval > 0 && cfg.Dir == "" {
+		// keys only in memory would differ between replicas and die with the process
+		return nil, errors.New("rotating keys needs a key dir to write them to")
+	}
+	m := &Manager{
+		cfg: cfg,
+		now: time.Now,
+	}
+	if cfg.Secret != "" {
+		m.keys = append(m.keys, &Key{
+			Method:  jwt.SigningMethodHS256,
+			Private: []byte(cfg.Secret),
+			Public:  []byte(cfg.Secret),
+		})
+	}
+	if err := m.Reload(); err != nil {
+		return nil, err
+	}
+	if err := m.Rotate(); err != nil {
+		return nil, err
+	}
+	if len(m.keys) == 0 {
+		return nil, errors.New("no signing keys are configured")
+	}
+	return m, nil
+}
+
+// Run reloads the keys on the reload interval, and rotates them when the
+// newest key is due to be rotated, until the returned func is called
+func (m *Manager) Run() (func() error, error) {
+	var reload <-chan time.Time
+	var ticker *time.Ticker
+	if m.cfg.ReloadInterval > 0 {
+		ticker = time.NewTicker(m.cfg.ReloadInterval)
+		reload = ticker.C
+	}
+	var rotate <-chan time.Time
+	rotation := time.NewTimer(m.untilRotation())
+	if m.cfg.RotationInterval > 0 {
+		rotate = rotation.C
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		defer rotation.Stop()
+		if ticker != nil {
+			defer ticker.Stop()
+		}
+		for {
+			select {
+			case <-done:
+				return
+			case <-reload:
+				// a bad key file should not take down the keys that are already loaded
+				_ = m.Reload()
+			case <-rotate:
+				// reloading first picks up a key another replica rotated in
+				if err := m.Reload(); err == nil {
+					_ = m.Rotate()
+				}
+				rotation.Reset(m.untilRotation())
+			}
+		}
+	}()
+	return func() error {
+		close(done)
+		<-stopped
+		return nil
+	}, nil
+}
+
+// untilRotation is how long until the newest key is due to be rotated, which
+// is a pre publish period before it has signed for the rotation interval
+func (m *Manager) untilRotation() time.Duration {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if len(m.keys) == 0 {
+		return 0
+	}
+	newest := m.keys[len(m.keys)-1]
+	until := newest.ActiveAt.Add(m.cfg.RotationInterval - m.cfg.PrePublish).Sub(m.now())
+	if until < time.Second {
+		// keys that cannot be rotated are not retried in a busy loop
+		return time.Second
+	}
+	return until
+}
+
+// SigningKey returns the key new tokens should be signed with
+func (m *Manager) SigningKey() (*Key, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	now := m.now()
+	var signing *Key
+	for _, key := range m.keys {
+		if key.ActiveAt.After(now) {
+			continue
+		}
+		signing = key
+	}
+	if signing == nil {
+		return nil, errors.New("no signing key is active")
+	}
+	return signing, nil
+}
+
+// Key returns the published key with the given ID
+func (m *Manager) Key(id string) (*Key, error) {
+	for _, key := range m.Published() {
+		if key.ID == id {
+			return key, nil
+		}
+	}
+	return nil, errors.Wrapf(ErrKeyNotFound, "no published key with ID %q", id)
+}
+
+// Published returns every key that tokens may currently be verified with
+func (m *Manager) Published() []*Key {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	now := m.now()
+	var published []*Key
+	for i, key := range m.keys {
+		if i+1 < len(m.keys) {
+			next := m.keys[i+1]
+			if !next.ActiveAt.After(now) && now.Sub(next.ActiveAt) > m.cfg.GracePeriod {
+				continue
+			}
+		}
+		published = append(published, key)
+	}
+	return published
+}
+
+// Reload reads the configured key files, picking up new and changed ones
+func (m *Manager) Reload() error {
+	paths := append([]string{}, m.cfg.Files...)
+	if m.cfg.Dir != "" {
+		matches, err := filepath.Glob(filepath.Join(m.cfg.Dir, "*.pem"))
+		if err != nil {
+			return errors.Wrapf(err, "failed to list key dir %s", m.cfg.Dir)
+		}
+		paths = append(paths, matches...)
+	}
+
+	m.mu.RLock()
+	loaded := map[string]*Key{}
+	for _, key := range m.keys {
+		if key.path != "" {
+			loaded[key.path] = key
+		}
+	}
+	m.mu.RUnlock()
+
+	var fileKeys []*Key
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return errors.Wrapf(err, "failed to stat key %s", path)
+		}
+		if key, ok := loaded[path]; ok && key.modTime.Equal(info.ModTime()) {
+			fileKeys = append(fileKeys, key)
+			continue
+		}
+		key, err := loadKeyFile(path, info.ModTime().Add(m.cfg.PrePublish))
+		if err != nil {
+			return err
+		}
+		key.modTime = info.ModTime()
+		fileKeys = append(fileKeys, key)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := fileKeys
+	for _, key := range m.keys {
+		if key.path == "" {
+			keys = append(keys, key)
+		}
+	}
+	m.setKeys(keys)
+	// the oldest key replaces no other, so it signs from when it was
+	// published rather than waiting out the pre publish period
+	if len(m.keys) > 0 && m.keys[0].path != "" && m.keys[0].ActiveAt.After(m.keys[0].modTime) {
+		first := *m.keys[0]
+		first.ActiveAt = first.modTime
+		m.keys[0] = &first
+	}
+	return nil
+}
+
+// Rotate generates a new key once the newest key is older than the rotation
+// interval. The new key is published straight away but only starts signing
+// after the pre publish period, unless there is no key yet for it to replace.
+func (m *Manager) Rotate() error {
+	if m.cfg.RotationInterval <= 0 {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	activeAt := now.Add(m.cfg.PrePublish)
+	if len(m.keys) > 0 {
+		newest := m.keys[len(m.keys)-1]
+		if newest.ActiveAt.Add(m.cfg.RotationInterval).After(activeAt) {
+			return nil
+		}
+	} else {
+		activeAt = now
+	}
+	key, err := generateKey(m.cfg.Algorithm, now.UTC().Format("20060102T150405Z"), activeAt)
+	if err != nil {
+		return err
+	}
+	if m.cfg.Dir != "" {
+		if err := writeKeyFile(m.cfg.Dir, key, now); err != nil {
+			return err
+		}
+	}
+	m.setKeys(append(m.keys, key))
+	return nil
+}
+
+// setKeys must be called with the lock held
+func (m *Manager) setKeys(keys []*Key) {
+	sort.SliceStable(keys, func(i, j int) bool {
+		return keys[i].ActiveAt.Before(keys[j].ActiveAt)
+	})
+	m.keys = keys
+}
+
+func loadKeyFile(path string, activeAt time.Time) (*Key, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read key %s", path)
+	}
+	key, err := parsePrivateKey(raw)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to load key %s", path)
+	}
+	key.ID = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	key.ActiveAt = activeAt
+	key.path = path
+	return key, nil
+}
+
+func parsePrivateKey(raw []byte) (*Key, error) {
+	if key, err := jwt.ParseRSAPrivateKeyFromPEM(raw); err == nil {
+		return &Key{Method: jwt.SigningMethodRS256, Private: key, Public: key.Public()}, nil
+	}
+	if key, err := jwt.ParseECPrivateKeyFromPEM(raw); err == nil {
+		return &Key{Method: jwt.SigningMethodES256, Private: key, Public: key.Public()}, nil
+	}
+	if key, err := jwt.ParseEdPrivateKeyFromPEM(raw); err == nil {
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, errors.New("ed25519 key cannot sign")
+		}
+		return &Key{Method: jwt.SigningMethodEdDSA, Private: key, Public: signer.Public()}, nil
+	}
+	return nil, errors.New("key is not a PEM encoded RSA, ECDSA or Ed25519 private key")
+}
+
+func generateKey(algorithm, id string, activeAt time.Time) (*Key, error) {
+	key := &Key{ID: id, ActiveAt: activeAt}
+	switch algorithm {
+	case "RS256":
+		private, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to generate rsa key")
+		}
+		key.Method, key.Private, key.Public = jwt.SigningMethodRS256, private, private.Public()
+	case "ES256":
+		private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to generate ecdsa key")
+		}
+		key.Method, key.Private, key.Public = jwt.SigningMethodES256, private, private.Public()
+	case "EdDSA":
+		public, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to generate ed25519 key")
+		}
+		key.Method, key.Private, key.Public = jwt.SigningMethodEdDSA, private, public
+	default:
+		return nil, errors.Errorf("unsupported key algorithm %q", algorithm)
+	}
+	return key, nil
+}
+
+// writeKeyFile writes the key to the dir with a mod time that makes it load
+// back in with the same activation time
+func writeKeyFile(dir string, key *Key, modTime time.Time) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key.Private)
+	if err != nil {
+		return errors.Wrapf(err, "failed to marshal key %s", key.ID)
+	}
+	path := filepath.Join(dir, key.ID+".pem")
+	raw := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := ioutil.WriteFile(path, raw, 0600); err != nil {
+		return errors.Wrapf(err, "failed to write key %s", path)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		return errors.Wrapf(err, "failed to set mod time of key %s", path)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return errors.Wrapf(err, "failed to stat key %s", path)
+	}
+	key.path = path
+	key.modTime = info.ModTime()
+	return nil
+}
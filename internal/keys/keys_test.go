@@ -0,0 +1,201 @@
+package keys_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/srcabl/users/internal/config"
+	"github.com/srcabl/users/internal/keys"
+	"github.com/srcabl/users/internal/token"
+)
+
+// writeKey writes a new key to the dir, last modified at the time, which is
+// when it becomes active with no pre publish period
+func writeKey(t *testing.T, dir, id string, modTime time.Time) {
+	t.Helper()
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+	path := filepath.Join(dir, id+".pem")
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatalf("failed to write key: %v", err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatalf("failed to set mod time: %v", err)
+	}
+}
+
+func publishedIDs(m *keys.Manager) []string {
+	var ids []string
+	for _, key := range m.Published() {
+		ids = append(ids, key.ID)
+	}
+	return ids
+}
+
+func TestPublishedPrunesAfterGracePeriod(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatalf("failed to make key dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	now := time.Now()
+	writeKey(t, dir, "old", now.Add(-3*time.Hour))
+	writeKey(t, dir, "current", now.Add(-2*time.Hour))
+
+	m, err := keys.NewManager(config.Keys{Dir: dir, GracePeriod: time.Hour})
+	if err != nil {
+		t.Fatalf("failed to new manager: %v", err)
+	}
+	if ids := publishedIDs(m); len(ids) != 1 || ids[0] != "current" {
+		t.Fatalf("expected the key superseded past the grace period unpublished, got %v", ids)
+	}
+	if _, err := m.Key("old"); errors.Cause(err) != keys.ErrKeyNotFound {
+		t.Fatalf("expected the old key not found, got %v", err)
+	}
+
+	m, err = keys.NewManager(config.Keys{Dir: dir, GracePeriod: 3 * time.Hour})
+	if err != nil {
+		t.Fatalf("failed to new manager: %v", err)
+	}
+	if ids := publishedIDs(m); len(ids) != 2 || ids[0] != "old" || ids[1] != "current" {
+		t.Fatalf("expected the superseded key published within the grace period, got %v", ids)
+	}
+	signing, err := m.SigningKey()
+	if err != nil || signing.ID != "current" {
+		t.Fatalf("expected the newest key to sign, got %v, %v", signing, err)
+	}
+}
+
+func TestKeyLookupAcrossRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatalf("failed to make key dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	writeKey(t, dir, "old", time.Now().Add(-2*time.Hour))
+	cfg := config.Keys{Dir: dir, Algorithm: "ES256", GracePeriod: time.Hour}
+	tokens := config.Default().Tokens
+
+	before, err := keys.NewManager(cfg)
+	if err != nil {
+		t.Fatalf("failed to new manager: %v", err)
+	}
+	beforeIssuer, err := token.NewIssuer(tokens, before)
+	if err != nil {
+		t.Fatalf("failed to new issuer: %v", err)
+	}
+	oldToken, _, err := beforeIssuer.Issue("user", "session", "laptop", nil)
+	if err != nil {
+		t.Fatalf("failed to issue: %v", err)
+	}
+
+	// the newest key is due, so a replica starting up rotates in a new one
+	cfg.RotationInterval = time.Hour
+	rotated, err := keys.NewManager(cfg)
+	if err != nil {
+		t.Fatalf("failed to new rotating manager: %v", err)
+	}
+	signing, err := rotated.SigningKey()
+	if err != nil || signing.ID == "old" {
+		t.Fatalf("expected a new key to sign, got %v, %v", signing, err)
+	}
+	rotatedIssuer, err := token.NewIssuer(tokens, rotated)
+	if err != nil {
+		t.Fatalf("failed to new issuer: %v", err)
+	}
+	if _, err := rotatedIssuer.Verify(oldToken); err != nil {
+		t.Fatalf("expected a token signed before the rotation to verify: %v", err)
+	}
+	newToken, _, err := rotatedIssuer.Issue("user", "session", "laptop", nil)
+	if err != nil {
+		t.Fatalf("failed to issue: %v", err)
+	}
+
+	// the other replica loads the rotated key from the shared dir
+	if err := before.Reload(); err != nil {
+		t.Fatalf("failed to reload: %v", err)
+	}
+	if _, err := beforeIssuer.Verify(newToken); err != nil {
+		t.Fatalf("expected a token signed after the rotation to verify on another replica: %v", err)
+	}
+
+	cfg.Dir = ""
+	if _, err := keys.NewManager(cfg); err == nil {
+		t.Fatal("expected rotating keys without a key dir to fail")
+	}
+}
+
+func TestFirstKeySignsOnBoot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatalf("failed to make key dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	writeKey(t, dir, "first", time.Now())
+	cfg := config.Keys{Dir: dir, PrePublish: time.Hour, GracePeriod: time.Hour}
+
+	m, err := keys.NewManager(cfg)
+	if err != nil {
+		t.Fatalf("expected the only key to be active on boot: %v", err)
+	}
+	signing, err := m.SigningKey()
+	if err != nil || signing.ID != "first" {
+		t.Fatalf("expected the only key to sign, got %v, %v", signing, err)
+	}
+
+	// a key replacing the active one waits out the pre publish period
+	writeKey(t, dir, "second", time.Now())
+	if err := m.Reload(); err != nil {
+		t.Fatalf("failed to reload: %v", err)
+	}
+	signing, err = m.SigningKey()
+	if err != nil || signing.ID != "first" {
+		t.Fatalf("expected the first key to sign while the second is pre published, got %v, %v", signing, err)
+	}
+	if ids := publishedIDs(m); len(ids) != 2 {
+		t.Fatalf("expected both keys published, got %v", ids)
+	}
+}
+
+func TestFirstRotatedKeySignsOnBoot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatalf("failed to make key dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := config.Keys{Dir: dir, Algorithm: "ES256", RotationInterval: 24 * time.Hour, PrePublish: time.Hour, GracePeriod: time.Hour}
+
+	m, err := keys.NewManager(cfg)
+	if err != nil {
+		t.Fatalf("failed to new manager: %v", err)
+	}
+	signing, err := m.SigningKey()
+	if err != nil {
+		t.Fatalf("expected the first generated key to sign straight away: %v", err)
+	}
+
+	// another replica booting on the same dir signs with it too
+	other, err := keys.NewManager(cfg)
+	if err != nil {
+		t.Fatalf("failed to new manager: %v", err)
+	}
+	otherSigning, err := other.SigningKey()
+	if err != nil || otherSigning.ID != signing.ID {
+		t.Fatalf("expected the other replica to sign with %s, got %v, %v", signing.ID, otherSigning, err)
+	}
+}
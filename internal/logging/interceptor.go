@@ -0,0 +1,136 @@
+package logging
+
+import (
+	"context"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/srcabl/users/internal/auth"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// RequestIDHeader is the metadata key a request ID is read from and sent back in
+const RequestIDHeader = "x-request-id"
+
+// UnaryServerInterceptor gives every unary rpc a logger carrying its request
+// ID and method, and logs the rpc once it finishes
+func UnaryServerInterceptor(logger *zap.Logger) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := time.Now()
+		ctx = newRequestContext(ctx, logger, info.FullMethod)
+		_ = grpc.SetHeader(ctx, metadata.Pairs(RequestIDHeader, RequestID(ctx)))
+		res, err := handler(ctx, req)
+		logFinished(ctx, start, err)
+		return res, err
+	}
+}
+
+// StreamServerInterceptor gives every streaming rpc a logger carrying its
+// request ID and method, and logs the rpc once it finishes
+func StreamServerInterceptor(logger *zap.Logger) grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		start := time.Now()
+		ctx := newRequestContext(stream.Context(), logger, info.FullMethod)
+		_ = stream.SetHeader(metadata.Pairs(RequestIDHeader, RequestID(ctx)))
+		err := handler(srv, &loggedStream{ServerStream: stream, ctx: ctx})
+		logFinished(ctx, start, err)
+		return err
+	}
+}
+
+// CallerUnaryServerInterceptor adds the authenticated caller to the request's
+// logger. It has to run after authentication.
+func CallerUnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		AddFields(ctx, callerFields(auth.FromContext(ctx))...)
+		return handler(ctx, req)
+	}
+}
+
+// CallerStreamServerInterceptor adds the authenticated caller to the
+// request's logger. It has to run after authentication.
+func CallerStreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		AddFields(stream.Context(), callerFields(auth.FromContext(stream.Context()))...)
+		return handler(srv, stream)
+	}
+}
+
+type requestIDKey struct{}
+
+func newRequestContext(ctx context.Context, logger *zap.Logger, method string) context.Context {
+	id := ""
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if ids := md.Get(RequestIDHeader); len(ids) > 0 && len(ids[0]) <= 128 {
+			id = ids[0]
+		}
+	}
+	if id == "" {
+		generated, err := uuid.NewV4()
+		if err == nil {
+			id = generated.String()
+		}
+	}
+	ctx = context.WithValue(ctx, requestIDKey{}, id)
+	return NewContext(ctx, logger.With(
+		zap.String("request_id", id),
+		zap.String("method", method),
+	))
+}
+
+// RequestID returns the ID of the request the context belongs to, or an
+// empty string outside of one
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+func callerFields(principal *auth.Principal) []zap.Field {
+	var fields []zap.Field
+	if principal.ServiceName != "" {
+		fields = append(fields, zap.String("caller_service", principal.ServiceName))
+	}
+	if principal.IsUser() {
+		fields = append(fields, zap.String("caller_user", principal.UserUUID))
+	}
+	if len(fields) == 0 {
+		fields = append(fields, zap.Bool("caller_anonymous", true))
+	}
+	return fields
+}
+
+// logFinished logs the outcome of an rpc, as an error when the failure is
+// the service's rather than the caller's
+func logFinished(ctx context.Context, start time.Time, err error) {
+	code := status.Code(err)
+	level := zapcore.InfoLevel
+	switch code {
+	case codes.Unknown, codes.Internal, codes.Unavailable, codes.DataLoss, codes.DeadlineExceeded, codes.Unimplemented:
+		level = zapcore.ErrorLevel
+	}
+	fields := []zap.Field{
+		zap.String("code", code.String()),
+		zap.Duration("duration", time.Since(start)),
+	}
+	if err != nil {
+		fields = append(fields, zap.Error(err))
+	}
+	if checked := FromContext(ctx).Check(level, "rpc finished"); checked != nil {
+		checked.Write(fields...)
+	}
+}
+
+// loggedStream carries the request's logger into a streaming handler
+type loggedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *loggedStream) Context() context.Context {
+	return s.ctx
+}
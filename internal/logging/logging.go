@@ -0,0 +1,71 @@
+package logging
+
+import (
+	"context"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/srcabl/users/internal/config"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// New news up the service logger. Everything it writes goes through redaction.
+func New(cfg config.Logging) (*zap.Logger, error) {
+	var level zapcore.Level
+	if err := level.UnmarshalText([]byte(cfg.Level)); err != nil {
+		return nil, errors.Wrapf(err, "log level %q is not valid", cfg.Level)
+	}
+	encoderConfig := zap.NewProductionEncoderConfig()
+	encoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+	var encoder zapcore.Encoder
+	switch cfg.Format {
+	case "json":
+		encoder = zapcore.NewJSONEncoder(encoderConfig)
+	case "console":
+		encoder = zapcore.NewConsoleEncoder(encoderConfig)
+	default:
+		return nil, errors.Errorf("log format %q is not valid, use json or console", cfg.Format)
+	}
+	core := zapcore.NewCore(encoder, zapcore.Lock(os.Stderr), level)
+	return zap.New(RedactingCore(core), zap.AddCaller(), zap.AddStacktrace(zapcore.ErrorLevel)), nil
+}
+
+type contextKey struct{}
+
+// requestLogger is the logger of one request. Interceptors further down the
+// chain add fields to it, such as the caller once it is authenticated, and
+// the request's final log line carries them.
+type requestLogger struct {
+	mu     sync.Mutex
+	logger *zap.Logger
+}
+
+// NewContext returns a context carrying the logger
+func NewContext(ctx context.Context, logger *zap.Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, &requestLogger{logger: logger})
+}
+
+// FromContext returns the logger of the request, or a logger discarding
+// everything when the context has none
+func FromContext(ctx context.Context) *zap.Logger {
+	rl, ok := ctx.Value(contextKey{}).(*requestLogger)
+	if !ok {
+		return zap.NewNop()
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return rl.logger
+}
+
+// AddFields adds fields to the logger of the request
+func AddFields(ctx context.Context, fields ...zap.Field) {
+	rl, ok := ctx.Value(contextKey{}).(*requestLogger)
+	if !ok {
+		return
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.logger = rl.logger.With(fields...)
+}
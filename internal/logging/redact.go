@@ -0,0 +1,92 @@
+package logging
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+const redacted = "[REDACTED]"
+
+// sensitiveKeys are field keys whose values are never logged. An OAuth
+// authorization code is logged as auth_code, code is the rpc's status code.
+var sensitiveKeys = map[string]bool{
+	"authorization":   true,
+	"access_token":    true,
+	"auth_code":       true,
+	"client_secret":   true,
+	"email":           true,
+	"hashed_password": true,
+	"id_token":        true,
+	"password":        true,
+	"refresh_token":   true,
+	"secret":          true,
+	"token":           true,
+}
+
+var (
+	emailPattern  = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`)
+	bcryptPattern = regexp.MustCompile(`\$2[abxy]?\$\d{2}\$[./A-Za-z0-9]{53}`)
+	jwtPattern    = regexp.MustCompile(`eyJ[A-Za-z0-9_\-]*\.[A-Za-z0-9_\-]+\.[A-Za-z0-9_\-]*`)
+	bearerPattern = regexp.MustCompile(`(?i)bearer\s+\S+`)
+)
+
+// Redact scrubs emails, password hashes and tokens out of s
+func Redact(s string) string {
+	s = emailPattern.ReplaceAllString(s, redacted)
+	s = bcryptPattern.ReplaceAllString(s, redacted)
+	s = jwtPattern.ReplaceAllString(s, redacted)
+	return bearerPattern.ReplaceAllString(s, "Bearer "+redacted)
+}
+
+// RedactingCore wraps core so the message and fields of every entry are
+// redacted before core encodes them
+func RedactingCore(core zapcore.Core) zapcore.Core {
+	return &redactingCore{Core: core}
+}
+
+// redactingCore redacts the message and fields of every entry before the
+// wrapped core encodes them
+type redactingCore struct {
+	zapcore.Core
+}
+
+func (c *redactingCore) With(fields []zapcore.Field) zapcore.Core {
+	return &redactingCore{Core: c.Core.With(redactFields(fields))}
+}
+
+func (c *redactingCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(entry.Level) {
+		return checked.AddCore(entry, c)
+	}
+	return checked
+}
+
+func (c *redactingCore) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	entry.Message = Redact(entry.Message)
+	return c.Core.Write(entry, redactFields(fields))
+}
+
+func redactFields(fields []zapcore.Field) []zapcore.Field {
+	out := make([]zapcore.Field, len(fields))
+	for i, field := range fields {
+		switch {
+		case sensitiveKeys[strings.ToLower(field.Key)]:
+			out[i] = zap.String(field.Key, redacted)
+		case field.Type == zapcore.StringType:
+			out[i] = zap.String(field.Key, Redact(field.String))
+		case field.Type == zapcore.ErrorType:
+			out[i] = zap.String(field.Key, Redact(field.Interface.(error).Error()))
+		case field.Type == zapcore.StringerType:
+			out[i] = zap.String(field.Key, Redact(field.Interface.(fmt.Stringer).String()))
+		case field.Type == zapcore.ReflectType:
+			out[i] = zap.String(field.Key, Redact(fmt.Sprintf("%+v", field.Interface)))
+		default:
+			out[i] = field
+		}
+	}
+	return out
+}
@@ -0,0 +1,61 @@
+package logging_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/srcabl/users/internal/logging"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func newObservedLogger() (*zap.Logger, *observer.ObservedLogs) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	return zap.New(logging.RedactingCore(core)), logs
+}
+
+func TestRedactKeepsStatusCode(t *testing.T) {
+	logger, logs := newObservedLogger()
+	interceptor := logging.UnaryServerInterceptor(logger)
+	info := &grpc.UnaryServerInfo{FullMethod: "/users.Users/GetUser"}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, status.Error(codes.NotFound, "user not found")
+	}
+	if _, err := interceptor(context.Background(), nil, info, handler); status.Code(err) != codes.NotFound {
+		t.Fatalf("expected NotFound, got %v", err)
+	}
+	entries := logs.All()
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 log entry, got %d", len(entries))
+	}
+	if got := entries[0].ContextMap()["code"]; got != codes.NotFound.String() {
+		t.Errorf("expected code %q, got %v", codes.NotFound.String(), got)
+	}
+}
+
+func TestRedactSensitiveFields(t *testing.T) {
+	logger, logs := newObservedLogger()
+	logger.Info("callback for jane@example.com",
+		zap.String("auth_code", "4/0AX4XfWh"),
+		zap.String("password", "hunter2"),
+		zap.String("detail", "sent to jane@example.com"),
+	)
+	entry := logs.All()[0]
+	if entry.Message != "callback for [REDACTED]" {
+		t.Errorf("expected the email to be redacted from the message, got %q", entry.Message)
+	}
+	fields := entry.ContextMap()
+	for key, want := range map[string]string{
+		"auth_code": "[REDACTED]",
+		"password":  "[REDACTED]",
+		"detail":    "sent to [REDACTED]",
+	} {
+		if fields[key] != want {
+			t.Errorf("expected %s to be %q, got %v", key, want, fields[key])
+		}
+	}
+}
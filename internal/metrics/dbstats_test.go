@@ -0,0 +1,56 @@
+package metrics_test
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/srcabl/users/internal/metrics"
+)
+
+func scrape(t *testing.T, m *metrics.Metrics) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("scrape failed with %d: %s", rec.Code, rec.Body.String())
+	}
+	return rec.Body.String()
+}
+
+func TestDBStatsBeforeAndAfterConnect(t *testing.T) {
+	m, err := metrics.New()
+	if err != nil {
+		t.Fatalf("failed to new metrics: %v", err)
+	}
+	var db *sql.DB
+	if err := m.RegisterDB("users", func() *sql.DB { return db }); err != nil {
+		t.Fatalf("failed to register db: %v", err)
+	}
+
+	if body := scrape(t, m); strings.Contains(body, "users_db_open_connections") {
+		t.Fatalf("expected no pool stats before the database connected, got %s", body)
+	}
+
+	db, err = sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(3)
+	if err := db.Ping(); err != nil {
+		t.Fatalf("failed to connect to database: %v", err)
+	}
+	body := scrape(t, m)
+	for _, want := range []string{
+		`users_db_max_open_connections{db_name="users"} 3`,
+		`users_db_open_connections{db_name="users"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("expected %s once connected, got %s", want, body)
+		}
+	}
+}
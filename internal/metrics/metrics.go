@@ -0,0 +1,199 @@
+package metrics
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+const namespace = "users"
+
+// The ways a user can sign up and log in
+const (
+	MethodPassword = "password"
+	MethodIdentity = "identity"
+)
+
+// Metrics holds the service's prometheus metrics on a registry of its own
+type Metrics struct {
+	registry *prometheus.Registry
+
+	handled  *prometheus.CounterVec
+	handling *prometheus.HistogramVec
+	signups  *prometheus.CounterVec
+	logins   *prometheus.CounterVec
+	lockouts prometheus.Counter
+	follows  *prometheus.CounterVec
+	events   *prometheus.CounterVec
+	webhooks *prometheus.CounterVec
+	exports  *prometheus.CounterVec
+}
+
+// New news up the metrics and registers them along with the go runtime and process metrics
+func New() (*Metrics, error) {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		handled: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "grpc_server_handled_total",
+			Help:      "RPCs completed by the server, by method and status code.",
+		}, []string{"grpc_method", "grpc_code"}),
+		handling: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "grpc_server_handling_seconds",
+			Help:      "Time taken to handle RPCs, by method.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"grpc_method"}),
+		signups: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "signups_total",
+			Help:      "Users created, by sign up method.",
+		}, []string{"method"}),
+		logins: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "logins_total",
+			Help:      "Login attempts, by method and result.",
+		}, []string{"method", "result"}),
+		lockouts: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "lockouts_total",
+			Help:      "Users locked after too many failed logins.",
+		}),
+		follows: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "follows_total",
+			Help:      "Follows and unfollows, by action and followed type.",
+		}, []string{"action", "type"}),
+		events: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "outbox_events_published_total",
+			Help:      "Outbox events handed to the publisher, by event type and result.",
+		}, []string{"type", "result"}),
+		webhooks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "webhook_attempts_total",
+			Help:      "Attempts at webhook deliveries, by result: delivered, failed or dead.",
+		}, []string{"result"}),
+		exports: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "data_exports_total",
+			Help:      "Data exports built, by format and result: ready or failed.",
+		}, []string{"format", "result"}),
+	}
+	collectors := []prometheus.Collector{
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		m.handled,
+		m.handling,
+		m.signups,
+		m.logins,
+		m.lockouts,
+		m.follows,
+		m.events,
+		m.webhooks,
+		m.exports,
+	}
+	for _, c := range collectors {
+		if err := m.registry.Register(c); err != nil {
+			return nil, errors.Wrap(err, "failed to register collector")
+		}
+	}
+	return m, nil
+}
+
+// Handler serves the metrics in the prometheus exposition format
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// RegisterDB exports the connection pool stats of the named database, from
+// the pool db returns when scraped
+func (m *Metrics) RegisterDB(name string, db func() *sql.DB) error {
+	if err := m.registry.Register(newDBStatsCollector(name, db)); err != nil {
+		return errors.Wrapf(err, "failed to register stats for database %s", name)
+	}
+	return nil
+}
+
+// UnaryServerInterceptor times unary rpcs and counts them by status code
+func (m *Metrics) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := time.Now()
+		res, err := handler(ctx, req)
+		m.observe(info.FullMethod, start, err)
+		return res, err
+	}
+}
+
+// StreamServerInterceptor times streaming rpcs and counts them by status code
+func (m *Metrics) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		start := time.Now()
+		err := handler(srv, stream)
+		m.observe(info.FullMethod, start, err)
+		return err
+	}
+}
+
+func (m *Metrics) observe(method string, start time.Time, err error) {
+	m.handling.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	m.handled.WithLabelValues(method, status.Code(err).String()).Inc()
+}
+
+// Signup counts a user created through the method
+func (m *Metrics) Signup(method string) {
+	m.signups.WithLabelValues(method).Inc()
+}
+
+// Login counts a login attempt through the method
+func (m *Metrics) Login(method string, succeeded bool) {
+	result := "failure"
+	if succeeded {
+		result = "success"
+	}
+	m.logins.WithLabelValues(method, result).Inc()
+}
+
+// Lockout counts a user locked after too many failed logins
+func (m *Metrics) Lockout() {
+	m.lockouts.Inc()
+}
+
+// Follow counts a follow of the followed type
+func (m *Metrics) Follow(followType string) {
+	m.follows.WithLabelValues("follow", followType).Inc()
+}
+
+// Unfollow counts an unfollow of the followed type
+func (m *Metrics) Unfollow(followType string) {
+	m.follows.WithLabelValues("unfollow", followType).Inc()
+}
+
+// EventPublished counts an outbox event handed to the publisher
+func (m *Metrics) EventPublished(eventType string, succeeded bool) {
+	result := "failure"
+	if succeeded {
+		result = "success"
+	}
+	m.events.WithLabelValues(eventType, result).Inc()
+}
+
+// WebhookAttempt counts an attempt at a webhook delivery by its result,
+// which is the status the delivery was left in or failed when it will be
+// attempted again
+func (m *Metrics) WebhookAttempt(result string) {
+	m.webhooks.WithLabelValues(result).Inc()
+}
+
+// DataExport counts a data export built in the format by its result, which
+// is the status the export was left in
+func (m *Metrics) DataExport(format, result string) {
+	m.exports.WithLabelValues(format, result).Inc()
+}
@@ -0,0 +1,398 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"hash/crc32"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/srcabl/users/internal/config"
+	"github.com/srcabl/users/migrations"
+)
+
+// Migration is one schema version, applied by its up statements and reverted
+// by its down statements
+type Migration struct {
+	Version uint64
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Status is the schema version a database is at. A zero version means no
+// migration is applied. Dirty means the migration at the version failed part
+// way, and the schema has to be fixed by hand before the version is forced.
+type Status struct {
+	Version uint64
+	Dirty   bool
+	Latest  uint64
+}
+
+// Migrator applies the embedded migrations of a storage driver to its
+// database. Every run holds a database wide lock, so replicas booting at the
+// same time take turns instead of racing through the same migrations. The
+// version is kept in the schema_migrations table the migrate cli used, so
+// databases it migrated carry on from where they are.
+type Migrator struct {
+	db         *sql.DB
+	dialect    *dialect
+	migrations []*Migration
+}
+
+// lockName names the lock migrations run under
+const lockName = "srcabl_users_migrations"
+
+// dialect is what differs between the databases migrations run on
+type dialect struct {
+	createTable   string
+	insertVersion string
+	// lock blocks until the migrations lock is held and returns the func
+	// that lets it go. It is nil for sqlite, whose database belongs to a
+	// single process.
+	lock func(ctx context.Context, conn *sql.Conn) (func() error, error)
+	// split runs the statements of a migration one by one, for drivers that
+	// take a single statement per exec
+	split bool
+}
+
+const createMigrationsTable = `
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		version BIGINT NOT NULL PRIMARY KEY,
+		dirty BOOLEAN NOT NULL
+	)
+`
+
+const selectVersion = `
+	SELECT version, dirty
+	FROM schema_migrations
+	LIMIT 1
+`
+
+const deleteVersion = `
+	DELETE FROM schema_migrations
+`
+
+var dialects = map[string]*dialect{
+	config.StorageMySQL: {
+		createTable:   createMigrationsTable,
+		insertVersion: `INSERT INTO schema_migrations (version, dirty) VALUES (?, ?)`,
+		lock:          mysqlLock,
+		split:         true,
+	},
+	config.StoragePostgres: {
+		createTable:   createMigrationsTable,
+		insertVersion: `INSERT INTO schema_migrations (version, dirty) VALUES ($1, $2)`,
+		lock:          postgresLock,
+	},
+	config.StorageSQLite: {
+		createTable:   createMigrationsTable,
+		insertVersion: `INSERT INTO schema_migrations (version, dirty) VALUES (?, ?)`,
+	},
+}
+
+// New news up a migrator for the storage driver's migrations on the database
+func New(driver string, db *sql.DB) (*Migrator, error) {
+	d, ok := dialects[driver]
+	if !ok {
+		return nil, errors.Errorf("storage driver %q has no migrations", driver)
+	}
+	all, err := Load(driver)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{
+		db:         db,
+		dialect:    d,
+		migrations: all,
+	}, nil
+}
+
+var migrationFile = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+
+// Load reads the embedded migrations of the storage driver in version order.
+// Every migration must have both an up and a down.
+func Load(driver string) ([]*Migration, error) {
+	dir, err := fs.Sub(migrations.FS, driver)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open %s migrations", driver)
+	}
+	entries, err := fs.ReadDir(dir, ".")
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list %s migrations", driver)
+	}
+	byVersion := map[uint64]*Migration{}
+	for _, entry := range entries {
+		match := migrationFile.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, errors.Errorf("migration file %s/%s is not named {version}_{name}.{up|down}.sql", driver, entry.Name())
+		}
+		version, err := strconv.ParseUint(match[1], 10, 64)
+		if err != nil || version == 0 {
+			return nil, errors.Errorf("migration file %s/%s has a bad version", driver, entry.Name())
+		}
+		raw, err := fs.ReadFile(dir, entry.Name())
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read migration %s/%s", driver, entry.Name())
+		}
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = migration
+		}
+		if migration.Name != match[2] {
+			return nil, errors.Errorf("migration %d of %s has two names, %s and %s", version, driver, migration.Name, match[2])
+		}
+		if match[3] == "up" {
+			migration.Up = string(raw)
+		} else {
+			migration.Down = string(raw)
+		}
+	}
+	all := make([]*Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if strings.TrimSpace(migration.Up) == "" {
+			return nil, errors.Errorf("migration %d of %s has no up", migration.Version, driver)
+		}
+		if strings.TrimSpace(migration.Down) == "" {
+			return nil, errors.Errorf("migration %d of %s has no down", migration.Version, driver)
+		}
+		all = append(all, migration)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].Version < all[j].Version
+	})
+	return all, nil
+}
+
+// Migrations returns the migrations in version order
+func (m *Migrator) Migrations() []*Migration {
+	return m.migrations
+}
+
+// Status returns the version the database is at
+func (m *Migrator) Status(ctx context.Context) (*Status, error) {
+	var status *Status
+	err := m.run(ctx, func(conn *sql.Conn, current *Status) error {
+		status = current
+		return nil
+	})
+	return status, err
+}
+
+// Up applies every migration newer than the database's version and returns
+// how many it applied
+func (m *Migrator) Up(ctx context.Context) (int, error) {
+	applied := 0
+	err := m.run(ctx, func(conn *sql.Conn, status *Status) error {
+		if status.Dirty {
+			return dirtyError(status)
+		}
+		for _, migration := range m.migrations {
+			if migration.Version <= status.Version {
+				continue
+			}
+			if err := m.apply(ctx, conn, migration.Version, migration.Up, migration.Version); err != nil {
+				return errors.Wrapf(err, "failed to apply migration %d %s", migration.Version, migration.Name)
+			}
+			applied++
+		}
+		return nil
+	})
+	return applied, err
+}
+
+// Down reverts up to the given number of migrations, newest first, and
+// returns how many it reverted
+func (m *Migrator) Down(ctx context.Context, steps int) (int, error) {
+	if steps < 1 {
+		return 0, errors.Errorf("cannot revert %d migrations", steps)
+	}
+	reverted := 0
+	err := m.run(ctx, func(conn *sql.Conn, status *Status) error {
+		if status.Dirty {
+			return dirtyError(status)
+		}
+		if status.Version == 0 {
+			return nil
+		}
+		i := m.index(status.Version)
+		if i < 0 {
+			return errors.Errorf("database is at version %d, which is not a known migration", status.Version)
+		}
+		for ; i >= 0 && reverted < steps; i-- {
+			migration := m.migrations[i]
+			var previous uint64
+			if i > 0 {
+				previous = m.migrations[i-1].Version
+			}
+			if err := m.apply(ctx, conn, migration.Version, migration.Down, previous); err != nil {
+				return errors.Wrapf(err, "failed to revert migration %d %s", migration.Version, migration.Name)
+			}
+			reverted++
+		}
+		return nil
+	})
+	return reverted, err
+}
+
+// Force sets the database's version without running any migration and
+// clears the dirty flag. It is how a database is recovered after a failed
+// migration was fixed by hand. Version zero marks no migration as applied.
+func (m *Migrator) Force(ctx context.Context, version uint64) error {
+	if version != 0 && m.index(version) < 0 {
+		return errors.Errorf("version %d is not a known migration", version)
+	}
+	return m.run(ctx, func(conn *sql.Conn, status *Status) error {
+		return m.setVersion(ctx, conn, version, false)
+	})
+}
+
+// run runs the func on one connection holding the migrations lock, with the
+// version the database is at once the lock is held
+func (m *Migrator) run(ctx context.Context, fn func(conn *sql.Conn, status *Status) error) (err error) {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to get a database connection")
+	}
+	defer conn.Close()
+	if m.dialect.lock != nil {
+		unlock, err := m.dialect.lock(ctx, conn)
+		if err != nil {
+			return errors.Wrap(err, "failed to take the migrations lock")
+		}
+		defer func() {
+			if uerr := unlock(); uerr != nil && err == nil {
+				err = errors.Wrap(uerr, "failed to release the migrations lock")
+			}
+		}()
+	}
+	if _, err := conn.ExecContext(ctx, m.dialect.createTable); err != nil {
+		return errors.Wrap(err, "failed to create the migrations table")
+	}
+	status := &Status{}
+	if len(m.migrations) > 0 {
+		status.Latest = m.migrations[len(m.migrations)-1].Version
+	}
+	var version int64
+	err = conn.QueryRowContext(ctx, selectVersion).Scan(&version, &status.Dirty)
+	if err != nil && err != sql.ErrNoRows {
+		return errors.Wrap(err, "failed to read the database version")
+	}
+	if version > 0 {
+		status.Version = uint64(version)
+	}
+	return fn(conn, status)
+}
+
+// apply marks the database dirty at the version, runs the statements and
+// sets the version they leave the database at
+func (m *Migrator) apply(ctx context.Context, conn *sql.Conn, version uint64, statements string, to uint64) error {
+	if err := m.setVersion(ctx, conn, version, true); err != nil {
+		return err
+	}
+	run := []string{statements}
+	if m.dialect.split {
+		run = splitStatements(statements)
+	}
+	for _, statement := range run {
+		if _, err := conn.ExecContext(ctx, statement); err != nil {
+			return err
+		}
+	}
+	return m.setVersion(ctx, conn, to, false)
+}
+
+// setVersion replaces the version row. There is no row at version zero.
+func (m *Migrator) setVersion(ctx context.Context, conn *sql.Conn, version uint64, dirty bool) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to begin version transaction")
+	}
+	if _, err := tx.ExecContext(ctx, deleteVersion); err != nil {
+		_ = tx.Rollback()
+		return errors.Wrap(err, "failed to clear the database version")
+	}
+	if version > 0 {
+		if _, err := tx.ExecContext(ctx, m.dialect.insertVersion, int64(version), dirty); err != nil {
+			_ = tx.Rollback()
+			return errors.Wrapf(err, "failed to set the database version to %d", version)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "failed to commit the database version")
+	}
+	return nil
+}
+
+// index returns where the version is in the migrations, or -1
+func (m *Migrator) index(version uint64) int {
+	for i, migration := range m.migrations {
+		if migration.Version == version {
+			return i
+		}
+	}
+	return -1
+}
+
+func dirtyError(status *Status) error {
+	return errors.Errorf("database is dirty at version %d, fix the schema by hand and force a version", status.Version)
+}
+
+// splitStatements splits a migration on semicolons, dropping the pieces that
+// hold only comments. Migrations for split dialects must not have a semicolon
+// inside a string or a comment.
+func splitStatements(statements string) []string {
+	var split []string
+	for _, piece := range strings.Split(statements, ";") {
+		if !onlyComments(piece) {
+			split = append(split, strings.TrimSpace(piece))
+		}
+	}
+	return split
+}
+
+func onlyComments(piece string) bool {
+	for _, line := range strings.Split(piece, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "--") {
+			return false
+		}
+	}
+	return true
+}
+
+// mysqlLock takes a named lock held by the connection's session, waiting for
+// as long as the context allows
+func mysqlLock(ctx context.Context, conn *sql.Conn) (func() error, error) {
+	var held sql.NullInt64
+	if err := conn.QueryRowContext(ctx, `SELECT GET_LOCK(?, -1)`, lockName).Scan(&held); err != nil {
+		return nil, err
+	}
+	if held.Int64 != 1 {
+		return nil, errors.Errorf("lock %s was not granted", lockName)
+	}
+	return func() error {
+		_, err := conn.ExecContext(context.Background(), `SELECT RELEASE_LOCK(?)`, lockName)
+		return err
+	}, nil
+}
+
+// postgresLockKey is the advisory lock key migrations run under
+var postgresLockKey = int64(crc32.ChecksumIEEE([]byte(lockName)))
+
+// postgresLock takes a session advisory lock, waiting for as long as the
+// context allows
+func postgresLock(ctx context.Context, conn *sql.Conn) (func() error, error) {
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, postgresLockKey); err != nil {
+		return nil, err
+	}
+	return func() error {
+		_, err := conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, postgresLockKey)
+		return err
+	}, nil
+}
@@ -0,0 +1,258 @@
+package migrate_test
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"testing"
+
+	// registers the mysql driver
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/srcabl/users/internal/config"
+	"github.com/srcabl/users/internal/db/postgres"
+	"github.com/srcabl/users/internal/db/sqlite"
+	"github.com/srcabl/users/internal/migrate"
+)
+
+// The migrations run down and up again against sqlite always, and against
+// mysql and postgres when these name a database. The test drops every table,
+// so the database must not be one other tests are using. The mysql one is a
+// go-sql-driver dsn for the srcabl_users database and the postgres one a
+// connection url.
+const (
+	mysqlDSNEnv    = "USERS_TEST_MIGRATE_MYSQL_DSN"
+	postgresDSNEnv = "USERS_TEST_MIGRATE_POSTGRES_DSN"
+)
+
+// tables are the tables the migrations create, bar schema_migrations
+var tables = []string{
+	"users",
+	"user_user_follows",
+	"user_source_follows",
+	"user_sessions",
+	"user_identities",
+	"user_roles",
+}
+
+func TestMigrationsMatchAcrossDrivers(t *testing.T) {
+	mysqlMigrations, err := migrate.Load(config.StorageMySQL)
+	if err != nil {
+		t.Fatalf("failed to load mysql migrations: %v", err)
+	}
+	for _, driver := range []string{config.StorageSQLite, config.StoragePostgres} {
+		driverMigrations, err := migrate.Load(driver)
+		if err != nil {
+			t.Fatalf("failed to load %s migrations: %v", driver, err)
+		}
+		if len(driverMigrations) != len(mysqlMigrations) {
+			t.Fatalf("expected %d %s migrations, got %d", len(mysqlMigrations), driver, len(driverMigrations))
+		}
+		for i, migration := range driverMigrations {
+			if migration.Version != mysqlMigrations[i].Version || migration.Name != mysqlMigrations[i].Name {
+				t.Errorf("expected %s migration %d to be %d %s, got %d %s", driver, i,
+					mysqlMigrations[i].Version, mysqlMigrations[i].Name, migration.Version, migration.Name)
+			}
+		}
+	}
+}
+
+func TestLoadUnknownDriver(t *testing.T) {
+	if _, err := migrate.New("oracle", nil); err == nil {
+		t.Fatal("expected an error for a driver without migrations")
+	}
+}
+
+func TestSQLiteMigrations(t *testing.T) {
+	db, err := sqlite.New(config.Storage{Path: ":memory:"})
+	if err != nil {
+		t.Fatalf("failed to new sqlite client: %v", err)
+	}
+	closeDB, err := db.Connect()
+	if err != nil {
+		t.Fatalf("failed to connect sqlite: %v", err)
+	}
+	t.Cleanup(func() { _ = closeDB() })
+	testMigrations(t, config.StorageSQLite, db.DB)
+}
+
+func TestMySQLMigrations(t *testing.T) {
+	dsn := os.Getenv(mysqlDSNEnv)
+	if dsn == "" {
+		t.Skipf("%s is not set", mysqlDSNEnv)
+	}
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		t.Fatalf("failed to open mysql: %v", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	testMigrations(t, config.StorageMySQL, db)
+}
+
+func TestPostgresMigrations(t *testing.T) {
+	dsn := os.Getenv(postgresDSNEnv)
+	if dsn == "" {
+		t.Skipf("%s is not set", postgresDSNEnv)
+	}
+	db, err := postgres.New(config.Storage{DSN: dsn})
+	if err != nil {
+		t.Fatalf("failed to new postgres client: %v", err)
+	}
+	closeDB, err := db.Connect()
+	if err != nil {
+		t.Fatalf("failed to connect postgres: %v", err)
+	}
+	t.Cleanup(func() { _ = closeDB() })
+	testMigrations(t, config.StoragePostgres, db.DB)
+}
+
+// testMigrations runs every migration up, one by one back down and up
+// again, which fails when a down leaves behind something its up creates
+func testMigrations(t *testing.T, driver string, db *sql.DB) {
+	ctx := context.Background()
+	migrator, err := migrate.New(driver, db)
+	if err != nil {
+		t.Fatalf("failed to new migrator: %v", err)
+	}
+	all := migrator.Migrations()
+	latest := all[len(all)-1].Version
+
+	// start from an empty schema when a previous run left one behind
+	status, err := migrator.Status(ctx)
+	if err != nil {
+		t.Fatalf("failed to get status: %v", err)
+	}
+	if status.Version != 0 {
+		if err := migrator.Force(ctx, status.Version); err != nil {
+			t.Fatalf("failed to force version %d: %v", status.Version, err)
+		}
+		if _, err := migrator.Down(ctx, len(all)); err != nil {
+			t.Fatalf("failed to reset: %v", err)
+		}
+	}
+
+	t.Run("up", func(t *testing.T) {
+		applied, err := migrator.Up(ctx)
+		if err != nil {
+			t.Fatalf("failed to migrate up: %v", err)
+		}
+		if applied != len(all) {
+			t.Errorf("expected %d migrations applied, got %d", len(all), applied)
+		}
+		expectStatus(t, migrator, latest, false)
+		for _, table := range tables {
+			expectTable(t, db, table, true)
+		}
+		applied, err = migrator.Up(ctx)
+		if err != nil {
+			t.Fatalf("failed to migrate up again: %v", err)
+		}
+		if applied != 0 {
+			t.Errorf("expected no migrations applied again, got %d", applied)
+		}
+	})
+
+	t.Run("down and up one at a time", func(t *testing.T) {
+		for i := len(all) - 1; i >= 0; i-- {
+			reverted, err := migrator.Down(ctx, 1)
+			if err != nil {
+				t.Fatalf("failed to revert %d %s: %v", all[i].Version, all[i].Name, err)
+			}
+			if reverted != 1 {
+				t.Fatalf("expected 1 migration reverted, got %d", reverted)
+			}
+			var previous uint64
+			if i > 0 {
+				previous = all[i-1].Version
+			}
+			expectStatus(t, migrator, previous, false)
+			if _, err := migrator.Up(ctx); err != nil {
+				t.Fatalf("failed to reapply %d %s: %v", all[i].Version, all[i].Name, err)
+			}
+			if _, err := migrator.Down(ctx, len(all)-i); err != nil {
+				t.Fatalf("failed to revert %d %s again: %v", all[i].Version, all[i].Name, err)
+			}
+			expectStatus(t, migrator, previous, false)
+		}
+		expectStatus(t, migrator, 0, false)
+		for _, table := range tables {
+			expectTable(t, db, table, false)
+		}
+		reverted, err := migrator.Down(ctx, 1)
+		if err != nil {
+			t.Fatalf("failed to revert an empty schema: %v", err)
+		}
+		if reverted != 0 {
+			t.Errorf("expected nothing reverted on an empty schema, got %d", reverted)
+		}
+	})
+
+	t.Run("down many", func(t *testing.T) {
+		if _, err := migrator.Up(ctx); err != nil {
+			t.Fatalf("failed to migrate up: %v", err)
+		}
+		reverted, err := migrator.Down(ctx, len(all)+1)
+		if err != nil {
+			t.Fatalf("failed to revert all: %v", err)
+		}
+		if reverted != len(all) {
+			t.Errorf("expected %d migrations reverted, got %d", len(all), reverted)
+		}
+		expectStatus(t, migrator, 0, false)
+		if _, err := migrator.Down(ctx, 0); err == nil {
+			t.Error("expected an error reverting zero migrations")
+		}
+	})
+
+	t.Run("force", func(t *testing.T) {
+		if _, err := migrator.Up(ctx); err != nil {
+			t.Fatalf("failed to migrate up: %v", err)
+		}
+		if _, err := db.Exec(`UPDATE schema_migrations SET dirty = true`); err != nil {
+			t.Fatalf("failed to dirty the version: %v", err)
+		}
+		expectStatus(t, migrator, latest, true)
+		if _, err := migrator.Up(ctx); err == nil {
+			t.Error("expected up to refuse a dirty database")
+		}
+		if _, err := migrator.Down(ctx, 1); err == nil {
+			t.Error("expected down to refuse a dirty database")
+		}
+		if err := migrator.Force(ctx, latest+1); err == nil {
+			t.Error("expected an error forcing an unknown version")
+		}
+		if err := migrator.Force(ctx, latest); err != nil {
+			t.Fatalf("failed to force: %v", err)
+		}
+		expectStatus(t, migrator, latest, false)
+		applied, err := migrator.Up(ctx)
+		if err != nil {
+			t.Fatalf("failed to migrate up after forcing: %v", err)
+		}
+		if applied != 0 {
+			t.Errorf("expected no migrations applied after forcing, got %d", applied)
+		}
+	})
+}
+
+func expectStatus(t *testing.T, migrator *migrate.Migrator, version uint64, dirty bool) {
+	t.Helper()
+	status, err := migrator.Status(context.Background())
+	if err != nil {
+		t.Fatalf("failed to get status: %v", err)
+	}
+	if status.Version != version || status.Dirty != dirty {
+		t.Errorf("expected version %d dirty %v, got version %d dirty %v", version, dirty, status.Version, status.Dirty)
+	}
+}
+
+func expectTable(t *testing.T, db *sql.DB, table string, exists bool) {
+	t.Helper()
+	var count int
+	err := db.QueryRow(`SELECT COUNT(*) FROM ` + table).Scan(&count)
+	if exists && err != nil {
+		t.Errorf("expected table %s, got %v", table, err)
+	}
+	if !exists && err == nil {
+		t.Errorf("expected table %s to be dropped", table)
+	}
+}
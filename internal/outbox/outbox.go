@@ -0,0 +1,85 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+	"github.com/srcabl/users/internal/config"
+	"github.com/srcabl/users/internal/service"
+)
+
+// Event is an outbox event as it is published. The payload is the json the
+// data repo recorded, a service.UserEventPayload or service.FollowEventPayload
+// depending on the type. Sequence grows in the order events were written.
+type Event struct {
+	ID            string          `json:"id"`
+	Sequence      int64           `json:"sequence"`
+	Type          string          `json:"type"`
+	AggregateType string          `json:"aggregate_type"`
+	AggregateUUID string          `json:"aggregate_uuid"`
+	CreatedAt     int64           `json:"created_at"`
+	Payload       json.RawMessage `json:"payload"`
+}
+
+// NewEvent news up the published form of an outbox row
+func NewEvent(dbEvent *service.DBEvent) *Event {
+	return &Event{
+		ID:            dbEvent.UUID,
+		Sequence:      dbEvent.ID,
+		Type:          dbEvent.Type,
+		AggregateType: dbEvent.AggregateType,
+		AggregateUUID: dbEvent.AggregateUUID,
+		CreatedAt:     dbEvent.CreatedAt,
+		Payload:       json.RawMessage(dbEvent.Payload),
+	}
+}
+
+// Marshal renders the event as the json publishers send
+func (e *Event) Marshal() ([]byte, error) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to marshal event %s", e.ID)
+	}
+	return body, nil
+}
+
+// Publisher hands events to the services that react to them. Publish returns
+// once the event is safely handed over, so the relay can mark it published.
+// Delivery is at least once: an event whose publish failed, or whose
+// publish succeeded but was not marked in time, is published again, so
+// consumers dedupe on the event id.
+type Publisher interface {
+	Publish(ctx context.Context, event *Event) error
+	Close() error
+}
+
+// NewPublisher news up the publisher the config picks. Without one events
+// are discarded, which marks them published as they come in.
+func NewPublisher(cfg config.Outbox) (Publisher, error) {
+	switch cfg.Publisher {
+	case "":
+		return discardPublisher{}, nil
+	case config.PublisherNATS:
+		return newNATSPublisher(cfg.NATS), nil
+	case config.PublisherKafka:
+		return newKafkaPublisher(cfg.Kafka), nil
+	case config.PublisherWebhook:
+		return newWebhookPublisher(cfg.Webhook), nil
+	case config.PublisherFile:
+		return newFilePublisher(cfg.File)
+	}
+	return nil, errors.Errorf("outbox publisher %q is not supported", cfg.Publisher)
+}
+
+// discardPublisher drops every event, for when nothing is configured to
+// take them
+type discardPublisher struct{}
+
+func (discardPublisher) Publish(ctx context.Context, event *Event) error {
+	return ctx.Err()
+}
+
+func (discardPublisher) Close() error {
+	return nil
+}
@@ -0,0 +1,47 @@
+package outbox
+
+import (
+	"context"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// filePublisher appends events to a file as json lines, for local
+// development. Each event is synced to disk before it counts as published.
+type filePublisher struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func newFilePublisher(path string) (*filePublisher, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open outbox file %s", path)
+	}
+	return &filePublisher{file: file}, nil
+}
+
+func (p *filePublisher) Publish(ctx context.Context, event *Event) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	body, err := event.Marshal()
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, err := p.file.Write(append(body, '\n')); err != nil {
+		return errors.Wrapf(err, "failed to write event %s", event.ID)
+	}
+	if err := p.file.Sync(); err != nil {
+		return errors.Wrapf(err, "failed to sync event %s", event.ID)
+	}
+	return nil
+}
+
+func (p *filePublisher) Close() error {
+	return errors.Wrap(p.file.Close(), "failed to close outbox file")
+}
@@ -0,0 +1,45 @@
+package outbox
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"github.com/segmentio/kafka-go"
+	"github.com/srcabl/users/internal/config"
+)
+
+// kafkaPublisher writes events to the topic keyed by the user they belong
+// to, so the hash balancer puts each user's events on one partition in
+// order. Writes wait for every in sync replica to acknowledge them.
+type kafkaPublisher struct {
+	writer *kafka.Writer
+}
+
+func newKafkaPublisher(cfg config.OutboxKafka) *kafkaPublisher {
+	return &kafkaPublisher{writer: kafka.NewWriter(kafka.WriterConfig{
+		Brokers:      cfg.Brokers,
+		Topic:        cfg.Topic,
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: -1,
+	})}
+}
+
+func (p *kafkaPublisher) Publish(ctx context.Context, event *Event) error {
+	body, err := event.Marshal()
+	if err != nil {
+		return err
+	}
+	err = p.writer.WriteMessages(ctx, kafka.Message{
+		Key:   []byte(event.AggregateUUID),
+		Value: body,
+		Headers: []kafka.Header{
+			{Key: EventTypeHeader, Value: []byte(event.Type)},
+			{Key: EventIDHeader, Value: []byte(event.ID)},
+		},
+	})
+	return errors.Wrapf(err, "failed to write event %s to kafka", event.ID)
+}
+
+func (p *kafkaPublisher) Close() error {
+	return errors.Wrap(p.writer.Close(), "failed to close kafka writer")
+}
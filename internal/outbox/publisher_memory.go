@@ -0,0 +1,54 @@
+package outbox
+
+import (
+	"context"
+	"sync"
+)
+
+// MemoryPublisher keeps the events it is handed, for tests
+type MemoryPublisher struct {
+	mu     sync.Mutex
+	events []*Event
+	fail   func(*Event) error
+}
+
+// NewMemoryPublisher news up a publisher that keeps events in memory
+func NewMemoryPublisher() *MemoryPublisher {
+	return &MemoryPublisher{}
+}
+
+// FailWith makes publishes fail with the error fail returns for the event,
+// or succeed when it returns nil
+func (p *MemoryPublisher) FailWith(fail func(*Event) error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.fail = fail
+}
+
+// Publish keeps the event unless it is made to fail
+func (p *MemoryPublisher) Publish(ctx context.Context, event *Event) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.fail != nil {
+		if err := p.fail(event); err != nil {
+			return err
+		}
+	}
+	p.events = append(p.events, event)
+	return nil
+}
+
+// Events returns the events published so far, in the order they were
+func (p *MemoryPublisher) Events() []*Event {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]*Event(nil), p.events...)
+}
+
+// Close does nothing since there is nothing to release
+func (p *MemoryPublisher) Close() error {
+	return nil
+}
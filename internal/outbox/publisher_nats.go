@@ -0,0 +1,73 @@
+package outbox
+
+import (
+	"context"
+	"sync"
+
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+	"github.com/srcabl/users/internal/config"
+)
+
+// natsPublisher publishes events to JetStream, which acknowledges them once
+// a stream stored them. The event id goes in the message id header, so
+// JetStream drops an event published twice within its duplicate window.
+// The connection is made on the first publish and made again if it closes.
+type natsPublisher struct {
+	cfg config.OutboxNATS
+
+	mu   sync.Mutex
+	conn *nats.Conn
+	js   nats.JetStreamContext
+}
+
+func newNATSPublisher(cfg config.OutboxNATS) *natsPublisher {
+	return &natsPublisher{cfg: cfg}
+}
+
+func (p *natsPublisher) Publish(ctx context.Context, event *Event) error {
+	js, err := p.jetStream()
+	if err != nil {
+		return err
+	}
+	body, err := event.Marshal()
+	if err != nil {
+		return err
+	}
+	msg := nats.NewMsg(p.cfg.SubjectPrefix + "." + event.Type)
+	msg.Data = body
+	msg.Header.Set(EventTypeHeader, event.Type)
+	if _, err := js.PublishMsg(msg, nats.MsgId(event.ID), nats.Context(ctx)); err != nil {
+		return errors.Wrapf(err, "failed to publish event %s to nats", event.ID)
+	}
+	return nil
+}
+
+func (p *natsPublisher) jetStream() (nats.JetStreamContext, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn != nil && !p.conn.IsClosed() {
+		return p.js, nil
+	}
+	conn, err := nats.Connect(p.cfg.URL, nats.Name("srcabl-users-outbox"))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to connect to nats")
+	}
+	js, err := conn.JetStream()
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "failed to new nats jetstream context")
+	}
+	p.conn, p.js = conn, js
+	return js, nil
+}
+
+func (p *natsPublisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn != nil {
+		p.conn.Close()
+		p.conn = nil
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package outbox
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/pkg/errors"
+	"github.com/srcabl/users/internal/config"
+)
+
+// The headers webhook requests carry besides the json body
+const (
+	EventTypeHeader = "X-Srcabl-Event"
+	EventIDHeader   = "X-Srcabl-Event-Id"
+	SignatureHeader = "X-Srcabl-Signature"
+)
+
+// webhookPublisher posts each event to the url, which takes it by answering
+// with a 2xx status
+type webhookPublisher struct {
+	cfg    config.OutboxWebhook
+	client *http.Client
+}
+
+func newWebhookPublisher(cfg config.OutboxWebhook) *webhookPublisher {
+	return &webhookPublisher{cfg: cfg, client: &http.Client{}}
+}
+
+func (p *webhookPublisher) Publish(ctx context.Context, event *Event) error {
+	body, err := event.Marshal()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "failed to new webhook request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventTypeHeader, event.Type)
+	req.Header.Set(EventIDHeader, event.ID)
+	if p.cfg.Secret != "" {
+		req.Header.Set(SignatureHeader, Sign(p.cfg.Secret, body))
+	}
+	res, err := p.client.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "failed to post event %s", event.ID)
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, res.Body)
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return errors.Errorf("webhook answered event %s with %s", event.ID, res.Status)
+	}
+	return nil
+}
+
+func (p *webhookPublisher) Close() error {
+	p.client.CloseIdleConnections()
+	return nil
+}
+
+// Sign returns the signature of the body under the secret as it is sent in
+// the signature header: sha256= and the hex HMAC-SHA256 of the body.
+// Receivers recompute it over the raw body and compare in constant time.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,159 @@
+package outbox
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/pkg/errors"
+	"github.com/srcabl/users/internal/config"
+	"github.com/srcabl/users/internal/metrics"
+	"github.com/srcabl/users/internal/service"
+	"go.uber.org/zap"
+)
+
+// maxConsecutiveFailures ends a pass early. A run of failed publishes reads
+// as the publisher being down, and waiting out every event's timeout would
+// hold the lease for nothing.
+const maxConsecutiveFailures = 3
+
+// Relay publishes the events in the outbox through the publisher, oldest
+// first, and marks them published once the publisher took them
+type Relay struct {
+	cfg       config.Outbox
+	datarepo  service.DataRepositoryOutbox
+	publisher Publisher
+	metrics   *metrics.Metrics
+	logger    *zap.Logger
+	holder    string
+	now       func() time.Time
+}
+
+// NewRelay news up a relay that contends for the outbox lease under a
+// holder name of its own, made from the host name and a fresh uuid
+func NewRelay(cfg config.Outbox, datarepo service.DataRepositoryOutbox, publisher Publisher, m *metrics.Metrics, logger *zap.Logger) (*Relay, error) {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate relay id")
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return &Relay{
+		cfg:       cfg,
+		datarepo:  datarepo,
+		publisher: publisher,
+		metrics:   m,
+		logger:    logger,
+		holder:    fmt.Sprintf("%s/%s", host, id),
+		now:       time.Now,
+	}, nil
+}
+
+// Run relays on the poll interval until the returned func is called, which
+// waits for the pass in flight and closes the publisher
+func (r *Relay) Run() (func() error, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	ticker := time.NewTicker(r.cfg.PollInterval)
+	go func() {
+		defer close(done)
+		for {
+			if _, err := r.RelayOnce(ctx); err != nil && ctx.Err() == nil {
+				r.logger.Warn("outbox relay failed", zap.Error(err))
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return func() error {
+		ticker.Stop()
+		cancel()
+		<-done
+		return r.publisher.Close()
+	}, nil
+}
+
+// RelayOnce takes or extends the lease and, while holding it, publishes the
+// pending events batch by batch until none are left, then prunes the events
+// published longer ago than the retention. It returns how many events it
+// published. Without the lease it does nothing.
+func (r *Relay) RelayOnce(ctx context.Context) (int, error) {
+	total := 0
+	for {
+		now := r.now()
+		held, err := r.datarepo.AcquireOutboxLease(ctx, r.holder, now.Unix(), now.Add(r.cfg.LeaseTTL).Unix())
+		if err != nil {
+			return total, err
+		}
+		if !held {
+			return total, nil
+		}
+		events, err := r.datarepo.ListPendingEvents(ctx, r.cfg.BatchSize)
+		if err != nil {
+			return total, err
+		}
+		published, publishErr := r.publish(ctx, events)
+		if len(published) > 0 {
+			if err := r.datarepo.MarkEventsPublished(ctx, published, r.now().Unix()); err != nil {
+				return total, err
+			}
+			total += len(published)
+		}
+		if publishErr != nil {
+			return total, publishErr
+		}
+		if len(events) < r.cfg.BatchSize {
+			break
+		}
+	}
+	if _, err := r.datarepo.PruneEvents(ctx, r.now().Add(-r.cfg.Retention).Unix()); err != nil {
+		return total, err
+	}
+	return total, nil
+}
+
+// publish publishes the events in order and returns the ids of those the
+// publisher took. Once an event fails the later events of its user are held
+// back, so each user's events go out in the order they were written. The
+// first failure is returned.
+func (r *Relay) publish(ctx context.Context, events []*service.DBEvent) ([]int64, error) {
+	var published []int64
+	var firstErr error
+	blocked := map[string]bool{}
+	failures := 0
+	for _, dbEvent := range events {
+		aggregate := dbEvent.AggregateType + "/" + dbEvent.AggregateUUID
+		if blocked[aggregate] {
+			continue
+		}
+		err := r.publishOne(ctx, NewEvent(dbEvent))
+		r.metrics.EventPublished(dbEvent.Type, err == nil)
+		if err == nil {
+			published = append(published, dbEvent.ID)
+			failures = 0
+			continue
+		}
+		if firstErr == nil {
+			firstErr = errors.Wrapf(err, "failed to publish %s event %s", dbEvent.Type, dbEvent.UUID)
+		}
+		blocked[aggregate] = true
+		failures++
+		if failures >= maxConsecutiveFailures || ctx.Err() != nil {
+			break
+		}
+	}
+	return published, firstErr
+}
+
+func (r *Relay) publishOne(ctx context.Context, event *Event) error {
+	ctx, cancel := context.WithTimeout(ctx, r.cfg.PublishTimeout)
+	defer cancel()
+	return r.publisher.Publish(ctx, event)
+}
@@ -0,0 +1,233 @@
+package outbox_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gofrs/uuid"
+	"github.com/pkg/errors"
+	"github.com/srcabl/users/internal/config"
+	"github.com/srcabl/users/internal/metrics"
+	"github.com/srcabl/users/internal/outbox"
+	"github.com/srcabl/users/internal/service"
+	"go.uber.org/zap"
+)
+
+func newRelay(t *testing.T, datarepo service.DataRepository, publisher outbox.Publisher) *outbox.Relay {
+	t.Helper()
+	m, err := metrics.New()
+	if err != nil {
+		t.Fatalf("failed to new metrics: %v", err)
+	}
+	cfg := config.Default().Outbox
+	cfg.BatchSize = 2
+	relay, err := outbox.NewRelay(cfg, datarepo, publisher, m, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to new relay: %v", err)
+	}
+	return relay
+}
+
+// createUsers creates users that each follow the next, which writes a
+// created event for every user and a follow event for all but the last
+func createUsers(t *testing.T, datarepo service.DataRepository, n int) []string {
+	t.Helper()
+	ctx := context.Background()
+	uuids := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		id, err := uuid.NewV4()
+		if err != nil {
+			t.Fatalf("failed to generate uuid: %v", err)
+		}
+		user := &service.DBUser{
+			UUID:           id.String(),
+			Username:       "user-" + id.String(),
+			Email:          id.String() + "@example.com",
+			HashedPassword: "hash",
+			CreatedByUUID:  id.String(),
+			CreatedAt:      1000,
+		}
+		if err := datarepo.CreateUser(ctx, user); err != nil {
+			t.Fatalf("failed to create user: %v", err)
+		}
+		uuids = append(uuids, user.UUID)
+	}
+	for i := 0; i+1 < n; i++ {
+		if err := datarepo.AddUserFollower(ctx, uuids[i], uuids[i+1]); err != nil {
+			t.Fatalf("failed to follow user: %v", err)
+		}
+	}
+	return uuids
+}
+
+func relayOnce(t *testing.T, relay *outbox.Relay) int {
+	t.Helper()
+	n, err := relay.RelayOnce(context.Background())
+	if err != nil {
+		t.Fatalf("failed to relay: %v", err)
+	}
+	return n
+}
+
+func TestRelayPublishesInOrder(t *testing.T) {
+	datarepo := service.NewMemoryDataRepository()
+	users := createUsers(t, datarepo, 3)
+	publisher := outbox.NewMemoryPublisher()
+	relay := newRelay(t, datarepo, publisher)
+
+	if n := relayOnce(t, relay); n != 5 {
+		t.Fatalf("expected 5 events published, got %d", n)
+	}
+	events := publisher.Events()
+	for i, event := range events {
+		if i > 0 && event.Sequence <= events[i-1].Sequence {
+			t.Fatalf("expected sequences to grow, got %d after %d", event.Sequence, events[i-1].Sequence)
+		}
+	}
+	if events[0].Type != service.EventUserCreated || events[0].AggregateUUID != users[0] {
+		t.Fatalf("expected the first user's creation first, got %+v", events[0])
+	}
+	var follow service.FollowEventPayload
+	if err := json.Unmarshal(events[3].Payload, &follow); err != nil {
+		t.Fatalf("failed to unmarshal follow payload: %v", err)
+	}
+	if events[3].Type != service.EventFollowAdded || follow.FollowerUUID != users[0] || follow.FollowedUUID != users[1] {
+		t.Fatalf("expected the first follow, got %+v %+v", events[3], follow)
+	}
+	if n := relayOnce(t, relay); n != 0 {
+		t.Fatalf("expected nothing left to publish, got %d", n)
+	}
+}
+
+func TestRelayHoldsBackFailedUser(t *testing.T) {
+	datarepo := service.NewMemoryDataRepository()
+	users := createUsers(t, datarepo, 2)
+	publisher := outbox.NewMemoryPublisher()
+	publisher.FailWith(func(event *outbox.Event) error {
+		if event.AggregateUUID == users[0] {
+			return errors.New("broker down")
+		}
+		return nil
+	})
+	relay := newRelay(t, datarepo, publisher)
+
+	n, err := relay.RelayOnce(context.Background())
+	if err == nil {
+		t.Fatal("expected the failed publish to be reported")
+	}
+	if n != 1 {
+		t.Fatalf("expected only the second user's event published, got %d", n)
+	}
+	for _, event := range publisher.Events() {
+		if event.AggregateUUID == users[0] {
+			t.Fatalf("expected the first user's events held back, got %+v", event)
+		}
+	}
+
+	publisher.FailWith(nil)
+	if n := relayOnce(t, relay); n != 2 {
+		t.Fatalf("expected the held back events published on retry, got %d", n)
+	}
+	events := publisher.Events()
+	if events[1].Type != service.EventUserCreated || events[2].Type != service.EventFollowAdded {
+		t.Fatalf("expected the first user's events in order, got %s then %s", events[1].Type, events[2].Type)
+	}
+}
+
+func TestRelayLease(t *testing.T) {
+	datarepo := service.NewMemoryDataRepository()
+	createUsers(t, datarepo, 1)
+	first, second := outbox.NewMemoryPublisher(), outbox.NewMemoryPublisher()
+	if n := relayOnce(t, newRelay(t, datarepo, first)); n != 1 {
+		t.Fatalf("expected the first relay to publish, got %d", n)
+	}
+	createUsers(t, datarepo, 1)
+	if n := relayOnce(t, newRelay(t, datarepo, second)); n != 0 {
+		t.Fatalf("expected the second relay to wait for the lease, got %d", n)
+	}
+}
+
+func TestWebhookPublisher(t *testing.T) {
+	var got []*http.Request
+	var bodies [][]byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		got, bodies = append(got, r), append(bodies, body)
+		if len(got) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	cfg := config.Default().Outbox
+	cfg.Publisher = config.PublisherWebhook
+	cfg.Webhook = config.OutboxWebhook{URL: server.URL, Secret: "webhook-secret"}
+	publisher, err := outbox.NewPublisher(cfg)
+	if err != nil {
+		t.Fatalf("failed to new publisher: %v", err)
+	}
+	defer publisher.Close()
+
+	event := &outbox.Event{ID: "event-id", Sequence: 1, Type: service.EventUserCreated, Payload: json.RawMessage(`{}`)}
+	if err := publisher.Publish(context.Background(), event); err == nil {
+		t.Fatal("expected a 503 to fail the publish")
+	}
+	if err := publisher.Publish(context.Background(), event); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+	req := got[1]
+	if req.Header.Get(outbox.EventTypeHeader) != service.EventUserCreated || req.Header.Get(outbox.EventIDHeader) != "event-id" {
+		t.Fatalf("expected the event headers, got %v", req.Header)
+	}
+	if req.Header.Get(outbox.SignatureHeader) != outbox.Sign("webhook-secret", bodies[1]) {
+		t.Fatalf("expected the body signed, got %s", req.Header.Get(outbox.SignatureHeader))
+	}
+	var sent outbox.Event
+	if err := json.Unmarshal(bodies[1], &sent); err != nil || sent.ID != "event-id" {
+		t.Fatalf("expected the event as the body, got %s: %v", bodies[1], err)
+	}
+}
+
+func TestFilePublisher(t *testing.T) {
+	datarepo := service.NewMemoryDataRepository()
+	createUsers(t, datarepo, 2)
+	cfg := config.Default().Outbox
+	cfg.Publisher = config.PublisherFile
+	cfg.File = filepath.Join(t.TempDir(), "events.jsonl")
+	publisher, err := outbox.NewPublisher(cfg)
+	if err != nil {
+		t.Fatalf("failed to new publisher: %v", err)
+	}
+	relay := newRelay(t, datarepo, publisher)
+	if n := relayOnce(t, relay); n != 3 {
+		t.Fatalf("expected 3 events published, got %d", n)
+	}
+	if err := publisher.Close(); err != nil {
+		t.Fatalf("failed to close publisher: %v", err)
+	}
+
+	file, err := os.Open(cfg.File)
+	if err != nil {
+		t.Fatalf("failed to open events file: %v", err)
+	}
+	defer file.Close()
+	var types []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var event outbox.Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("failed to unmarshal event line: %v", err)
+		}
+		types = append(types, event.Type)
+	}
+	if len(types) != 3 || types[2] != service.EventFollowAdded {
+		t.Fatalf("expected two creations and a follow, got %v", types)
+	}
+}
@@ -1,50 +1,90 @@
 package server
 
 import (
+	"crypto/tls"
 	"fmt"
-	"log"
 	"net"
+	"time"
 
 	"github.com/pkg/errors"
 	pb "github.com/srcabl/protos/users"
 	"github.com/srcabl/services/pkg/config"
+	"go.uber.org/zap"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/reflection"
 )
 
 // GRPC defines the actions of a grpc server
 type GRPC interface {
 	Run() (func() error, error)
+	Err() <-chan error
 }
 
 // GRPCServer is the sources grpc server
 type GRPCServer struct {
-	address string
-	port    int
-	server  *grpc.Server
+	address         string
+	port            int
+	shutdownTimeout time.Duration
+	server          *grpc.Server
+	errs            chan error
+	logger          *zap.Logger
 }
 
-// New news up a users grpc server
-func New(config *config.Service, middleware grpc.ServerOption, service pb.UsersServiceServer) (GRPC, error) {
-	server := grpc.NewServer(middleware)
+// New news up a users grpc server with the health service registered next to
+// it. It serves plaintext when tlsConfig is nil.
+func New(config *config.Service, tlsConfig *tls.Config, shutdownTimeout time.Duration, health *Health, middleware []grpc.ServerOption, service pb.UsersServiceServer, logger *zap.Logger) (GRPC, error) {
+	opts := middleware
+	if tlsConfig != nil {
+		opts = append([]grpc.ServerOption{grpc.Creds(credentials.NewTLS(tlsConfig))}, middleware...)
+	}
+	server := grpc.NewServer(opts...)
 	pb.RegisterUsersServiceServer(server, service)
+	health.Register(server)
 	reflection.Register(server)
 	return &GRPCServer{
-		server:  server,
-		address: config.Server.Address,
-		port:    config.Server.Port,
+		server:          server,
+		address:         config.Server.Address,
+		port:            config.Server.Port,
+		shutdownTimeout: shutdownTimeout,
+		errs:            make(chan error, 1),
+		logger:          logger,
 	}, nil
 }
 
-// Run starts the grpc server
+// Run starts serving in the background and returns the func that gracefully
+// stops it. In flight rpcs get the shutdown timeout to finish before the
+// server is stopped forcefully.
 func (s *GRPCServer) Run() (func() error, error) {
 	lis, err := net.Listen("tcp", fmt.Sprintf("%s:%d", s.address, s.port))
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to begin listening on port %d", s.port)
 	}
-	log.Printf("Serving Users on post: %d\n", s.port)
-	if err := s.server.Serve(lis); err != nil {
-		return nil, errors.Wrapf(err, "failed to serve on port %d", s.port)
-	}
-	return lis.Close, nil
+	s.logger.Info("serving grpc", zap.String("address", s.address), zap.Int("port", s.port))
+	go func() {
+		if err := s.server.Serve(lis); err != nil {
+			s.errs <- errors.Wrapf(err, "failed to serve on port %d", s.port)
+		}
+	}()
+	return func() error {
+		stopped := make(chan struct{})
+		go func() {
+			s.server.GracefulStop()
+			close(stopped)
+		}()
+		timer := time.NewTimer(s.shutdownTimeout)
+		defer timer.Stop()
+		select {
+		case <-stopped:
+			return nil
+		case <-timer.C:
+			s.server.Stop()
+			return errors.Errorf("rpcs still in flight after %s were cut off", s.shutdownTimeout)
+		}
+	}, nil
+}
+
+// Err reports the server failing after it started serving
+func (s *GRPCServer) Err() <-chan error {
+	return s.errs
 }
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	pb "github.com/srcabl/protos/users"
+	"github.com/srcabl/users/internal/config"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// LivenessService is the health service name an orchestrator should probe
+	// to decide whether to restart the process. It serves for as long as the
+	// process is up, including while it drains.
+	LivenessService = "liveness"
+	// ReadinessService is the health service name an orchestrator should probe
+	// to decide whether to route traffic here. It serves only while the
+	// dependencies check out and the server is not draining. The empty service
+	// name and the users service name follow it.
+	ReadinessService = "readiness"
+)
+
+// Health drives the statuses of the grpc.health.v1 service from a readiness
+// check run on an interval
+type Health struct {
+	cfg    config.Health
+	check  func(context.Context) error
+	server *health.Server
+	logger *zap.Logger
+
+	mu       sync.Mutex
+	draining bool
+	drained  chan struct{}
+}
+
+// NewHealth news up the health statuses. Readiness is not serving until the
+// first check passes.
+func NewHealth(cfg config.Health, check func(context.Context) error, logger *zap.Logger) *Health {
+	h := &Health{
+		cfg:     cfg,
+		check:   check,
+		server:  health.NewServer(),
+		logger:  logger,
+		drained: make(chan struct{}),
+	}
+	h.server.SetServingStatus(LivenessService, healthpb.HealthCheckResponse_SERVING)
+	h.setReadiness(healthpb.HealthCheckResponse_NOT_SERVING)
+	return h
+}
+
+// Register registers the health service on the grpc server
+func (h *Health) Register(s *grpc.Server) {
+	healthpb.RegisterHealthServer(s, &drainingHealthServer{Server: h.server, drained: h.drained})
+}
+
+// Check runs the readiness check once and updates the statuses
+func (h *Health) Check() {
+	ctx, cancel := context.WithTimeout(context.Background(), h.cfg.Timeout)
+	defer cancel()
+	err := h.check(ctx)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.draining {
+		return
+	}
+	if err != nil {
+		h.logger.Warn("readiness check failed", zap.Error(err))
+		h.setReadiness(healthpb.HealthCheckResponse_NOT_SERVING)
+		return
+	}
+	h.setReadiness(healthpb.HealthCheckResponse_SERVING)
+}
+
+// Run checks readiness on the interval until the returned func is called,
+// which marks the server as not ready so traffic drains away before it stops,
+// and ends the watches of the statuses, which would otherwise hold the
+// graceful stop up until the shutdown timeout
+func (h *Health) Run() (func() error, error) {
+	h.Check()
+	done := make(chan struct{})
+	ticker := time.NewTicker(h.cfg.Interval)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				h.Check()
+			}
+		}
+	}()
+	return func() error {
+		ticker.Stop()
+		close(done)
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if !h.draining {
+			h.draining = true
+			h.setReadiness(healthpb.HealthCheckResponse_NOT_SERVING)
+			close(h.drained)
+		}
+		return nil
+	}, nil
+}
+
+func (h *Health) setReadiness(status healthpb.HealthCheckResponse_ServingStatus) {
+	for _, service := range []string{"", ReadinessService, pb.UsersService_ServiceDesc.ServiceName} {
+		h.server.SetServingStatus(service, status)
+	}
+}
+
+// drainingHealthServer ends the watches of the health server once the server
+// drains. Watchers are sent NOT_SERVING last, and the stream ends as
+// unavailable so they reconnect to another replica.
+type drainingHealthServer struct {
+	*health.Server
+	drained <-chan struct{}
+}
+
+func (s *drainingHealthServer) Watch(req *healthpb.HealthCheckRequest, stream healthpb.Health_WatchServer) error {
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+	go func() {
+		select {
+		case <-s.drained:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	err := s.Server.Watch(req, &watchStream{Health_WatchServer: stream, ctx: ctx})
+	select {
+	case <-s.drained:
+	default:
+		return err
+	}
+	if err := stream.Send(&healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_NOT_SERVING}); err != nil {
+		return err
+	}
+	return status.Error(codes.Unavailable, "server is shutting down")
+}
+
+// watchStream carries a context ending with the drain into a watch
+type watchStream struct {
+	healthpb.Health_WatchServer
+	ctx context.Context
+}
+
+func (s *watchStream) Context() context.Context {
+	return s.ctx
+}
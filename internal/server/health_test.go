@@ -0,0 +1,161 @@
+package server_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/srcabl/protos/users"
+	"github.com/srcabl/users/internal/config"
+	"github.com/srcabl/users/internal/server"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// readiness is a readiness check the test fails and passes at will
+type readiness struct {
+	mu  sync.Mutex
+	err error
+}
+
+func (r *readiness) set(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.err = err
+}
+
+func (r *readiness) check(context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+// serveHealth serves the health statuses over bufconn
+func serveHealth(t *testing.T, health *server.Health) (*grpc.Server, healthpb.HealthClient) {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	s := grpc.NewServer()
+	health.Register(s)
+	go func() {
+		_ = s.Serve(lis)
+	}()
+	t.Cleanup(s.Stop)
+	conn, err := grpc.DialContext(context.Background(), "bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithInsecure(),
+	)
+	if err != nil {
+		t.Fatalf("failed to dial bufconn: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return s, healthpb.NewHealthClient(conn)
+}
+
+func expectStatus(t *testing.T, client healthpb.HealthClient, service string, want healthpb.HealthCheckResponse_ServingStatus) {
+	t.Helper()
+	res, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{Service: service})
+	if err != nil {
+		t.Fatalf("failed to check %q: %v", service, err)
+	}
+	if res.Status != want {
+		t.Fatalf("expected %q %s, got %s", service, want, res.Status)
+	}
+}
+
+func TestHealthFollowsReadiness(t *testing.T) {
+	ready := &readiness{err: errors.New("database is not reachable")}
+	health := server.NewHealth(config.Health{Interval: time.Hour, Timeout: time.Second}, ready.check, zap.NewNop())
+	_, client := serveHealth(t, health)
+	followers := []string{"", server.ReadinessService, pb.UsersService_ServiceDesc.ServiceName}
+
+	expectStatus(t, client, server.LivenessService, healthpb.HealthCheckResponse_SERVING)
+	for _, service := range followers {
+		expectStatus(t, client, service, healthpb.HealthCheckResponse_NOT_SERVING)
+	}
+
+	ready.set(nil)
+	health.Check()
+	for _, service := range followers {
+		expectStatus(t, client, service, healthpb.HealthCheckResponse_SERVING)
+	}
+
+	ready.set(errors.New("database is not reachable"))
+	health.Check()
+	for _, service := range followers {
+		expectStatus(t, client, service, healthpb.HealthCheckResponse_NOT_SERVING)
+	}
+	expectStatus(t, client, server.LivenessService, healthpb.HealthCheckResponse_SERVING)
+}
+
+func TestHealthDrainEndsWatches(t *testing.T) {
+	ready := &readiness{}
+	health := server.NewHealth(config.Health{Interval: time.Hour, Timeout: time.Second}, ready.check, zap.NewNop())
+	s, client := serveHealth(t, health)
+	stop, err := health.Run()
+	if err != nil {
+		t.Fatalf("failed to run health checks: %v", err)
+	}
+	expectStatus(t, client, server.ReadinessService, healthpb.HealthCheckResponse_SERVING)
+
+	watch, err := client.Watch(context.Background(), &healthpb.HealthCheckRequest{Service: server.ReadinessService})
+	if err != nil {
+		t.Fatalf("failed to watch: %v", err)
+	}
+	res, err := watch.Recv()
+	if err != nil || res.Status != healthpb.HealthCheckResponse_SERVING {
+		t.Fatalf("expected to watch SERVING first, got %v %v", res, err)
+	}
+
+	if err := stop(); err != nil {
+		t.Fatalf("failed to stop health checks: %v", err)
+	}
+	var last healthpb.HealthCheckResponse_ServingStatus
+	for {
+		res, err := watch.Recv()
+		if err != nil {
+			if status.Code(err) != codes.Unavailable {
+				t.Fatalf("expected the watch to end unavailable, got %v", err)
+			}
+			break
+		}
+		last = res.Status
+	}
+	if last != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Fatalf("expected NOT_SERVING last, got %s", last)
+	}
+
+	// readiness stays down once draining, however the check turns out
+	health.Check()
+	expectStatus(t, client, server.ReadinessService, healthpb.HealthCheckResponse_NOT_SERVING)
+	expectStatus(t, client, server.LivenessService, healthpb.HealthCheckResponse_SERVING)
+
+	// watches started while draining end too, so nothing holds the stop up
+	late, err := client.Watch(context.Background(), &healthpb.HealthCheckRequest{Service: server.LivenessService})
+	if err != nil {
+		t.Fatalf("failed to watch: %v", err)
+	}
+	for {
+		if _, err := late.Recv(); err != nil {
+			break
+		}
+	}
+	stopped := make(chan struct{})
+	go func() {
+		s.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the graceful stop not to wait on watches")
+	}
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// HTTPServer serves the auxiliary http endpoints next to the grpc server
+type HTTPServer struct {
+	name    string
+	address string
+	server  *http.Server
+	logger  *zap.Logger
+}
+
+// NewHTTP news up an http server for the handler
+func NewHTTP(name, address string, handler http.Handler, logger *zap.Logger) *HTTPServer {
+	return &HTTPServer{
+		name:    name,
+		address: address,
+		logger:  logger.With(zap.String("server", name)),
+		server: &http.Server{
+			Addr:              address,
+			Handler:           handler,
+			ReadHeaderTimeout: 10 * time.Second,
+		},
+	}
+}
+
+// Run starts serving in the background and returns the func that shuts it down
+func (s *HTTPServer) Run() (func() error, error) {
+	lis, err := net.Listen("tcp", s.address)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to begin listening for %s on %s", s.name, s.address)
+	}
+	s.logger.Info("serving http", zap.String("address", s.address))
+	go func() {
+		if err := s.server.Serve(lis); err != nil && err != http.ErrServerClosed {
+			s.logger.Error("failed to serve http", zap.String("address", s.address), zap.Error(err))
+		}
+	}()
+	return func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return s.server.Shutdown(ctx)
+	}, nil
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/srcabl/users/internal/config"
+)
+
+// TLS holds the certificate and client CAs the grpc server handshakes with and
+// reloads them when their files change, so certificates can be renewed
+// without a restart
+type TLS struct {
+	cfg config.TLS
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTimes  map[string]time.Time
+}
+
+// NewTLS news up the TLS config and loads the configured files
+func NewTLS(cfg config.TLS) (*TLS, error) {
+	if cfg.CertFile == "" || cfg.KeyFile == "" {
+		return nil, errors.New("tls needs both a cert file and a key file")
+	}
+	if cfg.RequireClientCert && cfg.ClientCAFile == "" {
+		return nil, errors.New("tls cannot require client certificates without a client ca file")
+	}
+	t := &TLS{cfg: cfg}
+	if err := t.Reload(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Config returns the tls config to serve with. Every handshake picks up the
+// most recently loaded certificate and client CAs.
+func (t *TLS) Config() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			t.mu.RLock()
+			defer t.mu.RUnlock()
+			cfg := &tls.Config{
+				MinVersion:            tls.VersionTLS12,
+				NextProtos:            []string{"h2"},
+				Certificates:          []tls.Certificate{*t.cert},
+				VerifyPeerCertificate: t.verifyPeerCertificate,
+			}
+			if t.clientCAs != nil {
+				cfg.ClientCAs = t.clientCAs
+				cfg.ClientAuth = tls.VerifyClientCertIfGiven
+				if t.cfg.RequireClientCert {
+					cfg.ClientAuth = tls.RequireAndVerifyClientCert
+				}
+			}
+			return cfg, nil
+		},
+	}
+}
+
+// Reload reads the files again if any of them changed. A file that fails to
+// load leaves the previous certificate and client CAs in place.
+func (t *TLS) Reload() error {
+	modTimes := map[string]time.Time{}
+	changed := false
+	for _, path := range []string{t.cfg.CertFile, t.cfg.KeyFile, t.cfg.ClientCAFile} {
+		if path == "" {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return errors.Wrapf(err, "failed to stat %s", path)
+		}
+		modTimes[path] = info.ModTime()
+		if !info.ModTime().Equal(t.modTimes[path]) {
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(t.cfg.CertFile, t.cfg.KeyFile)
+	if err != nil {
+		return errors.Wrapf(err, "failed to load certificate %s", t.cfg.CertFile)
+	}
+	var clientCAs *x509.CertPool
+	if t.cfg.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(t.cfg.ClientCAFile)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read client ca file %s", t.cfg.ClientCAFile)
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return errors.Errorf("no certificates found in client ca file %s", t.cfg.ClientCAFile)
+		}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.cert = &cert
+	t.clientCAs = clientCAs
+	t.modTimes = modTimes
+	return nil
+}
+
+// Run reloads the files on the reload interval until the returned func is called
+func (t *TLS) Run() (func() error, error) {
+	if t.cfg.ReloadInterval <= 0 {
+		return func() error { return nil }, nil
+	}
+	done := make(chan struct{})
+	ticker := time.NewTicker(t.cfg.ReloadInterval)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				// a half written file is picked up on the next tick
+				_ = t.Reload()
+			}
+		}
+	}()
+	return func() error {
+		ticker.Stop()
+		close(done)
+		return nil
+	}, nil
+}
+
+// verifyPeerCertificate checks a verified client certificate against the
+// allowed SANs. Clients without a certificate are left to token auth.
+func (t *TLS) verifyPeerCertificate(_ [][]byte, verifiedChains [][]*x509.Certificate) error {
+	if len(t.cfg.AllowedSANs) == 0 || len(verifiedChains) == 0 {
+		return nil
+	}
+	leaf := verifiedChains[0][0]
+	var sans []string
+	for _, uri := range leaf.URIs {
+		sans = append(sans, uri.String())
+	}
+	sans = append(sans, leaf.DNSNames...)
+	for _, san := range sans {
+		for _, allowed := range t.cfg.AllowedSANs {
+			if san == allowed {
+				return nil
+			}
+		}
+	}
+	return errors.Errorf("client certificate %q has none of the allowed SANs", leaf.Subject.CommonName)
+}
@@ -0,0 +1,250 @@
+package server_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/srcabl/users/internal/config"
+	"github.com/srcabl/users/internal/server"
+)
+
+// testCA is a throwaway certificate authority issuing the test certificates
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate ca key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create ca certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse ca certificate: %v", err)
+	}
+	return &testCA{
+		cert: cert,
+		key:  key,
+		pem:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+}
+
+func (ca *testCA) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// issue returns the PEM encoded certificate and key for the common name, with
+// the uri as a SAN when one is given
+func (ca *testCA) issue(t *testing.T, serial int64, commonName, uri string, usage x509.ExtKeyUsage) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if uri != "" {
+		parsed, err := url.Parse(uri)
+		if err != nil {
+			t.Fatalf("failed to parse uri: %v", err)
+		}
+		tmpl.URIs = []*url.URL{parsed}
+		tmpl.DNSNames = nil
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func (ca *testCA) clientCert(t *testing.T, serial int64, uri string) tls.Certificate {
+	certPEM, keyPEM := ca.issue(t, serial, "client", uri, x509.ExtKeyUsageClientAuth)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("failed to load client certificate: %v", err)
+	}
+	return cert
+}
+
+func writeFile(t *testing.T, path string, data []byte, modTime time.Time) {
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("failed to write %s: %v", path, err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatalf("failed to chtimes %s: %v", path, err)
+	}
+}
+
+// writeServerFiles writes a server certificate and the ca to dir and returns the tls config for them
+func writeServerFiles(t *testing.T, dir string, ca *testCA, serial int64, modTime time.Time) config.TLS {
+	certPEM, keyPEM := ca.issue(t, serial, "users", "", x509.ExtKeyUsageServerAuth)
+	cfg := config.TLS{
+		CertFile:     filepath.Join(dir, "server.crt"),
+		KeyFile:      filepath.Join(dir, "server.key"),
+		ClientCAFile: filepath.Join(dir, "ca.crt"),
+	}
+	writeFile(t, cfg.CertFile, certPEM, modTime)
+	writeFile(t, cfg.KeyFile, keyPEM, modTime)
+	writeFile(t, cfg.ClientCAFile, ca.pem, modTime)
+	return cfg
+}
+
+// handshake connects to a listener serving serverTLS and returns the
+// certificate the server presented. The server writes a byte once its side of
+// the handshake succeeds, so client certificate failures surface here too.
+func handshake(t *testing.T, serverTLS *server.TLS, client *tls.Config) (*x509.Certificate, error) {
+	lis, err := tls.Listen("tcp", "127.0.0.1:0", serverTLS.Config())
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer lis.Close()
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if err := conn.(*tls.Conn).Handshake(); err != nil {
+			return
+		}
+		_, _ = conn.Write([]byte{1})
+	}()
+	client.ServerName = "localhost"
+	client.NextProtos = []string{"h2"}
+	conn, err := tls.Dial("tcp", lis.Addr().String(), client)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if _, err := conn.Read(make([]byte, 1)); err != nil {
+		return nil, err
+	}
+	return conn.ConnectionState().PeerCertificates[0], nil
+}
+
+func TestTLSMutual(t *testing.T) {
+	ca := newTestCA(t)
+	cfg := writeServerFiles(t, t.TempDir(), ca, 2, time.Now())
+	cfg.RequireClientCert = true
+	cfg.AllowedSANs = []string{"spiffe://srcabl/orders"}
+	serverTLS, err := server.NewTLS(cfg)
+	if err != nil {
+		t.Fatalf("failed to new tls: %v", err)
+	}
+
+	allowed := ca.clientCert(t, 3, "spiffe://srcabl/orders")
+	if _, err := handshake(t, serverTLS, &tls.Config{RootCAs: ca.pool(), Certificates: []tls.Certificate{allowed}}); err != nil {
+		t.Errorf("expected an allowed client to connect: %v", err)
+	}
+
+	other := ca.clientCert(t, 4, "spiffe://srcabl/other")
+	if _, err := handshake(t, serverTLS, &tls.Config{RootCAs: ca.pool(), Certificates: []tls.Certificate{other}}); err == nil {
+		t.Error("expected a client without an allowed SAN to be rejected")
+	}
+
+	if _, err := handshake(t, serverTLS, &tls.Config{RootCAs: ca.pool()}); err == nil {
+		t.Error("expected a client without a certificate to be rejected")
+	}
+
+	untrusted := newTestCA(t).clientCert(t, 5, "spiffe://srcabl/orders")
+	if _, err := handshake(t, serverTLS, &tls.Config{RootCAs: ca.pool(), Certificates: []tls.Certificate{untrusted}}); err == nil {
+		t.Error("expected a client from another ca to be rejected")
+	}
+}
+
+func TestTLSOptionalClientCert(t *testing.T) {
+	ca := newTestCA(t)
+	cfg := writeServerFiles(t, t.TempDir(), ca, 2, time.Now())
+	serverTLS, err := server.NewTLS(cfg)
+	if err != nil {
+		t.Fatalf("failed to new tls: %v", err)
+	}
+	if _, err := handshake(t, serverTLS, &tls.Config{RootCAs: ca.pool()}); err != nil {
+		t.Errorf("expected a client without a certificate to connect: %v", err)
+	}
+}
+
+func TestTLSReload(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	cfg := writeServerFiles(t, dir, ca, 2, time.Now().Add(-time.Minute))
+	serverTLS, err := server.NewTLS(cfg)
+	if err != nil {
+		t.Fatalf("failed to new tls: %v", err)
+	}
+	client := &tls.Config{RootCAs: ca.pool()}
+	served, err := handshake(t, serverTLS, client.Clone())
+	if err != nil {
+		t.Fatalf("failed to handshake: %v", err)
+	}
+	if served.SerialNumber.Int64() != 2 {
+		t.Fatalf("expected serial 2, got %d", served.SerialNumber)
+	}
+
+	writeServerFiles(t, dir, ca, 6, time.Now())
+	if err := serverTLS.Reload(); err != nil {
+		t.Fatalf("failed to reload: %v", err)
+	}
+	served, err = handshake(t, serverTLS, client.Clone())
+	if err != nil {
+		t.Fatalf("failed to handshake after reload: %v", err)
+	}
+	if served.SerialNumber.Int64() != 6 {
+		t.Errorf("expected the renewed certificate with serial 6, got %d", served.SerialNumber)
+	}
+
+	writeFile(t, cfg.KeyFile, []byte("not a key"), time.Now().Add(time.Minute))
+	if err := serverTLS.Reload(); err == nil {
+		t.Error("expected a broken key file to fail the reload")
+	}
+	served, err = handshake(t, serverTLS, client.Clone())
+	if err != nil {
+		t.Fatalf("failed to handshake after a failed reload: %v", err)
+	}
+	if served.SerialNumber.Int64() != 6 {
+		t.Errorf("expected a failed reload to keep serial 6, got %d", served.SerialNumber)
+	}
+}
@@ -0,0 +1,180 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"strconv"
+
+	"github.com/gofrs/uuid"
+	"github.com/pkg/errors"
+	pb "github.com/srcabl/protos/users"
+	"github.com/srcabl/users/internal/logging"
+	"google.golang.org/grpc/peer"
+)
+
+// The actions the audit log records
+const (
+	AuditUserCreated     = "user.created"
+	AuditUserDeleted     = "user.deleted"
+	AuditUserErased      = "user.erased"
+	AuditUserUnlocked    = "user.unlocked"
+	AuditPasswordChanged = "password.changed"
+	AuditRoleGranted     = "role.granted"
+	AuditRoleRevoked     = "role.revoked"
+	AuditFollowAdded     = "follow.added"
+	AuditFollowRemoved   = "follow.removed"
+)
+
+// The fields audit changes name besides the user's own
+const (
+	AuditFieldRoles   = "roles"
+	AuditFieldFollows = "follows"
+)
+
+// AuditChange is a field an audited action changed with its value before and
+// after. Secret fields, such as the password, carry neither. A role change
+// carries the role granted as new or revoked as old, and a follow change the
+// followed type and uuid, as in user/<uuid>.
+type AuditChange struct {
+	Field string `json:"field"`
+	Old   string `json:"old,omitempty"`
+	New   string `json:"new,omitempty"`
+}
+
+// DBAuditEntry is the database model of an entry in the audit log, which is
+// only ever appended to. IDs grow in the order entries were written.
+type DBAuditEntry struct {
+	ID        int64
+	UUID      string
+	UserUUID  string
+	ActorUUID string
+	Action    string
+	Changes   []byte
+	ClientIP  string
+	RequestID string
+	CreatedAt int64
+}
+
+// newAuditEntry news up an entry recording the action the actor took on the
+// user, along with the client address and request ID of the rpc it came in on
+func newAuditEntry(ctx context.Context, action, userUUID, actorUUID string, at int64, changes ...AuditChange) (*DBAuditEntry, error) {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate uuid for audit entry")
+	}
+	if changes == nil {
+		changes = []AuditChange{}
+	}
+	raw, err := json.Marshal(changes)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to marshal %s changes", action)
+	}
+	return &DBAuditEntry{
+		UUID:      id.String(),
+		UserUUID:  userUUID,
+		ActorUUID: actorUUID,
+		Action:    action,
+		Changes:   raw,
+		ClientIP:  clientIP(ctx),
+		RequestID: logging.RequestID(ctx),
+		CreatedAt: at,
+	}, nil
+}
+
+// createdChanges are the changes creating the user made
+func createdChanges(user *DBUser) []AuditChange {
+	changes := []AuditChange{
+		{Field: "username", New: user.Username},
+		{Field: "email", New: user.Email},
+	}
+	if user.DisplayName.Valid {
+		changes = append(changes, AuditChange{Field: "display_name", New: user.DisplayName.String})
+	}
+	return changes
+}
+
+// unlockChanges are the changes lifting the lockout from the user as they
+// were before made
+func unlockChanges(before *DBUser) []AuditChange {
+	lockedUntil := ""
+	if before.LockedUntil.Valid {
+		lockedUntil = strconv.FormatInt(before.LockedUntil.Int64, 10)
+	}
+	return []AuditChange{
+		{Field: "failed_login_attempts", Old: strconv.Itoa(before.FailedLoginAttempts), New: "0"},
+		{Field: "locked_until", Old: lockedUntil},
+	}
+}
+
+// deletedChange is the change deleting a user at the time made
+func deletedChange(at int64) AuditChange {
+	return AuditChange{Field: "deleted_at", New: strconv.FormatInt(at, 10)}
+}
+
+// followAuditAction is the action the follow event of the type is audited as
+func followAuditAction(eventType string) string {
+	if eventType == EventFollowAdded {
+		return AuditFollowAdded
+	}
+	return AuditFollowRemoved
+}
+
+// followChange is the change a follow or unfollow made to the follower
+func followChange(eventType, followed, followedType string) AuditChange {
+	change := AuditChange{Field: AuditFieldFollows}
+	if eventType == EventFollowAdded {
+		change.New = followedType + "/" + followed
+	} else {
+		change.Old = followedType + "/" + followed
+	}
+	return change
+}
+
+// clientIP is the address of the client the rpc came from, without the port
+func clientIP(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+	addr := p.Addr.String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// ToGRPC transforms the dbauditentry to proto audit entry
+func (e *DBAuditEntry) ToGRPC() (*pb.AuditEntry, error) {
+	id, err := uuid.FromString(e.UUID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to transform audit entry uuid: %s", e.UUID)
+	}
+	userID, err := uuid.FromString(e.UserUUID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to transform audit entry user uuid: %s", e.UserUUID)
+	}
+	actorID, err := uuid.FromString(e.ActorUUID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to transform audit entry actor uuid: %s", e.ActorUUID)
+	}
+	var changes []AuditChange
+	if err := json.Unmarshal(e.Changes, &changes); err != nil {
+		return nil, errors.Wrapf(err, "failed to unmarshal changes of audit entry %s", e.UUID)
+	}
+	pbChanges := make([]*pb.AuditChange, 0, len(changes))
+	for _, change := range changes {
+		pbChanges = append(pbChanges, &pb.AuditChange{Field: change.Field, Old: change.Old, New: change.New})
+	}
+	return &pb.AuditEntry{
+		Id:        e.ID,
+		Uuid:      id.Bytes(),
+		UserUuid:  userID.Bytes(),
+		ActorUuid: actorID.Bytes(),
+		Action:    e.Action,
+		Changes:   pbChanges,
+		ClientIp:  e.ClientIP,
+		RequestId: e.RequestID,
+		CreatedAt: e.CreatedAt,
+	}, nil
+}
@@ -2,7 +2,7 @@ package service
 
 import (
 	"context"
-	"fmt"
+	"database/sql"
 
 	"github.com/pkg/errors"
 	"github.com/srcabl/services/pkg/db/mysql"
@@ -13,6 +13,18 @@ type DataRepository interface {
 	DataRepositoryGetter
 	DataRepositoryCreator
 	DataRepositoryUpdater
+	DataRepositoryFollows
+	DataRepositoryBlocks
+	DataRepositorySessions
+	DataRepositoryIdentities
+	DataRepositoryRoles
+	DataRepositoryOutbox
+	DataRepositoryWebhooks
+	DataRepositoryAudit
+	DataRepositoryExports
+	DataRepositoryErasures
+	DataRepositorySearch
+	Ping(context.Context) error
 }
 
 // DataRepositoryGetter specifies behavior of the data repo getters
@@ -34,17 +46,152 @@ type DataRepositoryUpdater interface {
 	RemoveUserFollower(context.Context, string, string) error
 	AddSourceFollower(context.Context, string, string) error
 	RemoveSourceFollower(context.Context, string, string) error
+	UpdateUserPassword(ctx context.Context, userUUID, hashedPassword, updatedByUUID string, updatedAt int64) error
+	RecordFailedLogin(ctx context.Context, userUUID string, threshold int, now, lockedUntil int64) error
+	ResetFailedLogins(context.Context, string) error
+	UnlockUser(ctx context.Context, userUUID, updatedByUUID string, updatedAt int64) error
+	DeleteUser(ctx context.Context, userUUID, deletedByUUID string, deletedAt int64) error
 }
 
+// DataRepositoryFollows specifies the behavior of the data repo follow listings
+type DataRepositoryFollows interface {
+	ListUserFollows(ctx context.Context, followerUUID string) ([]string, error)
+	ListSourceFollows(ctx context.Context, followerUUID string) ([]string, error)
+	ListUserFollowers(ctx context.Context, followedUUID string) ([]string, error)
+}
+
+// DataRepositoryBlocks specifies the behavior of the data repo user blocks.
+// Blocks are private to the users they are between, so they record no
+// events or audit entries.
+type DataRepositoryBlocks interface {
+	BlockUser(ctx context.Context, blockerUUID, blockedUUID string, blockedAt int64) error
+	UnblockUser(ctx context.Context, blockerUUID, blockedUUID string) error
+	ListUserBlocks(ctx context.Context, blockerUUID string) ([]string, error)
+	ListUserBlockers(ctx context.Context, blockedUUID string) ([]string, error)
+}
+
+// DataRepositoryRoles specifies the behavior of the data repo role grants
+type DataRepositoryRoles interface {
+	ListRolesForUser(context.Context, string) ([]string, error)
+	GrantRole(context.Context, *DBRole) error
+	RevokeRole(ctx context.Context, userUUID, role, revokedByUUID string, revokedAt int64) error
+}
+
+// DataRepositoryIdentities specifies the behavior of the data repo external identity links
+type DataRepositoryIdentities interface {
+	GetIdentity(ctx context.Context, provider, subject string) (*DBIdentity, error)
+	ListIdentitiesForUser(context.Context, string) ([]*DBIdentity, error)
+	CreateIdentity(context.Context, *DBIdentity) error
+	CreateUserWithIdentity(context.Context, *DBUser, *DBIdentity) error
+	DeleteIdentity(ctx context.Context, userUUID, provider, subject string) error
+}
+
+// DataRepositoryOutbox specifies the behavior of the data repo event outbox.
+// Writes to users and follows record their events in the same transaction,
+// and the relay holding the lease reads them back out to publish them.
+// Watches read them back out too, published or not.
+type DataRepositoryOutbox interface {
+	ListPendingEvents(ctx context.Context, limit int) ([]*DBEvent, error)
+	ListEventsAfter(ctx context.Context, afterID int64, limit int) ([]*DBEvent, error)
+	GetEventRange(context.Context) (*DBEventRange, error)
+	MarkEventsPublished(ctx context.Context, ids []int64, publishedAt int64) error
+	PruneEvents(ctx context.Context, publishedBefore int64) (int64, error)
+	AcquireOutboxLease(ctx context.Context, holder string, now, expiresAt int64) (bool, error)
+}
+
+// DataRepositoryWebhooks specifies the behavior of the data repo webhook
+// subscriptions. Recording an event queues a delivery of it to every webhook
+// subscribed, in the same transaction, and the dispatcher claims the due
+// ones to attempt them.
+type DataRepositoryWebhooks interface {
+	CreateWebhook(context.Context, *DBWebhook) error
+	ListWebhooks(context.Context) ([]*DBWebhook, error)
+	DeleteWebhook(ctx context.Context, webhookUUID string) error
+	GetWebhookDelivery(ctx context.Context, deliveryUUID string) (*DBWebhookDelivery, error)
+	ListWebhookDeliveries(ctx context.Context, webhookUUID, status string, limit int) ([]*DBWebhookDelivery, error)
+	ListDueWebhookDeliveries(ctx context.Context, now int64, limit int) ([]*DBWebhookDelivery, error)
+	ClaimWebhookDelivery(ctx context.Context, deliveryUUID string, nextAttemptAt, claimedUntil int64) (bool, error)
+	UpdateWebhookDelivery(context.Context, *DBWebhookDelivery) error
+	RedeliverWebhookDelivery(ctx context.Context, deliveryUUID string, now int64) error
+	PruneWebhookDeliveries(ctx context.Context, deliveredBefore int64) (int64, error)
+}
+
+// DataRepositoryAudit specifies the behavior of the data repo audit log. The
+// write paths append an entry for every account mutation in the transaction
+// making it, so the log only ever holds what happened.
+type DataRepositoryAudit interface {
+	ListAuditEntries(ctx context.Context, userUUID, actorUUID string, beforeID int64, limit int) ([]*DBAuditEntry, error)
+}
+
+// DataRepositoryExports specifies the behavior of the data repo data exports.
+// Exports are queued pending, claimed by a runner to be built and completed
+// with their data, which is only read when it is downloaded.
+type DataRepositoryExports interface {
+	CreateDataExport(context.Context, *DBDataExport) error
+	GetDataExport(ctx context.Context, exportUUID string) (*DBDataExport, error)
+	GetDataExportData(ctx context.Context, exportUUID string) ([]byte, error)
+	ListPendingDataExports(ctx context.Context, now int64, limit int) ([]*DBDataExport, error)
+	ClaimDataExport(ctx context.Context, exportUUID string, claimedSince, claimedUntil int64) (bool, error)
+	CompleteDataExport(context.Context, *DBDataExport) error
+	PruneDataExports(ctx context.Context, completedBefore int64) (int64, error)
+}
+
+// DataRepositoryErasures specifies the behavior of the data repo erasures.
+// An erasure is recorded pending first and erases the user in one go once
+// it is started, so one interrupted in between is erased again from scratch.
+type DataRepositoryErasures interface {
+	StartErasure(context.Context, *DBErasure) (*DBErasure, error)
+	EraseUser(ctx context.Context, erasure *DBErasure, erasedAt int64) error
+	GetErasure(ctx context.Context, userUUID string) (*DBErasure, error)
+}
+
+// DataRepositorySearch specifies the behavior of the data repo listing users
+// for search indexes to be built from
+type DataRepositorySearch interface {
+	ListSearchUsers(ctx context.Context, afterUUID string, limit int) ([]*DBSearchUser, error)
+	GetSearchUser(ctx context.Context, uuid string) (*DBSearchUser, error)
+}
+
+// DataRepositorySessions specifies the behavior of the data repo session store
+type DataRepositorySessions interface {
+	CreateSession(context.Context, *DBSession) error
+	GetSessionByID(context.Context, string) (*DBSession, error)
+	GetSessionByRefreshTokenHash(context.Context, string) (*DBSession, error)
+	RotateSession(ctx context.Context, sessionUUID, oldHash, newHash string, lastUsedAt, expiresAt int64) error
+	ListActiveSessionsForUser(ctx context.Context, userUUID string, now int64) ([]*DBSession, error)
+	ListSessionsForUser(ctx context.Context, userUUID string) ([]*DBSession, error)
+	RevokeSession(ctx context.Context, sessionUUID string, revokedAt int64) error
+	RevokeAllSessionsForUser(ctx context.Context, userUUID string, revokedAt int64) error
+}
+
+// sqlDB runs traced statements on a sql database. db is read on every
+// statement since clients only open their pool when they connect.
+type sqlDB struct {
+	system string
+	db     func() *sql.DB
+}
+
+// Ping checks the database can be reached
+func (s *sqlDB) Ping(ctx context.Context) error {
+	if err := s.db().PingContext(ctx); err != nil {
+		return errors.Wrap(err, "failed to ping database")
+	}
+	return nil
+}
+
+// dataRepository runs the data repo's statements on a sql database. The
+// statements stick to sql that mysql, sqlite and postgres all understand, and
+// their ? placeholders are numbered for postgres when they are run.
 type dataRepository struct {
-	db *mysql.Client
+	sqlDB
 }
 
-// NewDataRepository news up a data repo
+// NewDataRepository news up a data repo backed by mysql
 func NewDataRepository(db *mysql.Client) (DataRepository, error) {
-	return &dataRepository{
-		db: db,
-	}, nil
+	return &dataRepository{sqlDB{
+		system: "mysql",
+		db:     func() *sql.DB { return db.DB },
+	}}, nil
 }
 
 const getUserByQuery = `
@@ -53,10 +200,14 @@ SELECT
 	username,
 	email,
 	hashed_password,
+	display_name,
 	created_by_uuid,
 	created_at,
 	updated_by_uuid,
-	updated_at
+	updated_at,
+	failed_login_attempts,
+	locked_until,
+	deleted_at
 FROM
 	users
 
@@ -64,7 +215,7 @@ FROM
 
 // GetUserByID gets user by the id
 func (dr *dataRepository) GetUserByID(ctx context.Context, uuid string) (*DBUser, error) {
-	getQuery := getUserByQuery + `WHERE uuid=?`
+	getQuery := getUserByQuery + `WHERE deleted_at IS NULL AND uuid=?`
 	user, err := dr.getUser(ctx, getQuery, uuid)
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to find user with ID %s", uuid)
@@ -74,7 +225,7 @@ func (dr *dataRepository) GetUserByID(ctx context.Context, uuid string) (*DBUser
 
 // GetUserByUsername gets user by the username
 func (dr *dataRepository) GetUserByUsername(ctx context.Context, username string) (*DBUser, error) {
-	getQuery := getUserByQuery + `WHERE username=?`
+	getQuery := getUserByQuery + `WHERE deleted_at IS NULL AND username=?`
 	user, err := dr.getUser(ctx, getQuery, username)
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to find user with username %s", username)
@@ -84,7 +235,7 @@ func (dr *dataRepository) GetUserByUsername(ctx context.Context, username string
 
 // GetUserByEmail gets user by the email
 func (dr *dataRepository) GetUserByEmail(ctx context.Context, email string) (*DBUser, error) {
-	getQuery := getUserByQuery + `WHERE email=?`
+	getQuery := getUserByQuery + `WHERE deleted_at IS NULL AND email=?`
 	user, err := dr.getUser(ctx, getQuery, email)
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to find user with email %s", email)
@@ -93,19 +244,36 @@ func (dr *dataRepository) GetUserByEmail(ctx context.Context, email string) (*DB
 }
 
 func (dr *dataRepository) getUser(ctx context.Context, query string, param string) (*DBUser, error) {
+	user, err := scanUser(dr.queryRow(ctx, query, param))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to find user with param %s", param)
+	}
+	roles, err := dr.ListRolesForUser(ctx, user.UUID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to find roles of user with param %s", param)
+	}
+	user.Roles = roles
+	return user, nil
+}
+
+func scanUser(row scanner) (*DBUser, error) {
 	user := &DBUser{}
-	err := dr.db.DB.QueryRow(query, param).Scan(
+	err := row.Scan(
 		&user.UUID,
 		&user.Username,
 		&user.Email,
 		&user.HashedPassword,
+		&user.DisplayName,
 		&user.CreatedByUUID,
 		&user.CreatedAt,
 		&user.UpdatedByUUID,
 		&user.UpdatedAt,
+		&user.FailedLoginAttempts,
+		&user.LockedUntil,
+		&user.DeletedAt,
 	)
 	if err != nil {
-		return nil, errors.Wrapf(err, "failed to find user with param %s", param)
+		return nil, err
 	}
 	return user, nil
 }
@@ -113,16 +281,17 @@ func (dr *dataRepository) getUser(ctx context.Context, query string, param strin
 const addUserFollowerStatement = `
 INSERT INTO
 	user_user_follows (
-		follower,
-		followed
+		follower_uuid,
+		followed_uuid
 	)
 VALUES
 	(?, ?)
 `
 
-// AddUserFollower adds a user follow relationship
+// AddUserFollower adds a user follow relationship. Following a user already
+// followed does nothing.
 func (dr *dataRepository) AddUserFollower(ctx context.Context, follower, followed string) error {
-	if err := dr.performFollowStatement(ctx, addUserFollowerStatement, follower, followed); err != nil {
+	if err := dr.addFollow(ctx, addUserFollowerStatement, follower, followed, FollowedUser); err != nil {
 		return errors.Wrap(err, "failed to add user follower")
 	}
 	return nil
@@ -132,12 +301,12 @@ const removeUserFollowerStatement = `
 DELETE FROM
 	user_user_follows
 WHERE
-	follower=? AND followed=?
+	follower_uuid=? AND followed_uuid=?
 `
 
 // RevomeUserFollower adds a user follow relationship
 func (dr *dataRepository) RemoveUserFollower(ctx context.Context, follower, followed string) error {
-	if err := dr.performFollowStatement(ctx, removeUserFollowerStatement, follower, followed); err != nil {
+	if err := dr.removeFollow(ctx, removeUserFollowerStatement, follower, followed, FollowedUser); err != nil {
 		return errors.Wrap(err, "failed to remove user follower")
 	}
 	return nil
@@ -146,16 +315,17 @@ func (dr *dataRepository) RemoveUserFollower(ctx context.Context, follower, foll
 const addSourceFollowerStatement = `
 INSERT INTO
 	user_source_follows (
-		follower,
-		followed
+		follower_uuid,
+		followed_uuid
 	)
 VALUES
 	(?, ?)
 `
 
-// AddSourceFollower adds a user follow relationship
+// AddSourceFollower adds a source follow relationship. Following a source
+// already followed does nothing.
 func (dr *dataRepository) AddSourceFollower(ctx context.Context, follower, followed string) error {
-	if err := dr.performFollowStatement(ctx, addSourceFollowerStatement, follower, followed); err != nil {
+	if err := dr.addFollow(ctx, addSourceFollowerStatement, follower, followed, FollowedSource); err != nil {
 		return errors.Wrap(err, "failed to add source follower")
 	}
 	return nil
@@ -165,43 +335,48 @@ const removeSourceFollowerStatement = `
 DELETE FROM
 	user_source_follows
 WHERE
-	follower=? AND followed=?
+	follower_uuid=? AND followed_uuid=?
 `
 
 // RemoveSourceFollower adds a user follow relationship
 func (dr *dataRepository) RemoveSourceFollower(ctx context.Context, follower, followed string) error {
-	if err := dr.performFollowStatement(ctx, removeSourceFollowerStatement, follower, followed); err != nil {
+	if err := dr.removeFollow(ctx, removeSourceFollowerStatement, follower, followed, FollowedSource); err != nil {
 		return errors.Wrap(err, "failed to remove source follower")
 	}
 	return nil
 }
 
-func (dr *dataRepository) performFollowStatement(ctx context.Context, statement, follower, followed string) error {
-	tx, err := dr.db.DB.BeginTx(ctx, nil)
-	if err != nil {
-		return errors.Wrapf(err, "failed to begin transaction")
-	}
-	stm, err := tx.PrepareContext(ctx, addUserFollowerStatement)
-	if err != nil {
-		if rollErr := tx.Rollback(); rollErr != nil {
-			return errors.Wrapf(rollErr, "failed to rollback after failing to perform follow %s-%s", follower, followed)
+// addFollow adds the follow, recording an event only when it was not there already
+func (dr *dataRepository) addFollow(ctx context.Context, statement, follower, followed, followedType string) error {
+	err := dr.inTx(ctx, func(tx *dbTx) error {
+		added, err := tx.insertUnlessHeld(ctx, statement, "follower_uuid", follower, followed)
+		if err != nil {
+			return errors.Wrap(err, "failed to execute statement to follow")
 		}
-		return errors.Wrapf(err, "failed to prepare statement to perform follow %s-%s", follower, followed)
-	}
-	_, err = stm.ExecContext(ctx,
-		follower,
-		followed,
-	)
-	if err != nil {
-		if rollErr := tx.Rollback(); rollErr != nil {
-			return errors.Wrapf(rollErr, "failed to rollback after failing to perform follow %s-%s", follower, followed)
+		if !added {
+			return nil
 		}
-		return errors.Wrapf(err, "failed to execute statment to perform follow %s-%s", follower, followed)
+		return dr.recordFollowEvent(ctx, tx, EventFollowAdded, follower, followed, followedType)
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to perform follow %s-%s", follower, followed)
 	}
-	if err := tx.Commit(); err != nil {
-		if rollErr := tx.Rollback(); rollErr != nil {
-			return errors.Wrapf(rollErr, "failed to rollback after failing to perform follow %s-%s", follower, followed)
+	return nil
+}
+
+// removeFollow removes the follow, recording an event only when there was one to remove
+func (dr *dataRepository) removeFollow(ctx context.Context, statement, follower, followed, followedType string) error {
+	err := dr.inTx(ctx, func(tx *dbTx) error {
+		res, err := tx.ExecContext(ctx, statement, follower, followed)
+		if err != nil {
+			return errors.Wrap(err, "failed to execute statement to unfollow")
 		}
+		if affected, err := res.RowsAffected(); err == nil && affected == 0 {
+			return nil
+		}
+		return dr.recordFollowEvent(ctx, tx, EventFollowRemoved, follower, followed, followedType)
+	})
+	if err != nil {
 		return errors.Wrapf(err, "failed to perform follow %s-%s", follower, followed)
 	}
 	return nil
@@ -210,11 +385,9 @@ func (dr *dataRepository) performFollowStatement(ctx context.Context, statement,
 // ValidateUserForCreate validates user fields against the data repo for create
 func (dr *dataRepository) ValidateUserForCreate(ctx context.Context, user *DBUser) bool {
 	if checkUser, _ := dr.GetUserByEmail(ctx, user.Email); checkUser != nil {
-		fmt.Printf("user email exists\n")
 		return false
 	}
 	if checkUser, _ := dr.GetUserByUsername(ctx, user.Username); checkUser != nil {
-		fmt.Printf("user username exists\n")
 		return false
 	}
 	return true
@@ -227,49 +400,167 @@ INSERT INTO
 		username,
 		email,
 		hashed_password,
+		display_name,
 		created_by_uuid,
 		created_at,
 		updated_by_uuid,
 		updated_at
 	)
 VALUES
-	(?, ?, ?, ?, ?, ?, ?, ?)
+	(?, ?, ?, ?, ?, ?, ?, ?, ?)
 `
 
 //CreateUser creates a user
 func (dr *dataRepository) CreateUser(ctx context.Context, user *DBUser) error {
-	tx, err := dr.db.DB.BeginTx(ctx, nil)
+	err := dr.inTx(ctx, func(tx *dbTx) error {
+		_, err := tx.ExecContext(ctx, createUserStatement,
+			user.UUID,
+			user.Username,
+			user.Email,
+			user.HashedPassword,
+			user.DisplayName,
+			user.CreatedByUUID,
+			unixTime(user.CreatedAt),
+			user.UpdatedByUUID.String,
+			unixTime(user.UpdatedAt.Int64),
+		)
+		if err != nil {
+			return errors.Wrap(err, "failed to execute statment to create user")
+		}
+		return dr.recordUserCreated(ctx, tx, user)
+	})
 	if err != nil {
-		return errors.Wrapf(err, "failed to begin transaction")
+		return errors.Wrapf(err, "failed to create user %s", user.UUID)
 	}
-	stm, err := tx.PrepareContext(ctx, createUserStatement)
-	if err != nil {
-		if rollErr := tx.Rollback(); rollErr != nil {
-			return errors.Wrapf(rollErr, "failed to rollback after failing to create user %+v", user)
+	return nil
+}
+
+// clearExpiredLockStatement starts the count again once a lock has run out,
+// so one more failed login does not lock the user straight away
+const clearExpiredLockStatement = `
+UPDATE
+	users
+SET
+	failed_login_attempts=0,
+	locked_until=NULL
+WHERE
+	uuid=? AND locked_until IS NOT NULL AND locked_until<=?
+`
+
+// recordFailedLoginStatement locks the account once the attempt being
+// recorded reaches the threshold. locked_until is set first so it compares
+// against the count from before this attempt whichever way the database
+// orders the assignments.
+const recordFailedLoginStatement = `
+UPDATE
+	users
+SET
+	locked_until=CASE WHEN ? > 0 AND failed_login_attempts+1 >= ? THEN ? ELSE locked_until END,
+	failed_login_attempts=failed_login_attempts+1
+WHERE
+	uuid=?
+`
+
+// RecordFailedLogin counts a failed login and locks the user until
+// lockedUntil once the threshold is reached. A lock that ran out by now is
+// cleared first, so the count starts again from this attempt.
+func (dr *dataRepository) RecordFailedLogin(ctx context.Context, userUUID string, threshold int, now, lockedUntil int64) error {
+	err := dr.inTx(ctx, func(tx *dbTx) error {
+		if _, err := tx.ExecContext(ctx, clearExpiredLockStatement, userUUID, unixTime(now)); err != nil {
+			return errors.Wrap(err, "failed to execute statement to clear expired lock")
 		}
-		return errors.Wrapf(err, "failed to prepare statement to create user %+v", user)
-	}
-	_, err = stm.ExecContext(ctx,
-		user.UUID,
-		user.Username,
-		user.Email,
-		user.HashedPassword,
-		user.CreatedByUUID,
-		user.CreatedAt,
-		user.UpdatedByUUID.String,
-		user.UpdatedAt.Int64,
-	)
+		if _, err := tx.ExecContext(ctx, recordFailedLoginStatement, threshold, threshold, unixTime(lockedUntil), userUUID); err != nil {
+			return errors.Wrap(err, "failed to execute statement to record failed login")
+		}
+		return nil
+	})
 	if err != nil {
-		if rollErr := tx.Rollback(); rollErr != nil {
-			return errors.Wrapf(rollErr, "failed to rollback after failing to create user %+v", user)
+		return errors.Wrapf(err, "failed to record failed login for user %s", userUUID)
+	}
+	return nil
+}
+
+const resetFailedLoginsStatement = `
+UPDATE
+	users
+SET
+	failed_login_attempts=0
+WHERE
+	uuid=? AND failed_login_attempts>0
+`
+
+// ResetFailedLogins clears the failed login count after a successful login
+func (dr *dataRepository) ResetFailedLogins(ctx context.Context, userUUID string) error {
+	if _, err := dr.execStatement(ctx, resetFailedLoginsStatement, userUUID); err != nil {
+		return errors.Wrapf(err, "failed to reset failed logins for user %s", userUUID)
+	}
+	return nil
+}
+
+const unlockUserStatement = `
+UPDATE
+	users
+SET
+	failed_login_attempts=0,
+	locked_until=NULL,
+	updated_by_uuid=?,
+	updated_at=?
+WHERE
+	uuid=? AND deleted_at IS NULL
+`
+
+// UnlockUser lifts a lockout from the user
+func (dr *dataRepository) UnlockUser(ctx context.Context, userUUID, updatedByUUID string, updatedAt int64) error {
+	err := dr.inTx(ctx, func(tx *dbTx) error {
+		before, err := scanUser(tx.QueryRowContext(ctx, getUserByQuery+`WHERE deleted_at IS NULL AND uuid=?`, userUUID))
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, unlockUserStatement, updatedByUUID, unixTime(updatedAt), userUUID); err != nil {
+			return errors.Wrap(err, "failed to execute statement to unlock user")
+		}
+		if err := dr.recordAudit(ctx, tx, AuditUserUnlocked, userUUID, updatedByUUID, updatedAt, unlockChanges(before)...); err != nil {
+			return err
 		}
-		return errors.Wrapf(err, "failed to execute statment to create user %+v", user)
+		return dr.recordUserEvent(ctx, tx, EventUserUpdated, userUUID, updatedByUUID, updatedAt, ChangedLockout)
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to unlock user %s", userUUID)
 	}
-	if err := tx.Commit(); err != nil {
-		if rollErr := tx.Rollback(); rollErr != nil {
-			return errors.Wrapf(rollErr, "failed to rollback after failing to create user %+v", user)
+	return nil
+}
+
+const deleteUserStatement = `
+UPDATE
+	users
+SET
+	deleted_at=?,
+	updated_by_uuid=?,
+	updated_at=?
+WHERE
+	uuid=? AND deleted_at IS NULL
+`
+
+// DeleteUser marks the user deleted and revokes all of their sessions
+func (dr *dataRepository) DeleteUser(ctx context.Context, userUUID, deletedByUUID string, deletedAt int64) error {
+	err := dr.inTx(ctx, func(tx *dbTx) error {
+		res, err := tx.ExecContext(ctx, deleteUserStatement, unixTime(deletedAt), deletedByUUID, unixTime(deletedAt), userUUID)
+		if err != nil {
+			return errors.Wrap(err, "failed to execute statement to delete user")
+		}
+		if affected, err := res.RowsAffected(); err == nil && affected == 0 {
+			return sql.ErrNoRows
 		}
-		return errors.Wrapf(err, "failed to create user %+v", user)
+		if _, err := tx.ExecContext(ctx, revokeAllSessionsStatement, unixTime(deletedAt), userUUID); err != nil {
+			return errors.Wrap(err, "failed to execute statement to revoke sessions")
+		}
+		if err := dr.recordAudit(ctx, tx, AuditUserDeleted, userUUID, deletedByUUID, deletedAt, deletedChange(deletedAt)); err != nil {
+			return err
+		}
+		return dr.recordUserEvent(ctx, tx, EventUserDeleted, userUUID, deletedByUUID, deletedAt)
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to delete user %s", userUUID)
 	}
 	return nil
 }
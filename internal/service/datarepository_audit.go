@@ -0,0 +1,119 @@
+package service
+
+import (
+	"context"
+
+	"github.com/gofrs/uuid"
+	"github.com/pkg/errors"
+)
+
+const insertAuditEntryStatement = `
+INSERT INTO
+	user_audit_log (
+		uuid,
+		user_uuid,
+		actor_uuid,
+		action,
+		changes,
+		client_ip,
+		request_id,
+		created_at
+	)
+VALUES
+	(?, ?, ?, ?, ?, ?, ?, ?)
+`
+
+// recordAudit appends an entry recording the action the actor took on the
+// user to the audit log in the transaction
+func (dr *dataRepository) recordAudit(ctx context.Context, tx *dbTx, action, userUUID, actorUUID string, at int64, changes ...AuditChange) error {
+	return insertAuditEntry(ctx, tx, insertAuditEntryStatement, action, userUUID, actorUUID, at, changes...)
+}
+
+// insertAuditEntry runs the statement appending an entry to the audit log
+func insertAuditEntry(ctx context.Context, tx *dbTx, statement, action, userUUID, actorUUID string, at int64, changes ...AuditChange) error {
+	entry, err := newAuditEntry(ctx, action, userUUID, actorUUID, at, changes...)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, statement,
+		entry.UUID,
+		entry.UserUUID,
+		entry.ActorUUID,
+		entry.Action,
+		string(entry.Changes),
+		entry.ClientIP,
+		entry.RequestID,
+		unixTime(entry.CreatedAt),
+	)
+	return errors.Wrapf(err, "failed to execute statement to audit %s", entry.Action)
+}
+
+const listAuditEntriesQuery = `
+SELECT
+	id,
+	uuid,
+	user_uuid,
+	actor_uuid,
+	action,
+	changes,
+	client_ip,
+	request_id,
+	created_at
+FROM
+	user_audit_log
+WHERE
+	(?='' OR user_uuid=?) AND (?='' OR actor_uuid=?) AND (?=0 OR id<?)
+ORDER BY
+	id DESC
+LIMIT ?
+`
+
+// ListAuditEntries lists the newest entries of the audit log on the user,
+// by the actor or both, from before the id when it is set
+func (dr *dataRepository) ListAuditEntries(ctx context.Context, userUUID, actorUUID string, beforeID int64, limit int) ([]*DBAuditEntry, error) {
+	entries, err := dr.listAuditEntries(ctx, listAuditEntriesQuery, userUUID, orNilUUID(userUUID), actorUUID, orNilUUID(actorUUID), beforeID, beforeID, limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list audit entries")
+	}
+	return entries, nil
+}
+
+// orNilUUID is the uuid, or the nil uuid for a filter left empty, since
+// postgres cannot compare its uuid columns with an empty string
+func orNilUUID(id string) string {
+	if id == "" {
+		return uuid.Nil.String()
+	}
+	return id
+}
+
+func (s *sqlDB) listAuditEntries(ctx context.Context, query string, args ...interface{}) ([]*DBAuditEntry, error) {
+	rows, err := s.query(ctx, query, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query")
+	}
+	defer rows.Close()
+	var entries []*DBAuditEntry
+	for rows.Next() {
+		entry := &DBAuditEntry{}
+		err := rows.Scan(
+			&entry.ID,
+			&entry.UUID,
+			&entry.UserUUID,
+			&entry.ActorUUID,
+			&entry.Action,
+			&entry.Changes,
+			&entry.ClientIP,
+			&entry.RequestID,
+			&entry.CreatedAt,
+		)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to scan audit entry")
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to read rows")
+	}
+	return entries, nil
+}
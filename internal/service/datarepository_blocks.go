@@ -0,0 +1,87 @@
+package service
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+const blockUserStatement = `
+INSERT INTO
+	user_blocks (
+		blocker_uuid,
+		blocked_uuid,
+		created_at
+	)
+VALUES
+	(?, ?, ?)
+`
+
+// BlockUser records the blocker blocking the blocked user. Blocking a user
+// already blocked does nothing.
+func (dr *dataRepository) BlockUser(ctx context.Context, blockerUUID, blockedUUID string, blockedAt int64) error {
+	err := dr.inTx(ctx, func(tx *dbTx) error {
+		_, err := tx.insertUnlessHeld(ctx, blockUserStatement, "blocker_uuid", blockerUUID, blockedUUID, unixTime(blockedAt))
+		return errors.Wrap(err, "failed to execute statement to block")
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to block %s-%s", blockerUUID, blockedUUID)
+	}
+	return nil
+}
+
+const unblockUserStatement = `
+DELETE FROM
+	user_blocks
+WHERE
+	blocker_uuid=? AND blocked_uuid=?
+`
+
+// UnblockUser lifts the blocker's block of the blocked user. Unblocking a
+// user not blocked does nothing.
+func (dr *dataRepository) UnblockUser(ctx context.Context, blockerUUID, blockedUUID string) error {
+	if _, err := dr.execStatement(ctx, unblockUserStatement, blockerUUID, blockedUUID); err != nil {
+		return errors.Wrapf(err, "failed to unblock %s-%s", blockerUUID, blockedUUID)
+	}
+	return nil
+}
+
+const listUserBlocksQuery = `
+SELECT
+	blocked_uuid
+FROM
+	user_blocks
+WHERE
+	blocker_uuid=?
+ORDER BY
+	blocked_uuid
+`
+
+// ListUserBlocks lists the uuids of the users the user blocked
+func (dr *dataRepository) ListUserBlocks(ctx context.Context, blockerUUID string) ([]string, error) {
+	blocked, err := dr.listUUIDs(ctx, listUserBlocksQuery, blockerUUID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list users blocked by %s", blockerUUID)
+	}
+	return blocked, nil
+}
+
+const listUserBlockersQuery = `
+SELECT
+	blocker_uuid
+FROM
+	user_blocks
+WHERE
+	blocked_uuid=?
+ORDER BY
+	blocker_uuid
+`
+
+// ListUserBlockers lists the uuids of the users who blocked the user
+func (dr *dataRepository) ListUserBlockers(ctx context.Context, blockedUUID string) ([]string, error) {
+	blockers, err := dr.listUUIDs(ctx, listUserBlockersQuery, blockedUUID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list users blocking %s", blockedUUID)
+	}
+	return blockers, nil
+}
@@ -0,0 +1,339 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+// errErasureCompleted rolls back an erasure completed by someone else while
+// it was being run
+var errErasureCompleted = errors.New("erasure already completed")
+
+// erasureStep is a statement erasing the user from a table. Steps that
+// delete are keyed by their table, steps that pseudonymize by the table and
+// column, as in users.created_by_uuid. A step with a scrub query rewrites the
+// user event payloads it lists one row at a time instead, keyed by uuid.
+type erasureStep struct {
+	key        string
+	statement  string
+	args       func(*DBErasure) []interface{}
+	scrubQuery string
+}
+
+func byUser(erasure *DBErasure) []interface{} {
+	return []interface{}{erasure.UserUUID}
+}
+
+func toTombstone(erasure *DBErasure) []interface{} {
+	return []interface{}{erasure.TombstoneUUID, erasure.UserUUID}
+}
+
+func replaceUser(erasure *DBErasure) []interface{} {
+	return []interface{}{erasure.UserUUID, erasure.TombstoneUUID, "%" + erasure.UserUUID + "%"}
+}
+
+func userEvents(erasure *DBErasure) []interface{} {
+	return []interface{}{erasure.UserUUID, EventUserCreated, EventUserUpdated, EventUserDeleted}
+}
+
+// erasureSteps erase a user in order: what is only about them is deleted,
+// the user's own events scrubbed, and then every reference left replaced
+// with the tombstone. Each step is a no-op once run, so they can all be run
+// again.
+var erasureSteps = []erasureStep{
+	{key: "user_sessions", statement: `DELETE FROM user_sessions WHERE user_uuid=?`, args: byUser},
+	{key: "user_identities", statement: `DELETE FROM user_identities WHERE user_uuid=?`, args: byUser},
+	{key: "user_roles", statement: `DELETE FROM user_roles WHERE user_uuid=?`, args: byUser},
+	{key: "user_user_follows", statement: `DELETE FROM user_user_follows WHERE follower_uuid=?`, args: byUser},
+	{key: "user_user_follows", statement: `DELETE FROM user_user_follows WHERE followed_uuid=?`, args: byUser},
+	{key: "user_source_follows", statement: `DELETE FROM user_source_follows WHERE follower_uuid=?`, args: byUser},
+	{key: "user_blocks", statement: `DELETE FROM user_blocks WHERE blocker_uuid=?`, args: byUser},
+	{key: "user_blocks", statement: `DELETE FROM user_blocks WHERE blocked_uuid=?`, args: byUser},
+	{key: "data_exports", statement: `DELETE FROM data_exports WHERE user_uuid=?`, args: byUser},
+	{key: "users", statement: `DELETE FROM users WHERE uuid=?`, args: byUser},
+	{
+		key:        "outbox.payload",
+		scrubQuery: `SELECT uuid, payload FROM outbox WHERE aggregate_uuid=? AND event_type IN (?, ?, ?)`,
+		statement:  `UPDATE outbox SET payload=? WHERE uuid=?`,
+		args:       userEvents,
+	},
+	{
+		key:        "webhook_deliveries.payload",
+		scrubQuery: `SELECT uuid, payload FROM webhook_deliveries WHERE aggregate_uuid=? AND event_type IN (?, ?, ?)`,
+		statement:  `UPDATE webhook_deliveries SET payload=? WHERE uuid=?`,
+		args:       userEvents,
+	},
+	{key: "users.created_by_uuid", statement: `UPDATE users SET created_by_uuid=? WHERE created_by_uuid=?`, args: toTombstone},
+	{key: "users.updated_by_uuid", statement: `UPDATE users SET updated_by_uuid=? WHERE updated_by_uuid=?`, args: toTombstone},
+	{key: "user_identities.created_by_uuid", statement: `UPDATE user_identities SET created_by_uuid=? WHERE created_by_uuid=?`, args: toTombstone},
+	{key: "user_roles.created_by_uuid", statement: `UPDATE user_roles SET created_by_uuid=? WHERE created_by_uuid=?`, args: toTombstone},
+	{key: "webhooks.created_by_uuid", statement: `UPDATE webhooks SET created_by_uuid=? WHERE created_by_uuid=?`, args: toTombstone},
+	{key: "data_exports.requested_by_uuid", statement: `UPDATE data_exports SET requested_by_uuid=? WHERE requested_by_uuid=?`, args: toTombstone},
+	// entries on the user keep what was done and when, but not how or from where
+	{key: "user_audit_log.user_uuid", statement: `UPDATE user_audit_log SET user_uuid=?, changes='[]', client_ip='' WHERE user_uuid=?`, args: toTombstone},
+	{key: "user_audit_log.actor_uuid", statement: `UPDATE user_audit_log SET actor_uuid=?, client_ip='' WHERE actor_uuid=?`, args: toTombstone},
+	{key: "user_audit_log.changes", statement: `UPDATE user_audit_log SET changes=REPLACE(changes, ?, ?) WHERE changes LIKE ?`, args: replaceUser},
+	{key: "outbox.aggregate_uuid", statement: `UPDATE outbox SET aggregate_uuid=? WHERE aggregate_uuid=?`, args: toTombstone},
+	{key: "outbox.payload", statement: `UPDATE outbox SET payload=REPLACE(payload, ?, ?) WHERE payload LIKE ?`, args: replaceUser},
+	{key: "webhook_deliveries.aggregate_uuid", statement: `UPDATE webhook_deliveries SET aggregate_uuid=? WHERE aggregate_uuid=?`, args: toTombstone},
+	{key: "webhook_deliveries.payload", statement: `UPDATE webhook_deliveries SET payload=REPLACE(payload, ?, ?) WHERE payload LIKE ?`, args: replaceUser},
+}
+
+// postgresErasureSteps are the erasure steps with the user replaced in the
+// jsonb columns through their text, as postgres has no REPLACE or LIKE on jsonb
+var postgresErasureSteps = withStatements(erasureSteps, map[string]string{
+	`UPDATE user_audit_log SET changes=REPLACE(changes, ?, ?) WHERE changes LIKE ?`:     `UPDATE user_audit_log SET changes=REPLACE(changes::TEXT, ?, ?)::JSONB WHERE changes::TEXT LIKE ?`,
+	`UPDATE outbox SET payload=REPLACE(payload, ?, ?) WHERE payload LIKE ?`:             `UPDATE outbox SET payload=REPLACE(payload::TEXT, ?, ?)::JSONB WHERE payload::TEXT LIKE ?`,
+	`UPDATE webhook_deliveries SET payload=REPLACE(payload, ?, ?) WHERE payload LIKE ?`: `UPDATE webhook_deliveries SET payload=REPLACE(payload::TEXT, ?, ?)::JSONB WHERE payload::TEXT LIKE ?`,
+})
+
+// withStatements copies the steps, swapping the statements found in replaced
+func withStatements(steps []erasureStep, replaced map[string]string) []erasureStep {
+	swapped := make([]erasureStep, len(steps))
+	for i, step := range steps {
+		if statement, ok := replaced[step.statement]; ok {
+			step.statement = statement
+		}
+		swapped[i] = step
+	}
+	return swapped
+}
+
+// erasureSteps are the steps erasing a user from the system's schema
+func (s *sqlDB) erasureSteps() []erasureStep {
+	if s.system == "postgresql" {
+		return postgresErasureSteps
+	}
+	return erasureSteps
+}
+
+// runErasureSteps runs the steps in the transaction and counts the rows each
+// key erased
+func runErasureSteps(ctx context.Context, tx *dbTx, steps []erasureStep, erasure *DBErasure) (map[string]int64, error) {
+	erased := map[string]int64{}
+	for _, step := range steps {
+		var n int64
+		var err error
+		if step.scrubQuery != "" {
+			n, err = scrubUserEvents(ctx, tx, step, erasure)
+		} else {
+			var res sql.Result
+			if res, err = tx.ExecContext(ctx, step.statement, step.args(erasure)...); err == nil {
+				n, err = res.RowsAffected()
+			}
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to erase %s", step.key)
+		}
+		erased[step.key] += n
+	}
+	return erased, nil
+}
+
+// scrubUserEvents blanks the user's details out of the payloads of the user
+// events the step lists and swaps their uuid for the tombstone
+func scrubUserEvents(ctx context.Context, tx *dbTx, step erasureStep, erasure *DBErasure) (int64, error) {
+	rows, err := tx.QueryContext(ctx, step.scrubQuery, step.args(erasure)...)
+	if err != nil {
+		return 0, err
+	}
+	payloads := map[string][]byte{}
+	for rows.Next() {
+		var id string
+		var payload []byte
+		if err := rows.Scan(&id, &payload); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		payloads[id] = payload
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	for id, payload := range payloads {
+		scrubbed, err := scrubUserPayload(payload, erasure)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := tx.ExecContext(ctx, step.statement, string(scrubbed), id); err != nil {
+			return 0, err
+		}
+	}
+	return int64(len(payloads)), nil
+}
+
+const getErasureByQuery = `
+SELECT
+	uuid,
+	user_uuid,
+	tombstone_uuid,
+	requested_by_uuid,
+	status,
+	erased,
+	created_at,
+	completed_at
+FROM
+	user_erasures
+WHERE
+	user_uuid=?
+`
+
+const countStoredUsersQuery = `
+SELECT
+	COUNT(*)
+FROM
+	users
+WHERE
+	uuid=?
+`
+
+const createErasureStatement = `
+INSERT INTO
+	user_erasures (
+		uuid,
+		user_uuid,
+		tombstone_uuid,
+		requested_by_uuid,
+		status,
+		erased,
+		created_at
+	)
+VALUES
+	(?, ?, ?, ?, ?, ?, ?)
+`
+
+// StartErasure records the erasure of its user as pending, unless the user
+// already has one, and returns the erasure recorded. The user must be
+// stored, deleted or not, to start erasing them.
+func (dr *dataRepository) StartErasure(ctx context.Context, erasure *DBErasure) (*DBErasure, error) {
+	var started *DBErasure
+	err := dr.inTx(ctx, func(tx *dbTx) error {
+		var err error
+		started, err = startErasure(ctx, tx, getErasureByQuery, countStoredUsersQuery, createErasureStatement, erasure)
+		return err
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to start erasure of user %s", erasure.UserUUID)
+	}
+	return started, nil
+}
+
+// startErasure runs the queries returning the user's erasure, or recording
+// it when there is none
+func startErasure(ctx context.Context, tx *dbTx, getQuery, countQuery, createStatement string, erasure *DBErasure) (*DBErasure, error) {
+	started, err := scanErasure(tx.QueryRowContext(ctx, getQuery, erasure.UserUUID))
+	if err != sql.ErrNoRows {
+		return started, err
+	}
+	var stored int
+	if err := tx.QueryRowContext(ctx, countQuery, erasure.UserUUID).Scan(&stored); err != nil {
+		return nil, errors.Wrap(err, "failed to look up user")
+	}
+	if stored == 0 {
+		return nil, sql.ErrNoRows
+	}
+	_, err = tx.ExecContext(ctx, createStatement,
+		erasure.UUID,
+		erasure.UserUUID,
+		erasure.TombstoneUUID,
+		erasure.RequestedByUUID,
+		erasure.Status,
+		"{}",
+		unixTime(erasure.CreatedAt),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to execute statement to record erasure")
+	}
+	return erasure, nil
+}
+
+const completeErasureStatement = `
+UPDATE
+	user_erasures
+SET
+	status=?,
+	erased=?,
+	completed_at=?
+WHERE
+	uuid=? AND status=?
+`
+
+// EraseUser erases the user of the pending erasure in one transaction, which
+// also audits the erasure under the tombstone, records the event telling
+// other services to erase the user and completes the erasure with what it
+// erased. An erasure completed meanwhile is left as it is.
+func (dr *dataRepository) EraseUser(ctx context.Context, erasure *DBErasure, erasedAt int64) error {
+	err := dr.inTx(ctx, func(tx *dbTx) error {
+		erased, err := runErasureSteps(ctx, tx, dr.erasureSteps(), erasure)
+		if err != nil {
+			return err
+		}
+		if err := dr.recordAudit(ctx, tx, AuditUserErased, erasure.TombstoneUUID, erasedActor(erasure), erasedAt); err != nil {
+			return err
+		}
+		event, err := newErasedEvent(erasure, erasedAt)
+		if err != nil {
+			return err
+		}
+		if err := dr.recordEvent(ctx, tx, event); err != nil {
+			return err
+		}
+		return completeErasure(ctx, tx, completeErasureStatement, erasure, erased, erasedAt)
+	})
+	if errors.Cause(err) == errErasureCompleted {
+		return nil
+	}
+	return errors.Wrapf(err, "failed to erase user %s", erasure.UserUUID)
+}
+
+// completeErasure runs the statement completing the pending erasure with
+// what it erased
+func completeErasure(ctx context.Context, tx *dbTx, statement string, erasure *DBErasure, erased map[string]int64, erasedAt int64) error {
+	raw, err := json.Marshal(erased)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal what was erased")
+	}
+	res, err := tx.ExecContext(ctx, statement, ErasureCompleted, string(raw), unixTime(erasedAt), erasure.UUID, ErasurePending)
+	if err != nil {
+		return errors.Wrap(err, "failed to execute statement to complete erasure")
+	}
+	if affected, err := res.RowsAffected(); err == nil && affected == 0 {
+		return errErasureCompleted
+	}
+	return nil
+}
+
+// GetErasure gets the erasure of the user
+func (dr *dataRepository) GetErasure(ctx context.Context, userUUID string) (*DBErasure, error) {
+	erasure, err := scanErasure(dr.queryRow(ctx, getErasureByQuery, userUUID))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to find erasure of user %s", userUUID)
+	}
+	return erasure, nil
+}
+
+func scanErasure(row scanner) (*DBErasure, error) {
+	erasure := &DBErasure{}
+	var erased []byte
+	err := row.Scan(
+		&erasure.UUID,
+		&erasure.UserUUID,
+		&erasure.TombstoneUUID,
+		&erasure.RequestedByUUID,
+		&erasure.Status,
+		&erased,
+		&erasure.CreatedAt,
+		&erasure.CompletedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(erased, &erasure.Erased); err != nil {
+		return nil, errors.Wrapf(err, "failed to unmarshal what erasure %s erased", erasure.UUID)
+	}
+	return erasure, nil
+}
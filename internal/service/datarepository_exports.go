@@ -0,0 +1,203 @@
+package service
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+const createDataExportStatement = `
+INSERT INTO
+	data_exports (
+		uuid,
+		user_uuid,
+		requested_by_uuid,
+		format,
+		status,
+		claimed_until,
+		size,
+		error,
+		created_at
+	)
+VALUES
+	(?, ?, ?, ?, ?, ?, ?, ?, ?)
+`
+
+// CreateDataExport queues an export to be built
+func (dr *dataRepository) CreateDataExport(ctx context.Context, export *DBDataExport) error {
+	_, err := dr.execStatement(ctx, createDataExportStatement,
+		export.UUID,
+		export.UserUUID,
+		export.RequestedByUUID,
+		export.Format,
+		export.Status,
+		unixTime(export.ClaimedUntil),
+		export.Size,
+		export.Error,
+		unixTime(export.CreatedAt),
+	)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create data export %s", export.UUID)
+	}
+	return nil
+}
+
+const getDataExportByQuery = `
+SELECT
+	uuid,
+	user_uuid,
+	requested_by_uuid,
+	format,
+	status,
+	claimed_until,
+	size,
+	error,
+	created_at,
+	completed_at
+FROM
+	data_exports
+
+`
+
+// GetDataExport gets the data export by its id, without its data
+func (dr *dataRepository) GetDataExport(ctx context.Context, exportUUID string) (*DBDataExport, error) {
+	export, err := scanDataExport(dr.queryRow(ctx, getDataExportByQuery+`WHERE uuid=?`, exportUUID))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to find data export with ID %s", exportUUID)
+	}
+	return export, nil
+}
+
+const getDataExportDataQuery = `
+SELECT
+	data
+FROM
+	data_exports
+WHERE
+	uuid=? AND status=?
+`
+
+// GetDataExportData gets the built data of the ready export
+func (dr *dataRepository) GetDataExportData(ctx context.Context, exportUUID string) ([]byte, error) {
+	var data []byte
+	if err := dr.queryRow(ctx, getDataExportDataQuery, exportUUID, ExportReady).Scan(&data); err != nil {
+		return nil, errors.Wrapf(err, "failed to read data of data export %s", exportUUID)
+	}
+	return data, nil
+}
+
+// ListPendingDataExports lists the pending exports not claimed past now, the
+// oldest first
+func (dr *dataRepository) ListPendingDataExports(ctx context.Context, now int64, limit int) ([]*DBDataExport, error) {
+	listQuery := getDataExportByQuery + `WHERE status=? AND claimed_until<=? ORDER BY created_at, uuid LIMIT ?`
+	exports, err := dr.listDataExports(ctx, listQuery, ExportPending, unixTime(now), limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list pending data exports")
+	}
+	return exports, nil
+}
+
+func (s *sqlDB) listDataExports(ctx context.Context, query string, args ...interface{}) ([]*DBDataExport, error) {
+	rows, err := s.query(ctx, query, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query")
+	}
+	defer rows.Close()
+	var exports []*DBDataExport
+	for rows.Next() {
+		export, err := scanDataExport(rows)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to scan data export")
+		}
+		exports = append(exports, export)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to read rows")
+	}
+	return exports, nil
+}
+
+func scanDataExport(row scanner) (*DBDataExport, error) {
+	export := &DBDataExport{}
+	err := row.Scan(
+		&export.UUID,
+		&export.UserUUID,
+		&export.RequestedByUUID,
+		&export.Format,
+		&export.Status,
+		&export.ClaimedUntil,
+		&export.Size,
+		&export.Error,
+		&export.CreatedAt,
+		&export.CompletedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return export, nil
+}
+
+const claimDataExportStatement = `
+UPDATE
+	data_exports
+SET
+	claimed_until=?
+WHERE
+	uuid=? AND status=? AND claimed_until=?
+`
+
+// ClaimDataExport claims the pending export for building by moving its
+// claim to claimedUntil, so no other runner builds it in the meantime. It
+// reports whether the export was still claimed until claimedSince, as when
+// it was listed, and so was claimed.
+func (dr *dataRepository) ClaimDataExport(ctx context.Context, exportUUID string, claimedSince, claimedUntil int64) (bool, error) {
+	claimed, err := dr.execStatement(ctx, claimDataExportStatement, unixTime(claimedUntil), exportUUID, ExportPending, unixTime(claimedSince))
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to claim data export %s", exportUUID)
+	}
+	return claimed == 1, nil
+}
+
+const completeDataExportStatement = `
+UPDATE
+	data_exports
+SET
+	status=?,
+	data=?,
+	size=?,
+	error=?,
+	completed_at=?
+WHERE
+	uuid=?
+`
+
+// CompleteDataExport records the export as built, with its data, or as
+// failed, with its error
+func (dr *dataRepository) CompleteDataExport(ctx context.Context, export *DBDataExport) error {
+	_, err := dr.execStatement(ctx, completeDataExportStatement,
+		export.Status,
+		export.Data,
+		export.Size,
+		export.Error,
+		nullUnixTime(export.CompletedAt),
+		export.UUID,
+	)
+	return errors.Wrapf(err, "failed to complete data export %s", export.UUID)
+}
+
+const pruneDataExportsStatement = `
+DELETE FROM
+	data_exports
+WHERE
+	status<>? AND completed_at<?
+`
+
+// PruneDataExports deletes the exports completed before the given time, data
+// and all, and returns how many it deleted
+func (dr *dataRepository) PruneDataExports(ctx context.Context, completedBefore int64) (int64, error) {
+	pruned, err := dr.execStatement(ctx, pruneDataExportsStatement, ExportPending, unixTime(completedBefore))
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to prune data exports")
+	}
+	return pruned, nil
+}
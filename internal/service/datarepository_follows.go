@@ -0,0 +1,93 @@
+package service
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+const listUserFollowsQuery = `
+SELECT
+	followed_uuid
+FROM
+	user_user_follows
+WHERE
+	follower_uuid=?
+ORDER BY
+	followed_uuid
+`
+
+// ListUserFollows lists the uuids of the users the user follows
+func (dr *dataRepository) ListUserFollows(ctx context.Context, followerUUID string) ([]string, error) {
+	followed, err := dr.listUUIDs(ctx, listUserFollowsQuery, followerUUID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list users followed by %s", followerUUID)
+	}
+	return followed, nil
+}
+
+const listSourceFollowsQuery = `
+SELECT
+	followed_uuid
+FROM
+	user_source_follows
+WHERE
+	follower_uuid=?
+ORDER BY
+	followed_uuid
+`
+
+// ListSourceFollows lists the uuids of the sources the user follows
+func (dr *dataRepository) ListSourceFollows(ctx context.Context, followerUUID string) ([]string, error) {
+	followed, err := dr.listUUIDs(ctx, listSourceFollowsQuery, followerUUID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list sources followed by %s", followerUUID)
+	}
+	return followed, nil
+}
+
+const listUserFollowersQuery = `
+SELECT
+	follower_uuid
+FROM
+	user_user_follows
+WHERE
+	followed_uuid=?
+ORDER BY
+	follower_uuid
+`
+
+// ListUserFollowers lists the uuids of the users following the user
+func (dr *dataRepository) ListUserFollowers(ctx context.Context, followedUUID string) ([]string, error) {
+	followers, err := dr.listUUIDs(ctx, listUserFollowersQuery, followedUUID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list followers of %s", followedUUID)
+	}
+	return followers, nil
+}
+
+// listUUIDs runs a query selecting a single uuid column
+func (s *sqlDB) listUUIDs(ctx context.Context, query string, args ...interface{}) ([]string, error) {
+	rows, err := s.query(ctx, query, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query")
+	}
+	return scanStrings(rows)
+}
+
+// scanStrings reads the single string column of the rows and closes them
+func scanStrings(rows *dbRows) ([]string, error) {
+	defer rows.Close()
+	var values []string
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, errors.Wrap(err, "failed to scan row")
+		}
+		values = append(values, value)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to read rows")
+	}
+	return values, nil
+}
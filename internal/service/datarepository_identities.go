@@ -0,0 +1,154 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/pkg/errors"
+)
+
+const getIdentityByQuery = `
+SELECT
+	provider,
+	subject,
+	user_uuid,
+	email,
+	created_at,
+	created_by_uuid
+FROM
+	user_identities
+
+`
+
+// GetIdentity gets the identity linked for the provider and subject
+func (dr *dataRepository) GetIdentity(ctx context.Context, provider, subject string) (*DBIdentity, error) {
+	getQuery := getIdentityByQuery + `WHERE provider=? AND subject=?`
+	identity, err := scanIdentity(dr.queryRow(ctx, getQuery, provider, subject))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to find identity %s/%s", provider, subject)
+	}
+	return identity, nil
+}
+
+// ListIdentitiesForUser lists the identities linked to the user
+func (dr *dataRepository) ListIdentitiesForUser(ctx context.Context, userUUID string) ([]*DBIdentity, error) {
+	listQuery := getIdentityByQuery + `WHERE user_uuid=? ORDER BY created_at`
+	rows, err := dr.query(ctx, listQuery, userUUID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list identities for user %s", userUUID)
+	}
+	defer rows.Close()
+	var identities []*DBIdentity
+	for rows.Next() {
+		identity, err := scanIdentity(rows)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to scan identity for user %s", userUUID)
+		}
+		identities = append(identities, identity)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrapf(err, "failed to list identities for user %s", userUUID)
+	}
+	return identities, nil
+}
+
+func scanIdentity(row scanner) (*DBIdentity, error) {
+	identity := &DBIdentity{}
+	err := row.Scan(
+		&identity.Provider,
+		&identity.Subject,
+		&identity.UserUUID,
+		&identity.Email,
+		&identity.CreatedAt,
+		&identity.CreatedByUUID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return identity, nil
+}
+
+const createIdentityStatement = `
+INSERT INTO
+	user_identities (
+		provider,
+		subject,
+		user_uuid,
+		email,
+		created_at,
+		created_by_uuid
+	)
+VALUES
+	(?, ?, ?, ?, ?, ?)
+`
+
+// CreateIdentity links an identity to a user
+func (dr *dataRepository) CreateIdentity(ctx context.Context, identity *DBIdentity) error {
+	_, err := dr.execStatement(ctx, createIdentityStatement,
+		identity.Provider,
+		identity.Subject,
+		identity.UserUUID,
+		identity.Email,
+		unixTime(identity.CreatedAt),
+		identity.CreatedByUUID,
+	)
+	if err != nil {
+		return errors.Wrapf(err, "failed to link identity %s/%s", identity.Provider, identity.Subject)
+	}
+	return nil
+}
+
+// CreateUserWithIdentity creates a user and links the identity to them in one transaction
+func (dr *dataRepository) CreateUserWithIdentity(ctx context.Context, user *DBUser, identity *DBIdentity) error {
+	err := dr.inTx(ctx, func(tx *dbTx) error {
+		_, err := tx.ExecContext(ctx, createUserStatement,
+			user.UUID,
+			user.Username,
+			user.Email,
+			user.HashedPassword,
+			user.DisplayName,
+			user.CreatedByUUID,
+			unixTime(user.CreatedAt),
+			user.UpdatedByUUID.String,
+			unixTime(user.UpdatedAt.Int64),
+		)
+		if err != nil {
+			return errors.Wrap(err, "failed to execute statement to create user")
+		}
+		_, err = tx.ExecContext(ctx, createIdentityStatement,
+			identity.Provider,
+			identity.Subject,
+			identity.UserUUID,
+			identity.Email,
+			unixTime(identity.CreatedAt),
+			identity.CreatedByUUID,
+		)
+		if err != nil {
+			return errors.Wrap(err, "failed to execute statement to link identity")
+		}
+		return dr.recordUserCreated(ctx, tx, user)
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to create user %s with identity %s/%s", user.UUID, identity.Provider, identity.Subject)
+	}
+	return nil
+}
+
+const deleteIdentityStatement = `
+DELETE FROM
+	user_identities
+WHERE
+	user_uuid=? AND provider=? AND subject=?
+`
+
+// DeleteIdentity unlinks an identity from a user
+func (dr *dataRepository) DeleteIdentity(ctx context.Context, userUUID, provider, subject string) error {
+	affected, err := dr.execStatement(ctx, deleteIdentityStatement, userUUID, provider, subject)
+	if err != nil {
+		return errors.Wrapf(err, "failed to unlink identity %s/%s", provider, subject)
+	}
+	if affected == 0 {
+		return errors.Wrapf(sql.ErrNoRows, "failed to find identity %s/%s for user %s", provider, subject, userUUID)
+	}
+	return nil
+}
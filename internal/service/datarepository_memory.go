@@ -0,0 +1,1549 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrDuplicate is returned when a record clashes with a unique key of one already stored
+var ErrDuplicate = errors.New("duplicate entry")
+
+type followEdge struct {
+	follower string
+	followed string
+}
+
+type blockEdge struct {
+	blocker string
+	blocked string
+}
+
+type identityKey struct {
+	provider string
+	subject  string
+}
+
+type memoryDataRepository struct {
+	mu            sync.RWMutex
+	users         map[string]*DBUser
+	userFollows   map[followEdge]bool
+	sourceFollows map[followEdge]bool
+	blocks        map[blockEdge]int64
+	sessions      map[string]*DBSession
+	identities    map[identityKey]*DBIdentity
+	roles         map[string]map[string]*DBRole
+
+	events         []*DBEvent
+	lastEventID    int64
+	prunedEventID  int64
+	leaseHolder    string
+	leaseExpiresAt int64
+
+	webhooks   map[string]*DBWebhook
+	deliveries map[string]*DBWebhookDelivery
+
+	audit       []*DBAuditEntry
+	lastAuditID int64
+
+	exports map[string]*DBDataExport
+
+	erasures map[string]*DBErasure
+}
+
+// NewMemoryDataRepository news up a data repo that keeps everything in memory,
+// for tests and local development. It keeps to the same rules as the mysql
+// data repo: unique keys, lookups that miss wrap sql.ErrNoRows, deleted users
+// are hidden and give up their username and email, follow and block edges
+// need the users they join to exist and following or blocking twice does
+// nothing.
+func NewMemoryDataRepository() DataRepository {
+	return &memoryDataRepository{
+		users:         map[string]*DBUser{},
+		userFollows:   map[followEdge]bool{},
+		sourceFollows: map[followEdge]bool{},
+		blocks:        map[blockEdge]int64{},
+		sessions:      map[string]*DBSession{},
+		identities:    map[identityKey]*DBIdentity{},
+		roles:         map[string]map[string]*DBRole{},
+		webhooks:      map[string]*DBWebhook{},
+		deliveries:    map[string]*DBWebhookDelivery{},
+		exports:       map[string]*DBDataExport{},
+		erasures:      map[string]*DBErasure{},
+	}
+}
+
+// Ping always succeeds since there is nothing to reach
+func (mr *memoryDataRepository) Ping(ctx context.Context) error {
+	return ctx.Err()
+}
+
+// GetUserByID gets the user by its id
+func (mr *memoryDataRepository) GetUserByID(ctx context.Context, uuid string) (*DBUser, error) {
+	return mr.getUser(ctx, func(u *DBUser) bool { return u.UUID == uuid }, uuid)
+}
+
+// GetUserByUsername gets the user by its username
+func (mr *memoryDataRepository) GetUserByUsername(ctx context.Context, username string) (*DBUser, error) {
+	return mr.getUser(ctx, func(u *DBUser) bool { return u.Username == username }, username)
+}
+
+// GetUserByEmail gets the user by its email
+func (mr *memoryDataRepository) GetUserByEmail(ctx context.Context, email string) (*DBUser, error) {
+	return mr.getUser(ctx, func(u *DBUser) bool { return u.Email == email }, email)
+}
+
+func (mr *memoryDataRepository) getUser(ctx context.Context, match func(*DBUser) bool, param string) (*DBUser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+	for _, user := range mr.users {
+		if !user.DeletedAt.Valid && match(user) {
+			return mr.copyUser(user), nil
+		}
+	}
+	return nil, errors.Wrapf(sql.ErrNoRows, "failed to find user with param %s", param)
+}
+
+// copyUser copies the stored user along with its roles, so callers can't change what is stored
+func (mr *memoryDataRepository) copyUser(user *DBUser) *DBUser {
+	copied := *user
+	copied.Roles = mr.userRoles(user.UUID)
+	return &copied
+}
+
+func (mr *memoryDataRepository) userRoles(userUUID string) []string {
+	var roles []string
+	for role := range mr.roles[userUUID] {
+		roles = append(roles, role)
+	}
+	sort.Strings(roles)
+	return roles
+}
+
+// ValidateUserForCreate validates user fields against the data repo for create
+func (mr *memoryDataRepository) ValidateUserForCreate(ctx context.Context, user *DBUser) bool {
+	if checkUser, _ := mr.GetUserByEmail(ctx, user.Email); checkUser != nil {
+		return false
+	}
+	if checkUser, _ := mr.GetUserByUsername(ctx, user.Username); checkUser != nil {
+		return false
+	}
+	return true
+}
+
+// CreateUser creates a user
+func (mr *memoryDataRepository) CreateUser(ctx context.Context, user *DBUser) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	if err := mr.createUser(user); err != nil {
+		return err
+	}
+	if err := mr.recordAudit(ctx, AuditUserCreated, user.UUID, user.CreatedByUUID, user.CreatedAt, createdChanges(user)...); err != nil {
+		return err
+	}
+	return mr.recordUserEvent(EventUserCreated, user.UUID, user.CreatedByUUID, user.CreatedAt)
+}
+
+// createUser stores the user. Usernames and emails only have to be unique
+// among the users not deleted, like the unique indexes on them.
+func (mr *memoryDataRepository) createUser(user *DBUser) error {
+	for _, existing := range mr.users {
+		active := !existing.DeletedAt.Valid
+		if existing.UUID == user.UUID || (active && (existing.Username == user.Username || existing.Email == user.Email)) {
+			return errors.Wrapf(ErrDuplicate, "failed to create user %s", user.UUID)
+		}
+	}
+	stored := *user
+	stored.Roles = nil
+	mr.users[user.UUID] = &stored
+	return nil
+}
+
+// AddUserFollower adds a user follow relationship
+func (mr *memoryDataRepository) AddUserFollower(ctx context.Context, follower, followed string) error {
+	return mr.addFollow(ctx, mr.userFollows, follower, followed, FollowedUser)
+}
+
+// RemoveUserFollower removes a user follow relationship
+func (mr *memoryDataRepository) RemoveUserFollower(ctx context.Context, follower, followed string) error {
+	return mr.removeFollow(ctx, mr.userFollows, follower, followed, FollowedUser)
+}
+
+// AddSourceFollower adds a source follow relationship
+func (mr *memoryDataRepository) AddSourceFollower(ctx context.Context, follower, followed string) error {
+	return mr.addFollow(ctx, mr.sourceFollows, follower, followed, FollowedSource)
+}
+
+// RemoveSourceFollower removes a source follow relationship
+func (mr *memoryDataRepository) RemoveSourceFollower(ctx context.Context, follower, followed string) error {
+	return mr.removeFollow(ctx, mr.sourceFollows, follower, followed, FollowedSource)
+}
+
+// addFollow adds the edge, checking the users it joins exist the way the
+// foreign keys do. Sources live in another service so only the follower is
+// checked for source follows. Adding an edge already there does nothing.
+func (mr *memoryDataRepository) addFollow(ctx context.Context, edges map[followEdge]bool, follower, followed, followedType string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	if _, ok := mr.users[follower]; !ok {
+		return errors.Wrapf(sql.ErrNoRows, "failed to find follower %s", follower)
+	}
+	if _, ok := mr.users[followed]; followedType == FollowedUser && !ok {
+		return errors.Wrapf(sql.ErrNoRows, "failed to find followed %s", followed)
+	}
+	edge := followEdge{follower: follower, followed: followed}
+	if edges[edge] {
+		return nil
+	}
+	edges[edge] = true
+	return mr.recordFollowEvent(ctx, EventFollowAdded, follower, followed, followedType)
+}
+
+func (mr *memoryDataRepository) removeFollow(ctx context.Context, edges map[followEdge]bool, follower, followed, followedType string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	edge := followEdge{follower: follower, followed: followed}
+	if !edges[edge] {
+		return nil
+	}
+	delete(edges, edge)
+	return mr.recordFollowEvent(ctx, EventFollowRemoved, follower, followed, followedType)
+}
+
+// ListUserFollows lists the uuids of the users the user follows
+func (mr *memoryDataRepository) ListUserFollows(ctx context.Context, followerUUID string) ([]string, error) {
+	return mr.listFollows(ctx, mr.userFollows, func(edge followEdge) (string, bool) {
+		return edge.followed, edge.follower == followerUUID
+	})
+}
+
+// ListSourceFollows lists the uuids of the sources the user follows
+func (mr *memoryDataRepository) ListSourceFollows(ctx context.Context, followerUUID string) ([]string, error) {
+	return mr.listFollows(ctx, mr.sourceFollows, func(edge followEdge) (string, bool) {
+		return edge.followed, edge.follower == followerUUID
+	})
+}
+
+// ListUserFollowers lists the uuids of the users following the user
+func (mr *memoryDataRepository) ListUserFollowers(ctx context.Context, followedUUID string) ([]string, error) {
+	return mr.listFollows(ctx, mr.userFollows, func(edge followEdge) (string, bool) {
+		return edge.follower, edge.followed == followedUUID
+	})
+}
+
+// listFollows picks a uuid from every matching edge, sorted like the sql
+// queries sort them
+func (mr *memoryDataRepository) listFollows(ctx context.Context, edges map[followEdge]bool, pick func(followEdge) (string, bool)) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+	var uuids []string
+	for edge := range edges {
+		if id, ok := pick(edge); ok {
+			uuids = append(uuids, id)
+		}
+	}
+	sort.Strings(uuids)
+	return uuids, nil
+}
+
+// BlockUser records the blocker blocking the blocked user. Blocking a user
+// already blocked does nothing.
+func (mr *memoryDataRepository) BlockUser(ctx context.Context, blockerUUID, blockedUUID string, blockedAt int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	if _, ok := mr.users[blockerUUID]; !ok {
+		return errors.Wrapf(sql.ErrNoRows, "failed to find blocker %s", blockerUUID)
+	}
+	if _, ok := mr.users[blockedUUID]; !ok {
+		return errors.Wrapf(sql.ErrNoRows, "failed to find blocked %s", blockedUUID)
+	}
+	edge := blockEdge{blocker: blockerUUID, blocked: blockedUUID}
+	if _, ok := mr.blocks[edge]; !ok {
+		mr.blocks[edge] = blockedAt
+	}
+	return nil
+}
+
+// UnblockUser lifts the blocker's block of the blocked user. Unblocking a
+// user not blocked does nothing.
+func (mr *memoryDataRepository) UnblockUser(ctx context.Context, blockerUUID, blockedUUID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	delete(mr.blocks, blockEdge{blocker: blockerUUID, blocked: blockedUUID})
+	return nil
+}
+
+// ListUserBlocks lists the uuids of the users the user blocked
+func (mr *memoryDataRepository) ListUserBlocks(ctx context.Context, blockerUUID string) ([]string, error) {
+	return mr.listBlocks(ctx, func(edge blockEdge) (string, bool) {
+		return edge.blocked, edge.blocker == blockerUUID
+	})
+}
+
+// ListUserBlockers lists the uuids of the users who blocked the user
+func (mr *memoryDataRepository) ListUserBlockers(ctx context.Context, blockedUUID string) ([]string, error) {
+	return mr.listBlocks(ctx, func(edge blockEdge) (string, bool) {
+		return edge.blocker, edge.blocked == blockedUUID
+	})
+}
+
+// listBlocks picks a uuid from every matching block, sorted like the sql
+// queries sort them
+func (mr *memoryDataRepository) listBlocks(ctx context.Context, pick func(blockEdge) (string, bool)) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+	var uuids []string
+	for edge := range mr.blocks {
+		if id, ok := pick(edge); ok {
+			uuids = append(uuids, id)
+		}
+	}
+	sort.Strings(uuids)
+	return uuids, nil
+}
+
+// UpdateUserPassword sets the user's password and revokes all of their sessions
+func (mr *memoryDataRepository) UpdateUserPassword(ctx context.Context, userUUID, hashedPassword, updatedByUUID string, updatedAt int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	user, ok := mr.users[userUUID]
+	if !ok {
+		return errors.Wrapf(sql.ErrNoRows, "failed to update password for user %s", userUUID)
+	}
+	user.HashedPassword = hashedPassword
+	mr.touchUser(user, updatedByUUID, updatedAt)
+	mr.revokeAllSessions(userUUID, updatedAt)
+	if err := mr.recordAudit(ctx, AuditPasswordChanged, userUUID, updatedByUUID, updatedAt, AuditChange{Field: ChangedPassword}); err != nil {
+		return err
+	}
+	return mr.recordUserEvent(EventUserUpdated, userUUID, updatedByUUID, updatedAt, ChangedPassword)
+}
+
+// RecordFailedLogin counts a failed login and locks the user until
+// lockedUntil once the threshold is reached. A lock that ran out by now is
+// cleared first, so the count starts again from this attempt.
+func (mr *memoryDataRepository) RecordFailedLogin(ctx context.Context, userUUID string, threshold int, now, lockedUntil int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	user, ok := mr.users[userUUID]
+	if !ok {
+		return nil
+	}
+	if user.LockedUntil.Valid && user.LockedUntil.Int64 <= now {
+		user.FailedLoginAttempts = 0
+		user.LockedUntil = sql.NullInt64{}
+	}
+	if threshold > 0 && user.FailedLoginAttempts+1 >= threshold {
+		user.LockedUntil = sql.NullInt64{Valid: true, Int64: lockedUntil}
+	}
+	user.FailedLoginAttempts++
+	return nil
+}
+
+// ResetFailedLogins clears the failed login count after a successful login
+func (mr *memoryDataRepository) ResetFailedLogins(ctx context.Context, userUUID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	if user, ok := mr.users[userUUID]; ok {
+		user.FailedLoginAttempts = 0
+	}
+	return nil
+}
+
+// UnlockUser lifts a lockout from the user
+func (mr *memoryDataRepository) UnlockUser(ctx context.Context, userUUID, updatedByUUID string, updatedAt int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	user, ok := mr.users[userUUID]
+	if !ok || user.DeletedAt.Valid {
+		return errors.Wrapf(sql.ErrNoRows, "failed to unlock user %s", userUUID)
+	}
+	changes := unlockChanges(user)
+	user.FailedLoginAttempts = 0
+	user.LockedUntil = sql.NullInt64{}
+	mr.touchUser(user, updatedByUUID, updatedAt)
+	if err := mr.recordAudit(ctx, AuditUserUnlocked, userUUID, updatedByUUID, updatedAt, changes...); err != nil {
+		return err
+	}
+	return mr.recordUserEvent(EventUserUpdated, userUUID, updatedByUUID, updatedAt, ChangedLockout)
+}
+
+// DeleteUser marks the user deleted and revokes all of their sessions
+func (mr *memoryDataRepository) DeleteUser(ctx context.Context, userUUID, deletedByUUID string, deletedAt int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	user, ok := mr.users[userUUID]
+	if !ok || user.DeletedAt.Valid {
+		return errors.Wrapf(sql.ErrNoRows, "failed to delete user %s", userUUID)
+	}
+	user.DeletedAt = sql.NullInt64{Valid: true, Int64: deletedAt}
+	mr.touchUser(user, deletedByUUID, deletedAt)
+	mr.revokeAllSessions(userUUID, deletedAt)
+	if err := mr.recordAudit(ctx, AuditUserDeleted, userUUID, deletedByUUID, deletedAt, deletedChange(deletedAt)); err != nil {
+		return err
+	}
+	return mr.recordUserEvent(EventUserDeleted, userUUID, deletedByUUID, deletedAt)
+}
+
+func (mr *memoryDataRepository) touchUser(user *DBUser, updatedByUUID string, updatedAt int64) {
+	user.UpdatedByUUID = sql.NullString{Valid: true, String: updatedByUUID}
+	user.UpdatedAt = sql.NullInt64{Valid: true, Int64: updatedAt}
+}
+
+// ListRolesForUser lists the roles granted to the user
+func (mr *memoryDataRepository) ListRolesForUser(ctx context.Context, userUUID string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+	return mr.userRoles(userUUID), nil
+}
+
+// GrantRole grants the role to the user and records the granter as the
+// user's last updater. Granting a role the user already holds does nothing.
+func (mr *memoryDataRepository) GrantRole(ctx context.Context, role *DBRole) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	user, ok := mr.users[role.UserUUID]
+	if !ok {
+		return errors.Wrapf(sql.ErrNoRows, "failed to grant role %s to user %s", role.Role, role.UserUUID)
+	}
+	if _, held := mr.roles[role.UserUUID][role.Role]; held {
+		return nil
+	}
+	if mr.roles[role.UserUUID] == nil {
+		mr.roles[role.UserUUID] = map[string]*DBRole{}
+	}
+	stored := *role
+	mr.roles[role.UserUUID][role.Role] = &stored
+	mr.touchUser(user, role.CreatedByUUID, role.CreatedAt)
+	if err := mr.recordAudit(ctx, AuditRoleGranted, role.UserUUID, role.CreatedByUUID, role.CreatedAt, AuditChange{Field: AuditFieldRoles, New: role.Role}); err != nil {
+		return err
+	}
+	return mr.recordUserEvent(EventUserUpdated, role.UserUUID, role.CreatedByUUID, role.CreatedAt, ChangedRoles)
+}
+
+// RevokeRole revokes the role from the user and records the revoker as the
+// user's last updater
+func (mr *memoryDataRepository) RevokeRole(ctx context.Context, userUUID, role, revokedByUUID string, revokedAt int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	if _, held := mr.roles[userUUID][role]; !held {
+		return nil
+	}
+	delete(mr.roles[userUUID], role)
+	user, ok := mr.users[userUUID]
+	if !ok {
+		return nil
+	}
+	mr.touchUser(user, revokedByUUID, revokedAt)
+	if err := mr.recordAudit(ctx, AuditRoleRevoked, userUUID, revokedByUUID, revokedAt, AuditChange{Field: AuditFieldRoles, Old: role}); err != nil {
+		return err
+	}
+	return mr.recordUserEvent(EventUserUpdated, userUUID, revokedByUUID, revokedAt, ChangedRoles)
+}
+
+// GetIdentity gets the identity linked for the provider and subject
+func (mr *memoryDataRepository) GetIdentity(ctx context.Context, provider, subject string) (*DBIdentity, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+	identity, ok := mr.identities[identityKey{provider: provider, subject: subject}]
+	if !ok {
+		return nil, errors.Wrapf(sql.ErrNoRows, "failed to find identity %s/%s", provider, subject)
+	}
+	copied := *identity
+	return &copied, nil
+}
+
+// ListIdentitiesForUser lists the identities linked to the user
+func (mr *memoryDataRepository) ListIdentitiesForUser(ctx context.Context, userUUID string) ([]*DBIdentity, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+	var identities []*DBIdentity
+	for _, identity := range mr.identities {
+		if identity.UserUUID == userUUID {
+			copied := *identity
+			identities = append(identities, &copied)
+		}
+	}
+	sort.Slice(identities, func(i, j int) bool {
+		return identities[i].CreatedAt < identities[j].CreatedAt
+	})
+	return identities, nil
+}
+
+// CreateIdentity links an identity to a user
+func (mr *memoryDataRepository) CreateIdentity(ctx context.Context, identity *DBIdentity) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	return mr.createIdentity(identity)
+}
+
+func (mr *memoryDataRepository) createIdentity(identity *DBIdentity) error {
+	if _, ok := mr.users[identity.UserUUID]; !ok {
+		return errors.Wrapf(sql.ErrNoRows, "failed to find user %s to link identity to", identity.UserUUID)
+	}
+	key := identityKey{provider: identity.Provider, subject: identity.Subject}
+	if _, ok := mr.identities[key]; ok {
+		return errors.Wrapf(ErrDuplicate, "failed to link identity %s/%s", identity.Provider, identity.Subject)
+	}
+	stored := *identity
+	mr.identities[key] = &stored
+	return nil
+}
+
+// CreateUserWithIdentity creates a user and links the identity to them in one go
+func (mr *memoryDataRepository) CreateUserWithIdentity(ctx context.Context, user *DBUser, identity *DBIdentity) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	if _, ok := mr.identities[identityKey{provider: identity.Provider, subject: identity.Subject}]; ok {
+		return errors.Wrapf(ErrDuplicate, "failed to link identity %s/%s", identity.Provider, identity.Subject)
+	}
+	if err := mr.createUser(user); err != nil {
+		return err
+	}
+	if err := mr.createIdentity(identity); err != nil {
+		return err
+	}
+	if err := mr.recordAudit(ctx, AuditUserCreated, user.UUID, user.CreatedByUUID, user.CreatedAt, createdChanges(user)...); err != nil {
+		return err
+	}
+	return mr.recordUserEvent(EventUserCreated, user.UUID, user.CreatedByUUID, user.CreatedAt)
+}
+
+// DeleteIdentity unlinks an identity from a user
+func (mr *memoryDataRepository) DeleteIdentity(ctx context.Context, userUUID, provider, subject string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	key := identityKey{provider: provider, subject: subject}
+	identity, ok := mr.identities[key]
+	if !ok || identity.UserUUID != userUUID {
+		return errors.Wrapf(sql.ErrNoRows, "failed to find identity %s/%s for user %s", provider, subject, userUUID)
+	}
+	delete(mr.identities, key)
+	return nil
+}
+
+// CreateSession creates a session
+func (mr *memoryDataRepository) CreateSession(ctx context.Context, session *DBSession) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	if _, ok := mr.users[session.UserUUID]; !ok {
+		return errors.Wrapf(sql.ErrNoRows, "failed to find user %s to create session for", session.UserUUID)
+	}
+	for _, existing := range mr.sessions {
+		if existing.UUID == session.UUID || existing.RefreshTokenHash == session.RefreshTokenHash {
+			return errors.Wrapf(ErrDuplicate, "failed to create session %s", session.UUID)
+		}
+	}
+	stored := *session
+	stored.PreviousRefreshTokenHash = sql.NullString{}
+	stored.RevokedAt = sql.NullInt64{}
+	mr.sessions[session.UUID] = &stored
+	return nil
+}
+
+// GetSessionByID gets the session by its id
+func (mr *memoryDataRepository) GetSessionByID(ctx context.Context, uuid string) (*DBSession, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+	session, ok := mr.sessions[uuid]
+	if !ok {
+		return nil, errors.Wrapf(sql.ErrNoRows, "failed to find session with ID %s", uuid)
+	}
+	copied := *session
+	return &copied, nil
+}
+
+// GetSessionByRefreshTokenHash gets the session that currently holds, or
+// most recently held, the refresh token hash
+func (mr *memoryDataRepository) GetSessionByRefreshTokenHash(ctx context.Context, hash string) (*DBSession, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+	for _, session := range mr.sessions {
+		if session.RefreshTokenHash == hash || (session.PreviousRefreshTokenHash.Valid && session.PreviousRefreshTokenHash.String == hash) {
+			copied := *session
+			return &copied, nil
+		}
+	}
+	return nil, errors.Wrap(sql.ErrNoRows, "failed to find session by refresh token")
+}
+
+// RotateSession swaps the session's refresh token hash for a new one. It
+// fails with ErrSessionRotated if the old hash is no longer current.
+func (mr *memoryDataRepository) RotateSession(ctx context.Context, sessionUUID, oldHash, newHash string, lastUsedAt, expiresAt int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	session, ok := mr.sessions[sessionUUID]
+	if !ok || session.RefreshTokenHash != oldHash || session.RevokedAt.Valid {
+		return errors.Wrapf(ErrSessionRotated, "failed to rotate session %s", sessionUUID)
+	}
+	session.PreviousRefreshTokenHash = sql.NullString{Valid: true, String: session.RefreshTokenHash}
+	session.RefreshTokenHash = newHash
+	session.LastUsedAt = lastUsedAt
+	session.ExpiresAt = expiresAt
+	return nil
+}
+
+// ListActiveSessionsForUser lists the sessions of the user that are not
+// revoked or expired, most recently used first
+func (mr *memoryDataRepository) ListActiveSessionsForUser(ctx context.Context, userUUID string, now int64) ([]*DBSession, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+	var sessions []*DBSession
+	for _, session := range mr.sessions {
+		if session.UserUUID == userUUID && session.IsActive(now) {
+			copied := *session
+			sessions = append(sessions, &copied)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastUsedAt > sessions[j].LastUsedAt
+	})
+	return sessions, nil
+}
+
+// ListSessionsForUser lists every session the user has had, revoked and
+// expired ones included, oldest first
+func (mr *memoryDataRepository) ListSessionsForUser(ctx context.Context, userUUID string) ([]*DBSession, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+	var sessions []*DBSession
+	for _, session := range mr.sessions {
+		if session.UserUUID == userUUID {
+			copied := *session
+			sessions = append(sessions, &copied)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		if sessions[i].CreatedAt != sessions[j].CreatedAt {
+			return sessions[i].CreatedAt < sessions[j].CreatedAt
+		}
+		return sessions[i].UUID < sessions[j].UUID
+	})
+	return sessions, nil
+}
+
+// RevokeSession revokes a single session
+func (mr *memoryDataRepository) RevokeSession(ctx context.Context, sessionUUID string, revokedAt int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	if session, ok := mr.sessions[sessionUUID]; ok && !session.RevokedAt.Valid {
+		session.RevokedAt = sql.NullInt64{Valid: true, Int64: revokedAt}
+	}
+	return nil
+}
+
+// RevokeAllSessionsForUser revokes every session the user has
+func (mr *memoryDataRepository) RevokeAllSessionsForUser(ctx context.Context, userUUID string, revokedAt int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	mr.revokeAllSessions(userUUID, revokedAt)
+	return nil
+}
+
+func (mr *memoryDataRepository) revokeAllSessions(userUUID string, revokedAt int64) {
+	for _, session := range mr.sessions {
+		if session.UserUUID == userUUID && !session.RevokedAt.Valid {
+			session.RevokedAt = sql.NullInt64{Valid: true, Int64: revokedAt}
+		}
+	}
+}
+
+// recordUserEvent records an event carrying the stored user as the change left them
+func (mr *memoryDataRepository) recordUserEvent(eventType, userUUID, actorUUID string, at int64, changed ...string) error {
+	event, err := newUserEvent(eventType, mr.users[userUUID], mr.userRoles(userUUID), actorUUID, at, changed...)
+	if err != nil {
+		return err
+	}
+	return mr.recordEvent(event)
+}
+
+// recordFollowEvent records a follow or unfollow and audits it
+func (mr *memoryDataRepository) recordFollowEvent(ctx context.Context, eventType, follower, followed, followedType string) error {
+	at := time.Now().Unix()
+	if err := mr.recordAudit(ctx, followAuditAction(eventType), follower, actorUUID(ctx), at, followChange(eventType, followed, followedType)); err != nil {
+		return err
+	}
+	event, err := newFollowEvent(eventType, follower, followed, followedType, at)
+	if err != nil {
+		return err
+	}
+	return mr.recordEvent(event)
+}
+
+// recordEvent appends the event to the outbox under the next id and queues
+// its deliveries to the webhooks subscribed to it
+func (mr *memoryDataRepository) recordEvent(event *DBEvent) error {
+	webhooks := make([]*DBWebhook, 0, len(mr.webhooks))
+	for _, webhook := range mr.webhooks {
+		webhooks = append(webhooks, webhook)
+	}
+	event.ID = mr.lastEventID + 1
+	deliveries, err := newWebhookDeliveries(event, webhooks)
+	if err != nil {
+		return err
+	}
+	mr.lastEventID++
+	mr.events = append(mr.events, event)
+	for _, delivery := range deliveries {
+		mr.deliveries[delivery.UUID] = delivery
+	}
+	return nil
+}
+
+// recordAudit appends an entry recording the action the actor took on the
+// user to the audit log under the next id
+func (mr *memoryDataRepository) recordAudit(ctx context.Context, action, userUUID, actorUUID string, at int64, changes ...AuditChange) error {
+	entry, err := newAuditEntry(ctx, action, userUUID, actorUUID, at, changes...)
+	if err != nil {
+		return err
+	}
+	mr.lastAuditID++
+	entry.ID = mr.lastAuditID
+	mr.audit = append(mr.audit, entry)
+	return nil
+}
+
+// ListPendingEvents lists the oldest events not yet published, in the order
+// they were written
+func (mr *memoryDataRepository) ListPendingEvents(ctx context.Context, limit int) ([]*DBEvent, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+	var events []*DBEvent
+	for _, event := range mr.events {
+		if len(events) == limit {
+			break
+		}
+		if !event.PublishedAt.Valid {
+			copied := *event
+			events = append(events, &copied)
+		}
+	}
+	return events, nil
+}
+
+// ListEventsAfter lists the events written after the id, published or not,
+// in the order they were written
+func (mr *memoryDataRepository) ListEventsAfter(ctx context.Context, afterID int64, limit int) ([]*DBEvent, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+	var events []*DBEvent
+	for _, event := range mr.events {
+		if len(events) == limit {
+			break
+		}
+		if event.ID > afterID {
+			copied := *event
+			events = append(events, &copied)
+		}
+	}
+	return events, nil
+}
+
+// GetEventRange gets the range of ids the outbox can still be read from
+func (mr *memoryDataRepository) GetEventRange(ctx context.Context) (*DBEventRange, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+	return &DBEventRange{PrunedID: mr.prunedEventID, LatestID: mr.lastEventID}, nil
+}
+
+// MarkEventsPublished marks the events published so they are not published again
+func (mr *memoryDataRepository) MarkEventsPublished(ctx context.Context, ids []int64, publishedAt int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	published := map[int64]bool{}
+	for _, id := range ids {
+		published[id] = true
+	}
+	for _, event := range mr.events {
+		if published[event.ID] {
+			event.PublishedAt = sql.NullInt64{Valid: true, Int64: publishedAt}
+		}
+	}
+	return nil
+}
+
+// PruneEvents deletes the events published before the given time, moves the
+// pruned watermark up past them and returns how many it deleted. Events not
+// yet published are always kept.
+func (mr *memoryDataRepository) PruneEvents(ctx context.Context, publishedBefore int64) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	kept := mr.events[:0]
+	for _, event := range mr.events {
+		if !event.PublishedAt.Valid || event.PublishedAt.Int64 >= publishedBefore {
+			kept = append(kept, event)
+		} else if event.ID > mr.prunedEventID {
+			mr.prunedEventID = event.ID
+		}
+	}
+	pruned := int64(len(mr.events) - len(kept))
+	mr.events = kept
+	return pruned, nil
+}
+
+// AcquireOutboxLease takes the relay lease for the holder until expiresAt,
+// or extends it when the holder already has it
+func (mr *memoryDataRepository) AcquireOutboxLease(ctx context.Context, holder string, now, expiresAt int64) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	if mr.leaseHolder != holder && mr.leaseExpiresAt >= now {
+		return false, nil
+	}
+	mr.leaseHolder = holder
+	mr.leaseExpiresAt = expiresAt
+	return true, nil
+}
+
+// CreateWebhook creates a webhook subscription
+func (mr *memoryDataRepository) CreateWebhook(ctx context.Context, webhook *DBWebhook) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	if _, ok := mr.webhooks[webhook.UUID]; ok {
+		return errors.Wrapf(ErrDuplicate, "failed to create webhook %s", webhook.UUID)
+	}
+	copied := *webhook
+	mr.webhooks[webhook.UUID] = &copied
+	return nil
+}
+
+// ListWebhooks lists every webhook subscription, oldest first
+func (mr *memoryDataRepository) ListWebhooks(ctx context.Context) ([]*DBWebhook, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+	var webhooks []*DBWebhook
+	for _, webhook := range mr.webhooks {
+		copied := *webhook
+		webhooks = append(webhooks, &copied)
+	}
+	sort.Slice(webhooks, func(i, j int) bool {
+		if webhooks[i].CreatedAt != webhooks[j].CreatedAt {
+			return webhooks[i].CreatedAt < webhooks[j].CreatedAt
+		}
+		return webhooks[i].UUID < webhooks[j].UUID
+	})
+	return webhooks, nil
+}
+
+// DeleteWebhook deletes the webhook subscription along with its deliveries,
+// delivered or not
+func (mr *memoryDataRepository) DeleteWebhook(ctx context.Context, webhookUUID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	if _, ok := mr.webhooks[webhookUUID]; !ok {
+		return errors.Wrapf(sql.ErrNoRows, "failed to delete webhook %s", webhookUUID)
+	}
+	delete(mr.webhooks, webhookUUID)
+	for id, delivery := range mr.deliveries {
+		if delivery.WebhookUUID == webhookUUID {
+			delete(mr.deliveries, id)
+		}
+	}
+	return nil
+}
+
+// GetWebhookDelivery gets the webhook delivery by its id
+func (mr *memoryDataRepository) GetWebhookDelivery(ctx context.Context, deliveryUUID string) (*DBWebhookDelivery, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+	delivery, ok := mr.deliveries[deliveryUUID]
+	if !ok {
+		return nil, errors.Wrapf(sql.ErrNoRows, "failed to find webhook delivery with ID %s", deliveryUUID)
+	}
+	copied := *delivery
+	return &copied, nil
+}
+
+// ListWebhookDeliveries lists the newest deliveries to the webhook, only
+// those in the status when one is given
+func (mr *memoryDataRepository) ListWebhookDeliveries(ctx context.Context, webhookUUID, status string, limit int) ([]*DBWebhookDelivery, error) {
+	deliveries, err := mr.listWebhookDeliveries(ctx, func(d *DBWebhookDelivery) bool {
+		return d.WebhookUUID == webhookUUID && (status == "" || d.Status == status)
+	}, func(a, b *DBWebhookDelivery) bool {
+		if a.CreatedAt != b.CreatedAt {
+			return a.CreatedAt > b.CreatedAt
+		}
+		return a.EventID > b.EventID
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(deliveries) > limit {
+		deliveries = deliveries[:limit]
+	}
+	return deliveries, nil
+}
+
+// ListDueWebhookDeliveries lists the pending deliveries due by now, the
+// longest due first
+func (mr *memoryDataRepository) ListDueWebhookDeliveries(ctx context.Context, now int64, limit int) ([]*DBWebhookDelivery, error) {
+	deliveries, err := mr.listWebhookDeliveries(ctx, func(d *DBWebhookDelivery) bool {
+		return d.Status == DeliveryPending && d.NextAttemptAt <= now
+	}, func(a, b *DBWebhookDelivery) bool {
+		if a.NextAttemptAt != b.NextAttemptAt {
+			return a.NextAttemptAt < b.NextAttemptAt
+		}
+		return a.EventID < b.EventID
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(deliveries) > limit {
+		deliveries = deliveries[:limit]
+	}
+	return deliveries, nil
+}
+
+func (mr *memoryDataRepository) listWebhookDeliveries(ctx context.Context, match func(*DBWebhookDelivery) bool, less func(a, b *DBWebhookDelivery) bool) ([]*DBWebhookDelivery, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+	var deliveries []*DBWebhookDelivery
+	for _, delivery := range mr.deliveries {
+		if match(delivery) {
+			copied := *delivery
+			deliveries = append(deliveries, &copied)
+		}
+	}
+	sort.Slice(deliveries, func(i, j int) bool {
+		return less(deliveries[i], deliveries[j])
+	})
+	return deliveries, nil
+}
+
+// ClaimWebhookDelivery claims the pending delivery for an attempt by moving
+// its next attempt to claimedUntil, unless it was claimed since it was listed
+func (mr *memoryDataRepository) ClaimWebhookDelivery(ctx context.Context, deliveryUUID string, nextAttemptAt, claimedUntil int64) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	delivery, ok := mr.deliveries[deliveryUUID]
+	if !ok || delivery.Status != DeliveryPending || delivery.NextAttemptAt != nextAttemptAt {
+		return false, nil
+	}
+	delivery.NextAttemptAt = claimedUntil
+	return true, nil
+}
+
+// UpdateWebhookDelivery records the outcome of an attempt at the delivery
+func (mr *memoryDataRepository) UpdateWebhookDelivery(ctx context.Context, delivery *DBWebhookDelivery) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	stored, ok := mr.deliveries[delivery.UUID]
+	if !ok {
+		return nil
+	}
+	stored.Status = delivery.Status
+	stored.Attempts = delivery.Attempts
+	stored.NextAttemptAt = delivery.NextAttemptAt
+	stored.LastError = delivery.LastError
+	stored.LastStatusCode = delivery.LastStatusCode
+	stored.DeliveredAt = delivery.DeliveredAt
+	return nil
+}
+
+// RedeliverWebhookDelivery queues the delivery to be attempted again from
+// now with a fresh set of attempts, whatever state it is in
+func (mr *memoryDataRepository) RedeliverWebhookDelivery(ctx context.Context, deliveryUUID string, now int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	if delivery, ok := mr.deliveries[deliveryUUID]; ok {
+		delivery.Status = DeliveryPending
+		delivery.Attempts = 0
+		delivery.NextAttemptAt = now
+		delivery.DeliveredAt = sql.NullInt64{}
+	}
+	return nil
+}
+
+// PruneWebhookDeliveries deletes the deliveries delivered before the given
+// time and returns how many it deleted
+func (mr *memoryDataRepository) PruneWebhookDeliveries(ctx context.Context, deliveredBefore int64) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	var pruned int64
+	for id, delivery := range mr.deliveries {
+		if delivery.Status == DeliveryDelivered && delivery.DeliveredAt.Int64 < deliveredBefore {
+			delete(mr.deliveries, id)
+			pruned++
+		}
+	}
+	return pruned, nil
+}
+
+// ListAuditEntries lists the newest entries of the audit log on the user,
+// by the actor or both, from before the id when it is set
+func (mr *memoryDataRepository) ListAuditEntries(ctx context.Context, userUUID, actorUUID string, beforeID int64, limit int) ([]*DBAuditEntry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+	var entries []*DBAuditEntry
+	for i := len(mr.audit) - 1; i >= 0 && len(entries) < limit; i-- {
+		entry := mr.audit[i]
+		if (userUUID != "" && entry.UserUUID != userUUID) || (actorUUID != "" && entry.ActorUUID != actorUUID) || (beforeID != 0 && entry.ID >= beforeID) {
+			continue
+		}
+		copied := *entry
+		entries = append(entries, &copied)
+	}
+	return entries, nil
+}
+
+// CreateDataExport queues an export to be built
+func (mr *memoryDataRepository) CreateDataExport(ctx context.Context, export *DBDataExport) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	if _, ok := mr.exports[export.UUID]; ok {
+		return errors.Wrapf(ErrDuplicate, "failed to create data export %s", export.UUID)
+	}
+	stored := *export
+	stored.Data = nil
+	mr.exports[export.UUID] = &stored
+	return nil
+}
+
+// GetDataExport gets the data export by its id, without its data
+func (mr *memoryDataRepository) GetDataExport(ctx context.Context, exportUUID string) (*DBDataExport, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+	export, ok := mr.exports[exportUUID]
+	if !ok {
+		return nil, errors.Wrapf(sql.ErrNoRows, "failed to find data export with ID %s", exportUUID)
+	}
+	copied := *export
+	copied.Data = nil
+	return &copied, nil
+}
+
+// GetDataExportData gets the built data of the ready export
+func (mr *memoryDataRepository) GetDataExportData(ctx context.Context, exportUUID string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+	export, ok := mr.exports[exportUUID]
+	if !ok || export.Status != ExportReady {
+		return nil, errors.Wrapf(sql.ErrNoRows, "failed to read data of data export %s", exportUUID)
+	}
+	return append([]byte(nil), export.Data...), nil
+}
+
+// ListPendingDataExports lists the pending exports not claimed past now, the
+// oldest first
+func (mr *memoryDataRepository) ListPendingDataExports(ctx context.Context, now int64, limit int) ([]*DBDataExport, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+	var exports []*DBDataExport
+	for _, export := range mr.exports {
+		if export.Status == ExportPending && export.ClaimedUntil <= now {
+			copied := *export
+			copied.Data = nil
+			exports = append(exports, &copied)
+		}
+	}
+	sort.Slice(exports, func(i, j int) bool {
+		if exports[i].CreatedAt != exports[j].CreatedAt {
+			return exports[i].CreatedAt < exports[j].CreatedAt
+		}
+		return exports[i].UUID < exports[j].UUID
+	})
+	if len(exports) > limit {
+		exports = exports[:limit]
+	}
+	return exports, nil
+}
+
+// ClaimDataExport claims the pending export for building by moving its
+// claim to claimedUntil, so no other runner builds it in the meantime. It
+// reports whether the export was still claimed until claimedSince, as when
+// it was listed, and so was claimed.
+func (mr *memoryDataRepository) ClaimDataExport(ctx context.Context, exportUUID string, claimedSince, claimedUntil int64) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	export, ok := mr.exports[exportUUID]
+	if !ok || export.Status != ExportPending || export.ClaimedUntil != claimedSince {
+		return false, nil
+	}
+	export.ClaimedUntil = claimedUntil
+	return true, nil
+}
+
+// CompleteDataExport records the export as built, with its data, or as
+// failed, with its error
+func (mr *memoryDataRepository) CompleteDataExport(ctx context.Context, export *DBDataExport) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	stored, ok := mr.exports[export.UUID]
+	if !ok {
+		return nil
+	}
+	stored.Status = export.Status
+	stored.Data = append([]byte(nil), export.Data...)
+	stored.Size = export.Size
+	stored.Error = export.Error
+	stored.CompletedAt = export.CompletedAt
+	return nil
+}
+
+// PruneDataExports deletes the exports completed before the given time, data
+// and all, and returns how many it deleted
+func (mr *memoryDataRepository) PruneDataExports(ctx context.Context, completedBefore int64) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	var pruned int64
+	for id, export := range mr.exports {
+		if export.Status != ExportPending && export.CompletedAt.Int64 < completedBefore {
+			delete(mr.exports, id)
+			pruned++
+		}
+	}
+	return pruned, nil
+}
+
+// StartErasure records the erasure of its user as pending, unless the user
+// already has one, and returns the erasure recorded. The user must be
+// stored, deleted or not, to start erasing them.
+func (mr *memoryDataRepository) StartErasure(ctx context.Context, erasure *DBErasure) (*DBErasure, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	if started, ok := mr.erasures[erasure.UserUUID]; ok {
+		return copyErasure(started), nil
+	}
+	if _, ok := mr.users[erasure.UserUUID]; !ok {
+		return nil, errors.Wrapf(sql.ErrNoRows, "failed to start erasure of user %s", erasure.UserUUID)
+	}
+	mr.erasures[erasure.UserUUID] = copyErasure(erasure)
+	return copyErasure(erasure), nil
+}
+
+// EraseUser erases the user of the pending erasure, audits the erasure under
+// the tombstone, records the event telling other services to erase the user
+// and completes the erasure with what it erased, counted as the sql data
+// repos count it. An erasure completed meanwhile is left as it is.
+func (mr *memoryDataRepository) EraseUser(ctx context.Context, erasure *DBErasure, erasedAt int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	stored, ok := mr.erasures[erasure.UserUUID]
+	if !ok {
+		return errors.Wrapf(sql.ErrNoRows, "failed to erase user %s", erasure.UserUUID)
+	}
+	if stored.Status == ErasureCompleted {
+		return nil
+	}
+	erased, err := mr.erase(erasure)
+	if err != nil {
+		return errors.Wrapf(err, "failed to erase user %s", erasure.UserUUID)
+	}
+	if err := mr.recordAudit(ctx, AuditUserErased, erasure.TombstoneUUID, erasedActor(erasure), erasedAt); err != nil {
+		return err
+	}
+	event, err := newErasedEvent(erasure, erasedAt)
+	if err != nil {
+		return err
+	}
+	if err := mr.recordEvent(event); err != nil {
+		return err
+	}
+	stored.Status = ErasureCompleted
+	stored.Erased = erased
+	stored.CompletedAt = sql.NullInt64{Valid: true, Int64: erasedAt}
+	return nil
+}
+
+// erase runs the erasure steps over the maps and counts what each erased.
+// The user's events are scrubbed up front, so nothing is erased unless every
+// one of them can be.
+func (mr *memoryDataRepository) erase(erasure *DBErasure) (map[string]int64, error) {
+	user, tombstone := erasure.UserUUID, erasure.TombstoneUUID
+	isUserEvent := func(eventType, aggregateUUID string) bool {
+		switch eventType {
+		case EventUserCreated, EventUserUpdated, EventUserDeleted:
+			return aggregateUUID == user
+		}
+		return false
+	}
+	scrubbedEvents := map[*DBEvent][]byte{}
+	for _, event := range mr.events {
+		if isUserEvent(event.Type, event.AggregateUUID) {
+			scrubbed, err := scrubUserPayload(event.Payload, erasure)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to scrub event %s", event.UUID)
+			}
+			scrubbedEvents[event] = scrubbed
+		}
+	}
+	scrubbedDeliveries := map[*DBWebhookDelivery][]byte{}
+	for _, delivery := range mr.deliveries {
+		if isUserEvent(delivery.EventType, delivery.AggregateUUID) {
+			scrubbed, err := scrubUserPayload(delivery.Payload, erasure)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to scrub webhook delivery %s", delivery.UUID)
+			}
+			scrubbedDeliveries[delivery] = scrubbed
+		}
+	}
+
+	erased := map[string]int64{}
+	for _, step := range erasureSteps {
+		erased[step.key] = 0
+	}
+
+	for id, session := range mr.sessions {
+		if session.UserUUID == user {
+			delete(mr.sessions, id)
+			erased["user_sessions"]++
+		}
+	}
+	for key, identity := range mr.identities {
+		if identity.UserUUID == user {
+			delete(mr.identities, key)
+			erased["user_identities"]++
+		}
+	}
+	erased["user_roles"] += int64(len(mr.roles[user]))
+	delete(mr.roles, user)
+	for edge := range mr.userFollows {
+		if edge.follower == user || edge.followed == user {
+			delete(mr.userFollows, edge)
+			erased["user_user_follows"]++
+		}
+	}
+	for edge := range mr.sourceFollows {
+		if edge.follower == user {
+			delete(mr.sourceFollows, edge)
+			erased["user_source_follows"]++
+		}
+	}
+	for edge := range mr.blocks {
+		if edge.blocker == user || edge.blocked == user {
+			delete(mr.blocks, edge)
+			erased["user_blocks"]++
+		}
+	}
+	for id, export := range mr.exports {
+		if export.UserUUID == user {
+			delete(mr.exports, id)
+			erased["data_exports"]++
+		}
+	}
+	if _, ok := mr.users[user]; ok {
+		delete(mr.users, user)
+		erased["users"]++
+	}
+
+	for _, event := range mr.events {
+		if scrubbed, ok := scrubbedEvents[event]; ok {
+			event.Payload = scrubbed
+			erased["outbox.payload"]++
+		}
+	}
+	for _, delivery := range mr.deliveries {
+		if scrubbed, ok := scrubbedDeliveries[delivery]; ok {
+			delivery.Payload = scrubbed
+			erased["webhook_deliveries.payload"]++
+		}
+	}
+
+	pseudonymize := func(key string, value *string) {
+		if *value == user {
+			*value = tombstone
+			erased[key]++
+		}
+	}
+	for _, u := range mr.users {
+		pseudonymize("users.created_by_uuid", &u.CreatedByUUID)
+		pseudonymize("users.updated_by_uuid", &u.UpdatedByUUID.String)
+	}
+	for _, identity := range mr.identities {
+		pseudonymize("user_identities.created_by_uuid", &identity.CreatedByUUID)
+	}
+	for _, roles := range mr.roles {
+		for _, role := range roles {
+			pseudonymize("user_roles.created_by_uuid", &role.CreatedByUUID)
+		}
+	}
+	for _, webhook := range mr.webhooks {
+		pseudonymize("webhooks.created_by_uuid", &webhook.CreatedByUUID)
+	}
+	for _, export := range mr.exports {
+		pseudonymize("data_exports.requested_by_uuid", &export.RequestedByUUID)
+	}
+
+	replace := func(key string, value *[]byte) {
+		if bytes.Contains(*value, []byte(user)) {
+			*value = bytes.ReplaceAll(*value, []byte(user), []byte(tombstone))
+			erased[key]++
+		}
+	}
+	for _, entry := range mr.audit {
+		if entry.UserUUID == user {
+			entry.UserUUID, entry.Changes, entry.ClientIP = tombstone, []byte("[]"), ""
+			erased["user_audit_log.user_uuid"]++
+		}
+	}
+	for _, entry := range mr.audit {
+		if entry.ActorUUID == user {
+			entry.ActorUUID, entry.ClientIP = tombstone, ""
+			erased["user_audit_log.actor_uuid"]++
+		}
+	}
+	for _, entry := range mr.audit {
+		replace("user_audit_log.changes", &entry.Changes)
+	}
+	for _, event := range mr.events {
+		pseudonymize("outbox.aggregate_uuid", &event.AggregateUUID)
+	}
+	for _, event := range mr.events {
+		replace("outbox.payload", &event.Payload)
+	}
+	for _, delivery := range mr.deliveries {
+		pseudonymize("webhook_deliveries.aggregate_uuid", &delivery.AggregateUUID)
+	}
+	for _, delivery := range mr.deliveries {
+		replace("webhook_deliveries.payload", &delivery.Payload)
+	}
+	return erased, nil
+}
+
+// GetErasure gets the erasure of the user
+func (mr *memoryDataRepository) GetErasure(ctx context.Context, userUUID string) (*DBErasure, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+	erasure, ok := mr.erasures[userUUID]
+	if !ok {
+		return nil, errors.Wrapf(sql.ErrNoRows, "failed to find erasure of user %s", userUUID)
+	}
+	return copyErasure(erasure), nil
+}
+
+func copyErasure(erasure *DBErasure) *DBErasure {
+	copied := *erasure
+	copied.Erased = make(map[string]int64, len(erasure.Erased))
+	for key, n := range erasure.Erased {
+		copied.Erased[key] = n
+	}
+	return &copied
+}
+
+// ListSearchUsers lists the users that are not deleted by uuid, after the
+// given uuid, for search indexes to be built from
+func (mr *memoryDataRepository) ListSearchUsers(ctx context.Context, afterUUID string, limit int) ([]*DBSearchUser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+	followers := mr.countFollowers()
+	var users []*DBSearchUser
+	for _, user := range mr.users {
+		if user.DeletedAt.Valid || user.UUID <= afterUUID {
+			continue
+		}
+		users = append(users, newMemorySearchUser(user, followers))
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].UUID < users[j].UUID })
+	if len(users) > limit {
+		users = users[:limit]
+	}
+	return users, nil
+}
+
+// GetSearchUser gets the user as searches see them, for search indexes to be
+// kept up to date with. Deleted users are not found.
+func (mr *memoryDataRepository) GetSearchUser(ctx context.Context, uuid string) (*DBSearchUser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+	user, ok := mr.users[uuid]
+	if !ok || user.DeletedAt.Valid {
+		return nil, errors.Wrapf(sql.ErrNoRows, "failed to get search user %s", uuid)
+	}
+	return newMemorySearchUser(user, mr.countFollowers()), nil
+}
+
+// countFollowers counts the followers of every user, deleted followers left
+// uncounted
+func (mr *memoryDataRepository) countFollowers() map[string]int64 {
+	followers := map[string]int64{}
+	for edge := range mr.userFollows {
+		if follower, ok := mr.users[edge.follower]; ok && !follower.DeletedAt.Valid {
+			followers[edge.followed]++
+		}
+	}
+	return followers
+}
+
+func newMemorySearchUser(user *DBUser, followers map[string]int64) *DBSearchUser {
+	return &DBSearchUser{
+		UUID:        user.UUID,
+		Username:    user.Username,
+		DisplayName: user.DisplayName,
+		Followers:   followers[user.UUID],
+	}
+}
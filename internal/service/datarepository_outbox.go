@@ -0,0 +1,361 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// relayLease names the lease the outbox relays contend for, so only one of
+// them publishes at a time and events go out in the order they were written
+const relayLease = "relay"
+
+// prunedWatermark names the watermark holding the highest event id pruned so
+// far, which watches resuming from an older id are too late for
+const prunedWatermark = "pruned"
+
+const insertEventStatement = `
+INSERT INTO
+	outbox (
+		uuid,
+		aggregate_type,
+		aggregate_uuid,
+		event_type,
+		payload,
+		created_at
+	)
+VALUES
+	(?, ?, ?, ?, ?, ?)
+`
+
+// recordEvent writes the event to the outbox in the transaction and queues
+// its deliveries to the webhooks subscribed to it
+func (dr *dataRepository) recordEvent(ctx context.Context, tx *dbTx, event *DBEvent) error {
+	id, err := tx.insertReturningID(ctx, insertEventStatement,
+		event.UUID,
+		event.AggregateType,
+		event.AggregateUUID,
+		event.Type,
+		string(event.Payload),
+		unixTime(event.CreatedAt),
+	)
+	if err != nil {
+		return errors.Wrapf(err, "failed to execute statement to record %s event", event.Type)
+	}
+	event.ID = id
+	return queueWebhookDeliveries(ctx, tx, listWebhooksQuery, insertWebhookDeliveryStatement, event)
+}
+
+// recordUserCreated records the creation of a user, who has no roles yet,
+// and audits it
+func (dr *dataRepository) recordUserCreated(ctx context.Context, tx *dbTx, user *DBUser) error {
+	if err := dr.recordAudit(ctx, tx, AuditUserCreated, user.UUID, user.CreatedByUUID, user.CreatedAt, createdChanges(user)...); err != nil {
+		return err
+	}
+	event, err := newUserEvent(EventUserCreated, user, nil, user.CreatedByUUID, user.CreatedAt)
+	if err != nil {
+		return err
+	}
+	return dr.recordEvent(ctx, tx, event)
+}
+
+// recordUserEvent records an event carrying the user as the transaction
+// has left them, deleted or not
+func (dr *dataRepository) recordUserEvent(ctx context.Context, tx *dbTx, eventType, userUUID, actorUUID string, at int64, changed ...string) error {
+	user, err := scanUser(tx.QueryRowContext(ctx, getUserByQuery+`WHERE uuid=?`, userUUID))
+	if err != nil {
+		return errors.Wrapf(err, "failed to read user %s for %s event", userUUID, eventType)
+	}
+	rows, err := tx.QueryContext(ctx, listRolesQuery, userUUID)
+	if err != nil {
+		return errors.Wrapf(err, "failed to list roles of user %s for %s event", userUUID, eventType)
+	}
+	roles, err := scanStrings(rows)
+	if err != nil {
+		return errors.Wrapf(err, "failed to list roles of user %s for %s event", userUUID, eventType)
+	}
+	event, err := newUserEvent(eventType, user, roles, actorUUID, at, changed...)
+	if err != nil {
+		return err
+	}
+	return dr.recordEvent(ctx, tx, event)
+}
+
+// recordFollowEvent records a follow or unfollow and audits it
+func (dr *dataRepository) recordFollowEvent(ctx context.Context, tx *dbTx, eventType, follower, followed, followedType string) error {
+	at := time.Now().Unix()
+	if err := dr.recordAudit(ctx, tx, followAuditAction(eventType), follower, actorUUID(ctx), at, followChange(eventType, followed, followedType)); err != nil {
+		return err
+	}
+	event, err := newFollowEvent(eventType, follower, followed, followedType, at)
+	if err != nil {
+		return err
+	}
+	return dr.recordEvent(ctx, tx, event)
+}
+
+const listPendingEventsQuery = `
+SELECT
+	id,
+	uuid,
+	aggregate_type,
+	aggregate_uuid,
+	event_type,
+	payload,
+	created_at,
+	published_at
+FROM
+	outbox
+WHERE
+	published_at IS NULL
+ORDER BY
+	id
+LIMIT ?
+`
+
+// ListPendingEvents lists the oldest events not yet published, in the order
+// they were written
+func (dr *dataRepository) ListPendingEvents(ctx context.Context, limit int) ([]*DBEvent, error) {
+	events, err := dr.listEvents(ctx, listPendingEventsQuery, limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list pending events")
+	}
+	return events, nil
+}
+
+const listEventsAfterQuery = `
+SELECT
+	id,
+	uuid,
+	aggregate_type,
+	aggregate_uuid,
+	event_type,
+	payload,
+	created_at,
+	published_at
+FROM
+	outbox
+WHERE
+	id>?
+ORDER BY
+	id
+LIMIT ?
+`
+
+// ListEventsAfter lists the events written after the id, published or not,
+// in the order they were written
+func (dr *dataRepository) ListEventsAfter(ctx context.Context, afterID int64, limit int) ([]*DBEvent, error) {
+	events, err := dr.listEvents(ctx, listEventsAfterQuery, afterID, limit)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list events after %d", afterID)
+	}
+	return events, nil
+}
+
+const getEventRangeQuery = `
+SELECT
+	event_id,
+	(SELECT COALESCE(MAX(id), 0) FROM outbox)
+FROM
+	outbox_watermarks
+WHERE
+	name=?
+`
+
+// GetEventRange gets the range of ids the outbox can still be read from
+func (dr *dataRepository) GetEventRange(ctx context.Context) (*DBEventRange, error) {
+	eventRange, err := dr.getEventRange(ctx, getEventRangeQuery)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get event range")
+	}
+	return eventRange, nil
+}
+
+// getEventRange reads the pruned watermark along with the latest id. Once
+// everything was pruned the latest id is the watermark.
+func (s *sqlDB) getEventRange(ctx context.Context, query string) (*DBEventRange, error) {
+	eventRange := &DBEventRange{}
+	err := s.queryRow(ctx, query, prunedWatermark).Scan(&eventRange.PrunedID, &eventRange.LatestID)
+	if err == sql.ErrNoRows {
+		return nil, errors.Errorf("watermark %s does not exist, run the migrations", prunedWatermark)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to scan event range")
+	}
+	if eventRange.LatestID < eventRange.PrunedID {
+		eventRange.LatestID = eventRange.PrunedID
+	}
+	return eventRange, nil
+}
+
+// listEvents runs a query selecting outbox rows
+func (s *sqlDB) listEvents(ctx context.Context, query string, args ...interface{}) ([]*DBEvent, error) {
+	rows, err := s.query(ctx, query, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query")
+	}
+	defer rows.Close()
+	var events []*DBEvent
+	for rows.Next() {
+		event := &DBEvent{}
+		err := rows.Scan(
+			&event.ID,
+			&event.UUID,
+			&event.AggregateType,
+			&event.AggregateUUID,
+			&event.Type,
+			&event.Payload,
+			&event.CreatedAt,
+			&event.PublishedAt,
+		)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to scan event")
+		}
+		events = append(events, event)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to read rows")
+	}
+	return events, nil
+}
+
+const markEventPublishedStatement = `
+UPDATE
+	outbox
+SET
+	published_at=?
+WHERE
+	id=?
+`
+
+// MarkEventsPublished marks the events published so they are not published again
+func (dr *dataRepository) MarkEventsPublished(ctx context.Context, ids []int64, publishedAt int64) error {
+	if err := dr.markEventsPublished(ctx, markEventPublishedStatement, ids, publishedAt); err != nil {
+		return errors.Wrapf(err, "failed to mark %d events published", len(ids))
+	}
+	return nil
+}
+
+func (s *sqlDB) markEventsPublished(ctx context.Context, statement string, ids []int64, publishedAt int64) error {
+	return s.inTx(ctx, func(tx *dbTx) error {
+		for _, id := range ids {
+			if _, err := tx.ExecContext(ctx, statement, unixTime(publishedAt), id); err != nil {
+				return errors.Wrapf(err, "failed to execute statement to mark event %d published", id)
+			}
+		}
+		return nil
+	})
+}
+
+const lastPrunableEventQuery = `
+SELECT
+	COALESCE(MAX(id), 0)
+FROM
+	outbox
+WHERE
+	published_at IS NOT NULL AND published_at<?
+`
+
+const pruneEventsStatement = `
+DELETE FROM
+	outbox
+WHERE
+	published_at IS NOT NULL AND published_at<?
+`
+
+const raiseWatermarkStatement = `
+UPDATE
+	outbox_watermarks
+SET
+	event_id=?
+WHERE
+	name=? AND event_id<?
+`
+
+// PruneEvents deletes the events published before the given time, moves the
+// pruned watermark up past them and returns how many it deleted. Events not
+// yet published are always kept.
+func (dr *dataRepository) PruneEvents(ctx context.Context, publishedBefore int64) (int64, error) {
+	pruned, err := dr.pruneEvents(ctx, lastPrunableEventQuery, pruneEventsStatement, raiseWatermarkStatement, publishedBefore)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to prune events")
+	}
+	return pruned, nil
+}
+
+func (s *sqlDB) pruneEvents(ctx context.Context, query, statement, watermarkStatement string, publishedBefore int64) (int64, error) {
+	var pruned int64
+	err := s.inTx(ctx, func(tx *dbTx) error {
+		var lastID int64
+		if err := tx.QueryRowContext(ctx, query, unixTime(publishedBefore)).Scan(&lastID); err != nil {
+			return errors.Wrap(err, "failed to scan last prunable event")
+		}
+		if lastID == 0 {
+			return nil
+		}
+		res, err := tx.ExecContext(ctx, statement, unixTime(publishedBefore))
+		if err != nil {
+			return errors.Wrap(err, "failed to execute statement to prune events")
+		}
+		if pruned, err = res.RowsAffected(); err != nil {
+			return errors.Wrap(err, "failed to read rows affected")
+		}
+		_, err = tx.ExecContext(ctx, watermarkStatement, lastID, prunedWatermark, lastID)
+		return errors.Wrap(err, "failed to execute statement to raise pruned watermark")
+	})
+	return pruned, err
+}
+
+const acquireLeaseStatement = `
+UPDATE
+	outbox_leases
+SET
+	holder=?,
+	expires_at=?
+WHERE
+	name=? AND (holder=? OR expires_at<?)
+`
+
+const getLeaseHolderQuery = `
+SELECT
+	holder
+FROM
+	outbox_leases
+WHERE
+	name=?
+`
+
+// AcquireOutboxLease takes the relay lease for the holder until expiresAt,
+// or extends it when the holder already has it. It reports whether the
+// holder has the lease, which it does not while another holder's lease
+// runs.
+func (dr *dataRepository) AcquireOutboxLease(ctx context.Context, holder string, now, expiresAt int64) (bool, error) {
+	held, err := dr.acquireLease(ctx, acquireLeaseStatement, getLeaseHolderQuery, holder, now, expiresAt)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to acquire outbox lease for %s", holder)
+	}
+	return held, nil
+}
+
+// acquireLease runs the statement taking the lease and reads back who holds
+// it, since mysql counts rows changed rather than rows matched and reports
+// nothing affected when a holder renews within the same second
+func (s *sqlDB) acquireLease(ctx context.Context, statement, query, holder string, now, expiresAt int64) (bool, error) {
+	var current string
+	err := s.inTx(ctx, func(tx *dbTx) error {
+		if _, err := tx.ExecContext(ctx, statement, holder, unixTime(expiresAt), relayLease, holder, unixTime(now)); err != nil {
+			return errors.Wrap(err, "failed to execute statement to acquire lease")
+		}
+		err := tx.QueryRowContext(ctx, query, relayLease).Scan(&current)
+		if err == sql.ErrNoRows {
+			return errors.Errorf("lease %s does not exist, run the migrations", relayLease)
+		}
+		return errors.Wrap(err, "failed to read lease holder")
+	})
+	if err != nil {
+		return false, err
+	}
+	return current == holder, nil
+}
@@ -0,0 +1,18 @@
+package service
+
+import (
+	"database/sql"
+
+	"github.com/srcabl/users/internal/db/postgres"
+)
+
+// NewPostgresDataRepository news up a data repo backed by postgres. Its
+// schema is in migrations/postgres, with UUID, TIMESTAMPTZ and JSONB columns.
+// It shares its statements with mysql, timestamps being bound and scanned
+// as UNIX times like on the other systems.
+func NewPostgresDataRepository(db *postgres.Client) (DataRepository, error) {
+	return &dataRepository{sqlDB{
+		system: "postgresql",
+		db:     func() *sql.DB { return db.DB },
+	}}, nil
+}
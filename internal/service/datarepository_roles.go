@@ -0,0 +1,130 @@
+package service
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+const listRolesQuery = `
+SELECT
+	role
+FROM
+	user_roles
+WHERE
+	user_uuid=?
+ORDER BY
+	role
+`
+
+// ListRolesForUser lists the roles granted to the user
+func (dr *dataRepository) ListRolesForUser(ctx context.Context, userUUID string) ([]string, error) {
+	rows, err := dr.query(ctx, listRolesQuery, userUUID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list roles for user %s", userUUID)
+	}
+	defer rows.Close()
+	var roles []string
+	for rows.Next() {
+		var role string
+		if err := rows.Scan(&role); err != nil {
+			return nil, errors.Wrapf(err, "failed to scan role for user %s", userUUID)
+		}
+		roles = append(roles, role)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrapf(err, "failed to list roles for user %s", userUUID)
+	}
+	return roles, nil
+}
+
+const countRoleQuery = `
+SELECT
+	COUNT(*)
+FROM
+	user_roles
+WHERE
+	user_uuid=? AND role=?
+`
+
+const grantRoleStatement = `
+INSERT INTO
+	user_roles (
+		user_uuid,
+		role,
+		created_at,
+		created_by_uuid
+	)
+VALUES
+	(?, ?, ?, ?)
+`
+
+const touchUserStatement = `
+UPDATE
+	users
+SET
+	updated_by_uuid=?,
+	updated_at=?
+WHERE
+	uuid=?
+`
+
+// GrantRole grants the role to the user and records the granter as the
+// user's last updater. Granting a role the user already holds does nothing.
+func (dr *dataRepository) GrantRole(ctx context.Context, role *DBRole) error {
+	err := dr.inTx(ctx, func(tx *dbTx) error {
+		var held int
+		if err := tx.QueryRowContext(ctx, countRoleQuery, role.UserUUID, role.Role).Scan(&held); err != nil {
+			return errors.Wrap(err, "failed to check for role")
+		}
+		if held > 0 {
+			return nil
+		}
+		if _, err := tx.ExecContext(ctx, grantRoleStatement, role.UserUUID, role.Role, unixTime(role.CreatedAt), role.CreatedByUUID); err != nil {
+			return errors.Wrap(err, "failed to execute statement to grant role")
+		}
+		if _, err := tx.ExecContext(ctx, touchUserStatement, role.CreatedByUUID, unixTime(role.CreatedAt), role.UserUUID); err != nil {
+			return errors.Wrap(err, "failed to execute statement to update user")
+		}
+		if err := dr.recordAudit(ctx, tx, AuditRoleGranted, role.UserUUID, role.CreatedByUUID, role.CreatedAt, AuditChange{Field: AuditFieldRoles, New: role.Role}); err != nil {
+			return err
+		}
+		return dr.recordUserEvent(ctx, tx, EventUserUpdated, role.UserUUID, role.CreatedByUUID, role.CreatedAt, ChangedRoles)
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to grant role %s to user %s", role.Role, role.UserUUID)
+	}
+	return nil
+}
+
+const revokeRoleStatement = `
+DELETE FROM
+	user_roles
+WHERE
+	user_uuid=? AND role=?
+`
+
+// RevokeRole revokes the role from the user and records the revoker as the
+// user's last updater
+func (dr *dataRepository) RevokeRole(ctx context.Context, userUUID, role, revokedByUUID string, revokedAt int64) error {
+	err := dr.inTx(ctx, func(tx *dbTx) error {
+		res, err := tx.ExecContext(ctx, revokeRoleStatement, userUUID, role)
+		if err != nil {
+			return errors.Wrap(err, "failed to execute statement to revoke role")
+		}
+		if affected, err := res.RowsAffected(); err == nil && affected == 0 {
+			return nil
+		}
+		if _, err := tx.ExecContext(ctx, touchUserStatement, revokedByUUID, unixTime(revokedAt), userUUID); err != nil {
+			return errors.Wrap(err, "failed to execute statement to update user")
+		}
+		if err := dr.recordAudit(ctx, tx, AuditRoleRevoked, userUUID, revokedByUUID, revokedAt, AuditChange{Field: AuditFieldRoles, Old: role}); err != nil {
+			return err
+		}
+		return dr.recordUserEvent(ctx, tx, EventUserUpdated, userUUID, revokedByUUID, revokedAt, ChangedRoles)
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to revoke role %s from user %s", role, userUUID)
+	}
+	return nil
+}
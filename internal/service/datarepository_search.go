@@ -0,0 +1,79 @@
+package service
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+// searchUserByQuery selects users with how many users follow them, deleted
+// followers left uncounted. Queries on it end in GROUP BY searchUserGroupBy.
+const searchUserByQuery = `
+SELECT
+	u.uuid,
+	u.username,
+	u.display_name,
+	COUNT(fu.uuid)
+FROM
+	users u
+	LEFT JOIN user_user_follows f ON f.followed_uuid=u.uuid
+	LEFT JOIN users fu ON fu.uuid=f.follower_uuid AND fu.deleted_at IS NULL
+
+`
+
+const searchUserGroupBy = `
+GROUP BY
+	u.uuid,
+	u.username,
+	u.display_name
+`
+
+// ListSearchUsers lists the users that are not deleted by uuid, after the
+// given uuid, for search indexes to be built from
+func (dr *dataRepository) ListSearchUsers(ctx context.Context, afterUUID string, limit int) ([]*DBSearchUser, error) {
+	listQuery := searchUserByQuery + `WHERE u.deleted_at IS NULL AND u.uuid>?` + searchUserGroupBy + `ORDER BY u.uuid LIMIT ?`
+	users, err := dr.listSearchUsers(ctx, listQuery, orNilUUID(afterUUID), limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list search users")
+	}
+	return users, nil
+}
+
+// GetSearchUser gets the user as searches see them, for search indexes to be
+// kept up to date with. Deleted users are not found.
+func (dr *dataRepository) GetSearchUser(ctx context.Context, uuid string) (*DBSearchUser, error) {
+	getQuery := searchUserByQuery + `WHERE u.deleted_at IS NULL AND u.uuid=?` + searchUserGroupBy
+	user, err := scanSearchUser(dr.queryRow(ctx, getQuery, uuid))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get search user %s", uuid)
+	}
+	return user, nil
+}
+
+func (s *sqlDB) listSearchUsers(ctx context.Context, query string, args ...interface{}) ([]*DBSearchUser, error) {
+	rows, err := s.query(ctx, query, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query")
+	}
+	defer rows.Close()
+	var users []*DBSearchUser
+	for rows.Next() {
+		user, err := scanSearchUser(rows)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to scan search user")
+		}
+		users = append(users, user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to read rows")
+	}
+	return users, nil
+}
+
+func scanSearchUser(row scanner) (*DBSearchUser, error) {
+	user := &DBSearchUser{}
+	if err := row.Scan(&user.UUID, &user.Username, &user.DisplayName, &user.Followers); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
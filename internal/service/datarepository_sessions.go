@@ -0,0 +1,276 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ErrSessionRotated is returned when a session's refresh token was rotated by someone else first
+var ErrSessionRotated = errors.New("session refresh token was already rotated")
+
+const getSessionByQuery = `
+SELECT
+	uuid,
+	user_uuid,
+	refresh_token_hash,
+	previous_refresh_token_hash,
+	device,
+	user_agent,
+	created_at,
+	last_used_at,
+	expires_at,
+	revoked_at
+FROM
+	user_sessions
+
+`
+
+// GetSessionByID gets the session by its id
+func (dr *dataRepository) GetSessionByID(ctx context.Context, uuid string) (*DBSession, error) {
+	getQuery := getSessionByQuery + `WHERE uuid=?`
+	session, err := scanSession(dr.queryRow(ctx, getQuery, uuid))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to find session with ID %s", uuid)
+	}
+	return session, nil
+}
+
+// GetSessionByRefreshTokenHash gets the session that currently holds, or
+// most recently held, the refresh token hash
+func (dr *dataRepository) GetSessionByRefreshTokenHash(ctx context.Context, hash string) (*DBSession, error) {
+	getQuery := getSessionByQuery + `WHERE refresh_token_hash=? OR previous_refresh_token_hash=?`
+	session, err := scanSession(dr.queryRow(ctx, getQuery, hash, hash))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to find session by refresh token")
+	}
+	return session, nil
+}
+
+// ListActiveSessionsForUser lists the sessions of the user that are not revoked or expired
+func (dr *dataRepository) ListActiveSessionsForUser(ctx context.Context, userUUID string, now int64) ([]*DBSession, error) {
+	listQuery := getSessionByQuery + `WHERE user_uuid=? AND revoked_at IS NULL AND expires_at>? ORDER BY last_used_at DESC`
+	return dr.listSessions(ctx, userUUID, listQuery, userUUID, unixTime(now))
+}
+
+// ListSessionsForUser lists every session the user has had, revoked and
+// expired ones included, oldest first
+func (dr *dataRepository) ListSessionsForUser(ctx context.Context, userUUID string) ([]*DBSession, error) {
+	listQuery := getSessionByQuery + `WHERE user_uuid=? ORDER BY created_at, uuid`
+	return dr.listSessions(ctx, userUUID, listQuery, userUUID)
+}
+
+func (s *sqlDB) listSessions(ctx context.Context, userUUID, query string, args ...interface{}) ([]*DBSession, error) {
+	rows, err := s.query(ctx, query, args...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list sessions for user %s", userUUID)
+	}
+	defer rows.Close()
+	var sessions []*DBSession
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to scan session for user %s", userUUID)
+		}
+		sessions = append(sessions, session)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrapf(err, "failed to list sessions for user %s", userUUID)
+	}
+	return sessions, nil
+}
+
+type scanner interface {
+	Scan(...interface{}) error
+}
+
+func scanSession(row scanner) (*DBSession, error) {
+	session := &DBSession{}
+	err := row.Scan(
+		&session.UUID,
+		&session.UserUUID,
+		&session.RefreshTokenHash,
+		&session.PreviousRefreshTokenHash,
+		&session.Device,
+		&session.UserAgent,
+		&session.CreatedAt,
+		&session.LastUsedAt,
+		&session.ExpiresAt,
+		&session.RevokedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+const createSessionStatement = `
+INSERT INTO
+	user_sessions (
+		uuid,
+		user_uuid,
+		refresh_token_hash,
+		device,
+		user_agent,
+		created_at,
+		last_used_at,
+		expires_at
+	)
+VALUES
+	(?, ?, ?, ?, ?, ?, ?, ?)
+`
+
+// CreateSession creates a session
+func (dr *dataRepository) CreateSession(ctx context.Context, session *DBSession) error {
+	_, err := dr.execStatement(ctx, createSessionStatement,
+		session.UUID,
+		session.UserUUID,
+		session.RefreshTokenHash,
+		session.Device,
+		session.UserAgent,
+		unixTime(session.CreatedAt),
+		unixTime(session.LastUsedAt),
+		unixTime(session.ExpiresAt),
+	)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create session %s", session.UUID)
+	}
+	return nil
+}
+
+const rotateSessionStatement = `
+UPDATE
+	user_sessions
+SET
+	previous_refresh_token_hash=refresh_token_hash,
+	refresh_token_hash=?,
+	last_used_at=?,
+	expires_at=?
+WHERE
+	uuid=? AND refresh_token_hash=? AND revoked_at IS NULL
+`
+
+// RotateSession swaps the session's refresh token hash for a new one. It
+// fails with ErrSessionRotated if the old hash is no longer current.
+func (dr *dataRepository) RotateSession(ctx context.Context, sessionUUID, oldHash, newHash string, lastUsedAt, expiresAt int64) error {
+	affected, err := dr.execStatement(ctx, rotateSessionStatement, newHash, unixTime(lastUsedAt), unixTime(expiresAt), sessionUUID, oldHash)
+	if err != nil {
+		return errors.Wrapf(err, "failed to rotate session %s", sessionUUID)
+	}
+	if affected == 0 {
+		return errors.Wrapf(ErrSessionRotated, "failed to rotate session %s", sessionUUID)
+	}
+	return nil
+}
+
+const revokeSessionStatement = `
+UPDATE
+	user_sessions
+SET
+	revoked_at=?
+WHERE
+	uuid=? AND revoked_at IS NULL
+`
+
+// RevokeSession revokes a single session
+func (dr *dataRepository) RevokeSession(ctx context.Context, sessionUUID string, revokedAt int64) error {
+	if _, err := dr.execStatement(ctx, revokeSessionStatement, unixTime(revokedAt), sessionUUID); err != nil {
+		return errors.Wrapf(err, "failed to revoke session %s", sessionUUID)
+	}
+	return nil
+}
+
+const revokeAllSessionsStatement = `
+UPDATE
+	user_sessions
+SET
+	revoked_at=?
+WHERE
+	user_uuid=? AND revoked_at IS NULL
+`
+
+// RevokeAllSessionsForUser revokes every session the user has
+func (dr *dataRepository) RevokeAllSessionsForUser(ctx context.Context, userUUID string, revokedAt int64) error {
+	if _, err := dr.execStatement(ctx, revokeAllSessionsStatement, unixTime(revokedAt), userUUID); err != nil {
+		return errors.Wrapf(err, "failed to revoke sessions for user %s", userUUID)
+	}
+	return nil
+}
+
+const updateUserPasswordStatement = `
+UPDATE
+	users
+SET
+	hashed_password=?,
+	updated_by_uuid=?,
+	updated_at=?
+WHERE
+	uuid=?
+`
+
+// UpdateUserPassword sets the user's password and revokes all of their sessions
+func (dr *dataRepository) UpdateUserPassword(ctx context.Context, userUUID, hashedPassword, updatedByUUID string, updatedAt int64) error {
+	err := dr.inTx(ctx, func(tx *dbTx) error {
+		res, err := tx.ExecContext(ctx, updateUserPasswordStatement, hashedPassword, updatedByUUID, unixTime(updatedAt), userUUID)
+		if err != nil {
+			return errors.Wrap(err, "failed to execute statement to update password")
+		}
+		if affected, err := res.RowsAffected(); err == nil && affected == 0 {
+			return sql.ErrNoRows
+		}
+		if _, err := tx.ExecContext(ctx, revokeAllSessionsStatement, unixTime(updatedAt), userUUID); err != nil {
+			return errors.Wrap(err, "failed to execute statement to revoke sessions")
+		}
+		if err := dr.recordAudit(ctx, tx, AuditPasswordChanged, userUUID, updatedByUUID, updatedAt, AuditChange{Field: ChangedPassword}); err != nil {
+			return err
+		}
+		return dr.recordUserEvent(ctx, tx, EventUserUpdated, userUUID, updatedByUUID, updatedAt, ChangedPassword)
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to update password for user %s", userUUID)
+	}
+	return nil
+}
+
+// execStatement runs a single statement in its own transaction and returns the rows it affected
+func (s *sqlDB) execStatement(ctx context.Context, statement string, args ...interface{}) (int64, error) {
+	var affected int64
+	err := s.inTx(ctx, func(tx *dbTx) error {
+		res, err := tx.ExecContext(ctx, statement, args...)
+		if err != nil {
+			return errors.Wrap(err, "failed to execute statement")
+		}
+		affected, err = res.RowsAffected()
+		return errors.Wrap(err, "failed to read rows affected")
+	})
+	return affected, err
+}
+
+// inTx runs fn in a transaction, rolling back if it fails
+func (s *sqlDB) inTx(ctx context.Context, fn func(*dbTx) error) (err error) {
+	ctx, span := otel.Tracer(instrumentation).Start(ctx, "TRANSACTION",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("db.system", s.system)),
+	)
+	defer func() {
+		endDBSpan(span, err)
+	}()
+	tx, err := s.db().BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrapf(err, "failed to begin transaction")
+	}
+	if err := fn(&dbTx{tx: tx, system: s.system, span: span}); err != nil {
+		if rollErr := tx.Rollback(); rollErr != nil {
+			return errors.Wrapf(rollErr, "failed to rollback after: %s", err)
+		}
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "failed to commit transaction")
+	}
+	return nil
+}
@@ -0,0 +1,16 @@
+package service
+
+import (
+	"database/sql"
+
+	"github.com/srcabl/users/internal/db/sqlite"
+)
+
+// NewSQLiteDataRepository news up a data repo backed by sqlite, for local
+// development and CI. Its schema is in migrations/sqlite.
+func NewSQLiteDataRepository(db *sqlite.Client) (DataRepository, error) {
+	return &dataRepository{sqlDB{
+		system: "sqlite",
+		db:     func() *sql.DB { return db.DB },
+	}}, nil
+}
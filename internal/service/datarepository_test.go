@@ -1 +1,1541 @@
 package service_test
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	// registers the mysql driver
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/gofrs/uuid"
+	"github.com/pkg/errors"
+	"github.com/srcabl/services/pkg/db/mysql"
+	"github.com/srcabl/users/internal/config"
+	"github.com/srcabl/users/internal/db/postgres"
+	"github.com/srcabl/users/internal/db/sqlite"
+	"github.com/srcabl/users/internal/migrate"
+	"github.com/srcabl/users/internal/service"
+)
+
+// The conformance suite runs against every backend. Memory and sqlite always
+// run; mysql and postgres run when these name a migrated database, the mysql
+// one as a go-sql-driver dsn and the postgres one as a connection url.
+const (
+	mysqlDSNEnv    = "USERS_TEST_MYSQL_DSN"
+	postgresDSNEnv = "USERS_TEST_POSTGRES_DSN"
+)
+
+func TestMemoryDataRepository(t *testing.T) {
+	testDataRepository(t, func(t *testing.T) service.DataRepository {
+		return service.NewMemoryDataRepository()
+	})
+}
+
+func TestSQLiteDataRepository(t *testing.T) {
+	testDataRepository(t, func(t *testing.T) service.DataRepository {
+		db, err := sqlite.New(config.Storage{Path: ":memory:"})
+		if err != nil {
+			t.Fatalf("failed to new sqlite client: %v", err)
+		}
+		closeDB, err := db.Connect()
+		if err != nil {
+			t.Fatalf("failed to connect sqlite: %v", err)
+		}
+		t.Cleanup(func() { _ = closeDB() })
+		migrator, err := migrate.New(config.StorageSQLite, db.DB)
+		if err != nil {
+			t.Fatalf("failed to new migrator: %v", err)
+		}
+		if _, err := migrator.Up(context.Background()); err != nil {
+			t.Fatalf("failed to migrate sqlite: %v", err)
+		}
+		datarepo, err := service.NewSQLiteDataRepository(db)
+		if err != nil {
+			t.Fatalf("failed to new data repo: %v", err)
+		}
+		return datarepo
+	})
+}
+
+func TestMySQLDataRepository(t *testing.T) {
+	dsn := os.Getenv(mysqlDSNEnv)
+	if dsn == "" {
+		t.Skipf("%s is not set", mysqlDSNEnv)
+	}
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		t.Fatalf("failed to open mysql: %v", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	datarepo, err := service.NewDataRepository(&mysql.Client{DB: db})
+	if err != nil {
+		t.Fatalf("failed to new data repo: %v", err)
+	}
+	testDataRepository(t, func(t *testing.T) service.DataRepository {
+		return datarepo
+	})
+}
+
+func TestPostgresDataRepository(t *testing.T) {
+	dsn := os.Getenv(postgresDSNEnv)
+	if dsn == "" {
+		t.Skipf("%s is not set", postgresDSNEnv)
+	}
+	db, err := postgres.New(config.Storage{DSN: dsn})
+	if err != nil {
+		t.Fatalf("failed to new postgres client: %v", err)
+	}
+	closeDB, err := db.Connect()
+	if err != nil {
+		t.Fatalf("failed to connect postgres: %v", err)
+	}
+	t.Cleanup(func() { _ = closeDB() })
+	datarepo, err := service.NewPostgresDataRepository(db)
+	if err != nil {
+		t.Fatalf("failed to new data repo: %v", err)
+	}
+	testDataRepository(t, func(t *testing.T) service.DataRepository {
+		return datarepo
+	})
+}
+
+// testDataRepository is the behavior every backend must share. The backends
+// shared between tests are never emptied, so every case makes its own rows
+// under fresh uuids and names.
+func testDataRepository(t *testing.T, newRepo func(t *testing.T) service.DataRepository) {
+	cases := map[string]func(t *testing.T, dr service.DataRepository){
+		"users":        testUsers,
+		"audit":        testAudit,
+		"data exports": testDataExports,
+		"delete user":  testDeleteUser,
+		"erasure":      testErasure,
+		"follow list":  testFollowList,
+		"follows":      testFollows,
+		"blocks":       testBlocks,
+		"lockout":      testLockout,
+		"outbox":       testOutbox,
+		"outbox lease": testOutboxLease,
+		"password":     testPassword,
+		"roles":        testRoles,
+		"search users": testSearchUsers,
+		"identities":   testIdentities,
+		"sessions":     testSessions,
+		"session list": testSessionList,
+		"webhooks":     testWebhooks,
+	}
+	names := make([]string, 0, len(cases))
+	for name := range cases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		test := cases[name]
+		t.Run(name, func(t *testing.T) {
+			test(t, newRepo(t))
+		})
+	}
+}
+
+func newUUID(t *testing.T) string {
+	t.Helper()
+	id, err := uuid.NewV4()
+	if err != nil {
+		t.Fatalf("failed to generate uuid: %v", err)
+	}
+	return id.String()
+}
+
+func newDBUser(t *testing.T) *service.DBUser {
+	t.Helper()
+	id := newUUID(t)
+	return &service.DBUser{
+		UUID:           id,
+		Username:       "user-" + id,
+		Email:          id + "@example.com",
+		HashedPassword: "hash",
+		CreatedByUUID:  id,
+		CreatedAt:      1000,
+		UpdatedByUUID:  sql.NullString{Valid: true, String: id},
+		UpdatedAt:      sql.NullInt64{Valid: true, Int64: 1000},
+	}
+}
+
+func mustCreateUser(t *testing.T, dr service.DataRepository) *service.DBUser {
+	t.Helper()
+	user := newDBUser(t)
+	if err := dr.CreateUser(context.Background(), user); err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	return user
+}
+
+func expectNoRows(t *testing.T, err error) {
+	t.Helper()
+	if errors.Cause(err) != sql.ErrNoRows {
+		t.Fatalf("expected sql.ErrNoRows, got %v", err)
+	}
+}
+
+func testUsers(t *testing.T, dr service.DataRepository) {
+	ctx := context.Background()
+	user := newDBUser(t)
+	if !dr.ValidateUserForCreate(ctx, user) {
+		t.Fatal("expected a new user to validate for create")
+	}
+	if err := dr.CreateUser(ctx, user); err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	if dr.ValidateUserForCreate(ctx, user) {
+		t.Fatal("expected an existing user not to validate for create")
+	}
+
+	lookups := map[string]func() (*service.DBUser, error){
+		"id":       func() (*service.DBUser, error) { return dr.GetUserByID(ctx, user.UUID) },
+		"username": func() (*service.DBUser, error) { return dr.GetUserByUsername(ctx, user.Username) },
+		"email":    func() (*service.DBUser, error) { return dr.GetUserByEmail(ctx, user.Email) },
+	}
+	for by, lookup := range lookups {
+		got, err := lookup()
+		if err != nil {
+			t.Fatalf("failed to get user by %s: %v", by, err)
+		}
+		if got.UUID != user.UUID || got.Username != user.Username || got.Email != user.Email ||
+			got.HashedPassword != user.HashedPassword || got.CreatedAt != user.CreatedAt ||
+			got.UpdatedAt != user.UpdatedAt || got.UpdatedByUUID != user.UpdatedByUUID {
+			t.Fatalf("got user %+v by %s, want %+v", got, by, user)
+		}
+		if got.FailedLoginAttempts != 0 || got.LockedUntil.Valid || got.DeletedAt.Valid || len(got.Roles) != 0 {
+			t.Fatalf("expected a fresh user by %s, got %+v", by, got)
+		}
+	}
+
+	_, err := dr.GetUserByID(ctx, newUUID(t))
+	expectNoRows(t, err)
+	_, err = dr.GetUserByUsername(ctx, "missing-"+newUUID(t))
+	expectNoRows(t, err)
+	_, err = dr.GetUserByEmail(ctx, newUUID(t)+"@missing.example.com")
+	expectNoRows(t, err)
+
+	clashes := map[string]func(u *service.DBUser){
+		"uuid":     func(u *service.DBUser) { u.UUID = user.UUID },
+		"username": func(u *service.DBUser) { u.Username = user.Username },
+		"email":    func(u *service.DBUser) { u.Email = user.Email },
+	}
+	for key, clash := range clashes {
+		other := newDBUser(t)
+		clash(other)
+		if err := dr.CreateUser(ctx, other); err == nil {
+			t.Fatalf("expected a user with a taken %s to fail to create", key)
+		}
+	}
+}
+
+func testDeleteUser(t *testing.T, dr service.DataRepository) {
+	ctx := context.Background()
+	user := mustCreateUser(t, dr)
+	session := newDBSession(t, user.UUID, 1000)
+	if err := dr.CreateSession(ctx, session); err != nil {
+		t.Fatalf("failed to create session: %v", err)
+	}
+	deleter := newUUID(t)
+	if err := dr.DeleteUser(ctx, user.UUID, deleter, 2000); err != nil {
+		t.Fatalf("failed to delete user: %v", err)
+	}
+	_, err := dr.GetUserByID(ctx, user.UUID)
+	expectNoRows(t, err)
+	_, err = dr.GetUserByEmail(ctx, user.Email)
+	expectNoRows(t, err)
+	expectNoRows(t, dr.DeleteUser(ctx, user.UUID, deleter, 3000))
+	expectNoRows(t, dr.DeleteUser(ctx, newUUID(t), deleter, 3000))
+	expectNoRows(t, dr.UnlockUser(ctx, user.UUID, deleter, 3000))
+
+	got, err := dr.GetSessionByID(ctx, session.UUID)
+	if err != nil {
+		t.Fatalf("failed to get session: %v", err)
+	}
+	if !got.RevokedAt.Valid || got.RevokedAt.Int64 != 2000 {
+		t.Fatalf("expected the session revoked at 2000, got %+v", got.RevokedAt)
+	}
+
+	// the deleted user's username and email can be signed up with again,
+	// and are taken once they are
+	again := newDBUser(t)
+	again.Username, again.Email = user.Username, user.Email
+	if !dr.ValidateUserForCreate(ctx, again) {
+		t.Fatal("expected a deleted user's username and email to validate for create")
+	}
+	if err := dr.CreateUser(ctx, again); err != nil {
+		t.Fatalf("failed to create user with a deleted user's username and email: %v", err)
+	}
+	reused, err := dr.GetUserByUsername(ctx, user.Username)
+	if err != nil {
+		t.Fatalf("failed to get user by reused username: %v", err)
+	}
+	if reused.UUID != again.UUID {
+		t.Fatalf("expected the reused username to find %s, got %s", again.UUID, reused.UUID)
+	}
+	clash := newDBUser(t)
+	clash.Email = user.Email
+	if err := dr.CreateUser(ctx, clash); err == nil {
+		t.Fatal("expected a reused email to be taken again")
+	}
+	if err := dr.DeleteUser(ctx, again.UUID, deleter, 3000); err != nil {
+		t.Fatalf("failed to delete a second user with the same username and email: %v", err)
+	}
+}
+
+func testBlocks(t *testing.T, dr service.DataRepository) {
+	ctx := context.Background()
+	blocker, blocked, other := mustCreateUser(t, dr), mustCreateUser(t, dr), mustCreateUser(t, dr)
+
+	for i := 0; i < 2; i++ {
+		if err := dr.BlockUser(ctx, blocker.UUID, blocked.UUID, 1000); err != nil {
+			t.Fatalf("failed to block user, attempt %d: %v", i+1, err)
+		}
+	}
+	if err := dr.BlockUser(ctx, other.UUID, blocked.UUID, 1000); err != nil {
+		t.Fatalf("failed to block user: %v", err)
+	}
+	if err := dr.BlockUser(ctx, blocker.UUID, newUUID(t), 1000); err == nil {
+		t.Fatal("expected blocking a missing user to fail")
+	}
+	blocks, err := dr.ListUserBlocks(ctx, blocker.UUID)
+	if err != nil || len(blocks) != 1 || blocks[0] != blocked.UUID {
+		t.Fatalf("expected the blocker to have blocked only %s, got %v %v", blocked.UUID, blocks, err)
+	}
+	blockers, err := dr.ListUserBlockers(ctx, blocked.UUID)
+	if err != nil || len(blockers) != 2 {
+		t.Fatalf("expected the blocked user blocked by two users, got %v %v", blockers, err)
+	}
+	if blocks, err := dr.ListUserBlocks(ctx, blocked.UUID); err != nil || len(blocks) != 0 {
+		t.Fatalf("expected blocks to go one way, got %v %v", blocks, err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := dr.UnblockUser(ctx, blocker.UUID, blocked.UUID); err != nil {
+			t.Fatalf("failed to unblock user, attempt %d: %v", i+1, err)
+		}
+	}
+	blockers, err = dr.ListUserBlockers(ctx, blocked.UUID)
+	if err != nil || len(blockers) != 1 || blockers[0] != other.UUID {
+		t.Fatalf("expected only the other block left, got %v %v", blockers, err)
+	}
+}
+
+func testFollows(t *testing.T, dr service.DataRepository) {
+	ctx := context.Background()
+	follower := mustCreateUser(t, dr)
+	followed := mustCreateUser(t, dr)
+
+	for i := 0; i < 2; i++ {
+		if err := dr.AddUserFollower(ctx, follower.UUID, followed.UUID); err != nil {
+			t.Fatalf("failed to follow user, attempt %d: %v", i+1, err)
+		}
+	}
+	if err := dr.AddUserFollower(ctx, follower.UUID, newUUID(t)); err == nil {
+		t.Fatal("expected following a missing user to fail")
+	}
+	if err := dr.AddUserFollower(ctx, newUUID(t), followed.UUID); err == nil {
+		t.Fatal("expected a missing user following to fail")
+	}
+	for i := 0; i < 2; i++ {
+		if err := dr.RemoveUserFollower(ctx, follower.UUID, followed.UUID); err != nil {
+			t.Fatalf("failed to unfollow user, attempt %d: %v", i+1, err)
+		}
+	}
+	if err := dr.AddUserFollower(ctx, follower.UUID, followed.UUID); err != nil {
+		t.Fatalf("failed to follow user again: %v", err)
+	}
+
+	// sources live in another service, so any source can be followed
+	source := newUUID(t)
+	for i := 0; i < 2; i++ {
+		if err := dr.AddSourceFollower(ctx, follower.UUID, source); err != nil {
+			t.Fatalf("failed to follow source, attempt %d: %v", i+1, err)
+		}
+	}
+	if err := dr.AddSourceFollower(ctx, newUUID(t), source); err == nil {
+		t.Fatal("expected a missing user following a source to fail")
+	}
+	for i := 0; i < 2; i++ {
+		if err := dr.RemoveSourceFollower(ctx, follower.UUID, source); err != nil {
+			t.Fatalf("failed to unfollow source, attempt %d: %v", i+1, err)
+		}
+	}
+}
+
+func testFollowList(t *testing.T, dr service.DataRepository) {
+	ctx := context.Background()
+	follower := mustCreateUser(t, dr)
+	first := mustCreateUser(t, dr)
+	second := mustCreateUser(t, dr)
+	source := newUUID(t)
+
+	for _, followed := range []*service.DBUser{first, second} {
+		if err := dr.AddUserFollower(ctx, follower.UUID, followed.UUID); err != nil {
+			t.Fatalf("failed to follow user: %v", err)
+		}
+	}
+	if err := dr.AddUserFollower(ctx, second.UUID, first.UUID); err != nil {
+		t.Fatalf("failed to follow user: %v", err)
+	}
+	if err := dr.AddSourceFollower(ctx, follower.UUID, source); err != nil {
+		t.Fatalf("failed to follow source: %v", err)
+	}
+
+	expectUUIDs := func(what string, got []string, err error, want ...string) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("failed to list %s: %v", what, err)
+		}
+		sort.Strings(want)
+		if len(got) != len(want) {
+			t.Fatalf("expected %s %v, got %v", what, want, got)
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Fatalf("expected %s %v, got %v", what, want, got)
+			}
+		}
+	}
+	users, err := dr.ListUserFollows(ctx, follower.UUID)
+	expectUUIDs("user follows", users, err, first.UUID, second.UUID)
+	sources, err := dr.ListSourceFollows(ctx, follower.UUID)
+	expectUUIDs("source follows", sources, err, source)
+	followers, err := dr.ListUserFollowers(ctx, first.UUID)
+	expectUUIDs("followers", followers, err, follower.UUID, second.UUID)
+	none, err := dr.ListUserFollows(ctx, first.UUID)
+	expectUUIDs("user follows of a user following no one", none, err)
+
+	if err := dr.RemoveUserFollower(ctx, follower.UUID, first.UUID); err != nil {
+		t.Fatalf("failed to unfollow user: %v", err)
+	}
+	users, err = dr.ListUserFollows(ctx, follower.UUID)
+	expectUUIDs("user follows after unfollowing", users, err, second.UUID)
+}
+
+func testLockout(t *testing.T, dr service.DataRepository) {
+	ctx := context.Background()
+	user := mustCreateUser(t, dr)
+	get := func() *service.DBUser {
+		t.Helper()
+		got, err := dr.GetUserByID(ctx, user.UUID)
+		if err != nil {
+			t.Fatalf("failed to get user: %v", err)
+		}
+		return got
+	}
+
+	if err := dr.RecordFailedLogin(ctx, user.UUID, 2, 1000, 5000); err != nil {
+		t.Fatalf("failed to record failed login: %v", err)
+	}
+	if got := get(); got.FailedLoginAttempts != 1 || got.LockedUntil.Valid {
+		t.Fatalf("expected one failed login and no lock, got %d %+v", got.FailedLoginAttempts, got.LockedUntil)
+	}
+	if err := dr.ResetFailedLogins(ctx, user.UUID); err != nil {
+		t.Fatalf("failed to reset failed logins: %v", err)
+	}
+	if got := get(); got.FailedLoginAttempts != 0 {
+		t.Fatalf("expected failed logins reset, got %d", got.FailedLoginAttempts)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := dr.RecordFailedLogin(ctx, user.UUID, 2, 1000, 5000); err != nil {
+			t.Fatalf("failed to record failed login: %v", err)
+		}
+	}
+	got := get()
+	if got.FailedLoginAttempts != 2 || !got.LockedUntil.Valid || got.LockedUntil.Int64 != 5000 {
+		t.Fatalf("expected a lock until 5000 after two failed logins, got %d %+v", got.FailedLoginAttempts, got.LockedUntil)
+	}
+	if !got.IsLocked(4999) || got.IsLocked(5000) {
+		t.Fatal("expected the user locked until 5000")
+	}
+
+	unlocker := newUUID(t)
+	if err := dr.UnlockUser(ctx, user.UUID, unlocker, 3000); err != nil {
+		t.Fatalf("failed to unlock user: %v", err)
+	}
+	got = get()
+	if got.FailedLoginAttempts != 0 || got.LockedUntil.Valid {
+		t.Fatalf("expected the user unlocked, got %d %+v", got.FailedLoginAttempts, got.LockedUntil)
+	}
+	if got.UpdatedByUUID.String != unlocker || got.UpdatedAt.Int64 != 3000 {
+		t.Fatalf("expected the unlocker as last updater, got %+v %+v", got.UpdatedByUUID, got.UpdatedAt)
+	}
+	expectNoRows(t, dr.UnlockUser(ctx, newUUID(t), unlocker, 3000))
+
+	// failed logins after an unlock count from zero again
+	if err := dr.RecordFailedLogin(ctx, user.UUID, 2, 4000, 6000); err != nil {
+		t.Fatalf("failed to record failed login: %v", err)
+	}
+	if got := get(); got.FailedLoginAttempts != 1 || got.LockedUntil.Valid {
+		t.Fatalf("expected one failed login and no lock after the unlock, got %d %+v", got.FailedLoginAttempts, got.LockedUntil)
+	}
+	if err := dr.ResetFailedLogins(ctx, user.UUID); err != nil {
+		t.Fatalf("failed to reset failed logins: %v", err)
+	}
+
+	// a threshold of zero never locks
+	if err := dr.RecordFailedLogin(ctx, user.UUID, 0, 4000, 5000); err != nil {
+		t.Fatalf("failed to record failed login: %v", err)
+	}
+	if get().LockedUntil.Valid {
+		t.Fatal("expected no lock without a threshold")
+	}
+	if err := dr.ResetFailedLogins(ctx, user.UUID); err != nil {
+		t.Fatalf("failed to reset failed logins: %v", err)
+	}
+
+	// once a lock runs out the count starts again, so one more failed login
+	// does not lock the user straight away
+	for i := 0; i < 2; i++ {
+		if err := dr.RecordFailedLogin(ctx, user.UUID, 2, 4000, 8000); err != nil {
+			t.Fatalf("failed to record failed login: %v", err)
+		}
+	}
+	if !get().IsLocked(7999) {
+		t.Fatal("expected the user locked until 8000")
+	}
+	if err := dr.RecordFailedLogin(ctx, user.UUID, 2, 8000, 9000); err != nil {
+		t.Fatalf("failed to record failed login: %v", err)
+	}
+	if got := get(); got.FailedLoginAttempts != 1 || got.IsLocked(8000) {
+		t.Fatalf("expected one failed login and no lock once the lock ran out, got %d %+v", got.FailedLoginAttempts, got.LockedUntil)
+	}
+	if err := dr.RecordFailedLogin(ctx, user.UUID, 2, 8000, 9000); err != nil {
+		t.Fatalf("failed to record failed login: %v", err)
+	}
+	if got := get(); !got.IsLocked(8999) {
+		t.Fatalf("expected a lock until 9000 after two more failed logins, got %+v", got.LockedUntil)
+	}
+}
+
+func testPassword(t *testing.T, dr service.DataRepository) {
+	ctx := context.Background()
+	user := mustCreateUser(t, dr)
+	session := newDBSession(t, user.UUID, 1000)
+	if err := dr.CreateSession(ctx, session); err != nil {
+		t.Fatalf("failed to create session: %v", err)
+	}
+	if err := dr.UpdateUserPassword(ctx, user.UUID, "new-hash", user.UUID, 2000); err != nil {
+		t.Fatalf("failed to update password: %v", err)
+	}
+	got, err := dr.GetUserByID(ctx, user.UUID)
+	if err != nil {
+		t.Fatalf("failed to get user: %v", err)
+	}
+	if got.HashedPassword != "new-hash" || got.UpdatedAt.Int64 != 2000 {
+		t.Fatalf("expected the password updated at 2000, got %q at %d", got.HashedPassword, got.UpdatedAt.Int64)
+	}
+	sessions, err := dr.ListActiveSessionsForUser(ctx, user.UUID, 1500)
+	if err != nil {
+		t.Fatalf("failed to list sessions: %v", err)
+	}
+	if len(sessions) != 0 {
+		t.Fatalf("expected the sessions revoked, got %d active", len(sessions))
+	}
+	expectNoRows(t, dr.UpdateUserPassword(ctx, newUUID(t), "new-hash", user.UUID, 2000))
+}
+
+func testRoles(t *testing.T, dr service.DataRepository) {
+	ctx := context.Background()
+	user := mustCreateUser(t, dr)
+	granter := newUUID(t)
+	for _, role := range []string{"moderator", "admin", "admin"} {
+		err := dr.GrantRole(ctx, &service.DBRole{UserUUID: user.UUID, Role: role, CreatedAt: 2000, CreatedByUUID: granter})
+		if err != nil {
+			t.Fatalf("failed to grant %s: %v", role, err)
+		}
+	}
+	roles, err := dr.ListRolesForUser(ctx, user.UUID)
+	if err != nil {
+		t.Fatalf("failed to list roles: %v", err)
+	}
+	if len(roles) != 2 || roles[0] != "admin" || roles[1] != "moderator" {
+		t.Fatalf("expected [admin moderator], got %v", roles)
+	}
+	got, err := dr.GetUserByID(ctx, user.UUID)
+	if err != nil {
+		t.Fatalf("failed to get user: %v", err)
+	}
+	if len(got.Roles) != 2 || got.UpdatedByUUID.String != granter || got.UpdatedAt.Int64 != 2000 {
+		t.Fatalf("expected the user with two roles last updated by the granter, got %+v", got)
+	}
+	if err := dr.GrantRole(ctx, &service.DBRole{UserUUID: newUUID(t), Role: "admin", CreatedAt: 2000, CreatedByUUID: granter}); err == nil {
+		t.Fatal("expected granting a role to a missing user to fail")
+	}
+
+	revoker := newUUID(t)
+	if err := dr.RevokeRole(ctx, user.UUID, "admin", revoker, 3000); err != nil {
+		t.Fatalf("failed to revoke role: %v", err)
+	}
+	// revoking a role not held changes nothing, the last updater included
+	if err := dr.RevokeRole(ctx, user.UUID, "admin", newUUID(t), 4000); err != nil {
+		t.Fatalf("failed to revoke a role not held: %v", err)
+	}
+	got, err = dr.GetUserByID(ctx, user.UUID)
+	if err != nil {
+		t.Fatalf("failed to get user: %v", err)
+	}
+	if len(got.Roles) != 1 || got.Roles[0] != "moderator" {
+		t.Fatalf("expected [moderator], got %v", got.Roles)
+	}
+	if got.UpdatedByUUID.String != revoker || got.UpdatedAt.Int64 != 3000 {
+		t.Fatalf("expected the revoker as last updater, got %+v %+v", got.UpdatedByUUID, got.UpdatedAt)
+	}
+
+	// a revoked role can be granted again
+	if err := dr.GrantRole(ctx, &service.DBRole{UserUUID: user.UUID, Role: "admin", CreatedAt: 5000, CreatedByUUID: granter}); err != nil {
+		t.Fatalf("failed to grant a revoked role again: %v", err)
+	}
+	roles, err = dr.ListRolesForUser(ctx, user.UUID)
+	if err != nil {
+		t.Fatalf("failed to list roles: %v", err)
+	}
+	if len(roles) != 2 || roles[0] != "admin" || roles[1] != "moderator" {
+		t.Fatalf("expected [admin moderator] again, got %v", roles)
+	}
+}
+
+func newDBIdentity(t *testing.T, userUUID string, createdAt int64) *service.DBIdentity {
+	t.Helper()
+	return &service.DBIdentity{
+		Provider:      "provider",
+		Subject:       newUUID(t),
+		UserUUID:      userUUID,
+		Email:         sql.NullString{Valid: true, String: "linked@example.com"},
+		CreatedAt:     createdAt,
+		CreatedByUUID: userUUID,
+	}
+}
+
+func testIdentities(t *testing.T, dr service.DataRepository) {
+	ctx := context.Background()
+	user := mustCreateUser(t, dr)
+	later := newDBIdentity(t, user.UUID, 3000)
+	earlier := newDBIdentity(t, user.UUID, 2000)
+	for _, identity := range []*service.DBIdentity{later, earlier} {
+		if err := dr.CreateIdentity(ctx, identity); err != nil {
+			t.Fatalf("failed to create identity: %v", err)
+		}
+	}
+	if err := dr.CreateIdentity(ctx, later); err == nil {
+		t.Fatal("expected linking an identity twice to fail")
+	}
+	if err := dr.CreateIdentity(ctx, newDBIdentity(t, newUUID(t), 2000)); err == nil {
+		t.Fatal("expected linking an identity to a missing user to fail")
+	}
+
+	got, err := dr.GetIdentity(ctx, later.Provider, later.Subject)
+	if err != nil {
+		t.Fatalf("failed to get identity: %v", err)
+	}
+	if *got != *later {
+		t.Fatalf("got identity %+v, want %+v", got, later)
+	}
+	_, err = dr.GetIdentity(ctx, "provider", newUUID(t))
+	expectNoRows(t, err)
+
+	identities, err := dr.ListIdentitiesForUser(ctx, user.UUID)
+	if err != nil {
+		t.Fatalf("failed to list identities: %v", err)
+	}
+	if len(identities) != 2 || identities[0].Subject != earlier.Subject || identities[1].Subject != later.Subject {
+		t.Fatalf("expected the identities oldest first, got %+v", identities)
+	}
+
+	expectNoRows(t, dr.DeleteIdentity(ctx, newUUID(t), later.Provider, later.Subject))
+	if err := dr.DeleteIdentity(ctx, user.UUID, later.Provider, later.Subject); err != nil {
+		t.Fatalf("failed to delete identity: %v", err)
+	}
+	expectNoRows(t, dr.DeleteIdentity(ctx, user.UUID, later.Provider, later.Subject))
+
+	newUser := newDBUser(t)
+	linked := newDBIdentity(t, newUser.UUID, 2000)
+	if err := dr.CreateUserWithIdentity(ctx, newUser, linked); err != nil {
+		t.Fatalf("failed to create user with identity: %v", err)
+	}
+	if _, err := dr.GetIdentity(ctx, linked.Provider, linked.Subject); err != nil {
+		t.Fatalf("failed to get the identity created with its user: %v", err)
+	}
+
+	// a taken identity leaves no user behind
+	orphan := newDBUser(t)
+	taken := newDBIdentity(t, orphan.UUID, 2000)
+	taken.Subject = linked.Subject
+	if err := dr.CreateUserWithIdentity(ctx, orphan, taken); err == nil {
+		t.Fatal("expected creating a user with a taken identity to fail")
+	}
+	_, err = dr.GetUserByID(ctx, orphan.UUID)
+	expectNoRows(t, err)
+}
+
+func newDBSession(t *testing.T, userUUID string, now int64) *service.DBSession {
+	t.Helper()
+	id := newUUID(t)
+	return &service.DBSession{
+		UUID:             id,
+		UserUUID:         userUUID,
+		RefreshTokenHash: "hash-" + id,
+		Device:           "laptop",
+		UserAgent:        "test",
+		CreatedAt:        now,
+		LastUsedAt:       now,
+		ExpiresAt:        now + 1000,
+	}
+}
+
+func testSessions(t *testing.T, dr service.DataRepository) {
+	ctx := context.Background()
+	user := mustCreateUser(t, dr)
+	session := newDBSession(t, user.UUID, 1000)
+	if err := dr.CreateSession(ctx, session); err != nil {
+		t.Fatalf("failed to create session: %v", err)
+	}
+	if err := dr.CreateSession(ctx, session); err == nil {
+		t.Fatal("expected creating a session twice to fail")
+	}
+	if err := dr.CreateSession(ctx, newDBSession(t, newUUID(t), 1000)); err == nil {
+		t.Fatal("expected creating a session for a missing user to fail")
+	}
+
+	got, err := dr.GetSessionByID(ctx, session.UUID)
+	if err != nil {
+		t.Fatalf("failed to get session: %v", err)
+	}
+	if *got != *session {
+		t.Fatalf("got session %+v, want %+v", got, session)
+	}
+	_, err = dr.GetSessionByID(ctx, newUUID(t))
+	expectNoRows(t, err)
+
+	oldHash := session.RefreshTokenHash
+	newHash := "rotated-" + session.UUID
+	if err := dr.RotateSession(ctx, session.UUID, oldHash, newHash, 1500, 2500); err != nil {
+		t.Fatalf("failed to rotate session: %v", err)
+	}
+	err = dr.RotateSession(ctx, session.UUID, oldHash, "again-"+session.UUID, 1600, 2600)
+	if errors.Cause(err) != service.ErrSessionRotated {
+		t.Fatalf("expected rotating from a stale hash to fail with ErrSessionRotated, got %v", err)
+	}
+
+	for _, hash := range []string{oldHash, newHash} {
+		got, err := dr.GetSessionByRefreshTokenHash(ctx, hash)
+		if err != nil {
+			t.Fatalf("failed to get session by hash: %v", err)
+		}
+		if got.UUID != session.UUID || got.RefreshTokenHash != newHash || got.PreviousRefreshTokenHash.String != oldHash {
+			t.Fatalf("expected the rotated session by hash %s, got %+v", hash, got)
+		}
+		if got.LastUsedAt != 1500 || got.ExpiresAt != 2500 {
+			t.Fatalf("expected the rotated session used at 1500 and expiring at 2500, got %+v", got)
+		}
+	}
+	_, err = dr.GetSessionByRefreshTokenHash(ctx, "missing-"+session.UUID)
+	expectNoRows(t, err)
+
+	if err := dr.RevokeSession(ctx, session.UUID, 1700); err != nil {
+		t.Fatalf("failed to revoke session: %v", err)
+	}
+	// revoking again keeps the first revocation
+	if err := dr.RevokeSession(ctx, session.UUID, 1800); err != nil {
+		t.Fatalf("failed to revoke session again: %v", err)
+	}
+	got, err = dr.GetSessionByID(ctx, session.UUID)
+	if err != nil {
+		t.Fatalf("failed to get session: %v", err)
+	}
+	if got.RevokedAt.Int64 != 1700 {
+		t.Fatalf("expected the session revoked at 1700, got %+v", got.RevokedAt)
+	}
+	err = dr.RotateSession(ctx, session.UUID, newHash, "after-revoke-"+session.UUID, 1900, 2900)
+	if errors.Cause(err) != service.ErrSessionRotated {
+		t.Fatalf("expected rotating a revoked session to fail with ErrSessionRotated, got %v", err)
+	}
+}
+
+func testSessionList(t *testing.T, dr service.DataRepository) {
+	ctx := context.Background()
+	user := mustCreateUser(t, dr)
+	older := newDBSession(t, user.UUID, 1000)
+	newer := newDBSession(t, user.UUID, 1200)
+	expired := newDBSession(t, user.UUID, 1000)
+	expired.ExpiresAt = 1100
+	revoked := newDBSession(t, user.UUID, 1000)
+	for _, session := range []*service.DBSession{older, newer, expired, revoked} {
+		if err := dr.CreateSession(ctx, session); err != nil {
+			t.Fatalf("failed to create session: %v", err)
+		}
+	}
+	if err := dr.RevokeSession(ctx, revoked.UUID, 1050); err != nil {
+		t.Fatalf("failed to revoke session: %v", err)
+	}
+
+	sessions, err := dr.ListActiveSessionsForUser(ctx, user.UUID, 1100)
+	if err != nil {
+		t.Fatalf("failed to list sessions: %v", err)
+	}
+	if len(sessions) != 2 || sessions[0].UUID != newer.UUID || sessions[1].UUID != older.UUID {
+		t.Fatalf("expected the active sessions most recently used first, got %+v", sessions)
+	}
+
+	if err := dr.RevokeAllSessionsForUser(ctx, user.UUID, 1300); err != nil {
+		t.Fatalf("failed to revoke all sessions: %v", err)
+	}
+	sessions, err = dr.ListActiveSessionsForUser(ctx, user.UUID, 1100)
+	if err != nil {
+		t.Fatalf("failed to list sessions: %v", err)
+	}
+	if len(sessions) != 0 {
+		t.Fatalf("expected no active sessions, got %d", len(sessions))
+	}
+	got, err := dr.GetSessionByID(ctx, revoked.UUID)
+	if err != nil {
+		t.Fatalf("failed to get session: %v", err)
+	}
+	if got.RevokedAt.Int64 != 1050 {
+		t.Fatalf("expected revoking all to keep the earlier revocation, got %+v", got.RevokedAt)
+	}
+
+	sessions, err = dr.ListSessionsForUser(ctx, user.UUID)
+	if err != nil {
+		t.Fatalf("failed to list sessions: %v", err)
+	}
+	if len(sessions) != 4 {
+		t.Fatalf("expected every session of the user, revoked and expired included, got %d", len(sessions))
+	}
+}
+
+// drainEvents marks every pending event published, so a case on a shared
+// backend only sees the events it writes itself
+func drainEvents(t *testing.T, dr service.DataRepository) {
+	t.Helper()
+	ctx := context.Background()
+	for {
+		events, err := dr.ListPendingEvents(ctx, 100)
+		if err != nil {
+			t.Fatalf("failed to list pending events: %v", err)
+		}
+		if len(events) == 0 {
+			return
+		}
+		ids := make([]int64, 0, len(events))
+		for _, event := range events {
+			ids = append(ids, event.ID)
+		}
+		if err := dr.MarkEventsPublished(ctx, ids, 1); err != nil {
+			t.Fatalf("failed to mark events published: %v", err)
+		}
+	}
+}
+
+func pendingEvents(t *testing.T, dr service.DataRepository, userUUID string) []*service.DBEvent {
+	t.Helper()
+	events, err := dr.ListPendingEvents(context.Background(), 100)
+	if err != nil {
+		t.Fatalf("failed to list pending events: %v", err)
+	}
+	var mine []*service.DBEvent
+	for _, event := range events {
+		if event.AggregateUUID == userUUID {
+			mine = append(mine, event)
+		}
+	}
+	return mine
+}
+
+func testOutbox(t *testing.T, dr service.DataRepository) {
+	ctx := context.Background()
+	drainEvents(t, dr)
+	user := mustCreateUser(t, dr)
+	followed := mustCreateUser(t, dr)
+	actor := newUUID(t)
+	source := newUUID(t)
+
+	writes := []func() error{
+		func() error { return dr.AddUserFollower(ctx, user.UUID, followed.UUID) },
+		func() error { return dr.AddUserFollower(ctx, user.UUID, followed.UUID) },
+		func() error { return dr.AddSourceFollower(ctx, user.UUID, source) },
+		func() error { return dr.RemoveUserFollower(ctx, user.UUID, followed.UUID) },
+		func() error { return dr.RemoveUserFollower(ctx, user.UUID, followed.UUID) },
+		func() error {
+			return dr.GrantRole(ctx, &service.DBRole{UserUUID: user.UUID, Role: "admin", CreatedAt: 2000, CreatedByUUID: actor})
+		},
+		func() error {
+			return dr.GrantRole(ctx, &service.DBRole{UserUUID: user.UUID, Role: "admin", CreatedAt: 2000, CreatedByUUID: actor})
+		},
+		func() error { return dr.RevokeRole(ctx, user.UUID, "moderator", actor, 2000) },
+		func() error { return dr.UpdateUserPassword(ctx, user.UUID, "new-hash", actor, 3000) },
+		func() error { return dr.UnlockUser(ctx, user.UUID, actor, 4000) },
+		func() error { return dr.DeleteUser(ctx, user.UUID, actor, 5000) },
+	}
+	for i, write := range writes {
+		if err := write(); err != nil {
+			t.Fatalf("failed write %d: %v", i+1, err)
+		}
+	}
+	// failed writes record nothing
+	if err := dr.CreateUser(ctx, user); err == nil {
+		t.Fatal("expected creating a taken user to fail")
+	}
+	expectNoRows(t, dr.UnlockUser(ctx, user.UUID, actor, 6000))
+
+	events := pendingEvents(t, dr, user.UUID)
+	want := []struct {
+		eventType string
+		changed   string
+	}{
+		{service.EventUserCreated, ""},
+		{service.EventFollowAdded, ""},
+		{service.EventFollowAdded, ""},
+		{service.EventFollowRemoved, ""},
+		{service.EventUserUpdated, service.ChangedRoles},
+		{service.EventUserUpdated, service.ChangedPassword},
+		{service.EventUserUpdated, service.ChangedLockout},
+		{service.EventUserDeleted, ""},
+	}
+	if len(events) != len(want) {
+		got := make([]string, 0, len(events))
+		for _, event := range events {
+			got = append(got, event.Type)
+		}
+		t.Fatalf("expected %d events, got %v", len(want), got)
+	}
+	for i, event := range events {
+		if event.Type != want[i].eventType || event.AggregateType != service.AggregateUser || event.UUID == "" {
+			t.Fatalf("expected event %d to be a user's %s, got %+v", i+1, want[i].eventType, event)
+		}
+		if i > 0 && event.ID <= events[i-1].ID {
+			t.Fatalf("expected event ids to grow, got %d after %d", event.ID, events[i-1].ID)
+		}
+		if event.PublishedAt.Valid {
+			t.Fatalf("expected event %d to be pending, got %+v", i+1, event.PublishedAt)
+		}
+		if strings.Contains(string(event.Payload), user.HashedPassword) || strings.Contains(string(event.Payload), "new-hash") {
+			t.Fatalf("expected no password hash in %s", event.Payload)
+		}
+		if strings.HasPrefix(event.Type, "follow.") {
+			continue
+		}
+		var payload service.UserEventPayload
+		if err := json.Unmarshal(event.Payload, &payload); err != nil {
+			t.Fatalf("failed to unmarshal %s payload: %v", event.Type, err)
+		}
+		if payload.UUID != user.UUID || payload.Username != user.Username || payload.Email != user.Email {
+			t.Fatalf("expected the user in the %s payload, got %+v", event.Type, payload)
+		}
+		if want[i].changed != "" && (len(payload.Changed) != 1 || payload.Changed[0] != want[i].changed || payload.ActorUUID != actor) {
+			t.Fatalf("expected %s changed by the actor, got %+v", want[i].changed, payload)
+		}
+		if want[i].changed == service.ChangedRoles && (len(payload.Roles) != 1 || payload.Roles[0] != "admin") {
+			t.Fatalf("expected the roles after the grant, got %v", payload.Roles)
+		}
+	}
+	var follow service.FollowEventPayload
+	if err := json.Unmarshal(events[2].Payload, &follow); err != nil {
+		t.Fatalf("failed to unmarshal follow payload: %v", err)
+	}
+	if follow.FollowerUUID != user.UUID || follow.FollowedUUID != source || follow.FollowedType != service.FollowedSource {
+		t.Fatalf("expected the source follow, got %+v", follow)
+	}
+
+	after, err := dr.ListEventsAfter(ctx, events[0].ID-1, 2)
+	if err != nil {
+		t.Fatalf("failed to list events after %d: %v", events[0].ID-1, err)
+	}
+	if len(after) != 2 || after[0].UUID != events[0].UUID || after[1].ID <= after[0].ID {
+		t.Fatalf("expected the first two events from %d on, got %+v", events[0].ID, after)
+	}
+	eventRange, err := dr.GetEventRange(ctx)
+	if err != nil {
+		t.Fatalf("failed to get event range: %v", err)
+	}
+	if eventRange.LatestID < events[len(events)-1].ID || eventRange.PrunedID >= events[0].ID {
+		t.Fatalf("expected the range to hold every event, got %+v", eventRange)
+	}
+
+	published := []int64{events[0].ID, events[1].ID, events[2].ID}
+	publishedAt := time.Now().Unix()
+	if err := dr.MarkEventsPublished(ctx, published, publishedAt); err != nil {
+		t.Fatalf("failed to mark events published: %v", err)
+	}
+	if left := pendingEvents(t, dr, user.UUID); len(left) != len(events)-len(published) || left[0].ID != events[3].ID {
+		t.Fatalf("expected %d events left pending, got %d", len(events)-len(published), len(left))
+	}
+	pruned, err := dr.PruneEvents(ctx, publishedAt+1)
+	if err != nil {
+		t.Fatalf("failed to prune events: %v", err)
+	}
+	if pruned < int64(len(published)) {
+		t.Fatalf("expected at least %d events pruned, got %d", len(published), pruned)
+	}
+	if left := pendingEvents(t, dr, user.UUID); len(left) != len(events)-len(published) {
+		t.Fatalf("expected pruning to keep pending events, got %d", len(left))
+	}
+	if eventRange, err = dr.GetEventRange(ctx); err != nil {
+		t.Fatalf("failed to get event range: %v", err)
+	}
+	if eventRange.PrunedID < events[2].ID || eventRange.PrunedID >= events[3].ID || eventRange.LatestID < events[len(events)-1].ID {
+		t.Fatalf("expected the pruned watermark past the published events, got %+v", eventRange)
+	}
+	after, err = dr.ListEventsAfter(ctx, eventRange.PrunedID, 1)
+	if err != nil {
+		t.Fatalf("failed to list events after the watermark: %v", err)
+	}
+	if len(after) != 1 || after[0].ID != events[3].ID {
+		t.Fatalf("expected the first pending event after the watermark, got %+v", after)
+	}
+}
+
+func testOutboxLease(t *testing.T, dr service.DataRepository) {
+	ctx := context.Background()
+	first, second := "first-"+newUUID(t), "second-"+newUUID(t)
+	now := time.Now().Unix()
+	for _, step := range []struct {
+		holder         string
+		now, expiresAt int64
+		want           bool
+	}{
+		{first, now, now + 30, true},
+		{second, now + 10, now + 40, false},
+		{first, now + 20, now + 50, true},
+		{second, now + 40, now + 70, false},
+		{second, now + 51, now + 80, true},
+		{first, now + 60, now + 90, false},
+		// handing the lease back leaves it free for the next run
+		{second, now + 70, 0, true},
+	} {
+		held, err := dr.AcquireOutboxLease(ctx, step.holder, step.now, step.expiresAt)
+		if err != nil {
+			t.Fatalf("failed to acquire lease: %v", err)
+		}
+		if held != step.want {
+			t.Fatalf("expected %s to hold the lease at %d: %v, got %v", step.holder[:strings.Index(step.holder, "-")], step.now-now, step.want, held)
+		}
+	}
+}
+
+func webhookDeliveries(t *testing.T, dr service.DataRepository, webhookUUID, status string) []*service.DBWebhookDelivery {
+	t.Helper()
+	deliveries, err := dr.ListWebhookDeliveries(context.Background(), webhookUUID, status, 100)
+	if err != nil {
+		t.Fatalf("failed to list webhook deliveries: %v", err)
+	}
+	return deliveries
+}
+
+func testWebhooks(t *testing.T, dr service.DataRepository) {
+	ctx := context.Background()
+	actor := newUUID(t)
+	follows := &service.DBWebhook{
+		UUID:          newUUID(t),
+		URL:           "https://hooks.example.com/follows",
+		Secret:        "follows-secret",
+		EventTypes:    []string{service.EventFollowAdded, service.EventFollowRemoved},
+		CreatedByUUID: actor,
+		CreatedAt:     1000,
+	}
+	everything := &service.DBWebhook{
+		UUID:          newUUID(t),
+		URL:           "https://hooks.example.com/all",
+		Secret:        "all-secret",
+		CreatedByUUID: actor,
+		CreatedAt:     1001,
+	}
+	for _, webhook := range []*service.DBWebhook{follows, everything} {
+		if err := dr.CreateWebhook(ctx, webhook); err != nil {
+			t.Fatalf("failed to create webhook: %v", err)
+		}
+	}
+	webhooks, err := dr.ListWebhooks(ctx)
+	if err != nil {
+		t.Fatalf("failed to list webhooks: %v", err)
+	}
+	listed := map[string]*service.DBWebhook{}
+	for _, webhook := range webhooks {
+		listed[webhook.UUID] = webhook
+	}
+	if got := listed[follows.UUID]; got == nil || got.Secret != follows.Secret || strings.Join(got.EventTypes, ",") != "follow.added,follow.removed" {
+		t.Fatalf("expected the follows webhook listed, got %+v", got)
+	}
+	if got := listed[everything.UUID]; got == nil || len(got.EventTypes) != 0 || !got.Subscribes(service.EventUserDeleted) {
+		t.Fatalf("expected the webhook for every event listed, got %+v", got)
+	}
+
+	user := mustCreateUser(t, dr)
+	followed := mustCreateUser(t, dr)
+	if err := dr.AddUserFollower(ctx, user.UUID, followed.UUID); err != nil {
+		t.Fatalf("failed to follow: %v", err)
+	}
+	if got := webhookDeliveries(t, dr, everything.UUID, ""); len(got) != 3 {
+		t.Fatalf("expected two creations and a follow queued for every event, got %d", len(got))
+	}
+	queued := webhookDeliveries(t, dr, follows.UUID, "")
+	if len(queued) != 1 {
+		t.Fatalf("expected only the follow queued for follows, got %d", len(queued))
+	}
+	delivery := queued[0]
+	if delivery.EventType != service.EventFollowAdded || delivery.AggregateUUID != user.UUID || delivery.EventID == 0 ||
+		delivery.Status != service.DeliveryPending || delivery.Attempts != 0 || delivery.NextAttemptAt != delivery.EventCreatedAt || delivery.DeliveredAt.Valid {
+		t.Fatalf("expected a pending delivery of the follow, got %+v", delivery)
+	}
+	var payload service.FollowEventPayload
+	if err := json.Unmarshal(delivery.Payload, &payload); err != nil || payload.FollowedUUID != followed.UUID {
+		t.Fatalf("expected the follow payload, got %s: %v", delivery.Payload, err)
+	}
+	events := pendingEvents(t, dr, user.UUID)
+	if len(events) == 0 || events[len(events)-1].ID != delivery.EventID || events[len(events)-1].UUID != delivery.EventUUID {
+		t.Fatalf("expected the delivery to carry the follow event, got %+v", events)
+	}
+
+	due, err := dr.ListDueWebhookDeliveries(ctx, time.Now().Unix()+60, 1000)
+	if err != nil {
+		t.Fatalf("failed to list due deliveries: %v", err)
+	}
+	found := false
+	for _, d := range due {
+		found = found || d.UUID == delivery.UUID
+	}
+	if !found {
+		t.Fatal("expected the pending delivery to be due")
+	}
+	claimedUntil := delivery.NextAttemptAt + 30
+	if claimed, err := dr.ClaimWebhookDelivery(ctx, delivery.UUID, delivery.NextAttemptAt, claimedUntil); err != nil || !claimed {
+		t.Fatalf("expected the delivery claimed: %v, %v", claimed, err)
+	}
+	if claimed, err := dr.ClaimWebhookDelivery(ctx, delivery.UUID, delivery.NextAttemptAt, claimedUntil+30); err != nil || claimed {
+		t.Fatalf("expected a second claim to miss: %v, %v", claimed, err)
+	}
+
+	delivery.Status = service.DeliveryDead
+	delivery.Attempts = 3
+	delivery.NextAttemptAt = claimedUntil
+	delivery.LastError = "webhook answered with 503"
+	delivery.LastStatusCode = 503
+	if err := dr.UpdateWebhookDelivery(ctx, delivery); err != nil {
+		t.Fatalf("failed to update delivery: %v", err)
+	}
+	if got := webhookDeliveries(t, dr, follows.UUID, service.DeliveryDead); len(got) != 1 || got[0].Attempts != 3 || got[0].LastStatusCode != 503 || got[0].LastError != delivery.LastError {
+		t.Fatalf("expected the delivery dead, got %+v", got)
+	}
+	if got := webhookDeliveries(t, dr, follows.UUID, service.DeliveryPending); len(got) != 0 {
+		t.Fatalf("expected nothing pending, got %d", len(got))
+	}
+
+	if err := dr.RedeliverWebhookDelivery(ctx, delivery.UUID, 9000); err != nil {
+		t.Fatalf("failed to redeliver: %v", err)
+	}
+	got, err := dr.GetWebhookDelivery(ctx, delivery.UUID)
+	if err != nil {
+		t.Fatalf("failed to get delivery: %v", err)
+	}
+	if got.Status != service.DeliveryPending || got.Attempts != 0 || got.NextAttemptAt != 9000 || got.LastStatusCode != 503 {
+		t.Fatalf("expected the delivery pending again, got %+v", got)
+	}
+
+	got.Status = service.DeliveryDelivered
+	got.Attempts = 1
+	got.DeliveredAt = sql.NullInt64{Valid: true, Int64: 100}
+	if err := dr.UpdateWebhookDelivery(ctx, got); err != nil {
+		t.Fatalf("failed to update delivery: %v", err)
+	}
+	if pruned, err := dr.PruneWebhookDeliveries(ctx, 200); err != nil || pruned < 1 {
+		t.Fatalf("expected the delivered delivery pruned: %d, %v", pruned, err)
+	}
+	_, err = dr.GetWebhookDelivery(ctx, delivery.UUID)
+	expectNoRows(t, err)
+
+	if err := dr.DeleteWebhook(ctx, everything.UUID); err != nil {
+		t.Fatalf("failed to delete webhook: %v", err)
+	}
+	if got := webhookDeliveries(t, dr, everything.UUID, ""); len(got) != 0 {
+		t.Fatalf("expected the deliveries deleted with the webhook, got %d", len(got))
+	}
+	expectNoRows(t, dr.DeleteWebhook(ctx, everything.UUID))
+	if err := dr.DeleteWebhook(ctx, follows.UUID); err != nil {
+		t.Fatalf("failed to delete webhook: %v", err)
+	}
+}
+
+func testAudit(t *testing.T, dr service.DataRepository) {
+	ctx := context.Background()
+	admin := newUUID(t)
+	user := mustCreateUser(t, dr)
+	followed := mustCreateUser(t, dr)
+	if err := dr.AddUserFollower(ctx, user.UUID, followed.UUID); err != nil {
+		t.Fatalf("failed to follow: %v", err)
+	}
+	if err := dr.GrantRole(ctx, &service.DBRole{UserUUID: user.UUID, Role: "moderator", CreatedAt: 2000, CreatedByUUID: admin}); err != nil {
+		t.Fatalf("failed to grant role: %v", err)
+	}
+	if err := dr.RevokeRole(ctx, user.UUID, "moderator", admin, 2001); err != nil {
+		t.Fatalf("failed to revoke role: %v", err)
+	}
+	if err := dr.UpdateUserPassword(ctx, user.UUID, "hash2", user.UUID, 2002); err != nil {
+		t.Fatalf("failed to update password: %v", err)
+	}
+	if err := dr.RecordFailedLogin(ctx, user.UUID, 1, 1000, 5000); err != nil {
+		t.Fatalf("failed to record failed login: %v", err)
+	}
+	if err := dr.UnlockUser(ctx, user.UUID, admin, 2003); err != nil {
+		t.Fatalf("failed to unlock user: %v", err)
+	}
+	if err := dr.DeleteUser(ctx, user.UUID, admin, 2004); err != nil {
+		t.Fatalf("failed to delete user: %v", err)
+	}
+	expectNoRows(t, dr.UnlockUser(ctx, user.UUID, admin, 2005))
+
+	entries, err := dr.ListAuditEntries(ctx, user.UUID, "", 0, 10)
+	if err != nil {
+		t.Fatalf("failed to list audit entries: %v", err)
+	}
+	want := []struct {
+		action  string
+		actor   string
+		at      int64
+		changes []service.AuditChange
+	}{
+		{service.AuditUserDeleted, admin, 2004, []service.AuditChange{{Field: "deleted_at", New: "2004"}}},
+		{service.AuditUserUnlocked, admin, 2003, []service.AuditChange{{Field: "failed_login_attempts", Old: "1", New: "0"}, {Field: "locked_until", Old: "5000"}}},
+		{service.AuditPasswordChanged, user.UUID, 2002, []service.AuditChange{{Field: service.ChangedPassword}}},
+		{service.AuditRoleRevoked, admin, 2001, []service.AuditChange{{Field: service.AuditFieldRoles, Old: "moderator"}}},
+		{service.AuditRoleGranted, admin, 2000, []service.AuditChange{{Field: service.AuditFieldRoles, New: "moderator"}}},
+		{service.AuditFollowAdded, uuid.Nil.String(), 0, []service.AuditChange{{Field: service.AuditFieldFollows, New: "user/" + followed.UUID}}},
+		{service.AuditUserCreated, user.UUID, 1000, []service.AuditChange{{Field: "username", New: user.Username}, {Field: "email", New: user.Email}}},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("expected %d entries, got %d", len(want), len(entries))
+	}
+	for i, entry := range entries {
+		var changes []service.AuditChange
+		if err := json.Unmarshal(entry.Changes, &changes); err != nil {
+			t.Fatalf("failed to unmarshal changes of %s: %v", entry.Action, err)
+		}
+		if entry.Action != want[i].action || entry.UserUUID != user.UUID || entry.ActorUUID != want[i].actor || (want[i].at != 0 && entry.CreatedAt != want[i].at) {
+			t.Fatalf("expected entry %d to be %s by %s, got %+v", i, want[i].action, want[i].actor, entry)
+		}
+		if len(changes) != len(want[i].changes) {
+			t.Fatalf("expected %s to change %v, got %v", entry.Action, want[i].changes, changes)
+		}
+		for j := range changes {
+			if changes[j] != want[i].changes[j] {
+				t.Fatalf("expected %s to change %v, got %v", entry.Action, want[i].changes, changes)
+			}
+		}
+		if i > 0 && entry.ID >= entries[i-1].ID {
+			t.Fatalf("expected entries newest first, got %d after %d", entry.ID, entries[i-1].ID)
+		}
+	}
+
+	page, err := dr.ListAuditEntries(ctx, user.UUID, "", entries[1].ID, 2)
+	if err != nil {
+		t.Fatalf("failed to list audit entries: %v", err)
+	}
+	if len(page) != 2 || page[0].ID != entries[2].ID || page[1].ID != entries[3].ID {
+		t.Fatalf("expected the page before entry 1 to hold entries 2 and 3, got %+v", page)
+	}
+	byAdmin, err := dr.ListAuditEntries(ctx, "", admin, 0, 10)
+	if err != nil {
+		t.Fatalf("failed to list audit entries: %v", err)
+	}
+	var actions []string
+	for _, entry := range byAdmin {
+		actions = append(actions, entry.Action)
+	}
+	if strings.Join(actions, ",") != "user.deleted,user.unlocked,role.revoked,role.granted" {
+		t.Fatalf("expected the admin's actions, got %v", actions)
+	}
+	onUser, err := dr.ListAuditEntries(ctx, followed.UUID, followed.UUID, 0, 10)
+	if err != nil {
+		t.Fatalf("failed to list audit entries: %v", err)
+	}
+	if len(onUser) != 1 || onUser[0].Action != service.AuditUserCreated {
+		t.Fatalf("expected only the followed user's creation, got %+v", onUser)
+	}
+}
+
+func testDataExports(t *testing.T, dr service.DataRepository) {
+	ctx := context.Background()
+	user := mustCreateUser(t, dr)
+	export := &service.DBDataExport{
+		UUID:            newUUID(t),
+		UserUUID:        user.UUID,
+		RequestedByUUID: user.UUID,
+		Format:          service.ExportJSON,
+		Status:          service.ExportPending,
+		CreatedAt:       1000,
+	}
+	if err := dr.CreateDataExport(ctx, export); err != nil {
+		t.Fatalf("failed to create data export: %v", err)
+	}
+	got, err := dr.GetDataExport(ctx, export.UUID)
+	if err != nil {
+		t.Fatalf("failed to get data export: %v", err)
+	}
+	if got.Status != service.ExportPending || got.UserUUID != user.UUID || got.CompletedAt.Valid {
+		t.Fatalf("expected the export pending, got %+v", got)
+	}
+	if _, err := dr.GetDataExportData(ctx, export.UUID); errors.Cause(err) != sql.ErrNoRows {
+		t.Fatalf("expected no data while pending, got %v", err)
+	}
+
+	pendingUUIDs := func(now int64) []string {
+		t.Helper()
+		pending, err := dr.ListPendingDataExports(ctx, now, 1000)
+		if err != nil {
+			t.Fatalf("failed to list pending data exports: %v", err)
+		}
+		var uuids []string
+		for _, p := range pending {
+			if p.UUID == export.UUID {
+				uuids = append(uuids, p.UUID)
+			}
+		}
+		return uuids
+	}
+	if got := pendingUUIDs(2000); len(got) != 1 {
+		t.Fatalf("expected the export pending, got %v", got)
+	}
+	if claimed, err := dr.ClaimDataExport(ctx, export.UUID, 0, 5000); err != nil || !claimed {
+		t.Fatalf("expected the export claimed, got %v %v", claimed, err)
+	}
+	if claimed, err := dr.ClaimDataExport(ctx, export.UUID, 0, 6000); err != nil || claimed {
+		t.Fatalf("expected a stale claim refused, got %v %v", claimed, err)
+	}
+	if got := pendingUUIDs(4999); len(got) != 0 {
+		t.Fatalf("expected a claimed export not listed, got %v", got)
+	}
+	if got := pendingUUIDs(5000); len(got) != 1 {
+		t.Fatalf("expected the export listed once its claim ran out, got %v", got)
+	}
+
+	export.Status = service.ExportReady
+	export.Data = []byte(`{"user":{}}`)
+	export.Size = int64(len(export.Data))
+	export.CompletedAt = sql.NullInt64{Valid: true, Int64: 3000}
+	if err := dr.CompleteDataExport(ctx, export); err != nil {
+		t.Fatalf("failed to complete data export: %v", err)
+	}
+	if got := pendingUUIDs(10000); len(got) != 0 {
+		t.Fatalf("expected a ready export not listed, got %v", got)
+	}
+	got, err = dr.GetDataExport(ctx, export.UUID)
+	if err != nil {
+		t.Fatalf("failed to get data export: %v", err)
+	}
+	if got.Status != service.ExportReady || got.Size != export.Size || got.CompletedAt.Int64 != 3000 || got.Data != nil {
+		t.Fatalf("expected the export ready without its data, got %+v", got)
+	}
+	data, err := dr.GetDataExportData(ctx, export.UUID)
+	if err != nil {
+		t.Fatalf("failed to read data export: %v", err)
+	}
+	if string(data) != string(export.Data) {
+		t.Fatalf("expected the data stored, got %s", data)
+	}
+
+	if _, err := dr.PruneDataExports(ctx, 3000); err != nil {
+		t.Fatalf("failed to prune data exports: %v", err)
+	}
+	if _, err := dr.GetDataExport(ctx, export.UUID); err != nil {
+		t.Fatalf("expected an export completed at the cutoff kept, got %v", err)
+	}
+	if _, err := dr.PruneDataExports(ctx, 3001); err != nil {
+		t.Fatalf("failed to prune data exports: %v", err)
+	}
+	if _, err := dr.GetDataExport(ctx, export.UUID); errors.Cause(err) != sql.ErrNoRows {
+		t.Fatalf("expected the export pruned, got %v", err)
+	}
+}
+
+func testErasure(t *testing.T, dr service.DataRepository) {
+	ctx := context.Background()
+	drainEvents(t, dr)
+	user, friend := mustCreateUser(t, dr), mustCreateUser(t, dr)
+	invited := newDBUser(t)
+	invited.CreatedByUUID = user.UUID
+	for _, err := range []error{
+		dr.CreateUser(ctx, invited),
+		dr.AddUserFollower(ctx, user.UUID, friend.UUID),
+		dr.AddUserFollower(ctx, friend.UUID, user.UUID),
+		dr.AddSourceFollower(ctx, user.UUID, newUUID(t)),
+		dr.BlockUser(ctx, friend.UUID, user.UUID, 1000),
+		dr.CreateSession(ctx, newDBSession(t, user.UUID, 1000)),
+		dr.GrantRole(ctx, &service.DBRole{UserUUID: friend.UUID, Role: "moderator", CreatedAt: 1000, CreatedByUUID: user.UUID}),
+		dr.DeleteUser(ctx, user.UUID, user.UUID, 1500),
+	} {
+		if err != nil {
+			t.Fatalf("failed to set up user: %v", err)
+		}
+	}
+
+	_, err := dr.StartErasure(ctx, &service.DBErasure{UUID: newUUID(t), UserUUID: newUUID(t), TombstoneUUID: newUUID(t), RequestedByUUID: newUUID(t), Status: service.ErasurePending, CreatedAt: 2000})
+	expectNoRows(t, err)
+	erasure := &service.DBErasure{
+		UUID:            newUUID(t),
+		UserUUID:        user.UUID,
+		TombstoneUUID:   newUUID(t),
+		RequestedByUUID: user.UUID,
+		Status:          service.ErasurePending,
+		CreatedAt:       2000,
+	}
+	started, err := dr.StartErasure(ctx, erasure)
+	if err != nil {
+		t.Fatalf("failed to start erasure: %v", err)
+	}
+	again, err := dr.StartErasure(ctx, &service.DBErasure{UUID: newUUID(t), UserUUID: user.UUID, TombstoneUUID: newUUID(t), RequestedByUUID: user.UUID, Status: service.ErasurePending, CreatedAt: 2100})
+	if err != nil {
+		t.Fatalf("failed to start erasure again: %v", err)
+	}
+	if started.UUID != erasure.UUID || again.UUID != erasure.UUID || again.TombstoneUUID != erasure.TombstoneUUID || again.Status != service.ErasurePending {
+		t.Fatalf("expected the first erasure returned while pending, got %+v", again)
+	}
+
+	if err := dr.EraseUser(ctx, started, 3000); err != nil {
+		t.Fatalf("failed to erase user: %v", err)
+	}
+	got, err := dr.GetErasure(ctx, user.UUID)
+	if err != nil {
+		t.Fatalf("failed to get erasure: %v", err)
+	}
+	if got.Status != service.ErasureCompleted || got.CompletedAt.Int64 != 3000 {
+		t.Fatalf("expected the erasure completed, got %+v", got)
+	}
+	for key, n := range map[string]int64{
+		"users":                          1,
+		"user_sessions":                  1,
+		"user_user_follows":              2,
+		"user_source_follows":            1,
+		"user_blocks":                    1,
+		"users.created_by_uuid":          1,
+		"user_roles.created_by_uuid":     1,
+		"user_audit_log.user_uuid":       4,
+		"user_audit_log.changes":         1,
+		"outbox.aggregate_uuid":          4,
+		"webhooks.created_by_uuid":       0,
+		"data_exports.requested_by_uuid": 0,
+	} {
+		if got.Erased[key] != n {
+			t.Fatalf("expected %d rows erased from %s, got %+v", n, key, got.Erased)
+		}
+	}
+	if err := dr.EraseUser(ctx, started, 4000); err != nil {
+		t.Fatalf("failed to erase user again: %v", err)
+	}
+	if got, _ := dr.GetErasure(ctx, user.UUID); got.CompletedAt.Int64 != 3000 {
+		t.Fatalf("expected erasing again to leave the erasure as it is, got %+v", got)
+	}
+
+	_, err = dr.GetUserByID(ctx, user.UUID)
+	expectNoRows(t, err)
+	if err := dr.CreateUser(ctx, &service.DBUser{UUID: newUUID(t), Username: user.Username, Email: user.Email, HashedPassword: "hash", CreatedByUUID: friend.UUID, CreatedAt: 5000}); err != nil {
+		t.Fatalf("expected the username and email of an erased user free again: %v", err)
+	}
+	followers, err := dr.ListUserFollowers(ctx, friend.UUID)
+	if err != nil || len(followers) != 0 {
+		t.Fatalf("expected the erased user's follows removed, got %v %v", followers, err)
+	}
+	gotInvited, err := dr.GetUserByID(ctx, invited.UUID)
+	if err != nil || gotInvited.CreatedByUUID != erasure.TombstoneUUID {
+		t.Fatalf("expected the tombstone as the invited user's creator, got %+v %v", gotInvited, err)
+	}
+
+	onUser, err := dr.ListAuditEntries(ctx, user.UUID, "", 0, 100)
+	if err != nil || len(onUser) != 0 {
+		t.Fatalf("expected no audit entries left on the user, got %+v %v", onUser, err)
+	}
+	onTombstone, err := dr.ListAuditEntries(ctx, erasure.TombstoneUUID, "", 0, 100)
+	if err != nil {
+		t.Fatalf("failed to list audit entries: %v", err)
+	}
+	if len(onTombstone) != 5 || onTombstone[0].Action != service.AuditUserErased || onTombstone[0].ActorUUID != erasure.TombstoneUUID {
+		t.Fatalf("expected the user's entries and the erasure under the tombstone, got %+v", onTombstone)
+	}
+	for _, entry := range onTombstone {
+		if string(entry.Changes) != "[]" || strings.Contains(string(entry.Changes), user.Email) {
+			t.Fatalf("expected the changes of entries on the user cleared, got %s", entry.Changes)
+		}
+	}
+
+	erased := pendingEvents(t, dr, user.UUID)
+	if len(erased) != 1 || erased[0].Type != service.EventUserErased {
+		t.Fatalf("expected only the erased event left on the user, got %+v", erased)
+	}
+	var payload service.UserEventPayload
+	if err := json.Unmarshal(erased[0].Payload, &payload); err != nil || payload.UUID != user.UUID || payload.TombstoneUUID != erasure.TombstoneUUID {
+		t.Fatalf("expected the erased event to carry the user and tombstone, got %s", erased[0].Payload)
+	}
+	for _, event := range pendingEvents(t, dr, erasure.TombstoneUUID) {
+		if strings.Contains(string(event.Payload), user.UUID) || strings.Contains(string(event.Payload), user.Email) {
+			t.Fatalf("expected the user scrubbed from their events, got %s", event.Payload)
+		}
+	}
+}
+
+func testSearchUsers(t *testing.T, dr service.DataRepository) {
+	ctx := context.Background()
+	named := newDBUser(t)
+	named.DisplayName = sql.NullString{Valid: true, String: "Named User"}
+	if err := dr.CreateUser(ctx, named); err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	if got, err := dr.GetUserByID(ctx, named.UUID); err != nil || got.DisplayName != named.DisplayName {
+		t.Fatalf("expected the display name stored, got %+v, %v", got, err)
+	}
+	follower, deleted := mustCreateUser(t, dr), mustCreateUser(t, dr)
+	for _, err := range []error{
+		dr.AddUserFollower(ctx, follower.UUID, named.UUID),
+		dr.AddUserFollower(ctx, deleted.UUID, named.UUID),
+		dr.AddUserFollower(ctx, named.UUID, follower.UUID),
+		dr.DeleteUser(ctx, deleted.UUID, deleted.UUID, 1500),
+	} {
+		if err != nil {
+			t.Fatalf("failed to set up users: %v", err)
+		}
+	}
+
+	found := map[string]*service.DBSearchUser{}
+	after := ""
+	for {
+		users, err := dr.ListSearchUsers(ctx, after, 50)
+		if err != nil {
+			t.Fatalf("failed to list search users: %v", err)
+		}
+		for _, user := range users {
+			if user.UUID <= after {
+				t.Fatalf("expected users listed by uuid after %s, got %s", after, user.UUID)
+			}
+			after = user.UUID
+			found[user.UUID] = user
+		}
+		if len(users) < 50 {
+			break
+		}
+	}
+	if _, ok := found[deleted.UUID]; ok {
+		t.Fatal("expected the deleted user left out")
+	}
+	got, ok := found[named.UUID]
+	if !ok || got.Username != named.Username || got.DisplayName != named.DisplayName {
+		t.Fatalf("expected the named user listed, got %+v", got)
+	}
+	if got.Followers != 1 {
+		t.Fatalf("expected the deleted follower uncounted, got %d followers", got.Followers)
+	}
+	if got, ok := found[follower.UUID]; !ok || got.Followers != 1 || got.DisplayName.Valid {
+		t.Fatalf("expected the follower listed without a display name, got %+v", got)
+	}
+
+	one, err := dr.GetSearchUser(ctx, named.UUID)
+	if err != nil || one.Username != named.Username || one.DisplayName != named.DisplayName || one.Followers != 1 {
+		t.Fatalf("expected the named user got as listed, got %+v, %v", one, err)
+	}
+	_, err = dr.GetSearchUser(ctx, deleted.UUID)
+	expectNoRows(t, err)
+}
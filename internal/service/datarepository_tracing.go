@@ -0,0 +1,283 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentation = "github.com/srcabl/users/internal/service"
+
+// startDBSpan starts the span of a statement, named after its sql operation
+// and table as in "SELECT users". The statement's arguments are never put on
+// the span since they hold emails, password hashes and tokens.
+func startDBSpan(ctx context.Context, system, statement string) (context.Context, trace.Span) {
+	operation, table := describeStatement(statement)
+	name := operation
+	if table != "" {
+		name += " " + table
+	}
+	return otel.Tracer(instrumentation).Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system", system),
+			attribute.String("db.operation", operation),
+			attribute.String("db.sql.table", table),
+		),
+	)
+}
+
+func endDBSpan(span trace.Span, err error) {
+	if err != nil && err != sql.ErrNoRows {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "statement failed")
+	}
+	span.End()
+}
+
+// describeStatement picks the sql operation and the table it acts on out of a statement
+func describeStatement(statement string) (string, string) {
+	fields := strings.Fields(statement)
+	if len(fields) == 0 {
+		return "", ""
+	}
+	operation := strings.ToUpper(fields[0])
+	for i, field := range fields[:len(fields)-1] {
+		switch strings.ToUpper(field) {
+		case "FROM", "INTO", "UPDATE":
+			return operation, fields[i+1]
+		}
+	}
+	return operation, ""
+}
+
+// bindParams numbers the statement's ? placeholders $1, $2... for postgres,
+// which has no ? placeholders. Question marks in string literals are left be.
+func bindParams(system, statement string) string {
+	if system != "postgresql" {
+		return statement
+	}
+	var b strings.Builder
+	n := 0
+	quoted := false
+	for _, r := range statement {
+		switch {
+		case r == '\'':
+			quoted = !quoted
+		case r == '?' && !quoted:
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// unixTime is a UNIX time bound to a timestamp column. mysql and sqlite keep
+// timestamps as UNIX times, postgres gets it as a time.
+type unixTime int64
+
+// Value satisfies driver.Valuer
+func (t unixTime) Value() (driver.Value, error) {
+	return int64(t), nil
+}
+
+// nullUnixTime is a UNIX time bound to a nullable timestamp column
+type nullUnixTime sql.NullInt64
+
+// Value satisfies driver.Valuer
+func (t nullUnixTime) Value() (driver.Value, error) {
+	if !t.Valid {
+		return nil, nil
+	}
+	return t.Int64, nil
+}
+
+// bindArgs turns the UNIX times among the args into times for postgres,
+// whose timestamp columns are TIMESTAMPTZ
+func bindArgs(system string, args []interface{}) []interface{} {
+	if system != "postgresql" {
+		return args
+	}
+	bound := make([]interface{}, len(args))
+	for i, arg := range args {
+		switch v := arg.(type) {
+		case unixTime:
+			bound[i] = time.Unix(int64(v), 0).UTC()
+		case nullUnixTime:
+			if v.Valid {
+				bound[i] = time.Unix(v.Int64, 0).UTC()
+			}
+		default:
+			bound[i] = arg
+		}
+	}
+	return bound
+}
+
+// unixTimeScanner scans a postgres timestamp, or any integer, into a UNIX time
+type unixTimeScanner struct {
+	dest interface{}
+}
+
+// Scan satisfies sql.Scanner
+func (s unixTimeScanner) Scan(src interface{}) error {
+	var value sql.NullInt64
+	switch v := src.(type) {
+	case nil:
+	case time.Time:
+		value = sql.NullInt64{Valid: true, Int64: v.Unix()}
+	default:
+		if err := value.Scan(src); err != nil {
+			return err
+		}
+	}
+	switch dest := s.dest.(type) {
+	case *int64:
+		if !value.Valid {
+			return errors.New("converting NULL to int64 is unsupported")
+		}
+		*dest = value.Int64
+	case *sql.NullInt64:
+		*dest = value
+	}
+	return nil
+}
+
+// scanDests has the int64 dests of a postgres row take its timestamps as
+// UNIX times
+func scanDests(system string, dest []interface{}) []interface{} {
+	if system != "postgresql" {
+		return dest
+	}
+	wrapped := make([]interface{}, len(dest))
+	for i, d := range dest {
+		switch d.(type) {
+		case *int64, *sql.NullInt64:
+			wrapped[i] = unixTimeScanner{dest: d}
+		default:
+			wrapped[i] = d
+		}
+	}
+	return wrapped
+}
+
+// dbRow is a row whose timestamps scan into UNIX times on every system
+type dbRow struct {
+	*sql.Row
+	system string
+}
+
+// Scan copies the row's columns into dest
+func (r *dbRow) Scan(dest ...interface{}) error {
+	return r.Row.Scan(scanDests(r.system, dest)...)
+}
+
+// dbRows are rows whose timestamps scan into UNIX times on every system
+type dbRows struct {
+	*sql.Rows
+	system string
+}
+
+// Scan copies the current row's columns into dest
+func (r *dbRows) Scan(dest ...interface{}) error {
+	return r.Rows.Scan(scanDests(r.system, dest)...)
+}
+
+// queryRow runs a query expected to return at most one row
+func (s *sqlDB) queryRow(ctx context.Context, query string, args ...interface{}) *dbRow {
+	ctx, span := startDBSpan(ctx, s.system, query)
+	row := s.db().QueryRowContext(ctx, bindParams(s.system, query), bindArgs(s.system, args)...)
+	endDBSpan(span, row.Err())
+	return &dbRow{Row: row, system: s.system}
+}
+
+// query runs a query returning rows
+func (s *sqlDB) query(ctx context.Context, query string, args ...interface{}) (*dbRows, error) {
+	ctx, span := startDBSpan(ctx, s.system, query)
+	rows, err := s.db().QueryContext(ctx, bindParams(s.system, query), bindArgs(s.system, args)...)
+	endDBSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+	return &dbRows{Rows: rows, system: s.system}, nil
+}
+
+// dbTx is a transaction whose statements are traced as children of the
+// transaction's span
+type dbTx struct {
+	tx     *sql.Tx
+	system string
+	span   trace.Span
+}
+
+// ExecContext runs a statement in the transaction
+func (t *dbTx) ExecContext(ctx context.Context, statement string, args ...interface{}) (sql.Result, error) {
+	ctx, span := startDBSpan(trace.ContextWithSpan(ctx, t.span), t.system, statement)
+	res, err := t.tx.ExecContext(ctx, bindParams(t.system, statement), bindArgs(t.system, args)...)
+	endDBSpan(span, err)
+	return res, err
+}
+
+// QueryRowContext runs a query expected to return at most one row in the transaction
+func (t *dbTx) QueryRowContext(ctx context.Context, query string, args ...interface{}) *dbRow {
+	ctx, span := startDBSpan(trace.ContextWithSpan(ctx, t.span), t.system, query)
+	row := t.tx.QueryRowContext(ctx, bindParams(t.system, query), bindArgs(t.system, args)...)
+	endDBSpan(span, row.Err())
+	return &dbRow{Row: row, system: t.system}
+}
+
+// QueryContext runs a query returning rows in the transaction
+func (t *dbTx) QueryContext(ctx context.Context, query string, args ...interface{}) (*dbRows, error) {
+	ctx, span := startDBSpan(trace.ContextWithSpan(ctx, t.span), t.system, query)
+	rows, err := t.tx.QueryContext(ctx, bindParams(t.system, query), bindArgs(t.system, args)...)
+	endDBSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+	return &dbRows{Rows: rows, system: t.system}, nil
+}
+
+// insertReturningID runs an insert into a table with an id column and
+// returns the id of the row inserted. lib/pq does not support LastInsertId, so
+// postgres has the insert return the id instead.
+func (t *dbTx) insertReturningID(ctx context.Context, statement string, args ...interface{}) (int64, error) {
+	if t.system == "postgresql" {
+		var id int64
+		err := t.QueryRowContext(ctx, strings.TrimSpace(statement)+" RETURNING id", args...).Scan(&id)
+		return id, err
+	}
+	res, err := t.ExecContext(ctx, statement, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// insertUnlessHeld runs an insert that does nothing when the row is already
+// there, and reports whether it inserted it. key is a column of the primary
+// key, which mysql sets to itself on a duplicate.
+func (t *dbTx) insertUnlessHeld(ctx context.Context, statement, key string, args ...interface{}) (bool, error) {
+	statement = strings.TrimSpace(statement)
+	if t.system == "mysql" {
+		statement += "\nON DUPLICATE KEY UPDATE " + key + "=" + key
+	} else {
+		statement += "\nON CONFLICT DO NOTHING"
+	}
+	res, err := t.ExecContext(ctx, statement, args...)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
@@ -0,0 +1,387 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const listWebhooksQuery = `
+SELECT
+	uuid,
+	url,
+	secret,
+	event_types,
+	created_by_uuid,
+	created_at
+FROM
+	webhooks
+ORDER BY
+	created_at, uuid
+`
+
+const createWebhookStatement = `
+INSERT INTO
+	webhooks (
+		uuid,
+		url,
+		secret,
+		event_types,
+		created_by_uuid,
+		created_at
+	)
+VALUES
+	(?, ?, ?, ?, ?, ?)
+`
+
+// CreateWebhook creates a webhook subscription
+func (dr *dataRepository) CreateWebhook(ctx context.Context, webhook *DBWebhook) error {
+	_, err := dr.execStatement(ctx, createWebhookStatement,
+		webhook.UUID,
+		webhook.URL,
+		webhook.Secret,
+		strings.Join(webhook.EventTypes, ","),
+		webhook.CreatedByUUID,
+		unixTime(webhook.CreatedAt),
+	)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create webhook %s", webhook.UUID)
+	}
+	return nil
+}
+
+// ListWebhooks lists every webhook subscription, oldest first
+func (dr *dataRepository) ListWebhooks(ctx context.Context) ([]*DBWebhook, error) {
+	rows, err := dr.query(ctx, listWebhooksQuery)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list webhooks")
+	}
+	webhooks, err := scanWebhooks(rows)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list webhooks")
+	}
+	return webhooks, nil
+}
+
+// scanWebhooks scans and closes rows of webhooks
+func scanWebhooks(rows *dbRows) ([]*DBWebhook, error) {
+	defer rows.Close()
+	var webhooks []*DBWebhook
+	for rows.Next() {
+		webhook := &DBWebhook{}
+		var eventTypes string
+		err := rows.Scan(
+			&webhook.UUID,
+			&webhook.URL,
+			&webhook.Secret,
+			&eventTypes,
+			&webhook.CreatedByUUID,
+			&webhook.CreatedAt,
+		)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to scan webhook")
+		}
+		if eventTypes != "" {
+			webhook.EventTypes = strings.Split(eventTypes, ",")
+		}
+		webhooks = append(webhooks, webhook)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to read rows")
+	}
+	return webhooks, nil
+}
+
+const deleteWebhookDeliveriesStatement = `
+DELETE FROM
+	webhook_deliveries
+WHERE
+	webhook_uuid=?
+`
+
+const deleteWebhookStatement = `
+DELETE FROM
+	webhooks
+WHERE
+	uuid=?
+`
+
+// DeleteWebhook deletes the webhook subscription along with its deliveries,
+// delivered or not
+func (dr *dataRepository) DeleteWebhook(ctx context.Context, webhookUUID string) error {
+	if err := dr.deleteWebhook(ctx, deleteWebhookDeliveriesStatement, deleteWebhookStatement, webhookUUID); err != nil {
+		return errors.Wrapf(err, "failed to delete webhook %s", webhookUUID)
+	}
+	return nil
+}
+
+func (s *sqlDB) deleteWebhook(ctx context.Context, deliveriesStatement, webhookStatement, webhookUUID string) error {
+	return s.inTx(ctx, func(tx *dbTx) error {
+		if _, err := tx.ExecContext(ctx, deliveriesStatement, webhookUUID); err != nil {
+			return errors.Wrap(err, "failed to execute statement to delete deliveries")
+		}
+		res, err := tx.ExecContext(ctx, webhookStatement, webhookUUID)
+		if err != nil {
+			return errors.Wrap(err, "failed to execute statement to delete webhook")
+		}
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return errors.Wrap(err, "failed to read rows affected")
+		}
+		if affected == 0 {
+			return sql.ErrNoRows
+		}
+		return nil
+	})
+}
+
+const insertWebhookDeliveryStatement = `
+INSERT INTO
+	webhook_deliveries (
+		uuid,
+		webhook_uuid,
+		event_id,
+		event_uuid,
+		event_type,
+		aggregate_type,
+		aggregate_uuid,
+		payload,
+		event_created_at,
+		status,
+		attempts,
+		next_attempt_at,
+		last_error,
+		last_status_code,
+		created_at
+	)
+VALUES
+	(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+`
+
+// queueWebhookDeliveries queues a delivery of the recorded event to every
+// webhook subscribed to it, in the transaction that recorded it
+func queueWebhookDeliveries(ctx context.Context, tx *dbTx, listQuery, insertStatement string, event *DBEvent) error {
+	rows, err := tx.QueryContext(ctx, listQuery)
+	if err != nil {
+		return errors.Wrapf(err, "failed to list webhooks for %s event", event.Type)
+	}
+	webhooks, err := scanWebhooks(rows)
+	if err != nil {
+		return errors.Wrapf(err, "failed to list webhooks for %s event", event.Type)
+	}
+	deliveries, err := newWebhookDeliveries(event, webhooks)
+	if err != nil {
+		return err
+	}
+	for _, delivery := range deliveries {
+		_, err := tx.ExecContext(ctx, insertStatement,
+			delivery.UUID,
+			delivery.WebhookUUID,
+			delivery.EventID,
+			delivery.EventUUID,
+			delivery.EventType,
+			delivery.AggregateType,
+			delivery.AggregateUUID,
+			string(delivery.Payload),
+			unixTime(delivery.EventCreatedAt),
+			delivery.Status,
+			delivery.Attempts,
+			unixTime(delivery.NextAttemptAt),
+			delivery.LastError,
+			delivery.LastStatusCode,
+			unixTime(delivery.CreatedAt),
+		)
+		if err != nil {
+			return errors.Wrapf(err, "failed to execute statement to queue %s event for webhook %s", event.Type, delivery.WebhookUUID)
+		}
+	}
+	return nil
+}
+
+const getWebhookDeliveryByQuery = `
+SELECT
+	uuid,
+	webhook_uuid,
+	event_id,
+	event_uuid,
+	event_type,
+	aggregate_type,
+	aggregate_uuid,
+	payload,
+	event_created_at,
+	status,
+	attempts,
+	next_attempt_at,
+	last_error,
+	last_status_code,
+	created_at,
+	delivered_at
+FROM
+	webhook_deliveries
+
+`
+
+// GetWebhookDelivery gets the webhook delivery by its id
+func (dr *dataRepository) GetWebhookDelivery(ctx context.Context, deliveryUUID string) (*DBWebhookDelivery, error) {
+	delivery, err := scanWebhookDelivery(dr.queryRow(ctx, getWebhookDeliveryByQuery+`WHERE uuid=?`, deliveryUUID))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to find webhook delivery with ID %s", deliveryUUID)
+	}
+	return delivery, nil
+}
+
+// ListWebhookDeliveries lists the newest deliveries to the webhook, only
+// those in the status when one is given
+func (dr *dataRepository) ListWebhookDeliveries(ctx context.Context, webhookUUID, status string, limit int) ([]*DBWebhookDelivery, error) {
+	listQuery := getWebhookDeliveryByQuery + `WHERE webhook_uuid=? AND (?='' OR status=?) ORDER BY created_at DESC, event_id DESC LIMIT ?`
+	deliveries, err := dr.listWebhookDeliveries(ctx, listQuery, webhookUUID, status, status, limit)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list deliveries of webhook %s", webhookUUID)
+	}
+	return deliveries, nil
+}
+
+// ListDueWebhookDeliveries lists the pending deliveries due by now, the
+// longest due first
+func (dr *dataRepository) ListDueWebhookDeliveries(ctx context.Context, now int64, limit int) ([]*DBWebhookDelivery, error) {
+	listQuery := getWebhookDeliveryByQuery + `WHERE status=? AND next_attempt_at<=? ORDER BY next_attempt_at, event_id LIMIT ?`
+	deliveries, err := dr.listWebhookDeliveries(ctx, listQuery, DeliveryPending, unixTime(now), limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list due webhook deliveries")
+	}
+	return deliveries, nil
+}
+
+func (s *sqlDB) listWebhookDeliveries(ctx context.Context, query string, args ...interface{}) ([]*DBWebhookDelivery, error) {
+	rows, err := s.query(ctx, query, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query")
+	}
+	defer rows.Close()
+	var deliveries []*DBWebhookDelivery
+	for rows.Next() {
+		delivery, err := scanWebhookDelivery(rows)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to scan webhook delivery")
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to read rows")
+	}
+	return deliveries, nil
+}
+
+func scanWebhookDelivery(row scanner) (*DBWebhookDelivery, error) {
+	delivery := &DBWebhookDelivery{}
+	err := row.Scan(
+		&delivery.UUID,
+		&delivery.WebhookUUID,
+		&delivery.EventID,
+		&delivery.EventUUID,
+		&delivery.EventType,
+		&delivery.AggregateType,
+		&delivery.AggregateUUID,
+		&delivery.Payload,
+		&delivery.EventCreatedAt,
+		&delivery.Status,
+		&delivery.Attempts,
+		&delivery.NextAttemptAt,
+		&delivery.LastError,
+		&delivery.LastStatusCode,
+		&delivery.CreatedAt,
+		&delivery.DeliveredAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return delivery, nil
+}
+
+const claimWebhookDeliveryStatement = `
+UPDATE
+	webhook_deliveries
+SET
+	next_attempt_at=?
+WHERE
+	uuid=? AND status=? AND next_attempt_at=?
+`
+
+// ClaimWebhookDelivery claims the pending delivery for an attempt by moving
+// its next attempt to claimedUntil, so no other dispatcher attempts it in
+// the meantime. It reports whether the delivery was still due at
+// nextAttemptAt and so was claimed.
+func (dr *dataRepository) ClaimWebhookDelivery(ctx context.Context, deliveryUUID string, nextAttemptAt, claimedUntil int64) (bool, error) {
+	claimed, err := dr.execStatement(ctx, claimWebhookDeliveryStatement, unixTime(claimedUntil), deliveryUUID, DeliveryPending, unixTime(nextAttemptAt))
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to claim webhook delivery %s", deliveryUUID)
+	}
+	return claimed == 1, nil
+}
+
+const updateWebhookDeliveryStatement = `
+UPDATE
+	webhook_deliveries
+SET
+	status=?,
+	attempts=?,
+	next_attempt_at=?,
+	last_error=?,
+	last_status_code=?,
+	delivered_at=?
+WHERE
+	uuid=?
+`
+
+// UpdateWebhookDelivery records the outcome of an attempt at the delivery
+func (dr *dataRepository) UpdateWebhookDelivery(ctx context.Context, delivery *DBWebhookDelivery) error {
+	_, err := dr.execStatement(ctx, updateWebhookDeliveryStatement,
+		delivery.Status,
+		delivery.Attempts,
+		unixTime(delivery.NextAttemptAt),
+		delivery.LastError,
+		delivery.LastStatusCode,
+		nullUnixTime(delivery.DeliveredAt),
+		delivery.UUID,
+	)
+	return errors.Wrapf(err, "failed to update webhook delivery %s", delivery.UUID)
+}
+
+const redeliverWebhookDeliveryStatement = `
+UPDATE
+	webhook_deliveries
+SET
+	status=?,
+	attempts=0,
+	next_attempt_at=?,
+	delivered_at=NULL
+WHERE
+	uuid=?
+`
+
+// RedeliverWebhookDelivery queues the delivery to be attempted again from
+// now with a fresh set of attempts, whatever state it is in
+func (dr *dataRepository) RedeliverWebhookDelivery(ctx context.Context, deliveryUUID string, now int64) error {
+	_, err := dr.execStatement(ctx, redeliverWebhookDeliveryStatement, DeliveryPending, unixTime(now), deliveryUUID)
+	return errors.Wrapf(err, "failed to redeliver webhook delivery %s", deliveryUUID)
+}
+
+const pruneWebhookDeliveriesStatement = `
+DELETE FROM
+	webhook_deliveries
+WHERE
+	status=? AND delivered_at<?
+`
+
+// PruneWebhookDeliveries deletes the deliveries delivered before the given
+// time and returns how many it deleted. Dead deliveries are kept for
+// redelivery until their webhook is deleted.
+func (dr *dataRepository) PruneWebhookDeliveries(ctx context.Context, deliveredBefore int64) (int64, error) {
+	pruned, err := dr.execStatement(ctx, pruneWebhookDeliveriesStatement, DeliveryDelivered, unixTime(deliveredBefore))
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to prune webhook deliveries")
+	}
+	return pruned, nil
+}
@@ -0,0 +1,137 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/gofrs/uuid"
+	"github.com/pkg/errors"
+	pb "github.com/srcabl/protos/users"
+)
+
+// The states an erasure moves through. An erasure is pending from when it is
+// recorded until everything about the user is erased, so one that was
+// interrupted can be picked up again.
+const (
+	ErasurePending   = "pending"
+	ErasureCompleted = "completed"
+)
+
+// DBErasure is the database model of the erasure of a user, which is kept as
+// the proof that they were erased. Every reference to the user left on other
+// rows is replaced with the tombstone. Erased counts the rows erased, keyed by
+// the table they were deleted from or by the table and column pseudonymized,
+// as in users.created_by_uuid.
+type DBErasure struct {
+	UUID            string
+	UserUUID        string
+	TombstoneUUID   string
+	RequestedByUUID string
+	Status          string
+	Erased          map[string]int64
+	CreatedAt       int64
+	CompletedAt     sql.NullInt64
+}
+
+// Erase erases the user: their account and everything only about them is
+// deleted and every reference to them pseudonymized under a tombstone uuid.
+// Erasing is idempotent: erasing a user again returns the erasure recorded
+// the first time, and runs it again if it was interrupted before it
+// completed. A user that was never stored wraps sql.ErrNoRows.
+func Erase(ctx context.Context, datarepo DataRepository, userUUID, requestedByUUID string, now int64) (*DBErasure, error) {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate uuid for erasure")
+	}
+	tombstone, err := uuid.NewV4()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate tombstone uuid")
+	}
+	erasure, err := datarepo.StartErasure(ctx, &DBErasure{
+		UUID:            id.String(),
+		UserUUID:        userUUID,
+		TombstoneUUID:   tombstone.String(),
+		RequestedByUUID: requestedByUUID,
+		Status:          ErasurePending,
+		Erased:          map[string]int64{},
+		CreatedAt:       now,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if erasure.Status == ErasureCompleted {
+		return erasure, nil
+	}
+	if err := datarepo.EraseUser(ctx, erasure, now); err != nil {
+		return nil, err
+	}
+	return datarepo.GetErasure(ctx, userUUID)
+}
+
+// erasedActor is who an erasure is recorded as done by, the tombstone when
+// users erase themselves
+func erasedActor(erasure *DBErasure) string {
+	if erasure.RequestedByUUID == erasure.UserUUID {
+		return erasure.TombstoneUUID
+	}
+	return erasure.RequestedByUUID
+}
+
+// newErasedEvent news up the event telling other services to erase their
+// copies of the user. It is the only event left carrying the user's uuid.
+func newErasedEvent(erasure *DBErasure, at int64) (*DBEvent, error) {
+	return newEvent(EventUserErased, erasure.UserUUID, &UserEventPayload{
+		UUID:          erasure.UserUUID,
+		Roles:         []string{},
+		ActorUUID:     erasedActor(erasure),
+		TombstoneUUID: erasure.TombstoneUUID,
+	}, at)
+}
+
+// scrubUserPayload blanks the username and email out of the payload of an
+// event about the erased user and swaps their uuid for the tombstone
+func scrubUserPayload(raw []byte, erasure *DBErasure) ([]byte, error) {
+	var payload UserEventPayload
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal user event payload")
+	}
+	payload.UUID = erasure.TombstoneUUID
+	payload.Username = ""
+	payload.Email = ""
+	if payload.ActorUUID == erasure.UserUUID {
+		payload.ActorUUID = erasure.TombstoneUUID
+	}
+	scrubbed, err := json.Marshal(&payload)
+	return scrubbed, errors.Wrap(err, "failed to marshal user event payload")
+}
+
+// ToGRPC transforms the dberasure to proto erasure
+func (e *DBErasure) ToGRPC() (*pb.Erasure, error) {
+	id, err := uuid.FromString(e.UUID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to transform erasure uuid: %s", e.UUID)
+	}
+	userID, err := uuid.FromString(e.UserUUID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to transform erasure user uuid: %s", e.UserUUID)
+	}
+	tombstone, err := uuid.FromString(e.TombstoneUUID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to transform erasure tombstone uuid: %s", e.TombstoneUUID)
+	}
+	requestedBy, err := uuid.FromString(e.RequestedByUUID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to transform erasure requested by uuid: %s", e.RequestedByUUID)
+	}
+	return &pb.Erasure{
+		Uuid:            id.Bytes(),
+		UserUuid:        userID.Bytes(),
+		TombstoneUuid:   tombstone.Bytes(),
+		RequestedByUuid: requestedBy.Bytes(),
+		Status:          e.Status,
+		Erased:          e.Erased,
+		CreatedAt:       e.CreatedAt,
+		CompletedAt:     e.CompletedAt.Int64,
+	}, nil
+}
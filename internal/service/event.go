@@ -0,0 +1,187 @@
+package service
+
+import (
+	"database/sql"
+	"encoding/json"
+
+	"github.com/gofrs/uuid"
+	"github.com/pkg/errors"
+	sharedpb "github.com/srcabl/protos/shared"
+	pb "github.com/srcabl/protos/users"
+)
+
+// The types of the events written to the outbox
+const (
+	EventUserCreated   = "user.created"
+	EventUserUpdated   = "user.updated"
+	EventUserDeleted   = "user.deleted"
+	EventUserErased    = "user.erased"
+	EventFollowAdded   = "follow.added"
+	EventFollowRemoved = "follow.removed"
+)
+
+// AggregateUser is the aggregate type of every event. Follow events belong
+// to the follower, so a user's follows and unfollows keep their order.
+const AggregateUser = "user"
+
+// The types of what a follow event's user follows
+const (
+	FollowedUser   = "user"
+	FollowedSource = "source"
+)
+
+// The parts of a user an updated event says changed
+const (
+	ChangedPassword = "password"
+	ChangedRoles    = "roles"
+	ChangedLockout  = "lockout"
+)
+
+// DBEvent is the database model of an event in the outbox. IDs grow in the
+// order events were written, which is the order they are published in.
+type DBEvent struct {
+	ID            int64
+	UUID          string
+	AggregateType string
+	AggregateUUID string
+	Type          string
+	Payload       []byte
+	CreatedAt     int64
+	PublishedAt   sql.NullInt64
+}
+
+// DBEventRange is the range of event ids the outbox can still be read from.
+// Every event up to PrunedID may have been pruned, so reading on from an
+// earlier id would miss events. LatestID is the highest id written so far.
+type DBEventRange struct {
+	PrunedID int64
+	LatestID int64
+}
+
+// UserEventPayload is the payload of user events, the user as it is after
+// the change. It never carries the password hash. Erased events carry only
+// the uuid and the tombstone the user's references were replaced with.
+type UserEventPayload struct {
+	UUID          string   `json:"uuid"`
+	Username      string   `json:"username"`
+	Email         string   `json:"email"`
+	Roles         []string `json:"roles"`
+	Changed       []string `json:"changed,omitempty"`
+	ActorUUID     string   `json:"actor_uuid"`
+	TombstoneUUID string   `json:"tombstone_uuid,omitempty"`
+}
+
+// FollowEventPayload is the payload of follow events
+type FollowEventPayload struct {
+	FollowerUUID string `json:"follower_uuid"`
+	FollowedUUID string `json:"followed_uuid"`
+	FollowedType string `json:"followed_type"`
+}
+
+// newEvent news up an event about the user under a fresh uuid
+func newEvent(eventType, userUUID string, payload interface{}, createdAt int64) (*DBEvent, error) {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate uuid for event")
+	}
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to marshal %s payload", eventType)
+	}
+	return &DBEvent{
+		UUID:          id.String(),
+		AggregateType: AggregateUser,
+		AggregateUUID: userUUID,
+		Type:          eventType,
+		Payload:       raw,
+		CreatedAt:     createdAt,
+	}, nil
+}
+
+// newUserEvent news up a user event from the user as it is after the change
+func newUserEvent(eventType string, user *DBUser, roles []string, actorUUID string, createdAt int64, changed ...string) (*DBEvent, error) {
+	if roles == nil {
+		roles = []string{}
+	}
+	return newEvent(eventType, user.UUID, &UserEventPayload{
+		UUID:      user.UUID,
+		Username:  user.Username,
+		Email:     user.Email,
+		Roles:     roles,
+		Changed:   changed,
+		ActorUUID: actorUUID,
+	}, createdAt)
+}
+
+// newFollowEvent news up a follow event, which belongs to the follower
+func newFollowEvent(eventType, follower, followed, followedType string, createdAt int64) (*DBEvent, error) {
+	return newEvent(eventType, follower, &FollowEventPayload{
+		FollowerUUID: follower,
+		FollowedUUID: followed,
+		FollowedType: followedType,
+	}, createdAt)
+}
+
+// isEventType reports whether the outbox records events of the type
+func isEventType(eventType string) bool {
+	switch eventType {
+	case EventUserCreated, EventUserUpdated, EventUserDeleted, EventUserErased, EventFollowAdded, EventFollowRemoved:
+		return true
+	}
+	return false
+}
+
+// isFollowEvent reports whether events of the type carry a FollowEventPayload
+func isFollowEvent(eventType string) bool {
+	return eventType == EventFollowAdded || eventType == EventFollowRemoved
+}
+
+// ToGRPC transforms the event as it is sent to watches
+func (e *DBEvent) ToGRPC() (*pb.WatchEvent, error) {
+	event := &pb.WatchEvent{Id: e.UUID, Type: e.Type, CreatedAt: e.CreatedAt}
+	if isFollowEvent(e.Type) {
+		var payload FollowEventPayload
+		if err := json.Unmarshal(e.Payload, &payload); err != nil {
+			return nil, errors.Wrapf(err, "failed to unmarshal %s payload of event %s", e.Type, e.UUID)
+		}
+		follower, err := uuid.FromString(payload.FollowerUUID)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to transform follower uuid: %s", payload.FollowerUUID)
+		}
+		followed, err := uuid.FromString(payload.FollowedUUID)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to transform followed uuid: %s", payload.FollowedUUID)
+		}
+		followType := pb.FollowRequest_USER
+		if payload.FollowedType == FollowedSource {
+			followType = pb.FollowRequest_SOURCE
+		}
+		event.Follow = &pb.FollowChange{FollowerUuid: follower.Bytes(), FollowedUuid: followed.Bytes(), Type: followType}
+		return event, nil
+	}
+	var payload UserEventPayload
+	if err := json.Unmarshal(e.Payload, &payload); err != nil {
+		return nil, errors.Wrapf(err, "failed to unmarshal %s payload of event %s", e.Type, e.UUID)
+	}
+	id, err := uuid.FromString(payload.UUID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to transform uuid: %s", payload.UUID)
+	}
+	event.User = &pb.UserChange{
+		User: &sharedpb.User{
+			Uuid:     id.Bytes(),
+			Username: payload.Username,
+			Email:    payload.Email,
+			Roles:    payload.Roles,
+		},
+		Changed: payload.Changed,
+	}
+	if payload.ActorUUID != "" {
+		actor, err := uuid.FromString(payload.ActorUUID)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to transform actor uuid: %s", payload.ActorUUID)
+		}
+		event.User.ActorUuid = actor.Bytes()
+	}
+	return event, nil
+}
@@ -2,12 +2,21 @@ package service
 
 import (
 	"context"
-	"fmt"
+	"database/sql"
+	"strings"
+	"time"
 
 	"github.com/gofrs/uuid"
 	"github.com/pkg/errors"
 	pb "github.com/srcabl/protos/users"
-	"github.com/srcabl/services/pkg/db/mysql"
+	"github.com/srcabl/users/internal/auth"
+	"github.com/srcabl/users/internal/config"
+	"github.com/srcabl/users/internal/identity"
+	"github.com/srcabl/users/internal/keys"
+	"github.com/srcabl/users/internal/logging"
+	"github.com/srcabl/users/internal/metrics"
+	"github.com/srcabl/users/internal/token"
+	"go.uber.org/zap"
 	"golang.org/x/crypto/bcrypt"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -17,24 +26,47 @@ import (
 // Handler implments the users service
 type Handler struct {
 	pb.UnimplementedUsersServiceServer
-	datarepo DataRepository
+	datarepo   DataRepository
+	search     SearchIndex
+	tokens     *token.Issuer
+	keys       *keys.Manager
+	identities *identity.Providers
+	metrics    *metrics.Metrics
+	config     *config.Config
+
+	// watchesDone is closed on shutdown to end the watches
+	watchesDone chan struct{}
 }
 
-// New creates the service handler
-func New(db *mysql.Client) (*Handler, error) {
-	dataRepo, err := NewDataRepository(db)
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to create data repo")
-	}
+// New creates the service handler on top of any data repo
+func New(cfg *config.Config, datarepo DataRepository, search SearchIndex, tokens *token.Issuer, keyManager *keys.Manager, identities *identity.Providers, m *metrics.Metrics) (*Handler, error) {
 	return &Handler{
-		datarepo: dataRepo,
+		datarepo:    datarepo,
+		search:      search,
+		tokens:      tokens,
+		keys:        keyManager,
+		identities:  identities,
+		metrics:     m,
+		config:      cfg,
+		watchesDone: make(chan struct{}),
 	}, nil
 }
 
-// HealthCheck is the base healthcheck for the service
+// HealthCheck is the base healthcheck for the service. Orchestrators should
+// prefer the grpc.health.v1 service registered next to it.
 func (h *Handler) HealthCheck(ctx context.Context, empty *emptypb.Empty) (*emptypb.Empty, error) {
+	if err := h.Ready(ctx); err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	return &emptypb.Empty{}, nil
+}
 
-	return nil, nil
+// Ready checks that the service can reach everything it needs to serve
+func (h *Handler) Ready(ctx context.Context) error {
+	if err := h.datarepo.Ping(ctx); err != nil {
+		return errors.Wrap(err, "database is not reachable")
+	}
+	return nil
 }
 
 // GetUser handles the login of users
@@ -51,15 +83,26 @@ func (h *Handler) GetUser(ctx context.Context, req *pb.GetUserRequest) (*pb.GetU
 	if err != nil {
 		return nil, status.Error(codes.InvalidArgument, errors.Wrap(err, "uuid is not well formed").Error())
 	}
+	if !canSeeEmail(ctx, user.UUID) {
+		pbUser.Email = ""
+	}
 	return &pb.GetUserResponse{User: pbUser}, nil
 }
 
+// canSeeEmail reports whether the caller may see the user's email: the user
+// themselves, internal services and admins may
+func canSeeEmail(ctx context.Context, userUUID string) bool {
+	principal := auth.FromContext(ctx)
+	return principal.IsService() || principal.HasRole(auth.RoleAdmin) || principal.UserUUID == userUUID
+}
+
 // Follow handles the adding of followers
 func (h *Handler) Follow(ctx context.Context, req *pb.FollowRequest) (*pb.FollowResponse, error) {
 	res, err := performFollow(ctx, req, h.datarepo.AddUserFollower, h.datarepo.AddSourceFollower)
 	if err != nil {
 		return nil, status.Error(codes.Internal, errors.Wrap(err, "something happened when trying to follow").Error())
 	}
+	h.metrics.Follow(followType(req.Type))
 	return res, nil
 }
 
@@ -69,9 +112,14 @@ func (h *Handler) UnFollow(ctx context.Context, req *pb.FollowRequest) (*pb.Foll
 	if err != nil {
 		return nil, status.Error(codes.Internal, errors.Wrap(err, "something happened when trying to unfollow").Error())
 	}
+	h.metrics.Unfollow(followType(req.Type))
 	return res, nil
 }
 
+func followType(t pb.FollowRequest_FollowType) string {
+	return strings.ToLower(t.String())
+}
+
 type drFollowFunc func(context.Context, string, string) error
 
 func performFollow(ctx context.Context, req *pb.FollowRequest, userFollowFunc, sourceFollowFunc drFollowFunc) (*pb.FollowResponse, error) {
@@ -102,15 +150,38 @@ func performFollow(ctx context.Context, req *pb.FollowRequest, userFollowFunc, s
 
 // ValidateUserCredentials handles the login of users
 func (h *Handler) ValidateUserCredentials(ctx context.Context, req *pb.ValidateUserCredentialsRequest) (*pb.ValidateUserCredentialsResponse, error) {
+	dbUser, err := h.validateCredentials(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if dbUser == nil {
+		return &pb.ValidateUserCredentialsResponse{
+			User:    nil,
+			IsValid: false,
+		}, nil
+	}
+	pbUser, err := dbUser.ToCredentialsGRPC()
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, errors.Wrap(err, "uuid is not well formed").Error())
+	}
+	return &pb.ValidateUserCredentialsResponse{User: pbUser, IsValid: true}, nil
+}
+
+// validateCredentials looks the user up and checks their password. It returns
+// a nil user when the password does not match.
+func (h *Handler) validateCredentials(ctx context.Context, req *pb.ValidateUserCredentialsRequest) (validated *DBUser, err error) {
+	defer func() {
+		h.metrics.Login(metrics.MethodPassword, validated != nil && err == nil)
+	}()
 	var dbUser *DBUser
-	if req.ValidateUserBy == pb.ValidateUserCredentialsRequest_EMAIL {
+	if req.GetValidateUserBy() == pb.ValidateUserCredentialsRequest_EMAIL {
 		emailUser, err := h.datarepo.GetUserByEmail(ctx, req.Email)
 		if err != nil {
 			return nil, status.Error(codes.InvalidArgument, errors.Wrap(err, "failed to get user by email").Error())
 		}
 		dbUser = emailUser
 	}
-	if req.ValidateUserBy == pb.ValidateUserCredentialsRequest_USERNAME {
+	if req.GetValidateUserBy() == pb.ValidateUserCredentialsRequest_USERNAME {
 		usernameUser, err := h.datarepo.GetUserByUsername(ctx, req.Username)
 		if err != nil {
 			return nil, status.Error(codes.InvalidArgument, errors.Wrap(err, "failed to get user by username").Error())
@@ -120,21 +191,31 @@ func (h *Handler) ValidateUserCredentials(ctx context.Context, req *pb.ValidateU
 	if dbUser == nil {
 		return nil, status.Error(codes.InvalidArgument, errors.New("user can only be validated by email or username").Error())
 	}
+	now := time.Now()
+	if dbUser.IsLocked(now.Unix()) {
+		return nil, status.Error(codes.PermissionDenied, "user is locked after too many failed logins")
+	}
 	if err := bcrypt.CompareHashAndPassword([]byte(dbUser.HashedPassword), []byte(req.Password)); err != nil {
-		return &pb.ValidateUserCredentialsResponse{
-			User:    nil,
-			IsValid: false,
-		}, nil
+		lockout := h.config.Lockout
+		if err := h.datarepo.RecordFailedLogin(ctx, dbUser.UUID, lockout.Threshold, now.Unix(), now.Add(lockout.Duration).Unix()); err != nil {
+			return nil, status.Error(codes.Internal, errors.Wrap(err, "failed to record failed login").Error())
+		}
+		// a lock still set here has run out, and the count starts again
+		attempts := dbUser.FailedLoginAttempts
+		if dbUser.LockedUntil.Valid {
+			attempts = 0
+		}
+		if lockout.Threshold > 0 && attempts+1 >= lockout.Threshold {
+			h.metrics.Lockout()
+		}
+		return nil, nil
 	}
-
-	fmt.Printf("\n\nUser Getting GRPC: %+v", dbUser)
-	pbUser, err := dbUser.ToGRPC()
-	if err != nil {
-		return nil, status.Error(codes.InvalidArgument, errors.Wrap(err, "uuid is not well formed").Error())
+	if dbUser.FailedLoginAttempts > 0 {
+		if err := h.datarepo.ResetFailedLogins(ctx, dbUser.UUID); err != nil {
+			return nil, status.Error(codes.Internal, errors.Wrap(err, "failed to reset failed logins").Error())
+		}
 	}
-
-	fmt.Printf("\n\npb validated: %+v", pbUser)
-	return &pb.ValidateUserCredentialsResponse{User: pbUser, IsValid: true}, nil
+	return dbUser, nil
 }
 
 // CreateUser handles the creation of users
@@ -143,15 +224,14 @@ func (h *Handler) CreateUser(ctx context.Context, req *pb.CreateUserRequest) (*p
 	if err != nil {
 		return nil, status.Error(codes.InvalidArgument, errors.Wrap(err, "failed to hydrate user for create").Error())
 	}
-	fmt.Printf("incoming User: %+v", dbUser)
 	if isValid := h.datarepo.ValidateUserForCreate(ctx, dbUser); !isValid {
-		fmt.Println("not valid")
+		logging.FromContext(ctx).Debug("user to create clashes with an existing user", zap.String("username", dbUser.Username))
 		return nil, status.Error(codes.InvalidArgument, errors.New("failed to validate user for create").Error())
 	}
-	fmt.Println("isvalid")
 	if err := h.datarepo.CreateUser(ctx, dbUser); err != nil {
 		return nil, status.Error(codes.InvalidArgument, errors.Wrap(err, "failed to create user").Error())
 	}
+	h.metrics.Signup(metrics.MethodPassword)
 	hydratedPBUser, err := dbUser.ToGRPC()
 	if err != nil {
 		return nil, status.Error(codes.InvalidArgument, errors.Wrap(err, "something ridiculos").Error())
@@ -161,14 +241,23 @@ func (h *Handler) CreateUser(ctx context.Context, req *pb.CreateUserRequest) (*p
 	}, nil
 }
 
-// UpdateUser handles the updating of users
+// UpdateUser handles the updating of users. Profiles cannot be edited yet,
+// so it tells clients the rpc is unimplemented.
 func (h *Handler) UpdateUser(ctx context.Context, req *pb.UpdateUserRequest) (*pb.UpdateUserResponse, error) {
-
-	return nil, errors.New("not implemented")
+	return nil, status.Error(codes.Unimplemented, "UpdateUser is not implemented")
 }
 
 // DeleteUser handles the deletion of users
 func (h *Handler) DeleteUser(ctx context.Context, req *pb.DeleteUserRequest) (*pb.DeleteUserResponse, error) {
-
-	return nil, errors.New("not implemented")
+	id, err := uuid.FromBytes(req.Uuid)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, errors.Wrap(err, "uuid is not well formed").Error())
+	}
+	if err := h.datarepo.DeleteUser(ctx, id.String(), actorUUID(ctx), time.Now().Unix()); err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return nil, status.Error(codes.NotFound, "user does not exist")
+		}
+		return nil, status.Error(codes.Internal, errors.Wrap(err, "failed to delete user").Error())
+	}
+	return &pb.DeleteUserResponse{}, nil
 }
@@ -0,0 +1,65 @@
+package service
+
+import (
+	"context"
+
+	"github.com/gofrs/uuid"
+	"github.com/pkg/errors"
+	pb "github.com/srcabl/protos/users"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// The number of entries ListAuditLog returns without a limit, and the most it
+// returns with one
+const (
+	defaultAuditLimit = 50
+	maxAuditLimit     = 500
+)
+
+// ListAuditLog lists the newest entries of the audit log on a user, by an
+// actor or both. Passing the id of the oldest entry returned as before id
+// pages back through the log.
+func (h *Handler) ListAuditLog(ctx context.Context, req *pb.ListAuditLogRequest) (*pb.ListAuditLogResponse, error) {
+	if len(req.UserUuid) == 0 && len(req.ActorUuid) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "a user uuid or an actor uuid is required")
+	}
+	var userUUID, actorUUID string
+	if len(req.UserUuid) > 0 {
+		id, err := uuid.FromBytes(req.UserUuid)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, errors.Wrap(err, "uuid of user is invalid").Error())
+		}
+		userUUID = id.String()
+	}
+	if len(req.ActorUuid) > 0 {
+		id, err := uuid.FromBytes(req.ActorUuid)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, errors.Wrap(err, "uuid of actor is invalid").Error())
+		}
+		actorUUID = id.String()
+	}
+	if req.BeforeId < 0 {
+		return nil, status.Error(codes.InvalidArgument, "before id must not be negative")
+	}
+	limit := int(req.Limit)
+	if limit <= 0 {
+		limit = defaultAuditLimit
+	}
+	if limit > maxAuditLimit {
+		limit = maxAuditLimit
+	}
+	entries, err := h.datarepo.ListAuditEntries(ctx, userUUID, actorUUID, req.BeforeId, limit)
+	if err != nil {
+		return nil, status.Error(codes.Internal, errors.Wrap(err, "failed to list audit log").Error())
+	}
+	pbEntries := make([]*pb.AuditEntry, 0, len(entries))
+	for _, entry := range entries {
+		pbEntry, err := entry.ToGRPC()
+		if err != nil {
+			return nil, status.Error(codes.Internal, errors.Wrap(err, "failed to transform audit entry").Error())
+		}
+		pbEntries = append(pbEntries, pbEntry)
+	}
+	return &pb.ListAuditLogResponse{Entries: pbEntries}, nil
+}
@@ -0,0 +1,58 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/pkg/errors"
+	pb "github.com/srcabl/protos/users"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// BlockUser blocks a user for the blocker, so neither finds the other in
+// searches. Blocking a user already blocked does nothing.
+func (h *Handler) BlockUser(ctx context.Context, req *pb.BlockRequest) (*pb.BlockResponse, error) {
+	blockerUUID, blockedUUID, err := blockUUIDs(req)
+	if err != nil {
+		return nil, err
+	}
+	if blockerUUID == blockedUUID {
+		return nil, status.Error(codes.InvalidArgument, "users cannot block themselves")
+	}
+	for _, userUUID := range []string{blockerUUID, blockedUUID} {
+		if _, err := h.datarepo.GetUserByID(ctx, userUUID); err != nil {
+			return nil, status.Error(codes.NotFound, errors.Wrap(err, "failed to get user").Error())
+		}
+	}
+	if err := h.datarepo.BlockUser(ctx, blockerUUID, blockedUUID, time.Now().Unix()); err != nil {
+		return nil, status.Error(codes.Internal, errors.Wrap(err, "failed to block user").Error())
+	}
+	return &pb.BlockResponse{}, nil
+}
+
+// UnblockUser lifts the blocker's block of a user. Unblocking a user not
+// blocked does nothing.
+func (h *Handler) UnblockUser(ctx context.Context, req *pb.BlockRequest) (*pb.BlockResponse, error) {
+	blockerUUID, blockedUUID, err := blockUUIDs(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.datarepo.UnblockUser(ctx, blockerUUID, blockedUUID); err != nil {
+		return nil, status.Error(codes.Internal, errors.Wrap(err, "failed to unblock user").Error())
+	}
+	return &pb.BlockResponse{}, nil
+}
+
+func blockUUIDs(req *pb.BlockRequest) (string, string, error) {
+	blockerUUID, err := uuid.FromBytes(req.BlockerUuid)
+	if err != nil {
+		return "", "", status.Error(codes.InvalidArgument, errors.Wrap(err, "uuid of blocker is invalid").Error())
+	}
+	blockedUUID, err := uuid.FromBytes(req.BlockedUuid)
+	if err != nil {
+		return "", "", status.Error(codes.InvalidArgument, errors.Wrap(err, "uuid of blocked is invalid").Error())
+	}
+	return blockerUUID.String(), blockedUUID.String(), nil
+}
@@ -0,0 +1,55 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/pkg/errors"
+	pb "github.com/srcabl/protos/users"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// EraseUser erases everything stored about a user for good and returns the
+// erasure kept as proof. Erasing a user again returns the same erasure, so
+// an erasure that failed part way is completed by asking for it again.
+func (h *Handler) EraseUser(ctx context.Context, req *pb.EraseUserRequest) (*pb.EraseUserResponse, error) {
+	userUUID, err := uuid.FromBytes(req.UserUuid)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, errors.Wrap(err, "uuid of user is invalid").Error())
+	}
+	erasure, err := Erase(ctx, h.datarepo, userUUID.String(), actorUUID(ctx), time.Now().Unix())
+	if err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return nil, status.Error(codes.NotFound, "user does not exist")
+		}
+		return nil, status.Error(codes.Internal, errors.Wrap(err, "failed to erase user").Error())
+	}
+	pbErasure, err := erasure.ToGRPC()
+	if err != nil {
+		return nil, status.Error(codes.Internal, errors.Wrap(err, "failed to transform erasure").Error())
+	}
+	return &pb.EraseUserResponse{Erasure: pbErasure}, nil
+}
+
+// GetErasure gets the erasure of a user, the proof they were erased
+func (h *Handler) GetErasure(ctx context.Context, req *pb.GetErasureRequest) (*pb.GetErasureResponse, error) {
+	userUUID, err := uuid.FromBytes(req.UserUuid)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, errors.Wrap(err, "uuid of user is invalid").Error())
+	}
+	erasure, err := h.datarepo.GetErasure(ctx, userUUID.String())
+	if err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return nil, status.Error(codes.NotFound, "user has not been erased")
+		}
+		return nil, status.Error(codes.Internal, errors.Wrap(err, "failed to get erasure").Error())
+	}
+	pbErasure, err := erasure.ToGRPC()
+	if err != nil {
+		return nil, status.Error(codes.Internal, errors.Wrap(err, "failed to transform erasure").Error())
+	}
+	return &pb.GetErasureResponse{Erasure: pbErasure}, nil
+}
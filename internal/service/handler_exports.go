@@ -0,0 +1,126 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/pkg/errors"
+	pb "github.com/srcabl/protos/users"
+	"github.com/srcabl/users/internal/auth"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// exportChunkSize is how much of an export each download message carries,
+// well under the default grpc message size limit
+const exportChunkSize = 1 << 20
+
+// RequestDataExport queues an export of everything stored about a user, in
+// JSON unless a zip archive is asked for. Exports are built in the
+// background, GetDataExport tells when one is ready to download.
+func (h *Handler) RequestDataExport(ctx context.Context, req *pb.RequestDataExportRequest) (*pb.RequestDataExportResponse, error) {
+	userUUID, err := uuid.FromBytes(req.UserUuid)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, errors.Wrap(err, "uuid of user is invalid").Error())
+	}
+	format := req.Format
+	if format == "" {
+		format = ExportJSON
+	}
+	if format != ExportJSON && format != ExportZip {
+		return nil, status.Errorf(codes.InvalidArgument, "%q is not an export format", req.Format)
+	}
+	if _, err := h.datarepo.GetUserByID(ctx, userUUID.String()); err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return nil, status.Error(codes.NotFound, "user does not exist")
+		}
+		return nil, status.Error(codes.Internal, errors.Wrap(err, "failed to get user").Error())
+	}
+	id, err := uuid.NewV4()
+	if err != nil {
+		return nil, status.Error(codes.Internal, errors.Wrap(err, "failed to generate uuid").Error())
+	}
+	export := &DBDataExport{
+		UUID:            id.String(),
+		UserUUID:        userUUID.String(),
+		RequestedByUUID: actorUUID(ctx),
+		Format:          format,
+		Status:          ExportPending,
+		CreatedAt:       time.Now().Unix(),
+	}
+	if err := h.datarepo.CreateDataExport(ctx, export); err != nil {
+		return nil, status.Error(codes.Internal, errors.Wrap(err, "failed to create data export").Error())
+	}
+	pbExport, err := export.ToGRPC()
+	if err != nil {
+		return nil, status.Error(codes.Internal, errors.Wrap(err, "failed to transform data export").Error())
+	}
+	return &pb.RequestDataExportResponse{Export: pbExport}, nil
+}
+
+// GetDataExport gets a data export of a user, to see whether it is ready
+func (h *Handler) GetDataExport(ctx context.Context, req *pb.GetDataExportRequest) (*pb.GetDataExportResponse, error) {
+	export, err := h.getDataExport(ctx, req.UserUuid, req.ExportUuid)
+	if err != nil {
+		return nil, err
+	}
+	pbExport, err := export.ToGRPC()
+	if err != nil {
+		return nil, status.Error(codes.Internal, errors.Wrap(err, "failed to transform data export").Error())
+	}
+	return &pb.GetDataExportResponse{Export: pbExport}, nil
+}
+
+// DownloadDataExport streams a ready data export of a user in chunks. Users
+// may download their own exports, admins and internal services anyone's.
+func (h *Handler) DownloadDataExport(req *pb.DownloadDataExportRequest, stream pb.UsersService_DownloadDataExportServer) error {
+	ctx := stream.Context()
+	principal := auth.FromContext(ctx)
+	if !principal.IsService() && !principal.HasRole(auth.RoleAdmin) && !auth.IsUser(principal, req.UserUuid) {
+		return status.Error(codes.PermissionDenied, "users may only download their own exports")
+	}
+	export, err := h.getDataExport(ctx, req.UserUuid, req.ExportUuid)
+	if err != nil {
+		return err
+	}
+	if export.Status != ExportReady {
+		return status.Errorf(codes.FailedPrecondition, "data export is %s", export.Status)
+	}
+	data, err := h.datarepo.GetDataExportData(ctx, export.UUID)
+	if err != nil {
+		return status.Error(codes.Internal, errors.Wrap(err, "failed to read data export").Error())
+	}
+	for len(data) > 0 {
+		n := exportChunkSize
+		if n > len(data) {
+			n = len(data)
+		}
+		if err := stream.Send(&pb.DownloadDataExportResponse{Chunk: data[:n]}); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// getDataExport gets the export, which must be of the user
+func (h *Handler) getDataExport(ctx context.Context, rawUserUUID, rawExportUUID []byte) (*DBDataExport, error) {
+	userUUID, err := uuid.FromBytes(rawUserUUID)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, errors.Wrap(err, "uuid of user is invalid").Error())
+	}
+	exportUUID, err := uuid.FromBytes(rawExportUUID)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, errors.Wrap(err, "uuid of export is invalid").Error())
+	}
+	export, err := h.datarepo.GetDataExport(ctx, exportUUID.String())
+	if err != nil && errors.Cause(err) != sql.ErrNoRows {
+		return nil, status.Error(codes.Internal, errors.Wrap(err, "failed to get data export").Error())
+	}
+	if err != nil || export.UserUUID != userUUID.String() {
+		return nil, status.Error(codes.NotFound, "data export does not exist")
+	}
+	return export, nil
+}
@@ -0,0 +1,220 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/pkg/errors"
+	pb "github.com/srcabl/protos/users"
+	"github.com/srcabl/users/internal/identity"
+	"github.com/srcabl/users/internal/metrics"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// LinkIdentity links an external identity to an existing user
+func (h *Handler) LinkIdentity(ctx context.Context, req *pb.LinkIdentityRequest) (*pb.LinkIdentityResponse, error) {
+	userUUID, err := uuid.FromBytes(req.UserUuid)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, errors.Wrap(err, "uuid of user is invalid").Error())
+	}
+	ident, err := h.verifyIdentity(ctx, req.Proof)
+	if err != nil {
+		return nil, err
+	}
+	dbUser, err := h.datarepo.GetUserByID(ctx, userUUID.String())
+	if err != nil {
+		return nil, status.Error(codes.NotFound, errors.Wrap(err, "failed to get user").Error())
+	}
+	existing, err := h.datarepo.GetIdentity(ctx, ident.Provider, ident.Subject)
+	if err == nil {
+		if existing.UserUUID != dbUser.UUID {
+			return nil, status.Error(codes.AlreadyExists, "identity is already linked to another user")
+		}
+		return identityResponse(existing)
+	}
+	if errors.Cause(err) != sql.ErrNoRows {
+		return nil, status.Error(codes.Internal, errors.Wrap(err, "failed to check identity").Error())
+	}
+	dbIdentity := hydrateIdentity(ident, dbUser.UUID, dbUser.UUID)
+	if err := h.datarepo.CreateIdentity(ctx, dbIdentity); err != nil {
+		return nil, status.Error(codes.Internal, errors.Wrap(err, "failed to link identity").Error())
+	}
+	return identityResponse(dbIdentity)
+}
+
+func identityResponse(dbIdentity *DBIdentity) (*pb.LinkIdentityResponse, error) {
+	pbIdentity, err := dbIdentity.ToGRPC()
+	if err != nil {
+		return nil, status.Error(codes.Internal, errors.Wrap(err, "failed to transform identity").Error())
+	}
+	return &pb.LinkIdentityResponse{Identity: pbIdentity}, nil
+}
+
+// UnlinkIdentity removes the link between an external identity and a user
+func (h *Handler) UnlinkIdentity(ctx context.Context, req *pb.UnlinkIdentityRequest) (*pb.UnlinkIdentityResponse, error) {
+	userUUID, err := uuid.FromBytes(req.UserUuid)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, errors.Wrap(err, "uuid of user is invalid").Error())
+	}
+	dbUser, err := h.datarepo.GetUserByID(ctx, userUUID.String())
+	if err != nil {
+		return nil, status.Error(codes.NotFound, errors.Wrap(err, "failed to get user").Error())
+	}
+	if dbUser.HashedPassword == "" {
+		identities, err := h.datarepo.ListIdentitiesForUser(ctx, dbUser.UUID)
+		if err != nil {
+			return nil, status.Error(codes.Internal, errors.Wrap(err, "failed to list identities").Error())
+		}
+		if len(identities) <= 1 {
+			return nil, status.Error(codes.FailedPrecondition, "cannot unlink the only way this user can sign in")
+		}
+	}
+	if err := h.datarepo.DeleteIdentity(ctx, dbUser.UUID, req.Provider, req.Subject); err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return nil, status.Error(codes.NotFound, "identity is not linked to this user")
+		}
+		return nil, status.Error(codes.Internal, errors.Wrap(err, "failed to unlink identity").Error())
+	}
+	return &pb.UnlinkIdentityResponse{}, nil
+}
+
+// ListIdentities lists the external identities linked to a user
+func (h *Handler) ListIdentities(ctx context.Context, req *pb.ListIdentitiesRequest) (*pb.ListIdentitiesResponse, error) {
+	userUUID, err := uuid.FromBytes(req.UserUuid)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, errors.Wrap(err, "uuid of user is invalid").Error())
+	}
+	identities, err := h.datarepo.ListIdentitiesForUser(ctx, userUUID.String())
+	if err != nil {
+		return nil, status.Error(codes.Internal, errors.Wrap(err, "failed to list identities").Error())
+	}
+	res := &pb.ListIdentitiesResponse{}
+	for _, dbIdentity := range identities {
+		pbIdentity, err := dbIdentity.ToGRPC()
+		if err != nil {
+			return nil, status.Error(codes.Internal, errors.Wrap(err, "failed to transform identity").Error())
+		}
+		res.Identities = append(res.Identities, pbIdentity)
+	}
+	return res, nil
+}
+
+// LoginWithIdentity starts a session for the user linked to the external
+// identity, creating the user first if the identity has not been seen before
+func (h *Handler) LoginWithIdentity(ctx context.Context, req *pb.LoginWithIdentityRequest) (*pb.LoginWithIdentityResponse, error) {
+	ident, err := h.verifyIdentity(ctx, req.Proof)
+	if err != nil {
+		h.metrics.Login(metrics.MethodIdentity, false)
+		return nil, err
+	}
+	var dbUser *DBUser
+	created := false
+	existing, err := h.datarepo.GetIdentity(ctx, ident.Provider, ident.Subject)
+	switch {
+	case err == nil:
+		dbUser, err = h.datarepo.GetUserByID(ctx, existing.UserUUID)
+		if errors.Cause(err) == sql.ErrNoRows {
+			h.metrics.Login(metrics.MethodIdentity, false)
+			return nil, status.Error(codes.NotFound, "user linked to the identity is deleted")
+		}
+		if err != nil {
+			return nil, status.Error(codes.Internal, errors.Wrap(err, "failed to get linked user").Error())
+		}
+	case errors.Cause(err) == sql.ErrNoRows:
+		dbUser, err = h.createUserForIdentity(ctx, ident, req.Username)
+		if err != nil {
+			return nil, err
+		}
+		created = true
+	default:
+		return nil, status.Error(codes.Internal, errors.Wrap(err, "failed to check identity").Error())
+	}
+	if dbUser.IsLocked(time.Now().Unix()) {
+		h.metrics.Login(metrics.MethodIdentity, false)
+		return nil, status.Error(codes.PermissionDenied, "user is locked after too many failed logins")
+	}
+	issued, err := h.startSession(ctx, dbUser, req.Device, req.UserAgent)
+	if err != nil {
+		return nil, err
+	}
+	h.metrics.Login(metrics.MethodIdentity, true)
+	pbUser, err := dbUser.ToGRPC()
+	if err != nil {
+		return nil, status.Error(codes.Internal, errors.Wrap(err, "failed to transform user").Error())
+	}
+	pbSession, err := issued.session.ToGRPC()
+	if err != nil {
+		return nil, status.Error(codes.Internal, errors.Wrap(err, "failed to transform session").Error())
+	}
+	return &pb.LoginWithIdentityResponse{
+		User:                 pbUser,
+		Session:              pbSession,
+		AccessToken:          issued.accessToken,
+		AccessTokenExpiresAt: issued.accessTokenExpiresAt,
+		RefreshToken:         issued.refreshToken,
+		Created:              created,
+	}, nil
+}
+
+// createUserForIdentity creates a user without a password for a new external
+// identity, going through the same uniqueness checks as CreateUser
+func (h *Handler) createUserForIdentity(ctx context.Context, ident *identity.Identity, username string) (*DBUser, error) {
+	if ident.Email == "" || !ident.EmailVerified {
+		return nil, status.Error(codes.FailedPrecondition, "identity provider did not return a verified email")
+	}
+	if username == "" {
+		username = ident.PreferredUsername
+	}
+	if username == "" {
+		return nil, status.Error(codes.InvalidArgument, "a username is required to create a user")
+	}
+	dbUser, err := HydrateModelForCreate(&pb.CreateUserRequest{
+		Username: username,
+		Email:    ident.Email,
+	})
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, errors.Wrap(err, "failed to hydrate user for create").Error())
+	}
+	if isValid := h.datarepo.ValidateUserForCreate(ctx, dbUser); !isValid {
+		// an existing account has to sign in and link the identity itself,
+		// otherwise anyone controlling the identity could take the account over
+		return nil, status.Error(codes.AlreadyExists, "a user with this email or username already exists, sign in and link the identity instead")
+	}
+	if err := h.datarepo.CreateUserWithIdentity(ctx, dbUser, hydrateIdentity(ident, dbUser.UUID, dbUser.UUID)); err != nil {
+		return nil, status.Error(codes.Internal, errors.Wrap(err, "failed to create user for identity").Error())
+	}
+	h.metrics.Signup(metrics.MethodIdentity)
+	return dbUser, nil
+}
+
+func (h *Handler) verifyIdentity(ctx context.Context, proof *pb.IdentityProof) (*identity.Identity, error) {
+	if proof == nil {
+		return nil, status.Error(codes.InvalidArgument, "identity proof is required")
+	}
+	ident, err := h.identities.Verify(ctx, proof.Provider, identity.Proof{
+		Code:        proof.Code,
+		RedirectURL: proof.RedirectUri,
+		IDToken:     proof.IdToken,
+	})
+	if err != nil {
+		if cause := errors.Cause(err); cause == identity.ErrUnknownProvider || cause == identity.ErrRedirectNotAllowed {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		return nil, status.Error(codes.Unauthenticated, errors.Wrap(err, "failed to verify identity").Error())
+	}
+	return ident, nil
+}
+
+func hydrateIdentity(ident *identity.Identity, userUUID, createdByUUID string) *DBIdentity {
+	return &DBIdentity{
+		Provider:      ident.Provider,
+		Subject:       ident.Subject,
+		UserUUID:      userUUID,
+		Email:         sql.NullString{Valid: ident.Email != "", String: ident.Email},
+		CreatedAt:     time.Now().Unix(),
+		CreatedByUUID: createdByUUID,
+	}
+}
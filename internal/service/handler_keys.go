@@ -0,0 +1,26 @@
+package service
+
+import (
+	"context"
+
+	pb "github.com/srcabl/protos/users"
+)
+
+// GetJWKS returns the public keys access tokens can be verified with
+func (h *Handler) GetJWKS(ctx context.Context, req *pb.GetJWKSRequest) (*pb.GetJWKSResponse, error) {
+	res := &pb.GetJWKSResponse{}
+	for _, jwk := range h.keys.JWKS().Keys {
+		res.Keys = append(res.Keys, &pb.JSONWebKey{
+			Kty: jwk.KeyType,
+			Kid: jwk.KeyID,
+			Use: jwk.Use,
+			Alg: jwk.Algorithm,
+			N:   jwk.N,
+			E:   jwk.E,
+			Crv: jwk.Curve,
+			X:   jwk.X,
+			Y:   jwk.Y,
+		})
+	}
+	return res, nil
+}
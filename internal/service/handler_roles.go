@@ -0,0 +1,106 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/pkg/errors"
+	sharedpb "github.com/srcabl/protos/shared"
+	pb "github.com/srcabl/protos/users"
+	"github.com/srcabl/users/internal/auth"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// GrantRole grants a role to a user
+func (h *Handler) GrantRole(ctx context.Context, req *pb.GrantRoleRequest) (*pb.GrantRoleResponse, error) {
+	dbUser, err := h.userForRoleChange(ctx, req.UserUuid, req.Role)
+	if err != nil {
+		return nil, err
+	}
+	role := &DBRole{
+		UserUUID:      dbUser.UUID,
+		Role:          req.Role,
+		CreatedAt:     time.Now().Unix(),
+		CreatedByUUID: actorUUID(ctx),
+	}
+	if err := h.datarepo.GrantRole(ctx, role); err != nil {
+		return nil, status.Error(codes.Internal, errors.Wrap(err, "failed to grant role").Error())
+	}
+	pbUser, err := h.reloadUser(ctx, dbUser.UUID)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.GrantRoleResponse{User: pbUser}, nil
+}
+
+// RevokeRole revokes a role from a user
+func (h *Handler) RevokeRole(ctx context.Context, req *pb.RevokeRoleRequest) (*pb.RevokeRoleResponse, error) {
+	dbUser, err := h.userForRoleChange(ctx, req.UserUuid, req.Role)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.datarepo.RevokeRole(ctx, dbUser.UUID, req.Role, actorUUID(ctx), time.Now().Unix()); err != nil {
+		return nil, status.Error(codes.Internal, errors.Wrap(err, "failed to revoke role").Error())
+	}
+	pbUser, err := h.reloadUser(ctx, dbUser.UUID)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.RevokeRoleResponse{User: pbUser}, nil
+}
+
+// UnlockUser lifts the lockout a user got from too many failed logins
+func (h *Handler) UnlockUser(ctx context.Context, req *pb.UnlockUserRequest) (*pb.UnlockUserResponse, error) {
+	userUUID, err := uuid.FromBytes(req.UserUuid)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, errors.Wrap(err, "uuid of user is invalid").Error())
+	}
+	if err := h.datarepo.UnlockUser(ctx, userUUID.String(), actorUUID(ctx), time.Now().Unix()); err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return nil, status.Error(codes.NotFound, "user does not exist")
+		}
+		return nil, status.Error(codes.Internal, errors.Wrap(err, "failed to unlock user").Error())
+	}
+	return &pb.UnlockUserResponse{}, nil
+}
+
+func (h *Handler) userForRoleChange(ctx context.Context, rawUUID []byte, role string) (*DBUser, error) {
+	userUUID, err := uuid.FromBytes(rawUUID)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, errors.Wrap(err, "uuid of user is invalid").Error())
+	}
+	if !auth.IsRole(role) {
+		return nil, status.Errorf(codes.InvalidArgument, "%q is not a role", role)
+	}
+	dbUser, err := h.datarepo.GetUserByID(ctx, userUUID.String())
+	if err != nil {
+		return nil, status.Error(codes.NotFound, errors.Wrap(err, "failed to get user").Error())
+	}
+	return dbUser, nil
+}
+
+func (h *Handler) reloadUser(ctx context.Context, userUUID string) (*sharedpb.User, error) {
+	dbUser, err := h.datarepo.GetUserByID(ctx, userUUID)
+	if err != nil {
+		return nil, status.Error(codes.Internal, errors.Wrap(err, "failed to reload user").Error())
+	}
+	pbUser, err := dbUser.ToGRPC()
+	if err != nil {
+		return nil, status.Error(codes.Internal, errors.Wrap(err, "failed to transform user").Error())
+	}
+	return pbUser, nil
+}
+
+// actorUUID is the uuid recorded as the author of a change. Internal
+// services acting on their own have no uuid, so they are recorded as the
+// nil uuid.
+func actorUUID(ctx context.Context) string {
+	principal := auth.FromContext(ctx)
+	if principal.IsUser() {
+		return principal.UserUUID
+	}
+	return uuid.Nil.String()
+}
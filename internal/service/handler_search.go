@@ -0,0 +1,92 @@
+package service
+
+import (
+	"context"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+	pb "github.com/srcabl/protos/users"
+	"github.com/srcabl/users/internal/auth"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// The number of results SearchUsers returns without a limit, and the most it
+// returns with one
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+)
+
+// maxSearchQueryLength bounds queries to the longest usernames and display
+// names could start with
+const maxSearchQueryLength = 255
+
+// SearchUsers finds users by the start of their username or display name,
+// forgiving a typo or two in longer queries. Exact matches come first, then
+// the most followed. Passing the next offset of a response pages on through
+// the results, it is zero once there are no more. Users never find the users
+// they blocked or who blocked them.
+func (h *Handler) SearchUsers(ctx context.Context, req *pb.SearchUsersRequest) (*pb.SearchUsersResponse, error) {
+	query := NormalizeSearch(req.Query)
+	if query == "" {
+		return nil, status.Error(codes.InvalidArgument, "query is required")
+	}
+	if utf8.RuneCountInString(query) > maxSearchQueryLength {
+		return nil, status.Errorf(codes.InvalidArgument, "query must be at most %d characters", maxSearchQueryLength)
+	}
+	if req.Offset < 0 {
+		return nil, status.Error(codes.InvalidArgument, "offset must not be negative")
+	}
+	limit := int(req.Limit)
+	if limit <= 0 {
+		limit = defaultSearchLimit
+	}
+	if limit > maxSearchLimit {
+		limit = maxSearchLimit
+	}
+	exclude, err := h.blockedBetween(ctx, auth.FromContext(ctx))
+	if err != nil {
+		return nil, status.Error(codes.Internal, errors.Wrap(err, "failed to list blocks").Error())
+	}
+	// one more than the limit tells whether there is another page
+	results, err := h.search.SearchUsers(ctx, query, exclude, int(req.Offset), limit+1)
+	if err != nil {
+		return nil, status.Error(codes.Internal, errors.Wrap(err, "failed to search users").Error())
+	}
+	res := &pb.SearchUsersResponse{}
+	if len(results) > limit {
+		results = results[:limit]
+		res.NextOffset = req.Offset + int32(limit)
+	}
+	res.Results = make([]*pb.UserSearchResult, 0, len(results))
+	for _, result := range results {
+		pbResult, err := result.ToGRPC()
+		if err != nil {
+			return nil, status.Error(codes.Internal, errors.Wrap(err, "failed to transform search result").Error())
+		}
+		res.Results = append(res.Results, pbResult)
+	}
+	return res, nil
+}
+
+// blockedBetween is the set of users the calling user blocked or who blocked
+// them. Services block no one.
+func (h *Handler) blockedBetween(ctx context.Context, principal *auth.Principal) (map[string]bool, error) {
+	if !principal.IsUser() {
+		return nil, nil
+	}
+	blocked, err := h.datarepo.ListUserBlocks(ctx, principal.UserUUID)
+	if err != nil {
+		return nil, err
+	}
+	blockers, err := h.datarepo.ListUserBlockers(ctx, principal.UserUUID)
+	if err != nil {
+		return nil, err
+	}
+	exclude := make(map[string]bool, len(blocked)+len(blockers))
+	for _, userUUID := range append(blocked, blockers...) {
+		exclude[userUUID] = true
+	}
+	return exclude, nil
+}
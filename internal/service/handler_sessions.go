@@ -0,0 +1,227 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/pkg/errors"
+	pb "github.com/srcabl/protos/users"
+	"github.com/srcabl/users/internal/auth"
+	"github.com/srcabl/users/internal/token"
+	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// CreateSession validates the user's credentials and starts a session for their device
+func (h *Handler) CreateSession(ctx context.Context, req *pb.CreateSessionRequest) (*pb.CreateSessionResponse, error) {
+	if req.Credentials == nil {
+		return nil, status.Error(codes.InvalidArgument, "credentials are required")
+	}
+	dbUser, err := h.validateCredentials(ctx, req.Credentials)
+	if err != nil {
+		return nil, err
+	}
+	if dbUser == nil {
+		return nil, status.Error(codes.Unauthenticated, "credentials are not valid")
+	}
+	issued, err := h.startSession(ctx, dbUser, req.Device, req.UserAgent)
+	if err != nil {
+		return nil, err
+	}
+	pbUser, err := dbUser.ToGRPC()
+	if err != nil {
+		return nil, status.Error(codes.Internal, errors.Wrap(err, "failed to transform user").Error())
+	}
+	pbSession, err := issued.session.ToGRPC()
+	if err != nil {
+		return nil, status.Error(codes.Internal, errors.Wrap(err, "failed to transform session").Error())
+	}
+	return &pb.CreateSessionResponse{
+		User:                 pbUser,
+		Session:              pbSession,
+		AccessToken:          issued.accessToken,
+		AccessTokenExpiresAt: issued.accessTokenExpiresAt,
+		RefreshToken:         issued.refreshToken,
+	}, nil
+}
+
+// issuedSession is a newly started session and the tokens for it
+type issuedSession struct {
+	session              *DBSession
+	accessToken          string
+	accessTokenExpiresAt int64
+	refreshToken         string
+}
+
+// startSession creates a session for the authenticated user and issues its tokens
+func (h *Handler) startSession(ctx context.Context, dbUser *DBUser, device, userAgent string) (*issuedSession, error) {
+	sessionUUID, err := uuid.NewV4()
+	if err != nil {
+		return nil, status.Error(codes.Internal, errors.Wrap(err, "failed to generate uuid for session").Error())
+	}
+	refreshToken, refreshHash, err := token.NewRefreshToken()
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	now := time.Now().Unix()
+	session := &DBSession{
+		UUID:             sessionUUID.String(),
+		UserUUID:         dbUser.UUID,
+		RefreshTokenHash: refreshHash,
+		Device:           device,
+		UserAgent:        userAgent,
+		CreatedAt:        now,
+		LastUsedAt:       now,
+		ExpiresAt:        now + int64(h.config.Tokens.RefreshTokenTTL.Seconds()),
+	}
+	if err := h.datarepo.CreateSession(ctx, session); err != nil {
+		return nil, status.Error(codes.Internal, errors.Wrap(err, "failed to create session").Error())
+	}
+	accessToken, accessExpiresAt, err := h.tokens.Issue(dbUser.UUID, session.UUID, session.Device, dbUser.Roles)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &issuedSession{
+		session:              session,
+		accessToken:          accessToken,
+		accessTokenExpiresAt: accessExpiresAt.Unix(),
+		refreshToken:         refreshToken,
+	}, nil
+}
+
+// RefreshSession trades a refresh token for a new access token and rotates the refresh token
+func (h *Handler) RefreshSession(ctx context.Context, req *pb.RefreshSessionRequest) (*pb.RefreshSessionResponse, error) {
+	presentedHash := token.HashRefreshToken(req.RefreshToken)
+	session, err := h.datarepo.GetSessionByRefreshTokenHash(ctx, presentedHash)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, "refresh token is not valid")
+	}
+	now := time.Now().Unix()
+	if session.RefreshTokenHash != presentedHash {
+		// a rotated out token is being replayed, so the session can no longer be trusted
+		if err := h.datarepo.RevokeSession(ctx, session.UUID, now); err != nil {
+			return nil, status.Error(codes.Internal, errors.Wrap(err, "failed to revoke replayed session").Error())
+		}
+		return nil, status.Error(codes.Unauthenticated, "refresh token was already used, session revoked")
+	}
+	if !session.IsActive(now) {
+		return nil, status.Error(codes.Unauthenticated, "session is no longer active")
+	}
+	if session.Device != req.Device || session.UserAgent != req.UserAgent {
+		return nil, status.Error(codes.PermissionDenied, "refresh token belongs to a different device")
+	}
+	dbUser, err := h.datarepo.GetUserByID(ctx, session.UserUUID)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, "user of the session no longer exists")
+	}
+	if dbUser.IsLocked(now) {
+		return nil, status.Error(codes.PermissionDenied, "user is locked after too many failed logins")
+	}
+	refreshToken, refreshHash, err := token.NewRefreshToken()
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	expiresAt := now + int64(h.config.Tokens.RefreshTokenTTL.Seconds())
+	if err := h.datarepo.RotateSession(ctx, session.UUID, presentedHash, refreshHash, now, expiresAt); err != nil {
+		if errors.Cause(err) == ErrSessionRotated {
+			return nil, status.Error(codes.Unauthenticated, "refresh token was already used")
+		}
+		return nil, status.Error(codes.Internal, errors.Wrap(err, "failed to rotate session").Error())
+	}
+	session.PreviousRefreshTokenHash = sql.NullString{Valid: true, String: session.RefreshTokenHash}
+	session.RefreshTokenHash = refreshHash
+	session.LastUsedAt = now
+	session.ExpiresAt = expiresAt
+	accessToken, accessExpiresAt, err := h.tokens.Issue(session.UserUUID, session.UUID, session.Device, dbUser.Roles)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	pbSession, err := session.ToGRPC()
+	if err != nil {
+		return nil, status.Error(codes.Internal, errors.Wrap(err, "failed to transform session").Error())
+	}
+	return &pb.RefreshSessionResponse{
+		Session:              pbSession,
+		AccessToken:          accessToken,
+		AccessTokenExpiresAt: accessExpiresAt.Unix(),
+		RefreshToken:         refreshToken,
+	}, nil
+}
+
+// ListSessions lists the active sessions of a user
+func (h *Handler) ListSessions(ctx context.Context, req *pb.ListSessionsRequest) (*pb.ListSessionsResponse, error) {
+	userUUID, err := uuid.FromBytes(req.UserUuid)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, errors.Wrap(err, "uuid of user is invalid").Error())
+	}
+	sessions, err := h.datarepo.ListActiveSessionsForUser(ctx, userUUID.String(), time.Now().Unix())
+	if err != nil {
+		return nil, status.Error(codes.Internal, errors.Wrap(err, "failed to list sessions").Error())
+	}
+	res := &pb.ListSessionsResponse{}
+	for _, session := range sessions {
+		pbSession, err := session.ToGRPC()
+		if err != nil {
+			return nil, status.Error(codes.Internal, errors.Wrap(err, "failed to transform session").Error())
+		}
+		res.Sessions = append(res.Sessions, pbSession)
+	}
+	return res, nil
+}
+
+// RevokeSession revokes a single session
+func (h *Handler) RevokeSession(ctx context.Context, req *pb.RevokeSessionRequest) (*pb.RevokeSessionResponse, error) {
+	sessionUUID, err := uuid.FromBytes(req.SessionUuid)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, errors.Wrap(err, "uuid of session is invalid").Error())
+	}
+	session, err := h.datarepo.GetSessionByID(ctx, sessionUUID.String())
+	if err != nil {
+		return nil, status.Error(codes.NotFound, errors.Wrap(err, "failed to get session").Error())
+	}
+	principal := auth.FromContext(ctx)
+	if !principal.IsService() && principal.UserUUID != session.UserUUID {
+		return nil, status.Error(codes.PermissionDenied, "users may only revoke their own sessions")
+	}
+	if err := h.datarepo.RevokeSession(ctx, session.UUID, time.Now().Unix()); err != nil {
+		return nil, status.Error(codes.Internal, errors.Wrap(err, "failed to revoke session").Error())
+	}
+	return &pb.RevokeSessionResponse{}, nil
+}
+
+// RevokeAllSessions revokes every session of a user
+func (h *Handler) RevokeAllSessions(ctx context.Context, req *pb.RevokeAllSessionsRequest) (*pb.RevokeAllSessionsResponse, error) {
+	userUUID, err := uuid.FromBytes(req.UserUuid)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, errors.Wrap(err, "uuid of user is invalid").Error())
+	}
+	if err := h.datarepo.RevokeAllSessionsForUser(ctx, userUUID.String(), time.Now().Unix()); err != nil {
+		return nil, status.Error(codes.Internal, errors.Wrap(err, "failed to revoke sessions").Error())
+	}
+	return &pb.RevokeAllSessionsResponse{}, nil
+}
+
+// ChangePassword changes a user's password and revokes all of their sessions
+func (h *Handler) ChangePassword(ctx context.Context, req *pb.ChangePasswordRequest) (*pb.ChangePasswordResponse, error) {
+	userUUID, err := uuid.FromBytes(req.UserUuid)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, errors.Wrap(err, "uuid of user is invalid").Error())
+	}
+	if req.NewHashedPassword == "" {
+		return nil, status.Error(codes.InvalidArgument, "new password is required")
+	}
+	dbUser, err := h.datarepo.GetUserByID(ctx, userUUID.String())
+	if err != nil {
+		return nil, status.Error(codes.NotFound, errors.Wrap(err, "failed to get user").Error())
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(dbUser.HashedPassword), []byte(req.CurrentPassword)); err != nil {
+		return nil, status.Error(codes.PermissionDenied, "current password is not valid")
+	}
+	if err := h.datarepo.UpdateUserPassword(ctx, dbUser.UUID, req.NewHashedPassword, dbUser.UUID, time.Now().Unix()); err != nil {
+		return nil, status.Error(codes.Internal, errors.Wrap(err, "failed to change password").Error())
+	}
+	return &pb.ChangePasswordResponse{}, nil
+}
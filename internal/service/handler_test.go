@@ -1 +1,1439 @@
 package service_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/golang-jwt/jwt/v4"
+	sharedpb "github.com/srcabl/protos/shared"
+	pb "github.com/srcabl/protos/users"
+	"github.com/srcabl/users/internal/auth"
+	"github.com/srcabl/users/internal/config"
+	"github.com/srcabl/users/internal/export"
+	"github.com/srcabl/users/internal/identity"
+	"github.com/srcabl/users/internal/keys"
+	"github.com/srcabl/users/internal/metrics"
+	"github.com/srcabl/users/internal/service"
+	"github.com/srcabl/users/internal/token"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// harness is a users service backed by the in memory data repo, served over bufconn
+type harness struct {
+	client   pb.UsersServiceClient
+	tokens   *token.Issuer
+	handler  *service.Handler
+	datarepo service.DataRepository
+	search   *service.TrieSearchIndex
+}
+
+func newHarness(t *testing.T) *harness {
+	t.Helper()
+	return newHarnessOver(t, service.NewMemoryDataRepository())
+}
+
+// newHarnessOver news up a harness backed by the data repo
+func newHarnessOver(t *testing.T, datarepo service.DataRepository) *harness {
+	t.Helper()
+	return newHarnessWith(t, datarepo, nil)
+}
+
+// newHarnessWith news up a harness backed by the data repo, logging in with
+// the identity providers
+func newHarnessWith(t *testing.T, datarepo service.DataRepository, providers []config.IdentityProvider) *harness {
+	t.Helper()
+	cfg := config.Default()
+	cfg.Lockout = config.Lockout{Threshold: 3, Duration: time.Minute}
+	cfg.Watch.PollInterval = 10 * time.Millisecond
+	cfg.Search.PollInterval = 10 * time.Millisecond
+	keyManager, err := keys.NewManager(config.Keys{Secret: "handler-test-secret"})
+	if err != nil {
+		t.Fatalf("failed to new key manager: %v", err)
+	}
+	tokens, err := token.NewIssuer(cfg.Tokens, keyManager)
+	if err != nil {
+		t.Fatalf("failed to new token issuer: %v", err)
+	}
+	identities, err := identity.NewProviders(providers)
+	if err != nil {
+		t.Fatalf("failed to new identity providers: %v", err)
+	}
+	m, err := metrics.New()
+	if err != nil {
+		t.Fatalf("failed to new metrics: %v", err)
+	}
+	search := service.NewTrieSearchIndex(cfg.Search, datarepo, zap.NewNop())
+	handler, err := service.New(cfg, datarepo, search, tokens, keyManager, identities, m)
+	if err != nil {
+		t.Fatalf("failed to new handler: %v", err)
+	}
+
+	lis := bufconn.Listen(1 << 20)
+	authn := auth.NewAuthenticator(tokens, service.NewSessionChecker(datarepo))
+	server := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(auth.UnaryServerInterceptor(authn, service.Policies())),
+		grpc.ChainStreamInterceptor(auth.StreamServerInterceptor(authn, service.Policies())),
+	)
+	pb.RegisterUsersServiceServer(server, handler)
+	go func() {
+		_ = server.Serve(lis)
+	}()
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.DialContext(context.Background(), "bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithInsecure(),
+	)
+	if err != nil {
+		t.Fatalf("failed to dial bufconn: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return &harness{client: pb.NewUsersServiceClient(conn), tokens: tokens, handler: handler, datarepo: datarepo, search: search}
+}
+
+// as returns a context carrying a bearer token for the user with the roles,
+// on a session started for it. Users the data repo does not know yet are
+// stored first, and the roles granted to them, since tokens are only good
+// for their stored sessions and carry the roles stored.
+func (h *harness) as(t *testing.T, userUUID string, roles ...string) context.Context {
+	t.Helper()
+	if _, err := h.datarepo.GetUserByID(context.Background(), userUUID); err != nil {
+		user := &service.DBUser{
+			UUID:           userUUID,
+			Username:       "user-" + userUUID,
+			Email:          userUUID + "@example.com",
+			HashedPassword: "hash",
+			CreatedByUUID:  userUUID,
+			CreatedAt:      time.Now().Unix(),
+		}
+		if err := h.datarepo.CreateUser(context.Background(), user); err != nil {
+			t.Fatalf("failed to create user for token: %v", err)
+		}
+	}
+	now := time.Now().Unix()
+	for _, role := range roles {
+		if err := h.datarepo.GrantRole(context.Background(), &service.DBRole{UserUUID: userUUID, Role: role, CreatedAt: now, CreatedByUUID: userUUID}); err != nil {
+			t.Fatalf("failed to grant role for token: %v", err)
+		}
+	}
+	session := &service.DBSession{
+		UUID:             uuid.Must(uuid.NewV4()).String(),
+		UserUUID:         userUUID,
+		RefreshTokenHash: uuid.Must(uuid.NewV4()).String(),
+		Device:           "test",
+		CreatedAt:        now,
+		LastUsedAt:       now,
+		ExpiresAt:        now + 3600,
+	}
+	if err := h.datarepo.CreateSession(context.Background(), session); err != nil {
+		t.Fatalf("failed to create session for token: %v", err)
+	}
+	signed, _, err := h.tokens.Issue(userUUID, session.UUID, session.Device, roles)
+	if err != nil {
+		t.Fatalf("failed to issue token: %v", err)
+	}
+	return metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+signed)
+}
+
+// withToken returns a context carrying the access token
+func withToken(accessToken string) context.Context {
+	return metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+accessToken)
+}
+
+// asService returns a context carrying a token of an internal service
+func (h *harness) asService(t *testing.T) context.Context {
+	return h.as(t, uuid.Must(uuid.NewV4()).String(), auth.RoleService)
+}
+
+// createUser creates a user with the password and returns its uuid
+func (h *harness) createUser(t *testing.T, username, password string) []byte {
+	t.Helper()
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("failed to hash password: %v", err)
+	}
+	res, err := h.client.CreateUser(h.asService(t), &pb.CreateUserRequest{
+		Username:        username,
+		Email:           username + "@example.com",
+		HashedPasssword: string(hashed),
+	})
+	if err != nil {
+		t.Fatalf("failed to create user %s: %v", username, err)
+	}
+	return res.User.Uuid
+}
+
+func (h *harness) createSession(ctx context.Context, username, password string) (*pb.CreateSessionResponse, error) {
+	return h.client.CreateSession(ctx, &pb.CreateSessionRequest{
+		Credentials: &pb.ValidateUserCredentialsRequest{
+			ValidateUserBy: pb.ValidateUserCredentialsRequest_USERNAME,
+			Username:       username,
+			Password:       password,
+		},
+		Device:    "laptop",
+		UserAgent: "test",
+	})
+}
+
+func mustUUID(t *testing.T, b []byte) string {
+	t.Helper()
+	id, err := uuid.FromBytes(b)
+	if err != nil {
+		t.Fatalf("uuid is not well formed: %v", err)
+	}
+	return id.String()
+}
+
+func expectCode(t *testing.T, err error, code codes.Code) {
+	t.Helper()
+	if status.Code(err) != code {
+		t.Fatalf("expected %s, got %v", code, err)
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	h := newHarness(t)
+	if _, err := h.client.HealthCheck(context.Background(), &emptypb.Empty{}); err != nil {
+		t.Fatalf("health check failed: %v", err)
+	}
+}
+
+func TestCreateAndGetUser(t *testing.T) {
+	h := newHarness(t)
+	id := h.createUser(t, "ada", "hunter22")
+	userUUID := mustUUID(t, id)
+
+	res, err := h.client.GetUser(h.as(t, userUUID), &pb.GetUserRequest{Uuid: id})
+	if err != nil {
+		t.Fatalf("failed to get user: %v", err)
+	}
+	if res.User.Username != "ada" || res.User.Email != "ada@example.com" {
+		t.Fatalf("got user %s <%s>", res.User.Username, res.User.Email)
+	}
+
+	_, err = h.client.GetUser(h.as(t, userUUID), &pb.GetUserRequest{Uuid: uuid.Must(uuid.NewV4()).Bytes()})
+	if err == nil {
+		t.Fatal("expected getting a missing user to fail")
+	}
+}
+
+func TestGetUserHidesCredentials(t *testing.T) {
+	h := newHarness(t)
+	ada := h.createUser(t, "ada", "hunter22")
+	bob := h.createUser(t, "bob", "hunter22")
+	asBob := h.as(t, mustUUID(t, bob))
+
+	res, err := h.client.GetUser(asBob, &pb.GetUserRequest{Uuid: ada})
+	if err != nil {
+		t.Fatalf("failed to get user: %v", err)
+	}
+	if res.User.Username != "ada" || res.User.Email != "" || res.User.HashedPasssword != "" {
+		t.Fatalf("expected another user's email and hash left out, got <%s> %q", res.User.Email, res.User.HashedPasssword)
+	}
+	for _, ctx := range []context.Context{h.as(t, mustUUID(t, ada)), h.asService(t), h.as(t, mustUUID(t, bob), auth.RoleAdmin)} {
+		res, err := h.client.GetUser(ctx, &pb.GetUserRequest{Uuid: ada})
+		if err != nil {
+			t.Fatalf("failed to get user: %v", err)
+		}
+		if res.User.Email != "ada@example.com" || res.User.HashedPasssword != "" {
+			t.Fatalf("expected the email without the hash, got <%s> %q", res.User.Email, res.User.HashedPasssword)
+		}
+	}
+
+	valid, err := h.client.ValidateUserCredentials(h.asService(t), &pb.ValidateUserCredentialsRequest{
+		ValidateUserBy: pb.ValidateUserCredentialsRequest_USERNAME,
+		Username:       "ada",
+		Password:       "hunter22",
+	})
+	if err != nil {
+		t.Fatalf("failed to validate credentials: %v", err)
+	}
+	if !valid.IsValid || valid.User.HashedPasssword == "" {
+		t.Fatal("expected validating credentials to return the hash")
+	}
+}
+
+func TestCreateUserRejectsDuplicates(t *testing.T) {
+	h := newHarness(t)
+	h.createUser(t, "ada", "hunter22")
+	_, err := h.client.CreateUser(h.asService(t), &pb.CreateUserRequest{
+		Username:        "ada",
+		Email:           "other@example.com",
+		HashedPasssword: "x",
+	})
+	expectCode(t, err, codes.InvalidArgument)
+	_, err = h.client.CreateUser(h.asService(t), &pb.CreateUserRequest{
+		Username:        "other",
+		Email:           "ada@example.com",
+		HashedPasssword: "x",
+	})
+	expectCode(t, err, codes.InvalidArgument)
+}
+
+func TestCreateUserIsServiceOnly(t *testing.T) {
+	h := newHarness(t)
+	id := h.createUser(t, "ada", "hunter22")
+	_, err := h.client.CreateUser(h.as(t, mustUUID(t, id)), &pb.CreateUserRequest{
+		Username: "grace",
+		Email:    "grace@example.com",
+	})
+	expectCode(t, err, codes.PermissionDenied)
+}
+
+func TestGetUserRequiresAuthentication(t *testing.T) {
+	h := newHarness(t)
+	id := h.createUser(t, "ada", "hunter22")
+	_, err := h.client.GetUser(context.Background(), &pb.GetUserRequest{Uuid: id})
+	expectCode(t, err, codes.Unauthenticated)
+}
+
+func TestSessionRefreshRotatesAndDetectsReuse(t *testing.T) {
+	h := newHarness(t)
+	h.createUser(t, "ada", "hunter22")
+
+	_, err := h.createSession(context.Background(), "ada", "wrong")
+	expectCode(t, err, codes.Unauthenticated)
+
+	created, err := h.createSession(context.Background(), "ada", "hunter22")
+	if err != nil {
+		t.Fatalf("failed to create session: %v", err)
+	}
+	if created.AccessToken == "" || created.RefreshToken == "" {
+		t.Fatal("expected tokens for the new session")
+	}
+
+	refresh := func(refreshToken string) (*pb.RefreshSessionResponse, error) {
+		return h.client.RefreshSession(context.Background(), &pb.RefreshSessionRequest{
+			RefreshToken: refreshToken,
+			Device:       "laptop",
+			UserAgent:    "test",
+		})
+	}
+	refreshed, err := refresh(created.RefreshToken)
+	if err != nil {
+		t.Fatalf("failed to refresh session: %v", err)
+	}
+	if refreshed.RefreshToken == created.RefreshToken {
+		t.Fatal("expected the refresh token to rotate")
+	}
+
+	if _, err := h.client.GetUser(withToken(refreshed.AccessToken), &pb.GetUserRequest{Uuid: created.User.Uuid}); err != nil {
+		t.Fatalf("failed to call with the refreshed access token: %v", err)
+	}
+
+	// replaying the rotated out token revokes the session, so the current
+	// tokens die with it
+	_, err = refresh(created.RefreshToken)
+	expectCode(t, err, codes.Unauthenticated)
+	_, err = refresh(refreshed.RefreshToken)
+	expectCode(t, err, codes.Unauthenticated)
+	_, err = h.client.GetUser(withToken(refreshed.AccessToken), &pb.GetUserRequest{Uuid: created.User.Uuid})
+	expectCode(t, err, codes.Unauthenticated)
+}
+
+func TestRevokedSessionRejectsAccessToken(t *testing.T) {
+	h := newHarness(t)
+	id := h.createUser(t, "ada", "hunter22")
+	created, err := h.createSession(context.Background(), "ada", "hunter22")
+	if err != nil {
+		t.Fatalf("failed to create session: %v", err)
+	}
+	other, err := h.createSession(context.Background(), "ada", "hunter22")
+	if err != nil {
+		t.Fatalf("failed to create session: %v", err)
+	}
+	asCreated := withToken(created.AccessToken)
+	if _, err := h.client.RevokeSession(asCreated, &pb.RevokeSessionRequest{SessionUuid: other.Session.Uuid}); err != nil {
+		t.Fatalf("failed to revoke session: %v", err)
+	}
+	_, err = h.client.GetUser(withToken(other.AccessToken), &pb.GetUserRequest{Uuid: id})
+	expectCode(t, err, codes.Unauthenticated)
+	if _, err := h.client.GetUser(asCreated, &pb.GetUserRequest{Uuid: id}); err != nil {
+		t.Fatalf("expected the other session left alone: %v", err)
+	}
+
+	if _, err := h.client.RevokeAllSessions(h.asService(t), &pb.RevokeAllSessionsRequest{UserUuid: id}); err != nil {
+		t.Fatalf("failed to revoke sessions: %v", err)
+	}
+	_, err = h.client.GetUser(asCreated, &pb.GetUserRequest{Uuid: id})
+	expectCode(t, err, codes.Unauthenticated)
+
+	// a token signed for a session that was never started is no better
+	forged, _, err := h.tokens.Issue(mustUUID(t, id), uuid.Must(uuid.NewV4()).String(), "laptop", nil)
+	if err != nil {
+		t.Fatalf("failed to issue token: %v", err)
+	}
+	_, err = h.client.GetUser(withToken(forged), &pb.GetUserRequest{Uuid: id})
+	expectCode(t, err, codes.Unauthenticated)
+}
+
+func TestLockoutAfterFailedLogins(t *testing.T) {
+	h := newHarness(t)
+	h.createUser(t, "ada", "hunter22")
+	for i := 0; i < 3; i++ {
+		_, err := h.createSession(context.Background(), "ada", "wrong")
+		expectCode(t, err, codes.Unauthenticated)
+	}
+	_, err := h.createSession(context.Background(), "ada", "hunter22")
+	expectCode(t, err, codes.PermissionDenied)
+}
+
+func TestLockoutExpires(t *testing.T) {
+	h := newHarness(t)
+	ada := h.createUser(t, "ada", "hunter22")
+	ctx := context.Background()
+	// lock ada with a lock that has already run out
+	expired := time.Now().Add(-time.Second).Unix()
+	for i := 0; i < 3; i++ {
+		if err := h.datarepo.RecordFailedLogin(ctx, mustUUID(t, ada), 3, expired-60, expired); err != nil {
+			t.Fatalf("failed to record failed login: %v", err)
+		}
+	}
+	_, err := h.createSession(ctx, "ada", "wrong")
+	expectCode(t, err, codes.Unauthenticated)
+	if _, err := h.createSession(ctx, "ada", "hunter22"); err != nil {
+		t.Fatalf("expected one failed login after the lock ran out not to lock again: %v", err)
+	}
+}
+
+func TestRoleChangesApplyToIssuedTokens(t *testing.T) {
+	h := newHarness(t)
+	ada := h.createUser(t, "ada", "hunter22")
+	bob := h.createUser(t, "bob", "hunter22")
+	asAdmin := h.as(t, uuid.Must(uuid.NewV4()).String(), auth.RoleAdmin)
+	asAda := h.as(t, mustUUID(t, ada))
+
+	_, err := h.client.UnlockUser(asAda, &pb.UnlockUserRequest{UserUuid: bob})
+	expectCode(t, err, codes.PermissionDenied)
+
+	granted, err := h.client.GrantRole(asAdmin, &pb.GrantRoleRequest{UserUuid: ada, Role: auth.RoleModerator})
+	if err != nil {
+		t.Fatalf("failed to grant role: %v", err)
+	}
+	if len(granted.User.Roles) != 1 || granted.User.Roles[0] != auth.RoleModerator {
+		t.Fatalf("expected [moderator], got %v", granted.User.Roles)
+	}
+	if _, err := h.client.UnlockUser(asAda, &pb.UnlockUserRequest{UserUuid: bob}); err != nil {
+		t.Fatalf("expected the granted role to apply to the token issued before: %v", err)
+	}
+
+	revoked, err := h.client.RevokeRole(asAdmin, &pb.RevokeRoleRequest{UserUuid: ada, Role: auth.RoleModerator})
+	if err != nil {
+		t.Fatalf("failed to revoke role: %v", err)
+	}
+	if len(revoked.User.Roles) != 0 {
+		t.Fatalf("expected no roles, got %v", revoked.User.Roles)
+	}
+	_, err = h.client.UnlockUser(asAda, &pb.UnlockUserRequest{UserUuid: bob})
+	expectCode(t, err, codes.PermissionDenied)
+
+	_, err = h.client.GrantRole(asAda, &pb.GrantRoleRequest{UserUuid: ada, Role: auth.RoleAdmin})
+	expectCode(t, err, codes.PermissionDenied)
+	_, err = h.client.GrantRole(asAdmin, &pb.GrantRoleRequest{UserUuid: ada, Role: "owner"})
+	expectCode(t, err, codes.InvalidArgument)
+	_, err = h.client.GrantRole(asAdmin, &pb.GrantRoleRequest{UserUuid: uuid.Must(uuid.NewV4()).Bytes(), Role: auth.RoleModerator})
+	expectCode(t, err, codes.NotFound)
+}
+
+func TestUpdateUserIsUnimplemented(t *testing.T) {
+	h := newHarness(t)
+	ada := h.createUser(t, "ada", "hunter22")
+	_, err := h.client.UpdateUser(h.as(t, mustUUID(t, ada)), &pb.UpdateUserRequest{User: &sharedpb.User{Uuid: ada, Username: "ada2"}})
+	expectCode(t, err, codes.Unimplemented)
+}
+
+func TestUnlockUser(t *testing.T) {
+	h := newHarness(t)
+	ada := h.createUser(t, "ada", "hunter22")
+	asModerator := h.as(t, uuid.Must(uuid.NewV4()).String(), auth.RoleModerator)
+	for i := 0; i < 3; i++ {
+		_, err := h.createSession(context.Background(), "ada", "wrong")
+		expectCode(t, err, codes.Unauthenticated)
+	}
+	_, err := h.createSession(context.Background(), "ada", "hunter22")
+	expectCode(t, err, codes.PermissionDenied)
+
+	_, err = h.client.UnlockUser(h.as(t, mustUUID(t, ada)), &pb.UnlockUserRequest{UserUuid: ada})
+	expectCode(t, err, codes.PermissionDenied)
+	if _, err := h.client.UnlockUser(asModerator, &pb.UnlockUserRequest{UserUuid: ada}); err != nil {
+		t.Fatalf("failed to unlock user: %v", err)
+	}
+	if _, err := h.createSession(context.Background(), "ada", "hunter22"); err != nil {
+		t.Fatalf("failed to log in once unlocked: %v", err)
+	}
+	_, err = h.client.UnlockUser(asModerator, &pb.UnlockUserRequest{UserUuid: uuid.Must(uuid.NewV4()).Bytes()})
+	expectCode(t, err, codes.NotFound)
+}
+
+func TestChangePasswordRevokesSessions(t *testing.T) {
+	h := newHarness(t)
+	id := h.createUser(t, "ada", "hunter22")
+	userUUID := mustUUID(t, id)
+	created, err := h.createSession(context.Background(), "ada", "hunter22")
+	if err != nil {
+		t.Fatalf("failed to create session: %v", err)
+	}
+
+	hashed, err := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("failed to hash password: %v", err)
+	}
+	_, err = h.client.ChangePassword(h.as(t, userUUID), &pb.ChangePasswordRequest{
+		UserUuid:          id,
+		CurrentPassword:   "wrong",
+		NewHashedPassword: string(hashed),
+	})
+	expectCode(t, err, codes.PermissionDenied)
+	_, err = h.client.ChangePassword(h.as(t, userUUID), &pb.ChangePasswordRequest{
+		UserUuid:          id,
+		CurrentPassword:   "hunter22",
+		NewHashedPassword: string(hashed),
+	})
+	if err != nil {
+		t.Fatalf("failed to change password: %v", err)
+	}
+
+	sessions, err := h.client.ListSessions(h.as(t, userUUID), &pb.ListSessionsRequest{UserUuid: id})
+	if err != nil {
+		t.Fatalf("failed to list sessions: %v", err)
+	}
+	for _, session := range sessions.Sessions {
+		if bytes.Equal(session.Uuid, created.Session.Uuid) {
+			t.Fatal("expected the session from before the change revoked")
+		}
+	}
+	_, err = h.client.GetUser(withToken(created.AccessToken), &pb.GetUserRequest{Uuid: id})
+	expectCode(t, err, codes.Unauthenticated)
+	_, err = h.client.RefreshSession(context.Background(), &pb.RefreshSessionRequest{
+		RefreshToken: created.RefreshToken,
+		Device:       "laptop",
+		UserAgent:    "test",
+	})
+	expectCode(t, err, codes.Unauthenticated)
+	if _, err := h.createSession(context.Background(), "ada", "correct horse"); err != nil {
+		t.Fatalf("failed to log in with the new password: %v", err)
+	}
+}
+
+func TestFollowAndUnfollow(t *testing.T) {
+	h := newHarness(t)
+	ada := h.createUser(t, "ada", "hunter22")
+	grace := h.createUser(t, "grace", "hunter22")
+	follow := &pb.FollowRequest{
+		FollowerUuid: ada,
+		FollowedUuid: grace,
+		Type:         pb.FollowRequest_USER,
+	}
+
+	_, err := h.client.Follow(h.as(t, mustUUID(t, grace)), follow)
+	expectCode(t, err, codes.PermissionDenied)
+
+	asAda := h.as(t, mustUUID(t, ada))
+	if _, err := h.client.Follow(asAda, follow); err != nil {
+		t.Fatalf("failed to follow: %v", err)
+	}
+	if _, err := h.client.Follow(asAda, follow); err != nil {
+		t.Fatalf("failed to follow twice: %v", err)
+	}
+	if _, err := h.client.UnFollow(asAda, follow); err != nil {
+		t.Fatalf("failed to unfollow: %v", err)
+	}
+	if _, err := h.client.Follow(asAda, follow); err != nil {
+		t.Fatalf("failed to follow again after unfollowing: %v", err)
+	}
+
+	_, err = h.client.Follow(asAda, &pb.FollowRequest{
+		FollowerUuid: ada,
+		FollowedUuid: uuid.Must(uuid.NewV4()).Bytes(),
+		Type:         pb.FollowRequest_USER,
+	})
+	if err == nil {
+		t.Fatal("expected following a missing user to fail")
+	}
+}
+
+func TestDeleteUser(t *testing.T) {
+	h := newHarness(t)
+	ada := h.createUser(t, "ada", "hunter22")
+	grace := h.createUser(t, "grace", "hunter22")
+
+	_, err := h.client.DeleteUser(h.as(t, mustUUID(t, grace)), &pb.DeleteUserRequest{Uuid: ada})
+	expectCode(t, err, codes.PermissionDenied)
+
+	asAda := h.as(t, mustUUID(t, ada))
+	if _, err := h.client.DeleteUser(asAda, &pb.DeleteUserRequest{Uuid: ada}); err != nil {
+		t.Fatalf("failed to delete user: %v", err)
+	}
+	// deleting ada ended her sessions, and the token on hers with them
+	_, err = h.client.DeleteUser(asAda, &pb.DeleteUserRequest{Uuid: ada})
+	expectCode(t, err, codes.Unauthenticated)
+	_, err = h.client.DeleteUser(h.asService(t), &pb.DeleteUserRequest{Uuid: ada})
+	expectCode(t, err, codes.NotFound)
+	if _, err := h.createSession(context.Background(), "ada", "hunter22"); err == nil {
+		t.Fatal("expected a deleted user to be unable to log in")
+	}
+}
+
+type watchStream interface {
+	Recv() (*pb.WatchResponse, error)
+}
+
+// watchContext returns a service context that ends the watch if the test
+// hangs waiting on it
+func (h *harness) watchContext(t *testing.T) context.Context {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(h.asService(t), 5*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+// checkpoint reads the checkpoint a watch starts with and returns its token
+func checkpoint(t *testing.T, stream watchStream) string {
+	t.Helper()
+	res, err := stream.Recv()
+	if err != nil {
+		t.Fatalf("failed to receive checkpoint: %v", err)
+	}
+	if res.Event != nil || res.ResumeToken == "" {
+		t.Fatalf("expected a checkpoint, got %v", res)
+	}
+	return res.ResumeToken
+}
+
+// nextEvent reads past checkpoints to the next event
+func nextEvent(t *testing.T, stream watchStream, eventType string) *pb.WatchResponse {
+	t.Helper()
+	for {
+		res, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("failed to receive %s event: %v", eventType, err)
+		}
+		if res.Event == nil {
+			continue
+		}
+		if res.Event.Type != eventType || res.ResumeToken == "" {
+			t.Fatalf("expected a %s event, got %v", eventType, res)
+		}
+		return res
+	}
+}
+
+func expectFollow(t *testing.T, res *pb.WatchResponse, follower, followed []byte) {
+	t.Helper()
+	follow := res.Event.Follow
+	if follow == nil || string(follow.FollowerUuid) != string(follower) || string(follow.FollowedUuid) != string(followed) || follow.Type != pb.FollowRequest_USER {
+		t.Fatalf("expected %s to follow %s, got %v", mustUUID(t, follower), mustUUID(t, followed), res.Event)
+	}
+}
+
+func (h *harness) follow(t *testing.T, follower, followed []byte) {
+	t.Helper()
+	req := &pb.FollowRequest{FollowerUuid: follower, FollowedUuid: followed, Type: pb.FollowRequest_USER}
+	if _, err := h.client.Follow(h.as(t, mustUUID(t, follower)), req); err != nil {
+		t.Fatalf("failed to follow: %v", err)
+	}
+}
+
+func TestWatchUser(t *testing.T) {
+	h := newHarness(t)
+	ada := h.createUser(t, "ada", "hunter22")
+	grace := h.createUser(t, "grace", "hunter22")
+
+	denied, err := h.client.WatchUser(h.as(t, mustUUID(t, ada)), &pb.WatchUserRequest{UserUuid: ada})
+	if err == nil {
+		_, err = denied.Recv()
+	}
+	expectCode(t, err, codes.PermissionDenied)
+
+	stream, err := h.client.WatchUser(h.watchContext(t), &pb.WatchUserRequest{UserUuid: ada})
+	if err != nil {
+		t.Fatalf("failed to watch user: %v", err)
+	}
+	checkpoint(t, stream)
+
+	h.follow(t, ada, grace)
+	admin := uuid.Must(uuid.NewV4())
+	if _, err := h.client.GrantRole(h.as(t, admin.String(), auth.RoleAdmin), &pb.GrantRoleRequest{UserUuid: ada, Role: auth.RoleModerator}); err != nil {
+		t.Fatalf("failed to grant role: %v", err)
+	}
+	if _, err := h.client.DeleteUser(h.as(t, mustUUID(t, ada)), &pb.DeleteUserRequest{Uuid: ada}); err != nil {
+		t.Fatalf("failed to delete user: %v", err)
+	}
+
+	updated := nextEvent(t, stream, service.EventUserUpdated)
+	change := updated.Event.User
+	if change == nil || string(change.User.Uuid) != string(ada) || change.User.Username != "ada" || change.User.HashedPasssword != "" {
+		t.Fatalf("expected ada without her password hash, got %v", change)
+	}
+	if len(change.Changed) != 1 || change.Changed[0] != service.ChangedRoles || len(change.User.Roles) != 1 || string(change.ActorUuid) != string(admin.Bytes()) {
+		t.Fatalf("expected the admin to have changed ada's roles, got %v", change)
+	}
+	deleted := nextEvent(t, stream, service.EventUserDeleted)
+
+	resumed, err := h.client.WatchUser(h.watchContext(t), &pb.WatchUserRequest{UserUuid: ada, ResumeToken: updated.ResumeToken})
+	if err != nil {
+		t.Fatalf("failed to resume watch: %v", err)
+	}
+	if token := checkpoint(t, resumed); token != updated.ResumeToken {
+		t.Fatalf("expected the resumed watch to start at its token, got %s", token)
+	}
+	if replayed := nextEvent(t, resumed, service.EventUserDeleted); replayed.Event.Id != deleted.Event.Id {
+		t.Fatalf("expected the deletion replayed, got %v", replayed.Event)
+	}
+
+	bad, err := h.client.WatchUser(h.watchContext(t), &pb.WatchUserRequest{UserUuid: ada, ResumeToken: "not a token"})
+	if err == nil {
+		_, err = bad.Recv()
+	}
+	expectCode(t, err, codes.InvalidArgument)
+}
+
+func TestWatchFollows(t *testing.T) {
+	h := newHarness(t)
+	ada := h.createUser(t, "ada", "hunter22")
+	grace := h.createUser(t, "grace", "hunter22")
+	lin := h.createUser(t, "lin", "hunter22")
+
+	stream, err := h.client.WatchFollows(h.watchContext(t), &pb.WatchFollowsRequest{FollowedUuid: grace})
+	if err != nil {
+		t.Fatalf("failed to watch follows: %v", err)
+	}
+	checkpoint(t, stream)
+
+	h.follow(t, ada, lin)
+	h.follow(t, ada, grace)
+	h.follow(t, lin, grace)
+	req := &pb.FollowRequest{FollowerUuid: ada, FollowedUuid: grace, Type: pb.FollowRequest_USER}
+	if _, err := h.client.UnFollow(h.as(t, mustUUID(t, ada)), req); err != nil {
+		t.Fatalf("failed to unfollow: %v", err)
+	}
+
+	expectFollow(t, nextEvent(t, stream, service.EventFollowAdded), ada, grace)
+	expectFollow(t, nextEvent(t, stream, service.EventFollowAdded), lin, grace)
+	expectFollow(t, nextEvent(t, stream, service.EventFollowRemoved), ada, grace)
+}
+
+func TestWatchResumeAfterPrune(t *testing.T) {
+	h := newHarness(t)
+	ada := h.createUser(t, "ada", "hunter22")
+	stream, err := h.client.WatchUser(h.watchContext(t), &pb.WatchUserRequest{UserUuid: ada})
+	if err != nil {
+		t.Fatalf("failed to watch user: %v", err)
+	}
+	token := checkpoint(t, stream)
+	h.createUser(t, "grace", "hunter22")
+
+	ctx := context.Background()
+	events, err := h.datarepo.ListPendingEvents(ctx, 100)
+	if err != nil {
+		t.Fatalf("failed to list pending events: %v", err)
+	}
+	ids := make([]int64, 0, len(events))
+	for _, event := range events {
+		ids = append(ids, event.ID)
+	}
+	if err := h.datarepo.MarkEventsPublished(ctx, ids, 1000); err != nil {
+		t.Fatalf("failed to mark events published: %v", err)
+	}
+	if _, err := h.datarepo.PruneEvents(ctx, 2000); err != nil {
+		t.Fatalf("failed to prune events: %v", err)
+	}
+
+	resumed, err := h.client.WatchUser(h.watchContext(t), &pb.WatchUserRequest{UserUuid: ada, ResumeToken: token})
+	if err == nil {
+		_, err = resumed.Recv()
+	}
+	expectCode(t, err, codes.OutOfRange)
+}
+
+func TestWatchEndsOnShutdown(t *testing.T) {
+	h := newHarness(t)
+	stream, err := h.client.WatchFollows(h.watchContext(t), &pb.WatchFollowsRequest{})
+	if err != nil {
+		t.Fatalf("failed to watch follows: %v", err)
+	}
+	checkpoint(t, stream)
+	stop, err := h.handler.RunWatches()
+	if err != nil {
+		t.Fatalf("failed to run watches: %v", err)
+	}
+	if err := stop(); err != nil {
+		t.Fatalf("failed to stop watches: %v", err)
+	}
+	for {
+		if _, err = stream.Recv(); err != nil {
+			break
+		}
+	}
+	expectCode(t, err, codes.Unavailable)
+}
+
+// gappedDataRepository hides an event from reads until it is shown, as
+// though the transaction that wrote it had not committed yet
+type gappedDataRepository struct {
+	service.DataRepository
+	mu     sync.Mutex
+	hidden int64
+}
+
+func (g *gappedDataRepository) hide(id int64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.hidden = id
+}
+
+func (g *gappedDataRepository) ListEventsAfter(ctx context.Context, afterID int64, limit int) ([]*service.DBEvent, error) {
+	events, err := g.DataRepository.ListEventsAfter(ctx, afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	visible := events[:0]
+	for _, event := range events {
+		if event.ID != g.hidden {
+			visible = append(visible, event)
+		}
+	}
+	return visible, nil
+}
+
+func TestWatchWaitsForGaps(t *testing.T) {
+	datarepo := &gappedDataRepository{DataRepository: service.NewMemoryDataRepository()}
+	h := newHarnessOver(t, datarepo)
+	ada := h.createUser(t, "ada", "hunter22")
+	grace := h.createUser(t, "grace", "hunter22")
+	watchCtx := h.watchContext(t)
+	eventRange, err := datarepo.GetEventRange(context.Background())
+	if err != nil {
+		t.Fatalf("failed to get event range: %v", err)
+	}
+
+	stream, err := h.client.WatchFollows(watchCtx, &pb.WatchFollowsRequest{})
+	if err != nil {
+		t.Fatalf("failed to watch follows: %v", err)
+	}
+	checkpoint(t, stream)
+	datarepo.hide(eventRange.LatestID + 1)
+	h.follow(t, ada, grace)
+	h.follow(t, grace, ada)
+
+	above := nextEvent(t, stream, service.EventFollowAdded)
+	expectFollow(t, above, grace, ada)
+	datarepo.hide(0)
+	expectFollow(t, nextEvent(t, stream, service.EventFollowAdded), ada, grace)
+
+	// the event above the gap came with a token from below it
+	resumed, err := h.client.WatchFollows(h.watchContext(t), &pb.WatchFollowsRequest{ResumeToken: above.ResumeToken})
+	if err != nil {
+		t.Fatalf("failed to resume watch: %v", err)
+	}
+	checkpoint(t, resumed)
+	expectFollow(t, nextEvent(t, resumed, service.EventFollowAdded), ada, grace)
+	expectFollow(t, nextEvent(t, resumed, service.EventFollowAdded), grace, ada)
+}
+
+func TestWebhooks(t *testing.T) {
+	h := newHarness(t)
+	ada, bob := h.createUser(t, "ada", "hunter22"), h.createUser(t, "bob", "hunter22")
+	adminUUID := uuid.Must(uuid.NewV4()).String()
+	admin := h.as(t, adminUUID, auth.RoleAdmin)
+
+	_, err := h.client.CreateWebhook(h.as(t, mustUUID(t, ada)), &pb.CreateWebhookRequest{Url: "https://hooks.example.com"})
+	expectCode(t, err, codes.PermissionDenied)
+	_, err = h.client.CreateWebhook(admin, &pb.CreateWebhookRequest{Url: "ftp://hooks.example.com"})
+	expectCode(t, err, codes.InvalidArgument)
+	_, err = h.client.CreateWebhook(admin, &pb.CreateWebhookRequest{Url: "https://hooks.example.com", EventTypes: []string{"user.renamed"}})
+	expectCode(t, err, codes.InvalidArgument)
+
+	created, err := h.client.CreateWebhook(admin, &pb.CreateWebhookRequest{
+		Url:        "https://hooks.example.com",
+		EventTypes: []string{service.EventFollowAdded},
+	})
+	if err != nil {
+		t.Fatalf("failed to create webhook: %v", err)
+	}
+	if created.Secret == "" || mustUUID(t, created.Webhook.CreatedByUuid) != adminUUID {
+		t.Fatalf("expected a secret and the admin as creator, got %v", created)
+	}
+	listed, err := h.client.ListWebhooks(admin, &pb.ListWebhooksRequest{})
+	if err != nil {
+		t.Fatalf("failed to list webhooks: %v", err)
+	}
+	if len(listed.Webhooks) != 1 || string(listed.Webhooks[0].Uuid) != string(created.Webhook.Uuid) {
+		t.Fatalf("expected the webhook listed, got %v", listed.Webhooks)
+	}
+
+	h.follow(t, ada, bob)
+	_, err = h.client.ListWebhookDeliveries(admin, &pb.ListWebhookDeliveriesRequest{WebhookUuid: created.Webhook.Uuid, Status: "lost"})
+	expectCode(t, err, codes.InvalidArgument)
+	deliveries, err := h.client.ListWebhookDeliveries(admin, &pb.ListWebhookDeliveriesRequest{WebhookUuid: created.Webhook.Uuid})
+	if err != nil {
+		t.Fatalf("failed to list deliveries: %v", err)
+	}
+	if len(deliveries.Deliveries) != 1 || deliveries.Deliveries[0].EventType != service.EventFollowAdded || deliveries.Deliveries[0].Status != service.DeliveryPending {
+		t.Fatalf("expected the follow pending, got %v", deliveries.Deliveries)
+	}
+
+	delivery, err := h.datarepo.GetWebhookDelivery(context.Background(), mustUUID(t, deliveries.Deliveries[0].Uuid))
+	if err != nil {
+		t.Fatalf("failed to get delivery: %v", err)
+	}
+	delivery.Status, delivery.Attempts, delivery.LastError = service.DeliveryDead, 10, "connection refused"
+	if err := h.datarepo.UpdateWebhookDelivery(context.Background(), delivery); err != nil {
+		t.Fatalf("failed to kill delivery: %v", err)
+	}
+	redelivered, err := h.client.RedeliverWebhook(admin, &pb.RedeliverWebhookRequest{DeliveryUuid: deliveries.Deliveries[0].Uuid})
+	if err != nil {
+		t.Fatalf("failed to redeliver: %v", err)
+	}
+	if redelivered.Delivery.Status != service.DeliveryPending || redelivered.Delivery.Attempts != 0 || redelivered.Delivery.LastError != "connection refused" {
+		t.Fatalf("expected the delivery pending again, got %v", redelivered.Delivery)
+	}
+	_, err = h.client.RedeliverWebhook(admin, &pb.RedeliverWebhookRequest{DeliveryUuid: uuid.Must(uuid.NewV4()).Bytes()})
+	expectCode(t, err, codes.NotFound)
+
+	if _, err := h.client.DeleteWebhook(admin, &pb.DeleteWebhookRequest{Uuid: created.Webhook.Uuid}); err != nil {
+		t.Fatalf("failed to delete webhook: %v", err)
+	}
+	_, err = h.client.DeleteWebhook(admin, &pb.DeleteWebhookRequest{Uuid: created.Webhook.Uuid})
+	expectCode(t, err, codes.NotFound)
+}
+
+func TestAuditLog(t *testing.T) {
+	h := newHarness(t)
+	ada, bob := h.createUser(t, "ada", "hunter22"), h.createUser(t, "bob", "hunter22")
+	adminUUID := uuid.Must(uuid.NewV4()).String()
+	admin := h.as(t, adminUUID, auth.RoleAdmin)
+	h.follow(t, ada, bob)
+	if _, err := h.client.GrantRole(admin, &pb.GrantRoleRequest{UserUuid: ada, Role: auth.RoleModerator}); err != nil {
+		t.Fatalf("failed to grant role: %v", err)
+	}
+
+	_, err := h.client.ListAuditLog(h.as(t, mustUUID(t, ada)), &pb.ListAuditLogRequest{UserUuid: ada})
+	expectCode(t, err, codes.PermissionDenied)
+	_, err = h.client.ListAuditLog(admin, &pb.ListAuditLogRequest{})
+	expectCode(t, err, codes.InvalidArgument)
+	_, err = h.client.ListAuditLog(admin, &pb.ListAuditLogRequest{UserUuid: []byte("ada")})
+	expectCode(t, err, codes.InvalidArgument)
+
+	res, err := h.client.ListAuditLog(admin, &pb.ListAuditLogRequest{UserUuid: ada})
+	if err != nil {
+		t.Fatalf("failed to list audit log: %v", err)
+	}
+	var actions []string
+	for _, entry := range res.Entries {
+		actions = append(actions, entry.Action)
+	}
+	if strings.Join(actions, ",") != "role.granted,follow.added,user.created" {
+		t.Fatalf("expected ada's grant, follow and creation, got %v", actions)
+	}
+	granted := res.Entries[0]
+	if mustUUID(t, granted.ActorUuid) != adminUUID || len(granted.Changes) != 1 || granted.Changes[0].New != auth.RoleModerator {
+		t.Fatalf("expected the admin to have granted moderator, got %v", granted)
+	}
+	if followed := res.Entries[1]; !bytes.Equal(followed.ActorUuid, ada) || followed.Changes[0].New != "user/"+mustUUID(t, bob) {
+		t.Fatalf("expected ada to have followed bob, got %v", followed)
+	}
+
+	byAdmin, err := h.client.ListAuditLog(admin, &pb.ListAuditLogRequest{ActorUuid: uuid.FromStringOrNil(adminUUID).Bytes(), Limit: 1})
+	if err != nil {
+		t.Fatalf("failed to list audit log: %v", err)
+	}
+	if len(byAdmin.Entries) != 1 || byAdmin.Entries[0].Id != granted.Id {
+		t.Fatalf("expected only the admin's grant, got %v", byAdmin.Entries)
+	}
+}
+
+// download reads a data export to its end
+func (h *harness) download(ctx context.Context, userUUID, exportUUID []byte) ([]byte, error) {
+	stream, err := h.client.DownloadDataExport(ctx, &pb.DownloadDataExportRequest{UserUuid: userUUID, ExportUuid: exportUUID})
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	for {
+		res, err := stream.Recv()
+		if err == io.EOF {
+			return data, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, res.Chunk...)
+	}
+}
+
+func TestDataExports(t *testing.T) {
+	h := newHarness(t)
+	ada, bob := h.createUser(t, "ada", "hunter22"), h.createUser(t, "bob", "hunter22")
+	asAda := h.as(t, mustUUID(t, ada))
+
+	_, err := h.client.RequestDataExport(h.as(t, mustUUID(t, bob)), &pb.RequestDataExportRequest{UserUuid: ada})
+	expectCode(t, err, codes.PermissionDenied)
+	_, err = h.client.RequestDataExport(asAda, &pb.RequestDataExportRequest{UserUuid: ada, Format: "xml"})
+	expectCode(t, err, codes.InvalidArgument)
+
+	requested, err := h.client.RequestDataExport(asAda, &pb.RequestDataExportRequest{UserUuid: ada})
+	if err != nil {
+		t.Fatalf("failed to request data export: %v", err)
+	}
+	exportUUID := requested.Export.Uuid
+	if requested.Export.Format != service.ExportJSON || requested.Export.Status != service.ExportPending {
+		t.Fatalf("expected a pending json export, got %v", requested.Export)
+	}
+	_, err = h.download(asAda, ada, exportUUID)
+	expectCode(t, err, codes.FailedPrecondition)
+	_, err = h.client.GetDataExport(h.as(t, mustUUID(t, bob)), &pb.GetDataExportRequest{UserUuid: bob, ExportUuid: exportUUID})
+	expectCode(t, err, codes.NotFound)
+
+	m, err := metrics.New()
+	if err != nil {
+		t.Fatalf("failed to new metrics: %v", err)
+	}
+	if _, err := export.NewRunner(config.Default().Exports, h.datarepo, m, zap.NewNop()).RunOnce(context.Background()); err != nil {
+		t.Fatalf("failed to build data exports: %v", err)
+	}
+	got, err := h.client.GetDataExport(asAda, &pb.GetDataExportRequest{UserUuid: ada, ExportUuid: exportUUID})
+	if err != nil {
+		t.Fatalf("failed to get data export: %v", err)
+	}
+	if got.Export.Status != service.ExportReady || got.Export.Size == 0 {
+		t.Fatalf("expected the export ready, got %v", got.Export)
+	}
+
+	data, err := h.download(asAda, ada, exportUUID)
+	if err != nil {
+		t.Fatalf("failed to download data export: %v", err)
+	}
+	var built export.Export
+	if err := json.Unmarshal(data, &built); err != nil {
+		t.Fatalf("failed to unmarshal export: %v", err)
+	}
+	if int64(len(data)) != got.Export.Size || built.User.UUID != mustUUID(t, ada) {
+		t.Fatalf("expected ada's export, got %s", data)
+	}
+	_, err = h.download(h.as(t, mustUUID(t, bob)), ada, exportUUID)
+	expectCode(t, err, codes.PermissionDenied)
+	if _, err := h.download(h.as(t, uuid.Must(uuid.NewV4()).String(), auth.RoleAdmin), ada, exportUUID); err != nil {
+		t.Fatalf("expected an admin to download any export: %v", err)
+	}
+}
+
+func TestEraseUser(t *testing.T) {
+	h := newHarness(t)
+	ada, bob := h.createUser(t, "ada", "hunter22"), h.createUser(t, "bob", "hunter22")
+	admin := h.as(t, uuid.Must(uuid.NewV4()).String(), auth.RoleAdmin)
+	h.follow(t, bob, ada)
+
+	_, err := h.client.EraseUser(h.as(t, mustUUID(t, bob)), &pb.EraseUserRequest{UserUuid: ada})
+	expectCode(t, err, codes.PermissionDenied)
+	_, err = h.client.EraseUser(admin, &pb.EraseUserRequest{UserUuid: uuid.Must(uuid.NewV4()).Bytes()})
+	expectCode(t, err, codes.NotFound)
+	_, err = h.client.GetErasure(admin, &pb.GetErasureRequest{UserUuid: ada})
+	expectCode(t, err, codes.NotFound)
+
+	erased, err := h.client.EraseUser(h.as(t, mustUUID(t, ada)), &pb.EraseUserRequest{UserUuid: ada})
+	if err != nil {
+		t.Fatalf("failed to erase user: %v", err)
+	}
+	if erased.Erasure.Status != service.ErasureCompleted || erased.Erasure.Erased["users"] != 1 || erased.Erasure.Erased["user_user_follows"] != 1 {
+		t.Fatalf("expected ada and bob's follow erased, got %v", erased.Erasure)
+	}
+	if _, err := h.client.GetUser(admin, &pb.GetUserRequest{Uuid: ada}); err == nil {
+		t.Fatal("expected an erased user to be gone")
+	}
+
+	again, err := h.client.EraseUser(admin, &pb.EraseUserRequest{UserUuid: ada})
+	if err != nil {
+		t.Fatalf("failed to erase user again: %v", err)
+	}
+	if !bytes.Equal(again.Erasure.Uuid, erased.Erasure.Uuid) || again.Erasure.CompletedAt != erased.Erasure.CompletedAt {
+		t.Fatalf("expected erasing again to return the first erasure, got %v", again.Erasure)
+	}
+	_, err = h.client.GetErasure(h.as(t, mustUUID(t, bob)), &pb.GetErasureRequest{UserUuid: ada})
+	expectCode(t, err, codes.PermissionDenied)
+	proof, err := h.client.GetErasure(admin, &pb.GetErasureRequest{UserUuid: ada})
+	if err != nil {
+		t.Fatalf("failed to get erasure: %v", err)
+	}
+	if !bytes.Equal(proof.Erasure.TombstoneUuid, erased.Erasure.TombstoneUuid) || !bytes.Equal(proof.Erasure.RequestedByUuid, ada) {
+		t.Fatalf("expected the erasure ada requested, got %v", proof.Erasure)
+	}
+
+	events, err := h.datarepo.ListPendingEvents(context.Background(), 100)
+	if err != nil {
+		t.Fatalf("failed to list events: %v", err)
+	}
+	last := events[len(events)-1]
+	if last.Type != service.EventUserErased || last.AggregateUUID != mustUUID(t, ada) {
+		t.Fatalf("expected the erasure announced last, got %+v", last)
+	}
+	for _, event := range events[:len(events)-1] {
+		if strings.Contains(string(event.Payload), "ada@example.com") || strings.Contains(string(event.Payload), mustUUID(t, ada)) {
+			t.Fatalf("expected ada scrubbed from every other event, got %s", event.Payload)
+		}
+	}
+}
+
+func TestSearchUsers(t *testing.T) {
+	h := newHarness(t)
+	ctx := h.asService(t)
+	users := map[string][]byte{}
+	for _, user := range []struct{ username, displayName string }{
+		{"alice", "Alice Liddell"},
+		{"alicia", "Ali Cia"},
+		{"malice", ""},
+		{"bob", "Bob Alison"},
+	} {
+		res, err := h.client.CreateUser(ctx, &pb.CreateUserRequest{
+			Username:        user.username,
+			Email:           user.username + "@example.com",
+			HashedPasssword: "hash",
+			DisplayName:     user.displayName,
+		})
+		if err != nil {
+			t.Fatalf("failed to create user %s: %v", user.username, err)
+		}
+		users[user.username] = res.User.Uuid
+	}
+	for _, follower := range []string{"bob", "malice"} {
+		req := &pb.FollowRequest{FollowerUuid: users[follower], FollowedUuid: users["alicia"], Type: pb.FollowRequest_USER}
+		if _, err := h.client.Follow(ctx, req); err != nil {
+			t.Fatalf("failed to follow: %v", err)
+		}
+	}
+	if err := h.search.Refresh(context.Background()); err != nil {
+		t.Fatalf("failed to refresh search index: %v", err)
+	}
+
+	asAlice := h.as(t, mustUUID(t, users["alice"]))
+	search := func(query string, offset, limit int32) *pb.SearchUsersResponse {
+		t.Helper()
+		res, err := h.client.SearchUsers(asAlice, &pb.SearchUsersRequest{Query: query, Offset: offset, Limit: limit})
+		if err != nil {
+			t.Fatalf("failed to search %q: %v", query, err)
+		}
+		return res
+	}
+	usernames := func(res *pb.SearchUsersResponse) string {
+		var names []string
+		for _, result := range res.Results {
+			names = append(names, result.Username)
+		}
+		return strings.Join(names, ",")
+	}
+
+	// exactly alice, a typo away from alicia and malice
+	res := search("  ALICE ", 0, 0)
+	if got := usernames(res); got != "alice,alicia,malice" {
+		t.Fatalf("expected the exact match then the near one, got %s", got)
+	}
+	if !res.Results[0].Exact || res.Results[0].DisplayName != "Alice Liddell" || res.Results[1].Exact || res.Results[1].Followers != 2 {
+		t.Fatalf("expected the exact match flagged and the followers counted, got %v", res.Results)
+	}
+	if got := usernames(search("liddell", 0, 0)); got != "alice" {
+		t.Fatalf("expected later words of display names searched, got %s", got)
+	}
+	if got := usernames(search("ali cia", 0, 0)); got != "alicia" {
+		t.Fatalf("expected whole display names searched, got %s", got)
+	}
+	if got := usernames(search("alx", 0, 0)); got != "" {
+		t.Fatalf("expected short queries matched exactly, got %s", got)
+	}
+
+	// the most followed first, then by username
+	first := search("ali", 0, 2)
+	if got := usernames(first); got != "alicia,alice" || first.NextOffset != 2 {
+		t.Fatalf("expected the first page, got %s next %d", got, first.NextOffset)
+	}
+	second := search("ali", first.NextOffset, 2)
+	if got := usernames(second); got != "bob" || second.NextOffset != 0 {
+		t.Fatalf("expected the last page, got %s next %d", got, second.NextOffset)
+	}
+
+	if _, err := h.client.DeleteUser(ctx, &pb.DeleteUserRequest{Uuid: users["bob"]}); err != nil {
+		t.Fatalf("failed to delete user: %v", err)
+	}
+	if err := h.search.Refresh(context.Background()); err != nil {
+		t.Fatalf("failed to refresh search index: %v", err)
+	}
+	res = search("ali", 0, 0)
+	if got := usernames(res); got != "alicia,alice" || res.Results[0].Followers != 1 {
+		t.Fatalf("expected the deleted user and their follow left out, got %v", res.Results)
+	}
+
+	for _, query := range []string{"", "   "} {
+		_, err := h.client.SearchUsers(asAlice, &pb.SearchUsersRequest{Query: query})
+		expectCode(t, err, codes.InvalidArgument)
+	}
+	_, err := h.client.SearchUsers(asAlice, &pb.SearchUsersRequest{Query: "ali", Offset: -1})
+	expectCode(t, err, codes.InvalidArgument)
+	_, err = h.client.SearchUsers(context.Background(), &pb.SearchUsersRequest{Query: "ali"})
+	expectCode(t, err, codes.Unauthenticated)
+}
+
+func TestSearchIndexFollowsChanges(t *testing.T) {
+	h := newHarness(t)
+	stop, err := h.search.Run()
+	if err != nil {
+		t.Fatalf("failed to run search index: %v", err)
+	}
+	defer func() { _ = stop() }()
+	ctx := context.Background()
+	found := func(query string) map[string]int64 {
+		t.Helper()
+		results, err := h.search.SearchUsers(ctx, query, nil, 0, 10)
+		if err != nil {
+			t.Fatalf("failed to search: %v", err)
+		}
+		followers := map[string]int64{}
+		for _, result := range results {
+			followers[result.Username] = result.Followers
+		}
+		return followers
+	}
+	eventually := func(what string, cond func() bool) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %s without a refresh", what)
+			}
+		}
+	}
+
+	ada, bob := h.createUser(t, "ada", "hunter22"), h.createUser(t, "bob", "hunter22")
+	eventually("the created user found", func() bool {
+		_, ok := found("ada")["ada"]
+		return ok
+	})
+	req := &pb.FollowRequest{FollowerUuid: bob, FollowedUuid: ada, Type: pb.FollowRequest_USER}
+	if _, err := h.client.Follow(h.as(t, mustUUID(t, bob)), req); err != nil {
+		t.Fatalf("failed to follow: %v", err)
+	}
+	eventually("the follow counted", func() bool {
+		return found("ada")["ada"] == 1
+	})
+	if err := h.datarepo.DeleteUser(ctx, mustUUID(t, ada), mustUUID(t, ada), time.Now().Unix()); err != nil {
+		t.Fatalf("failed to delete user: %v", err)
+	}
+	eventually("the deleted user left out", func() bool {
+		_, ok := found("ada")["ada"]
+		return !ok
+	})
+}
+
+func TestSearchUsersLeavesOutBlocks(t *testing.T) {
+	h := newHarness(t)
+	ada, adam, adamina := h.createUser(t, "ada", "hunter22"), h.createUser(t, "adam", "hunter22"), h.createUser(t, "adamina", "hunter22")
+	if err := h.search.Refresh(context.Background()); err != nil {
+		t.Fatalf("failed to refresh search index: %v", err)
+	}
+	asAda, asAdam, asAdamina := h.as(t, mustUUID(t, ada)), h.as(t, mustUUID(t, adam)), h.as(t, mustUUID(t, adamina))
+	search := func(ctx context.Context) string {
+		t.Helper()
+		res, err := h.client.SearchUsers(ctx, &pb.SearchUsersRequest{Query: "ada"})
+		if err != nil {
+			t.Fatalf("failed to search: %v", err)
+		}
+		var names []string
+		for _, result := range res.Results {
+			names = append(names, result.Username)
+		}
+		return strings.Join(names, ",")
+	}
+	if got := search(asAda); got != "ada,adam,adamina" {
+		t.Fatalf("expected every user found before blocking, got %s", got)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := h.client.BlockUser(asAda, &pb.BlockRequest{BlockerUuid: ada, BlockedUuid: adam}); err != nil {
+			t.Fatalf("failed to block user, attempt %d: %v", i+1, err)
+		}
+	}
+	if got := search(asAda); got != "ada,adamina" {
+		t.Fatalf("expected the blocked user left out of the blocker's search, got %s", got)
+	}
+	if got := search(asAdam); got != "adam,adamina" {
+		t.Fatalf("expected the blocker left out of the blocked user's search, got %s", got)
+	}
+	if got := search(asAdamina); got != "ada,adam,adamina" {
+		t.Fatalf("expected blocks to leave other users' searches be, got %s", got)
+	}
+	if got := search(h.asService(t)); got != "ada,adam,adamina" {
+		t.Fatalf("expected services to find every user, got %s", got)
+	}
+
+	_, err := h.client.BlockUser(asAda, &pb.BlockRequest{BlockerUuid: ada, BlockedUuid: ada})
+	expectCode(t, err, codes.InvalidArgument)
+	_, err = h.client.BlockUser(asAda, &pb.BlockRequest{BlockerUuid: ada, BlockedUuid: uuid.Must(uuid.NewV4()).Bytes()})
+	expectCode(t, err, codes.NotFound)
+	_, err = h.client.BlockUser(asAdam, &pb.BlockRequest{BlockerUuid: ada, BlockedUuid: adamina})
+	expectCode(t, err, codes.PermissionDenied)
+	_, err = h.client.UnblockUser(asAdam, &pb.BlockRequest{BlockerUuid: ada, BlockedUuid: adam})
+	expectCode(t, err, codes.PermissionDenied)
+
+	for i := 0; i < 2; i++ {
+		if _, err := h.client.UnblockUser(asAda, &pb.BlockRequest{BlockerUuid: ada, BlockedUuid: adam}); err != nil {
+			t.Fatalf("failed to unblock user, attempt %d: %v", i+1, err)
+		}
+	}
+	if got := search(asAdam); got != "ada,adam,adamina" {
+		t.Fatalf("expected every user found after unblocking, got %s", got)
+	}
+}
+
+// mockIdP is an OIDC provider serving discovery and keys, for id tokens it signs
+type mockIdP struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	idp := &mockIdP{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                idp.URL,
+			"authorization_endpoint":                idp.URL + "/authorize",
+			"token_endpoint":                        idp.URL + "/token",
+			"jwks_uri":                              idp.URL + "/keys",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "mock",
+				"alg": "RS256",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+func (idp *mockIdP) provider() config.IdentityProvider {
+	return config.IdentityProvider{Name: "mock", IssuerURL: idp.URL, ClientID: "client", RedirectURL: "http://localhost/callback"}
+}
+
+func (idp *mockIdP) proof(t *testing.T, subject string) *pb.IdentityProof {
+	now := time.Now()
+	tok := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":                idp.URL,
+		"sub":                subject,
+		"aud":                "client",
+		"iat":                now.Unix(),
+		"exp":                now.Add(time.Hour).Unix(),
+		"email":              subject + "@example.com",
+		"email_verified":     true,
+		"preferred_username": subject,
+	})
+	tok.Header["kid"] = "mock"
+	signed, err := tok.SignedString(idp.key)
+	if err != nil {
+		t.Fatalf("failed to sign id token: %v", err)
+	}
+	return &pb.IdentityProof{Provider: "mock", IdToken: signed}
+}
+
+func TestLoginWithIdentityRefusesLockedUsers(t *testing.T) {
+	idp := newMockIdP(t)
+	h := newHarnessWith(t, service.NewMemoryDataRepository(), []config.IdentityProvider{idp.provider()})
+	ctx := context.Background()
+
+	res, err := h.client.LoginWithIdentity(ctx, &pb.LoginWithIdentityRequest{Proof: idp.proof(t, "dinah"), Device: "phone"})
+	if err != nil {
+		t.Fatalf("failed to log in with identity: %v", err)
+	}
+	if !res.Created {
+		t.Fatal("expected the first login to create the user")
+	}
+	userUUID, err := uuid.FromBytes(res.User.Uuid)
+	if err != nil {
+		t.Fatalf("failed to parse user uuid: %v", err)
+	}
+	if err := h.datarepo.RecordFailedLogin(ctx, userUUID.String(), 1, time.Now().Unix(), time.Now().Add(time.Minute).Unix()); err != nil {
+		t.Fatalf("failed to lock user: %v", err)
+	}
+	_, err = h.client.LoginWithIdentity(ctx, &pb.LoginWithIdentityRequest{Proof: idp.proof(t, "dinah"), Device: "phone"})
+	expectCode(t, err, codes.PermissionDenied)
+
+	if err := h.datarepo.UnlockUser(ctx, userUUID.String(), userUUID.String(), time.Now().Unix()); err != nil {
+		t.Fatalf("failed to unlock user: %v", err)
+	}
+	res, err = h.client.LoginWithIdentity(ctx, &pb.LoginWithIdentityRequest{Proof: idp.proof(t, "dinah"), Device: "phone"})
+	if err != nil {
+		t.Fatalf("failed to log in once unlocked: %v", err)
+	}
+	if res.Created {
+		t.Fatal("expected the linked user to be logged in")
+	}
+}
+
+func TestLoginWithIdentityOfDeletedUser(t *testing.T) {
+	idp := newMockIdP(t)
+	h := newHarnessWith(t, service.NewMemoryDataRepository(), []config.IdentityProvider{idp.provider()})
+	ctx := context.Background()
+
+	res, err := h.client.LoginWithIdentity(ctx, &pb.LoginWithIdentityRequest{Proof: idp.proof(t, "dinah"), Device: "phone"})
+	if err != nil {
+		t.Fatalf("failed to log in with identity: %v", err)
+	}
+	userUUID, err := uuid.FromBytes(res.User.Uuid)
+	if err != nil {
+		t.Fatalf("failed to parse user uuid: %v", err)
+	}
+	if err := h.datarepo.DeleteUser(ctx, userUUID.String(), userUUID.String(), time.Now().Unix()); err != nil {
+		t.Fatalf("failed to delete user: %v", err)
+	}
+	_, err = h.client.LoginWithIdentity(ctx, &pb.LoginWithIdentityRequest{Proof: idp.proof(t, "dinah"), Device: "phone"})
+	expectCode(t, err, codes.NotFound)
+}
+
+func TestLoginWithIdentityRefusesUnknownRedirect(t *testing.T) {
+	idp := newMockIdP(t)
+	h := newHarnessWith(t, service.NewMemoryDataRepository(), []config.IdentityProvider{idp.provider()})
+
+	proof := idp.proof(t, "dinah")
+	proof.RedirectUri = "https://evil.example/callback"
+	_, err := h.client.LoginWithIdentity(context.Background(), &pb.LoginWithIdentityRequest{Proof: proof, Device: "phone"})
+	expectCode(t, err, codes.InvalidArgument)
+
+	proof.RedirectUri = "http://localhost/callback"
+	if _, err := h.client.LoginWithIdentity(context.Background(), &pb.LoginWithIdentityRequest{Proof: proof, Device: "phone"}); err != nil {
+		t.Fatalf("expected the configured redirect url to be allowed: %v", err)
+	}
+}
@@ -0,0 +1,139 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/pkg/errors"
+	pb "github.com/srcabl/protos/users"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// WatchUser streams the changes to a user. With a resume token it first
+// replays the changes since the event the token came with.
+func (h *Handler) WatchUser(req *pb.WatchUserRequest, stream pb.UsersService_WatchUserServer) error {
+	id, err := uuid.FromBytes(req.UserUuid)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, errors.Wrap(err, "user uuid is not well formed").Error())
+	}
+	return h.watch(stream.Context(), req.ResumeToken, stream.Send, func(event *DBEvent) bool {
+		return !isFollowEvent(event.Type) && event.AggregateUUID == id.String()
+	})
+}
+
+// WatchFollows streams follows and unfollows, of the follower and of the
+// followed when they are set and of everyone when neither is. With a resume
+// token it first replays the ones since the event the token came with.
+func (h *Handler) WatchFollows(req *pb.WatchFollowsRequest, stream pb.UsersService_WatchFollowsServer) error {
+	var follower, followed string
+	if len(req.FollowerUuid) > 0 {
+		id, err := uuid.FromBytes(req.FollowerUuid)
+		if err != nil {
+			return status.Error(codes.InvalidArgument, errors.Wrap(err, "follower uuid is not well formed").Error())
+		}
+		follower = id.String()
+	}
+	if len(req.FollowedUuid) > 0 {
+		id, err := uuid.FromBytes(req.FollowedUuid)
+		if err != nil {
+			return status.Error(codes.InvalidArgument, errors.Wrap(err, "followed uuid is not well formed").Error())
+		}
+		followed = id.String()
+	}
+	return h.watch(stream.Context(), req.ResumeToken, stream.Send, func(event *DBEvent) bool {
+		if !isFollowEvent(event.Type) || (follower != "" && event.AggregateUUID != follower) {
+			return false
+		}
+		if followed == "" {
+			return true
+		}
+		var payload FollowEventPayload
+		return json.Unmarshal(event.Payload, &payload) == nil && payload.FollowedUUID == followed
+	})
+}
+
+// RunWatches lets watches stream until the returned func is called, which
+// ends them so the server can drain. Clients resume them on another replica
+// with their last resume token.
+func (h *Handler) RunWatches() (func() error, error) {
+	return func() error {
+		close(h.watchesDone)
+		return nil
+	}, nil
+}
+
+// watch polls the outbox and sends the events keep keeps, each with the
+// token to resume after it from. It starts at the resume token, or at the
+// latest event without one, and first sends a checkpoint, a response with
+// a token and no event. Quiet streams get another checkpoint whenever the
+// checkpoint interval passes and their token moved.
+func (h *Handler) watch(ctx context.Context, resumeToken string, send func(*pb.WatchResponse) error, keep func(*DBEvent) bool) error {
+	eventRange, err := h.datarepo.GetEventRange(ctx)
+	if err != nil {
+		return status.Error(codes.Internal, errors.Wrap(err, "failed to start watch").Error())
+	}
+	position := eventRange.LatestID
+	if resumeToken != "" {
+		if position, err = decodeResumeToken(resumeToken); err != nil {
+			return status.Error(codes.InvalidArgument, errors.Wrap(err, "resume token is not well formed").Error())
+		}
+		if position > eventRange.LatestID {
+			return status.Error(codes.InvalidArgument, "resume token is ahead of the events written")
+		}
+		if position < eventRange.PrunedID {
+			return status.Error(codes.OutOfRange, "resume token is older than the events kept, read the current state and watch without one")
+		}
+	}
+
+	cfg := h.config.Watch
+	tail := newEventTail(position, cfg.GapTimeout)
+	sentToken := encodeResumeToken(position)
+	if err := send(&pb.WatchResponse{ResumeToken: sentToken}); err != nil {
+		return errors.Wrap(err, "failed to send checkpoint")
+	}
+	sentAt := time.Now()
+	poll := time.NewTicker(cfg.PollInterval)
+	defer poll.Stop()
+	for {
+		from := tail.position
+		events, err := h.datarepo.ListEventsAfter(ctx, from, cfg.BatchSize)
+		if err != nil {
+			return status.Error(codes.Internal, errors.Wrap(err, "failed to list events").Error())
+		}
+		now := time.Now()
+		for _, event := range tail.next(events, now) {
+			if !keep(event) {
+				continue
+			}
+			pbEvent, err := event.ToGRPC()
+			if err != nil {
+				return status.Error(codes.Internal, errors.Wrap(err, "failed to transform event").Error())
+			}
+			sentToken = tail.resumeToken(event)
+			if err := send(&pb.WatchResponse{Event: pbEvent, ResumeToken: sentToken}); err != nil {
+				return errors.Wrapf(err, "failed to send event %s", event.UUID)
+			}
+			sentAt = now
+		}
+		if token := encodeResumeToken(tail.position); token != sentToken && now.Sub(sentAt) >= cfg.CheckpointInterval {
+			if err := send(&pb.WatchResponse{ResumeToken: token}); err != nil {
+				return errors.Wrap(err, "failed to send checkpoint")
+			}
+			sentToken, sentAt = token, now
+		}
+		// a full batch that moved the tail means more are waiting
+		if len(events) == cfg.BatchSize && tail.position > from {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-h.watchesDone:
+			return status.Error(codes.Unavailable, "server is shutting down, resume the watch")
+		case <-poll.C:
+		}
+	}
+}
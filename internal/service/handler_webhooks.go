@@ -0,0 +1,158 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"net/url"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/pkg/errors"
+	pb "github.com/srcabl/protos/users"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// webhookSecretBytes is how much randomness goes into a webhook's secret
+const webhookSecretBytes = 32
+
+// The number of deliveries ListWebhookDeliveries returns without a limit,
+// and the most it returns with one
+const (
+	defaultDeliveriesLimit = 50
+	maxDeliveriesLimit     = 500
+)
+
+// CreateWebhook subscribes a url to the events of the types given, or to
+// every event without any. The secret the deliveries are signed with is
+// only ever returned here.
+func (h *Handler) CreateWebhook(ctx context.Context, req *pb.CreateWebhookRequest) (*pb.CreateWebhookResponse, error) {
+	if u, err := url.Parse(req.Url); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "%q is not an http or https url", req.Url)
+	}
+	for _, eventType := range req.EventTypes {
+		if !isEventType(eventType) {
+			return nil, status.Errorf(codes.InvalidArgument, "%q is not an event type", eventType)
+		}
+	}
+	id, err := uuid.NewV4()
+	if err != nil {
+		return nil, status.Error(codes.Internal, errors.Wrap(err, "failed to generate uuid").Error())
+	}
+	raw := make([]byte, webhookSecretBytes)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, status.Error(codes.Internal, errors.Wrap(err, "failed to generate webhook secret").Error())
+	}
+	webhook := &DBWebhook{
+		UUID:          id.String(),
+		URL:           req.Url,
+		Secret:        hex.EncodeToString(raw),
+		EventTypes:    req.EventTypes,
+		CreatedByUUID: actorUUID(ctx),
+		CreatedAt:     time.Now().Unix(),
+	}
+	if err := h.datarepo.CreateWebhook(ctx, webhook); err != nil {
+		return nil, status.Error(codes.Internal, errors.Wrap(err, "failed to create webhook").Error())
+	}
+	pbWebhook, err := webhook.ToGRPC()
+	if err != nil {
+		return nil, status.Error(codes.Internal, errors.Wrap(err, "failed to transform webhook").Error())
+	}
+	return &pb.CreateWebhookResponse{Webhook: pbWebhook, Secret: webhook.Secret}, nil
+}
+
+// ListWebhooks lists every webhook subscription, oldest first
+func (h *Handler) ListWebhooks(ctx context.Context, req *pb.ListWebhooksRequest) (*pb.ListWebhooksResponse, error) {
+	webhooks, err := h.datarepo.ListWebhooks(ctx)
+	if err != nil {
+		return nil, status.Error(codes.Internal, errors.Wrap(err, "failed to list webhooks").Error())
+	}
+	pbWebhooks := make([]*pb.Webhook, 0, len(webhooks))
+	for _, webhook := range webhooks {
+		pbWebhook, err := webhook.ToGRPC()
+		if err != nil {
+			return nil, status.Error(codes.Internal, errors.Wrap(err, "failed to transform webhook").Error())
+		}
+		pbWebhooks = append(pbWebhooks, pbWebhook)
+	}
+	return &pb.ListWebhooksResponse{Webhooks: pbWebhooks}, nil
+}
+
+// DeleteWebhook unsubscribes a webhook and drops its deliveries, including
+// those not delivered yet
+func (h *Handler) DeleteWebhook(ctx context.Context, req *pb.DeleteWebhookRequest) (*pb.DeleteWebhookResponse, error) {
+	webhookUUID, err := uuid.FromBytes(req.Uuid)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, errors.Wrap(err, "uuid of webhook is invalid").Error())
+	}
+	if err := h.datarepo.DeleteWebhook(ctx, webhookUUID.String()); err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return nil, status.Error(codes.NotFound, "webhook does not exist")
+		}
+		return nil, status.Error(codes.Internal, errors.Wrap(err, "failed to delete webhook").Error())
+	}
+	return &pb.DeleteWebhookResponse{}, nil
+}
+
+// ListWebhookDeliveries lists the newest deliveries to a webhook, only those
+// in the status when one is given
+func (h *Handler) ListWebhookDeliveries(ctx context.Context, req *pb.ListWebhookDeliveriesRequest) (*pb.ListWebhookDeliveriesResponse, error) {
+	webhookUUID, err := uuid.FromBytes(req.WebhookUuid)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, errors.Wrap(err, "uuid of webhook is invalid").Error())
+	}
+	switch req.Status {
+	case "", DeliveryPending, DeliveryDelivered, DeliveryDead:
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "%q is not a delivery status", req.Status)
+	}
+	limit := int(req.Limit)
+	if limit <= 0 {
+		limit = defaultDeliveriesLimit
+	}
+	if limit > maxDeliveriesLimit {
+		limit = maxDeliveriesLimit
+	}
+	deliveries, err := h.datarepo.ListWebhookDeliveries(ctx, webhookUUID.String(), req.Status, limit)
+	if err != nil {
+		return nil, status.Error(codes.Internal, errors.Wrap(err, "failed to list webhook deliveries").Error())
+	}
+	pbDeliveries := make([]*pb.WebhookDelivery, 0, len(deliveries))
+	for _, delivery := range deliveries {
+		pbDelivery, err := delivery.ToGRPC()
+		if err != nil {
+			return nil, status.Error(codes.Internal, errors.Wrap(err, "failed to transform webhook delivery").Error())
+		}
+		pbDeliveries = append(pbDeliveries, pbDelivery)
+	}
+	return &pb.ListWebhookDeliveriesResponse{Deliveries: pbDeliveries}, nil
+}
+
+// RedeliverWebhook queues a delivery, usually a dead one, to be attempted
+// again right away with a fresh set of attempts
+func (h *Handler) RedeliverWebhook(ctx context.Context, req *pb.RedeliverWebhookRequest) (*pb.RedeliverWebhookResponse, error) {
+	deliveryUUID, err := uuid.FromBytes(req.DeliveryUuid)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, errors.Wrap(err, "uuid of delivery is invalid").Error())
+	}
+	if _, err := h.datarepo.GetWebhookDelivery(ctx, deliveryUUID.String()); err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return nil, status.Error(codes.NotFound, "webhook delivery does not exist")
+		}
+		return nil, status.Error(codes.Internal, errors.Wrap(err, "failed to get webhook delivery").Error())
+	}
+	if err := h.datarepo.RedeliverWebhookDelivery(ctx, deliveryUUID.String(), time.Now().Unix()); err != nil {
+		return nil, status.Error(codes.Internal, errors.Wrap(err, "failed to redeliver webhook delivery").Error())
+	}
+	delivery, err := h.datarepo.GetWebhookDelivery(ctx, deliveryUUID.String())
+	if err != nil {
+		return nil, status.Error(codes.Internal, errors.Wrap(err, "failed to reload webhook delivery").Error())
+	}
+	pbDelivery, err := delivery.ToGRPC()
+	if err != nil {
+		return nil, status.Error(codes.Internal, errors.Wrap(err, "failed to transform webhook delivery").Error())
+	}
+	return &pb.RedeliverWebhookResponse{Delivery: pbDelivery}, nil
+}
@@ -19,10 +19,21 @@ type DBUser struct {
 	Username       string
 	Email          string
 	HashedPassword string
+	DisplayName    sql.NullString
 	CreatedByUUID  string
 	CreatedAt      int64
 	UpdatedByUUID  sql.NullString
 	UpdatedAt      sql.NullInt64
+
+	FailedLoginAttempts int
+	LockedUntil         sql.NullInt64
+	DeletedAt           sql.NullInt64
+	Roles               []string
+}
+
+// IsLocked reports whether the user is locked out at the given unix time
+func (u *DBUser) IsLocked(now int64) bool {
+	return u.LockedUntil.Valid && now < u.LockedUntil.Int64
 }
 
 // CreatedByUUIDString satisfies the services helper to transform db auditfields to grpc auditfields
@@ -45,7 +56,7 @@ func (u *DBUser) UpdatedAtUnixNullInt() sql.NullInt64 {
 	return u.UpdatedAt
 }
 
-// ToGRPC transforms the dbuser to proto user
+// ToGRPC transforms the dbuser to proto user, leaving out their hashed password
 func (u *DBUser) ToGRPC() (*sharedpb.User, error) {
 	id, err := uuid.FromString(u.UUID)
 	if err != nil {
@@ -56,30 +67,319 @@ func (u *DBUser) ToGRPC() (*sharedpb.User, error) {
 		return nil, errors.Wrap(err, "failed to transform auditfields")
 	}
 	return &sharedpb.User{
-		Uuid:            id.Bytes(),
-		Username:        u.Username,
-		Email:           u.Email,
-		HashedPasssword: u.HashedPassword,
-		AuditFields:     auditFields,
+		Uuid:        id.Bytes(),
+		Username:    u.Username,
+		Email:       u.Email,
+		AuditFields: auditFields,
+		Roles:       u.Roles,
 	}, nil
 }
 
+// ToCredentialsGRPC transforms the dbuser to proto user along with their
+// hashed password, for the services checking credentials themselves
+func (u *DBUser) ToCredentialsGRPC() (*sharedpb.User, error) {
+	pbUser, err := u.ToGRPC()
+	if err != nil {
+		return nil, err
+	}
+	pbUser.HashedPasssword = u.HashedPassword
+	return pbUser, nil
+}
+
 // HydrateModelForCreate creates a db user from a proto user and fills in any missing data
 func HydrateModelForCreate(req *userspb.CreateUserRequest) (*DBUser, error) {
+	dbUser, err := NewDBUser(req.Username, req.Email, req.HashedPasssword, "")
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if req.DisplayName != "" {
+		dbUser.DisplayName = sql.NullString{Valid: true, String: req.DisplayName}
+	}
+	//TODO description
+	return dbUser, nil
+}
+
+// NewDBUser news up a db user under a fresh uuid, created and last updated now
+// by the creator. Users signing themselves up are their own creator, which an
+// empty creator uuid stands for.
+func NewDBUser(username, email, hashedPassword, createdByUUID string) (*DBUser, error) {
 	newUUID, err := uuid.NewV4()
 	if err != nil {
-		return nil, status.Error(codes.Internal, errors.Wrap(err, "failed to generate uuid for user").Error())
+		return nil, errors.Wrap(err, "failed to generate uuid for user")
+	}
+	if createdByUUID == "" {
+		createdByUUID = newUUID.String()
 	}
 	now := time.Now().Unix()
 	return &DBUser{
 		UUID:           newUUID.String(),
-		Username:       req.Username,
-		Email:          req.Email,
-		HashedPassword: req.HashedPasssword,
-		CreatedByUUID:  newUUID.String(),
+		Username:       username,
+		Email:          email,
+		HashedPassword: hashedPassword,
+		CreatedByUUID:  createdByUUID,
 		CreatedAt:      now,
-		UpdatedByUUID:  sql.NullString{Valid: true, String: newUUID.String()},
+		UpdatedByUUID:  sql.NullString{Valid: true, String: createdByUUID},
 		UpdatedAt:      sql.NullInt64{Valid: true, Int64: now},
-		//TODO display and description
+	}, nil
+}
+
+// DBSession is the database session model
+type DBSession struct {
+	UUID                     string
+	UserUUID                 string
+	RefreshTokenHash         string
+	PreviousRefreshTokenHash sql.NullString
+	Device                   string
+	UserAgent                string
+	CreatedAt                int64
+	LastUsedAt               int64
+	ExpiresAt                int64
+	RevokedAt                sql.NullInt64
+}
+
+// IsActive reports whether the session can still be used at the given unix time
+func (s *DBSession) IsActive(now int64) bool {
+	return !s.RevokedAt.Valid && now < s.ExpiresAt
+}
+
+// ToGRPC transforms the dbsession to proto session
+func (s *DBSession) ToGRPC() (*userspb.Session, error) {
+	id, err := uuid.FromString(s.UUID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to transform session uuid: %s", s.UUID)
+	}
+	userID, err := uuid.FromString(s.UserUUID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to transform session user uuid: %s", s.UserUUID)
+	}
+	return &userspb.Session{
+		Uuid:       id.Bytes(),
+		UserUuid:   userID.Bytes(),
+		Device:     s.Device,
+		UserAgent:  s.UserAgent,
+		CreatedAt:  s.CreatedAt,
+		LastUsedAt: s.LastUsedAt,
+		ExpiresAt:  s.ExpiresAt,
+		RevokedAt:  s.RevokedAt.Int64,
+	}, nil
+}
+
+// DBIdentity is the database model of an external identity linked to a user
+type DBIdentity struct {
+	Provider      string
+	Subject       string
+	UserUUID      string
+	Email         sql.NullString
+	CreatedAt     int64
+	CreatedByUUID string
+}
+
+// ToGRPC transforms the dbidentity to proto identity
+func (i *DBIdentity) ToGRPC() (*userspb.Identity, error) {
+	userID, err := uuid.FromString(i.UserUUID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to transform identity user uuid: %s", i.UserUUID)
+	}
+	return &userspb.Identity{
+		Provider:  i.Provider,
+		Subject:   i.Subject,
+		UserUuid:  userID.Bytes(),
+		Email:     i.Email.String,
+		CreatedAt: i.CreatedAt,
+	}, nil
+}
+
+// DBRole is the database model of a role granted to a user
+type DBRole struct {
+	UserUUID      string
+	Role          string
+	CreatedAt     int64
+	CreatedByUUID string
+}
+
+// The states a webhook delivery moves through. Deliveries are pending until
+// the receiver takes them, and dead once they ran out of attempts.
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryDead      = "dead"
+)
+
+// DBWebhook is the database model of a webhook subscription. It receives the
+// events of the types listed, or of every type when none are.
+type DBWebhook struct {
+	UUID          string
+	URL           string
+	Secret        string
+	EventTypes    []string
+	CreatedByUUID string
+	CreatedAt     int64
+}
+
+// Subscribes reports whether the webhook receives events of the type
+func (w *DBWebhook) Subscribes(eventType string) bool {
+	if len(w.EventTypes) == 0 {
+		return true
+	}
+	for _, subscribed := range w.EventTypes {
+		if subscribed == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// ToGRPC transforms the dbwebhook to proto webhook, leaving out the secret
+func (w *DBWebhook) ToGRPC() (*userspb.Webhook, error) {
+	id, err := uuid.FromString(w.UUID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to transform webhook uuid: %s", w.UUID)
+	}
+	createdBy, err := uuid.FromString(w.CreatedByUUID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to transform webhook created by uuid: %s", w.CreatedByUUID)
+	}
+	return &userspb.Webhook{
+		Uuid:          id.Bytes(),
+		Url:           w.URL,
+		EventTypes:    w.EventTypes,
+		CreatedByUuid: createdBy.Bytes(),
+		CreatedAt:     w.CreatedAt,
+	}, nil
+}
+
+// DBWebhookDelivery is the database model of an event on its way to a
+// webhook. It carries a copy of the event, which outlives the event's
+// retention in the outbox so dead deliveries can be redelivered.
+type DBWebhookDelivery struct {
+	UUID           string
+	WebhookUUID    string
+	EventID        int64
+	EventUUID      string
+	EventType      string
+	AggregateType  string
+	AggregateUUID  string
+	Payload        []byte
+	EventCreatedAt int64
+	Status         string
+	Attempts       int
+	NextAttemptAt  int64
+	LastError      string
+	LastStatusCode int
+	CreatedAt      int64
+	DeliveredAt    sql.NullInt64
+}
+
+// newWebhookDeliveries news up a pending delivery of the event to each of
+// the webhooks subscribed to it
+func newWebhookDeliveries(event *DBEvent, webhooks []*DBWebhook) ([]*DBWebhookDelivery, error) {
+	var deliveries []*DBWebhookDelivery
+	for _, webhook := range webhooks {
+		if !webhook.Subscribes(event.Type) {
+			continue
+		}
+		id, err := uuid.NewV4()
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to generate uuid for webhook delivery")
+		}
+		deliveries = append(deliveries, &DBWebhookDelivery{
+			UUID:           id.String(),
+			WebhookUUID:    webhook.UUID,
+			EventID:        event.ID,
+			EventUUID:      event.UUID,
+			EventType:      event.Type,
+			AggregateType:  event.AggregateType,
+			AggregateUUID:  event.AggregateUUID,
+			Payload:        event.Payload,
+			EventCreatedAt: event.CreatedAt,
+			Status:         DeliveryPending,
+			NextAttemptAt:  event.CreatedAt,
+			CreatedAt:      event.CreatedAt,
+		})
+	}
+	return deliveries, nil
+}
+
+// ToGRPC transforms the dbwebhookdelivery to proto webhook delivery
+func (d *DBWebhookDelivery) ToGRPC() (*userspb.WebhookDelivery, error) {
+	id, err := uuid.FromString(d.UUID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to transform webhook delivery uuid: %s", d.UUID)
+	}
+	webhookID, err := uuid.FromString(d.WebhookUUID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to transform webhook uuid: %s", d.WebhookUUID)
+	}
+	return &userspb.WebhookDelivery{
+		Uuid:           id.Bytes(),
+		WebhookUuid:    webhookID.Bytes(),
+		EventId:        d.EventUUID,
+		EventType:      d.EventType,
+		Status:         d.Status,
+		Attempts:       int32(d.Attempts),
+		NextAttemptAt:  d.NextAttemptAt,
+		LastError:      d.LastError,
+		LastStatusCode: int32(d.LastStatusCode),
+		CreatedAt:      d.CreatedAt,
+		DeliveredAt:    d.DeliveredAt.Int64,
+	}, nil
+}
+
+// The states a data export moves through. Exports are pending until the
+// runner builds them, and then ready to download or failed.
+const (
+	ExportPending = "pending"
+	ExportReady   = "ready"
+	ExportFailed  = "failed"
+)
+
+// The formats a data export is built in: a single JSON document, or a zip
+// archive holding a JSON file per part of the export
+const (
+	ExportJSON = "json"
+	ExportZip  = "zip"
+)
+
+// DBDataExport is the database model of an export of everything stored about
+// a user. Data holds the built export once it is ready and is only read when
+// it is downloaded.
+type DBDataExport struct {
+	UUID            string
+	UserUUID        string
+	RequestedByUUID string
+	Format          string
+	Status          string
+	ClaimedUntil    int64
+	Data            []byte
+	Size            int64
+	Error           string
+	CreatedAt       int64
+	CompletedAt     sql.NullInt64
+}
+
+// ToGRPC transforms the dbdataexport to proto data export
+func (e *DBDataExport) ToGRPC() (*userspb.DataExport, error) {
+	id, err := uuid.FromString(e.UUID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to transform data export uuid: %s", e.UUID)
+	}
+	userID, err := uuid.FromString(e.UserUUID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to transform data export user uuid: %s", e.UserUUID)
+	}
+	requestedBy, err := uuid.FromString(e.RequestedByUUID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to transform data export requested by uuid: %s", e.RequestedByUUID)
+	}
+	return &userspb.DataExport{
+		Uuid:            id.Bytes(),
+		UserUuid:        userID.Bytes(),
+		RequestedByUuid: requestedBy.Bytes(),
+		Format:          e.Format,
+		Status:          e.Status,
+		Error:           e.Error,
+		Size:            e.Size,
+		CreatedAt:       e.CreatedAt,
+		CompletedAt:     e.CompletedAt.Int64,
 	}, nil
 }
@@ -0,0 +1,117 @@
+package service
+
+import (
+	pb "github.com/srcabl/protos/users"
+	"github.com/srcabl/users/internal/auth"
+)
+
+// method is the full grpc name of a users service rpc
+func method(name string) string {
+	return "/" + pb.UsersService_ServiceDesc.ServiceName + "/" + name
+}
+
+// Policies is the authorization policy of every users service rpc
+func Policies() auth.Policies {
+	return auth.Policies{
+		method("HealthCheck"): auth.Public,
+		method("GetJWKS"):     auth.Public,
+
+		// these authenticate the caller themselves
+		method("CreateSession"):     auth.Public,
+		method("RefreshSession"):    auth.Public,
+		method("LoginWithIdentity"): auth.Public,
+
+		method("ValidateUserCredentials"): auth.ServiceOnly,
+		method("CreateUser"):              auth.ServiceOnly,
+		method("WatchUser"):               auth.ServiceOnly,
+		method("WatchFollows"):            auth.ServiceOnly,
+
+		method("GetUser"):     auth.Authenticated,
+		method("SearchUsers"): auth.Authenticated,
+		// the handler checks the session belongs to the caller
+		method("RevokeSession"): auth.Authenticated,
+
+		method("Follow"): auth.SelfOrService(func(req interface{}) []byte {
+			return req.(*pb.FollowRequest).FollowerUuid
+		}),
+		method("UnFollow"): auth.SelfOrService(func(req interface{}) []byte {
+			return req.(*pb.FollowRequest).FollowerUuid
+		}),
+		method("BlockUser"): auth.SelfOrService(func(req interface{}) []byte {
+			return req.(*pb.BlockRequest).BlockerUuid
+		}),
+		method("UnblockUser"): auth.SelfOrService(func(req interface{}) []byte {
+			return req.(*pb.BlockRequest).BlockerUuid
+		}),
+		method("UpdateUser"): auth.SelfOrService(func(req interface{}) []byte {
+			return req.(*pb.UpdateUserRequest).GetUser().GetUuid()
+		}),
+		method("DeleteUser"): auth.AnyOf(
+			auth.RoleOrService(auth.RoleAdmin),
+			auth.SelfOrService(func(req interface{}) []byte {
+				return req.(*pb.DeleteUserRequest).Uuid
+			}),
+		),
+		method("ChangePassword"): auth.SelfOrService(func(req interface{}) []byte {
+			return req.(*pb.ChangePasswordRequest).UserUuid
+		}),
+		method("ListSessions"): auth.SelfOrService(func(req interface{}) []byte {
+			return req.(*pb.ListSessionsRequest).UserUuid
+		}),
+		method("RevokeAllSessions"): auth.SelfOrService(func(req interface{}) []byte {
+			return req.(*pb.RevokeAllSessionsRequest).UserUuid
+		}),
+		method("LinkIdentity"): auth.SelfOrService(func(req interface{}) []byte {
+			return req.(*pb.LinkIdentityRequest).UserUuid
+		}),
+		method("UnlinkIdentity"): auth.SelfOrService(func(req interface{}) []byte {
+			return req.(*pb.UnlinkIdentityRequest).UserUuid
+		}),
+		method("ListIdentities"): auth.SelfOrService(func(req interface{}) []byte {
+			return req.(*pb.ListIdentitiesRequest).UserUuid
+		}),
+
+		method("GrantRole"):  auth.RoleOrService(auth.RoleAdmin),
+		method("RevokeRole"): auth.RoleOrService(auth.RoleAdmin),
+		method("UnlockUser"): auth.RoleOrService(auth.RoleAdmin, auth.RoleModerator),
+
+		method("CreateWebhook"):         auth.RoleOrService(auth.RoleAdmin),
+		method("ListWebhooks"):          auth.RoleOrService(auth.RoleAdmin),
+		method("DeleteWebhook"):         auth.RoleOrService(auth.RoleAdmin),
+		method("ListWebhookDeliveries"): auth.RoleOrService(auth.RoleAdmin),
+		method("RedeliverWebhook"):      auth.RoleOrService(auth.RoleAdmin),
+
+		method("ListAuditLog"): auth.RoleOrService(auth.RoleAdmin),
+
+		method("RequestDataExport"): auth.AnyOf(
+			auth.RoleOrService(auth.RoleAdmin),
+			auth.SelfOrService(func(req interface{}) []byte {
+				return req.(*pb.RequestDataExportRequest).UserUuid
+			}),
+		),
+		method("GetDataExport"): auth.AnyOf(
+			auth.RoleOrService(auth.RoleAdmin),
+			auth.SelfOrService(func(req interface{}) []byte {
+				return req.(*pb.GetDataExportRequest).UserUuid
+			}),
+		),
+		// streams are authorized before their request is read, so the
+		// handler checks the export belongs to the caller
+		method("DownloadDataExport"): auth.Authenticated,
+
+		method("EraseUser"): auth.AnyOf(
+			auth.RoleOrService(auth.RoleAdmin),
+			auth.SelfOrService(func(req interface{}) []byte {
+				return req.(*pb.EraseUserRequest).UserUuid
+			}),
+		),
+		method("GetErasure"): auth.RoleOrService(auth.RoleAdmin),
+
+		// orchestrators probe health without credentials
+		"/grpc.health.v1.Health/Check": auth.Public,
+		"/grpc.health.v1.Health/Watch": auth.Public,
+
+		// the schema is not a secret and grpcurl needs it
+		"/grpc.reflection.v1alpha.ServerReflection/ServerReflectionInfo": auth.Public,
+	}
+}
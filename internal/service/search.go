@@ -0,0 +1,172 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"strings"
+
+	"github.com/gofrs/uuid"
+	"github.com/pkg/errors"
+	pb "github.com/srcabl/protos/users"
+)
+
+// SearchIndex finds the users whose username or display name, or a word of
+// it, starts with the query, or would with a typo or two. Results are ranked
+// exact matches first, then by followers, and paged through by offset.
+// Deleted users are never found, nor are the users excluded by uuid, such as
+// those blocked by or blocking the searcher.
+type SearchIndex interface {
+	SearchUsers(ctx context.Context, query string, exclude map[string]bool, offset, limit int) ([]*DBSearchResult, error)
+}
+
+// DBSearchUser is a user as searches see them, with how many users follow them
+type DBSearchUser struct {
+	UUID        string
+	Username    string
+	DisplayName sql.NullString
+	Followers   int64
+}
+
+// DBSearchResult is a user a search found. Exact is set when the query is
+// the whole of their username or display name.
+type DBSearchResult struct {
+	DBSearchUser
+	Exact bool
+}
+
+// NormalizeSearch lowercases the query and collapses its whitespace, the way
+// indexes compare queries to users
+func NormalizeSearch(query string) string {
+	return strings.Join(strings.Fields(strings.ToLower(query)), " ")
+}
+
+// maxSearchEdits is how many typos a query of the length may have. Short
+// queries have to match exactly, or they would match nearly everyone.
+func maxSearchEdits(query []rune) int {
+	switch {
+	case len(query) < 4:
+		return 0
+	case len(query) < 8:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// searchTerms are what the start of a query is matched against: the
+// username, the display name and every later word of the display name
+func searchTerms(user *DBSearchUser) []string {
+	terms := []string{strings.ToLower(user.Username)}
+	displayName := NormalizeSearch(user.DisplayName.String)
+	if displayName == "" {
+		return terms
+	}
+	terms = append(terms, displayName)
+	words := strings.Fields(displayName)
+	if len(words) > 1 {
+		terms = append(terms, words[1:]...)
+	}
+	return terms
+}
+
+// newSearchResult makes the result of a normalized query found the user
+func newSearchResult(query string, user *DBSearchUser) *DBSearchResult {
+	return &DBSearchResult{
+		DBSearchUser: *user,
+		Exact:        query == strings.ToLower(user.Username) || query == NormalizeSearch(user.DisplayName.String),
+	}
+}
+
+// matchSearch reports whether the normalized query finds the user
+func matchSearch(query string, user *DBSearchUser) bool {
+	runes := []rune(query)
+	maxEdits := maxSearchEdits(runes)
+	for _, term := range searchTerms(user) {
+		if prefixDistance(runes, []rune(term)) <= maxEdits {
+			return true
+		}
+	}
+	return false
+}
+
+// prefixDistance is the fewest single rune edits that turn the query into a
+// prefix of the term
+func prefixDistance(query, term []rune) int {
+	row := make([]int, len(query)+1)
+	for i := range row {
+		row[i] = i
+	}
+	best := row[len(query)]
+	for _, r := range term {
+		row = nextEditRow(row, query, r)
+		if row[len(query)] < best {
+			best = row[len(query)]
+		}
+	}
+	return best
+}
+
+// nextEditRow is the row of edit distances between the query and a term one
+// rune r longer than the term of the previous row
+func nextEditRow(prev []int, query []rune, r rune) []int {
+	row := make([]int, len(prev))
+	row[0] = prev[0] + 1
+	for i, q := range query {
+		cost := 1
+		if q == r {
+			cost = 0
+		}
+		row[i+1] = minInt(prev[i]+cost, minInt(prev[i+1]+1, row[i]+1))
+	}
+	return row
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// rankSearch sorts results exact matches first, then by followers, most
+// first, then by username so pages stay put between searches
+func rankSearch(results []*DBSearchResult) {
+	sort.Slice(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if a.Exact != b.Exact {
+			return a.Exact
+		}
+		if a.Followers != b.Followers {
+			return a.Followers > b.Followers
+		}
+		return a.Username < b.Username
+	})
+}
+
+// pageSearch picks the page of ranked results at the offset
+func pageSearch(results []*DBSearchResult, offset, limit int) []*DBSearchResult {
+	if offset >= len(results) {
+		return nil
+	}
+	results = results[offset:]
+	if limit < len(results) {
+		results = results[:limit]
+	}
+	return results
+}
+
+// ToGRPC transforms the dbsearchresult to proto user search result
+func (r *DBSearchResult) ToGRPC() (*pb.UserSearchResult, error) {
+	id, err := uuid.FromString(r.UUID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to transform search result uuid: %s", r.UUID)
+	}
+	return &pb.UserSearchResult{
+		Uuid:        id.Bytes(),
+		Username:    r.Username,
+		DisplayName: r.DisplayName.String,
+		Followers:   r.Followers,
+		Exact:       r.Exact,
+	}, nil
+}
@@ -0,0 +1,79 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/srcabl/users/internal/config"
+)
+
+// ngramSize is the token size of mysql's ngram parser. Queries shorter than
+// a token are not in the FULLTEXT index and are looked up with LIKE instead.
+const ngramSize = 2
+
+const fullTextSearchQuery = searchUserByQuery + `
+WHERE
+	u.deleted_at IS NULL AND MATCH(u.username, u.display_name) AGAINST(? IN NATURAL LANGUAGE MODE)
+` + searchUserGroupBy + `
+ORDER BY
+	MATCH(u.username, u.display_name) AGAINST(? IN NATURAL LANGUAGE MODE) DESC
+LIMIT ?
+`
+
+const likeSearchQuery = searchUserByQuery + `
+WHERE
+	u.deleted_at IS NULL AND (u.username LIKE ? OR u.display_name LIKE ? OR u.display_name LIKE ?)
+` + searchUserGroupBy + `
+ORDER BY
+	u.username
+LIMIT ?
+`
+
+// FullTextSearchIndex is a search index querying the FULLTEXT index on the
+// users table in mysql, so searches see users as soon as they are stored.
+// The index finds the users sharing the most two rune grams with the query,
+// up to the max candidates, which are then matched and ranked like the trie
+// search index does.
+type FullTextSearchIndex struct {
+	sqlDB
+	maxCandidates int
+}
+
+// NewFullTextSearchIndex news up a search index on the mysql database
+func NewFullTextSearchIndex(cfg config.Search, db func() *sql.DB) *FullTextSearchIndex {
+	return &FullTextSearchIndex{
+		sqlDB:         sqlDB{system: "mysql", db: db},
+		maxCandidates: cfg.MaxCandidates,
+	}
+}
+
+// SearchUsers finds the users the query matches in the FULLTEXT index
+func (f *FullTextSearchIndex) SearchUsers(ctx context.Context, query string, exclude map[string]bool, offset, limit int) ([]*DBSearchResult, error) {
+	query = NormalizeSearch(query)
+	var candidates []*DBSearchUser
+	var err error
+	if len([]rune(query)) < ngramSize {
+		prefix := escapeLike(query) + "%"
+		candidates, err = f.listSearchUsers(ctx, likeSearchQuery, prefix, prefix, "% "+prefix, f.maxCandidates)
+	} else {
+		candidates, err = f.listSearchUsers(ctx, fullTextSearchQuery, query, query, f.maxCandidates)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to search users")
+	}
+	var results []*DBSearchResult
+	for _, user := range candidates {
+		if !exclude[user.UUID] && matchSearch(query, user) {
+			results = append(results, newSearchResult(query, user))
+		}
+	}
+	rankSearch(results)
+	return pageSearch(results, offset, limit), nil
+}
+
+// escapeLike escapes the wildcards of LIKE in s
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
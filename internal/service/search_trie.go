@@ -0,0 +1,310 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/srcabl/users/internal/config"
+	"go.uber.org/zap"
+)
+
+// searchRefreshBatch is how many users a refresh lists, and how many events
+// a poll of the outbox reads, at a time
+const searchRefreshBatch = 500
+
+// TrieSearchIndex is a search index keeping every user in memory, in a trie
+// of their search terms. It follows the outbox on the poll interval and
+// updates the users events are about, so created users show up in searches
+// and deleted and erased ones drop out of them within a poll. Changes no
+// event is about, such as a deleted follower no longer counting, are picked
+// up when the index is rebuilt from the data repo on the refresh interval.
+type TrieSearchIndex struct {
+	cfg      config.Search
+	datarepo DataRepository
+	logger   *zap.Logger
+
+	mu   sync.RWMutex
+	trie *searchTrie
+}
+
+// NewTrieSearchIndex news up a trie search index, empty until it is refreshed
+func NewTrieSearchIndex(cfg config.Search, datarepo DataRepository, logger *zap.Logger) *TrieSearchIndex {
+	return &TrieSearchIndex{
+		cfg:      cfg,
+		datarepo: datarepo,
+		logger:   logger,
+		trie:     newSearchTrie(),
+	}
+}
+
+// Run refreshes the index, then applies the events written to the outbox on
+// the poll interval and refreshes it again on the refresh interval, until the
+// returned func is called, which waits for the step in flight. Both run on
+// the same goroutine, so events written during a refresh are applied on top
+// of it.
+func (t *TrieSearchIndex) Run() (func() error, error) {
+	eventRange, err := t.datarepo.GetEventRange(context.Background())
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get the events to follow")
+	}
+	// a gap older than a refresh is covered by the refresh anyway
+	tail := newEventTail(eventRange.LatestID, t.cfg.RefreshInterval)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	poll := time.NewTicker(t.cfg.PollInterval)
+	refresh := time.NewTicker(t.cfg.RefreshInterval)
+	go func() {
+		defer close(done)
+		if err := t.Refresh(ctx); err != nil && ctx.Err() == nil {
+			t.logger.Warn("search index refresh failed", zap.Error(err))
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-poll.C:
+				if err := t.applyEvents(ctx, tail); err != nil && ctx.Err() == nil {
+					t.logger.Warn("search index update failed", zap.Error(err))
+				}
+			case <-refresh.C:
+				if err := t.Refresh(ctx); err != nil && ctx.Err() == nil {
+					t.logger.Warn("search index refresh failed", zap.Error(err))
+				}
+			}
+		}
+	}()
+	return func() error {
+		poll.Stop()
+		refresh.Stop()
+		cancel()
+		<-done
+		return nil
+	}, nil
+}
+
+// Refresh rebuilds the index from every user in the data repo. The index
+// searched so far is kept when the rebuild fails.
+func (t *TrieSearchIndex) Refresh(ctx context.Context) error {
+	trie := newSearchTrie()
+	after := ""
+	for {
+		users, err := t.datarepo.ListSearchUsers(ctx, after, searchRefreshBatch)
+		if err != nil {
+			return err
+		}
+		for _, user := range users {
+			trie.insert(user)
+		}
+		if len(users) < searchRefreshBatch {
+			break
+		}
+		after = users[len(users)-1].UUID
+	}
+	t.mu.Lock()
+	t.trie = trie
+	t.mu.Unlock()
+	return nil
+}
+
+// applyEvents updates the users the events written since the tail's
+// position are about, until it has read every event written so far
+func (t *TrieSearchIndex) applyEvents(ctx context.Context, tail *eventTail) error {
+	for {
+		from := tail.position
+		events, err := t.datarepo.ListEventsAfter(ctx, from, searchRefreshBatch)
+		if err != nil {
+			return errors.Wrap(err, "failed to list events")
+		}
+		for _, event := range tail.next(events, time.Now()) {
+			userUUID, err := searchEventUser(event)
+			if err != nil {
+				return err
+			}
+			if userUUID == "" {
+				continue
+			}
+			if err := t.Update(ctx, userUUID); err != nil {
+				return err
+			}
+		}
+		// a full batch that moved the tail means more are waiting
+		if len(events) < searchRefreshBatch || tail.position == from {
+			return nil
+		}
+	}
+}
+
+// searchEventUser is the user whose search entry the event changes, if any.
+// User events change the user, follow events the followers of the followed.
+func searchEventUser(event *DBEvent) (string, error) {
+	if !isFollowEvent(event.Type) {
+		return event.AggregateUUID, nil
+	}
+	var payload FollowEventPayload
+	if err := json.Unmarshal(event.Payload, &payload); err != nil {
+		return "", errors.Wrapf(err, "failed to unmarshal %s payload of event %s", event.Type, event.UUID)
+	}
+	if payload.FollowedType != FollowedUser {
+		return "", nil
+	}
+	return payload.FollowedUUID, nil
+}
+
+// Update reads the user back from the data repo into the index, or takes
+// them out of it when they are deleted
+func (t *TrieSearchIndex) Update(ctx context.Context, userUUID string) error {
+	user, err := t.datarepo.GetSearchUser(ctx, userUUID)
+	if errors.Cause(err) == sql.ErrNoRows {
+		t.mu.Lock()
+		t.trie.remove(userUUID)
+		t.mu.Unlock()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	t.trie.insert(user)
+	t.mu.Unlock()
+	return nil
+}
+
+// SearchUsers finds the users the query matches in the index
+func (t *TrieSearchIndex) SearchUsers(ctx context.Context, query string, exclude map[string]bool, offset, limit int) ([]*DBSearchResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	query = NormalizeSearch(query)
+	t.mu.RLock()
+	found := t.trie.search([]rune(query))
+	t.mu.RUnlock()
+
+	var results []*DBSearchResult
+	for _, user := range found {
+		if !exclude[user.UUID] {
+			results = append(results, newSearchResult(query, user))
+		}
+	}
+	rankSearch(results)
+	if len(results) > t.cfg.MaxCandidates {
+		results = results[:t.cfg.MaxCandidates]
+	}
+	return pageSearch(results, offset, limit), nil
+}
+
+// searchTrie holds users under every one of their search terms. It is not
+// safe for concurrent use.
+type searchTrie struct {
+	root  *trieNode
+	users map[string]*DBSearchUser
+}
+
+// trieNode is a node of a search trie. Users are the uuids of the users with
+// a search term ending at the node.
+type trieNode struct {
+	children map[rune]*trieNode
+	users    map[string]bool
+}
+
+func newSearchTrie() *searchTrie {
+	return &searchTrie{root: &trieNode{}, users: map[string]*DBSearchUser{}}
+}
+
+// insert adds the user to the trie, in place of what it held of them before
+func (s *searchTrie) insert(user *DBSearchUser) {
+	s.remove(user.UUID)
+	s.users[user.UUID] = user
+	for _, term := range searchTerms(user) {
+		node := s.root
+		for _, r := range term {
+			if node.children == nil {
+				node.children = map[rune]*trieNode{}
+			}
+			child, ok := node.children[r]
+			if !ok {
+				child = &trieNode{}
+				node.children[r] = child
+			}
+			node = child
+		}
+		if node.users == nil {
+			node.users = map[string]bool{}
+		}
+		node.users[user.UUID] = true
+	}
+}
+
+// remove takes the user out of the trie, along with the nodes only they
+// were under
+func (s *searchTrie) remove(userUUID string) {
+	user, ok := s.users[userUUID]
+	if !ok {
+		return
+	}
+	delete(s.users, userUUID)
+	for _, term := range searchTerms(user) {
+		s.root.remove([]rune(term), userUUID)
+	}
+}
+
+// remove takes the user out of the node the term leads to, and reports
+// whether the node is left empty
+func (n *trieNode) remove(term []rune, userUUID string) bool {
+	if len(term) == 0 {
+		delete(n.users, userUUID)
+	} else if child, ok := n.children[term[0]]; ok && child.remove(term[1:], userUUID) {
+		delete(n.children, term[0])
+	}
+	return len(n.users) == 0 && len(n.children) == 0
+}
+
+// search finds the users with a search term the query is a prefix of, within
+// the edits the query may have. It walks the trie keeping the row of edit
+// distances between the query and the path to each node, and stops going
+// down a path once every distance on it is past the edits allowed.
+func (s *searchTrie) search(query []rune) []*DBSearchUser {
+	maxEdits := maxSearchEdits(query)
+	found := map[string]bool{}
+	row := make([]int, len(query)+1)
+	for i := range row {
+		row[i] = i
+	}
+	var walk func(node *trieNode, row []int)
+	walk = func(node *trieNode, row []int) {
+		if row[len(query)] <= maxEdits {
+			node.collect(found)
+			return
+		}
+		best := row[0]
+		for _, d := range row {
+			best = minInt(best, d)
+		}
+		if best > maxEdits {
+			return
+		}
+		for r, child := range node.children {
+			walk(child, nextEditRow(row, query, r))
+		}
+	}
+	walk(s.root, row)
+
+	users := make([]*DBSearchUser, 0, len(found))
+	for userUUID := range found {
+		users = append(users, s.users[userUUID])
+	}
+	return users
+}
+
+// collect adds the users under the node to found
+func (n *trieNode) collect(found map[string]bool) {
+	for userUUID := range n.users {
+		found[userUUID] = true
+	}
+	for _, child := range n.children {
+		child.collect(found)
+	}
+}
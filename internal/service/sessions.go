@@ -0,0 +1,55 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// SessionChecker checks access tokens against the sessions and roles stored,
+// so a token stops working as soon as its session is revoked, which revoking
+// sessions, changing the password, deleting or erasing the user all do, and
+// stops carrying a role as soon as the role is revoked
+type SessionChecker struct {
+	datarepo DataRepository
+	now      func() time.Time
+}
+
+// NewSessionChecker news up a session checker on the data repo
+func NewSessionChecker(datarepo DataRepository) *SessionChecker {
+	return &SessionChecker{
+		datarepo: datarepo,
+		now:      time.Now,
+	}
+}
+
+// CheckSession checks the session is the user's and still active, and returns
+// the roles the user holds. Failing to read the session or the user is an
+// unavailable status rather than the token's fault.
+func (c *SessionChecker) CheckSession(ctx context.Context, userUUID, sessionUUID string) ([]string, error) {
+	session, err := c.datarepo.GetSessionByID(ctx, sessionUUID)
+	if errors.Cause(err) == sql.ErrNoRows {
+		return nil, errors.New("session of the token does not exist")
+	}
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, errors.Wrap(err, "failed to check session").Error())
+	}
+	if session.UserUUID != userUUID {
+		return nil, errors.New("session of the token is not the user's")
+	}
+	if !session.IsActive(c.now().Unix()) {
+		return nil, errors.New("session of the token is no longer active")
+	}
+	user, err := c.datarepo.GetUserByID(ctx, userUUID)
+	if errors.Cause(err) == sql.ErrNoRows {
+		return nil, errors.New("user of the token no longer exists")
+	}
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, errors.Wrap(err, "failed to check user").Error())
+	}
+	return user.Roles, nil
+}
@@ -0,0 +1,96 @@
+package service
+
+import (
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// resumeTokenPrefix versions resume tokens, which clients keep as opaque
+// strings
+const resumeTokenPrefix = "v1:"
+
+// encodeResumeToken encodes a position in the outbox as a resume token
+func encodeResumeToken(position int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(resumeTokenPrefix + strconv.FormatInt(position, 10)))
+}
+
+// decodeResumeToken decodes the position in the outbox a resume token holds
+func decodeResumeToken(token string) (int64, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to decode resume token")
+	}
+	if !strings.HasPrefix(string(raw), resumeTokenPrefix) {
+		return 0, errors.New("resume token has an unknown version")
+	}
+	position, err := strconv.ParseInt(strings.TrimPrefix(string(raw), resumeTokenPrefix), 10, 64)
+	if err != nil || position < 0 {
+		return 0, errors.New("resume token holds no position")
+	}
+	return position, nil
+}
+
+// eventTail follows the outbox from a position, every event up to which was
+// seen. Outbox ids are handed out when an event is written but show up when
+// its transaction commits, so a lower id can show up after higher ones. The
+// position stays below such a gap until it fills, or until it is older than
+// the gap timeout and its transaction must have rolled back.
+type eventTail struct {
+	position   int64
+	seen       map[int64]bool
+	gapSince   time.Time
+	gapTimeout time.Duration
+}
+
+func newEventTail(position int64, gapTimeout time.Duration) *eventTail {
+	return &eventTail{
+		position:   position,
+		seen:       map[int64]bool{},
+		gapTimeout: gapTimeout,
+	}
+}
+
+// next returns the events, listed in id order from the position on, that
+// were not seen yet and moves the position up as far as it can
+func (t *eventTail) next(events []*DBEvent, now time.Time) []*DBEvent {
+	var unseen []*DBEvent
+	for _, event := range events {
+		if event.ID <= t.position || t.seen[event.ID] {
+			continue
+		}
+		t.seen[event.ID] = true
+		unseen = append(unseen, event)
+	}
+	for len(t.seen) > 0 {
+		if t.seen[t.position+1] {
+			delete(t.seen, t.position+1)
+			t.position++
+			t.gapSince = time.Time{}
+			continue
+		}
+		if t.gapSince.IsZero() {
+			t.gapSince = now
+		}
+		if now.Sub(t.gapSince) < t.gapTimeout {
+			break
+		}
+		t.position++
+	}
+	if len(t.seen) == 0 {
+		t.gapSince = time.Time{}
+	}
+	return unseen
+}
+
+// resumeToken is the token to resume after the event from, which is the
+// event itself unless it came in above a gap
+func (t *eventTail) resumeToken(event *DBEvent) string {
+	if event.ID < t.position {
+		return encodeResumeToken(event.ID)
+	}
+	return encodeResumeToken(t.position)
+}
@@ -0,0 +1,80 @@
+package timeout
+
+import (
+	"context"
+	"time"
+
+	"github.com/srcabl/users/internal/config"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// UnaryServerInterceptor bounds every unary rpc by its configured timeout. A
+// caller's own deadline is kept when it is sooner. When the rpc fails after
+// its context ended the error is reported as Canceled or DeadlineExceeded,
+// whatever the handler made of the failed query.
+func UnaryServerInterceptor(cfg config.Timeouts) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, cancel := withTimeout(ctx, timeoutFor(cfg, info.FullMethod, true))
+		defer cancel()
+		res, err := handler(ctx, req)
+		if err != nil {
+			return nil, contextError(ctx, err)
+		}
+		return res, nil
+	}
+}
+
+// StreamServerInterceptor bounds streaming rpcs only when their method has a
+// timeout of its own, since streams are meant to stay open. Failures after the
+// context ended are reported as for unary rpcs.
+func StreamServerInterceptor(cfg config.Timeouts) grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, cancel := withTimeout(stream.Context(), timeoutFor(cfg, info.FullMethod, false))
+		defer cancel()
+		err := handler(srv, &boundedStream{ServerStream: stream, ctx: ctx})
+		if err != nil {
+			return contextError(ctx, err)
+		}
+		return nil
+	}
+}
+
+func timeoutFor(cfg config.Timeouts, method string, unary bool) time.Duration {
+	if timeout, ok := cfg.Methods[method]; ok {
+		return timeout
+	}
+	if unary {
+		return cfg.Default
+	}
+	return 0
+}
+
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// contextError reports err as the end of the context when the context ended
+func contextError(ctx context.Context, err error) error {
+	switch ctx.Err() {
+	case context.Canceled:
+		return status.Error(codes.Canceled, err.Error())
+	case context.DeadlineExceeded:
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	}
+	return err
+}
+
+// boundedStream carries the bounded context into a streaming handler
+type boundedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *boundedStream) Context() context.Context {
+	return s.ctx
+}
@@ -0,0 +1,107 @@
+package timeout_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/srcabl/users/internal/config"
+	"github.com/srcabl/users/internal/timeout"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// waitForContext is a handler failing the way a query does once its context ends
+func waitForContext(ctx context.Context, _ interface{}) (interface{}, error) {
+	<-ctx.Done()
+	return nil, status.Error(codes.Internal, "failed to query: "+ctx.Err().Error())
+}
+
+func TestUnaryTimeouts(t *testing.T) {
+	cfg := config.Timeouts{
+		Default: 20 * time.Millisecond,
+		Methods: map[string]time.Duration{"/users.UsersService/Slow": time.Hour},
+	}
+	interceptor := timeout.UnaryServerInterceptor(cfg)
+	call := func(ctx context.Context, method string, handler grpc.UnaryHandler) error {
+		_, err := interceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: method}, handler)
+		return err
+	}
+
+	if err := call(context.Background(), "/users.UsersService/GetUser", waitForContext); status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("expected the default timeout as DeadlineExceeded, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	if err := call(ctx, "/users.UsersService/Slow", waitForContext); status.Code(err) != codes.Canceled {
+		t.Fatalf("expected the caller cancelling as Canceled, got %v", err)
+	}
+
+	var deadline time.Time
+	_ = call(context.Background(), "/users.UsersService/Slow", func(ctx context.Context, _ interface{}) (interface{}, error) {
+		deadline, _ = ctx.Deadline()
+		return nil, nil
+	})
+	if time.Until(deadline) < time.Minute {
+		t.Fatalf("expected the method's own timeout, got a deadline in %s", time.Until(deadline))
+	}
+
+	// a sooner deadline of the caller's is kept
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := call(ctx, "/users.UsersService/Slow", waitForContext); status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("expected the caller's deadline as DeadlineExceeded, got %v", err)
+	}
+
+	// failures before the context ended are left as they are
+	failed := status.Error(codes.NotFound, "user does not exist")
+	err := call(context.Background(), "/users.UsersService/GetUser", func(context.Context, interface{}) (interface{}, error) {
+		return nil, failed
+	})
+	if err != failed {
+		t.Fatalf("expected the handler's error, got %v", err)
+	}
+}
+
+// stream is a server stream on a context
+type stream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *stream) Context() context.Context {
+	return s.ctx
+}
+
+func TestStreamTimeouts(t *testing.T) {
+	cfg := config.Timeouts{
+		Default: 10 * time.Millisecond,
+		Methods: map[string]time.Duration{"/users.UsersService/WatchUser": 20 * time.Millisecond},
+	}
+	interceptor := timeout.StreamServerInterceptor(cfg)
+	call := func(method string, handler grpc.StreamHandler) error {
+		return interceptor(nil, &stream{ctx: context.Background()}, &grpc.StreamServerInfo{FullMethod: method}, handler)
+	}
+
+	err := call("/users.UsersService/WatchUser", func(_ interface{}, s grpc.ServerStream) error {
+		<-s.Context().Done()
+		return errors.New("stream ended")
+	})
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("expected the method's timeout as DeadlineExceeded, got %v", err)
+	}
+
+	// streams are not bound by the default
+	err = call("/users.UsersService/WatchFollows", func(_ interface{}, s grpc.ServerStream) error {
+		if _, ok := s.Context().Deadline(); ok {
+			return errors.New("stream has a deadline")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("expected no deadline on the stream: %v", err)
+	}
+}
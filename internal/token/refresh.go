@@ -0,0 +1,29 @@
+package token
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+
+	"github.com/pkg/errors"
+)
+
+const refreshTokenBytes = 32
+
+// NewRefreshToken generates an opaque refresh token and the hash of it that
+// is safe to store
+func NewRefreshToken() (string, string, error) {
+	raw := make([]byte, refreshTokenBytes)
+	if _, err := rand.Read(raw); err != nil {
+		return "", "", errors.Wrap(err, "failed to generate refresh token")
+	}
+	refreshToken := base64.RawURLEncoding.EncodeToString(raw)
+	return refreshToken, HashRefreshToken(refreshToken), nil
+}
+
+// HashRefreshToken hashes a refresh token for storage and lookup
+func HashRefreshToken(refreshToken string) string {
+	sum := sha256.Sum256([]byte(refreshToken))
+	return hex.EncodeToString(sum[:])
+}
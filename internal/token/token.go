@@ -0,0 +1,108 @@
+package token
+
+import (
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/pkg/errors"
+	"github.com/srcabl/users/internal/config"
+	"github.com/srcabl/users/internal/keys"
+)
+
+// Claims are the claims carried by an access token
+type Claims struct {
+	jwt.RegisteredClaims
+	SessionUUID string   `json:"sid"`
+	Device      string   `json:"dev,omitempty"`
+	Roles       []string `json:"roles,omitempty"`
+}
+
+// KeySet supplies the keys tokens are signed and verified with
+type KeySet interface {
+	SigningKey() (*keys.Key, error)
+	Key(id string) (*keys.Key, error)
+}
+
+// Issuer signs and verifies access tokens
+type Issuer struct {
+	issuer   string
+	audience string
+	ttl      time.Duration
+	keys     KeySet
+}
+
+// NewIssuer news up a token issuer from the tokens config
+func NewIssuer(cfg config.Tokens, keySet KeySet) (*Issuer, error) {
+	if keySet == nil {
+		return nil, errors.New("a key set is required to issue tokens")
+	}
+	return &Issuer{
+		issuer:   cfg.Issuer,
+		audience: cfg.Audience,
+		ttl:      cfg.AccessTokenTTL,
+		keys:     keySet,
+	}, nil
+}
+
+// TTL is how long issued access tokens are valid for
+func (i *Issuer) TTL() time.Duration {
+	return i.ttl
+}
+
+// Issue signs an access token for the user's session
+func (i *Issuer) Issue(userUUID, sessionUUID, device string, roles []string) (string, time.Time, error) {
+	now := time.Now()
+	expiresAt := now.Add(i.ttl)
+	claims := &Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    i.issuer,
+			Subject:   userUUID,
+			Audience:  jwt.ClaimStrings{i.audience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+		SessionUUID: sessionUUID,
+		Device:      device,
+		Roles:       roles,
+	}
+	key, err := i.keys.SigningKey()
+	if err != nil {
+		return "", time.Time{}, errors.Wrap(err, "failed to get signing key")
+	}
+	unsigned := jwt.NewWithClaims(key.Method, claims)
+	if key.ID != "" {
+		unsigned.Header["kid"] = key.ID
+	}
+	signed, err := unsigned.SignedString(key.Private)
+	if err != nil {
+		return "", time.Time{}, errors.Wrapf(err, "failed to sign access token for session %s", sessionUUID)
+	}
+	return signed, expiresAt, nil
+}
+
+// Verify parses the access token and checks its signature and claims
+func (i *Issuer) Verify(signed string) (*Claims, error) {
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(signed, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		key, err := i.keys.Key(kid)
+		if err != nil {
+			return nil, err
+		}
+		if t.Method.Alg() != key.Method.Alg() {
+			return nil, errors.Errorf("unexpected signing method %s", t.Method.Alg())
+		}
+		return key.Public, nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to verify access token")
+	}
+	if !claims.VerifyIssuer(i.issuer, true) {
+		return nil, errors.Errorf("unexpected token issuer %s", claims.Issuer)
+	}
+	if !claims.VerifyAudience(i.audience, true) {
+		return nil, errors.New("token is not meant for this audience")
+	}
+	return claims, nil
+}
@@ -0,0 +1,63 @@
+package token_test
+
+import (
+	"testing"
+
+	"github.com/srcabl/users/internal/config"
+	"github.com/srcabl/users/internal/keys"
+	"github.com/srcabl/users/internal/token"
+)
+
+func newIssuer(t *testing.T, cfg config.Tokens, secret string) *token.Issuer {
+	t.Helper()
+	keyManager, err := keys.NewManager(config.Keys{Secret: secret})
+	if err != nil {
+		t.Fatalf("failed to new key manager: %v", err)
+	}
+	issuer, err := token.NewIssuer(cfg, keyManager)
+	if err != nil {
+		t.Fatalf("failed to new issuer: %v", err)
+	}
+	return issuer
+}
+
+func TestIssueAndVerify(t *testing.T) {
+	cfg := config.Default().Tokens
+	issuer := newIssuer(t, cfg, "token-test-secret")
+	signed, _, err := issuer.Issue("user", "session", "laptop", []string{"admin"})
+	if err != nil {
+		t.Fatalf("failed to issue: %v", err)
+	}
+	claims, err := issuer.Verify(signed)
+	if err != nil {
+		t.Fatalf("failed to verify: %v", err)
+	}
+	if claims.Subject != "user" || claims.SessionUUID != "session" || claims.Device != "laptop" {
+		t.Fatalf("expected the claims issued, got %+v", claims)
+	}
+
+	if _, err := newIssuer(t, cfg, "other-secret").Verify(signed); err == nil {
+		t.Fatal("expected a token signed with another key to fail")
+	}
+	cfg.Audience = "elsewhere"
+	if _, err := newIssuer(t, cfg, "token-test-secret").Verify(signed); err == nil {
+		t.Fatal("expected a token for another audience to fail")
+	}
+}
+
+func TestRefreshTokens(t *testing.T) {
+	first, firstHash, err := token.NewRefreshToken()
+	if err != nil {
+		t.Fatalf("failed to new refresh token: %v", err)
+	}
+	second, secondHash, err := token.NewRefreshToken()
+	if err != nil {
+		t.Fatalf("failed to new refresh token: %v", err)
+	}
+	if first == second || firstHash == secondHash {
+		t.Fatal("expected every refresh token to be new")
+	}
+	if token.HashRefreshToken(first) != firstHash || firstHash == first {
+		t.Fatal("expected the stored hash to be the hash of the token")
+	}
+}
@@ -0,0 +1,103 @@
+package tracing
+
+import (
+	"context"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const instrumentation = "github.com/srcabl/users/internal/tracing"
+
+// UnaryServerInterceptor starts a span for every unary rpc, continuing the
+// trace from the incoming metadata when the caller sent one
+func UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, span := startSpan(ctx, info.FullMethod)
+		defer span.End()
+		res, err := handler(ctx, req)
+		endSpan(span, err)
+		return res, err
+	}
+}
+
+// StreamServerInterceptor starts a span for every streaming rpc, continuing
+// the trace from the incoming metadata when the caller sent one
+func StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, span := startSpan(stream.Context(), info.FullMethod)
+		defer span.End()
+		err := handler(srv, &tracedStream{ServerStream: stream, ctx: ctx})
+		endSpan(span, err)
+		return err
+	}
+}
+
+func startSpan(ctx context.Context, fullMethod string) (context.Context, trace.Span) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	ctx = otel.GetTextMapPropagator().Extract(ctx, metadataCarrier(md))
+	service, method := splitMethod(fullMethod)
+	return otel.Tracer(instrumentation).Start(ctx, strings.TrimPrefix(fullMethod, "/"),
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("rpc.system", "grpc"),
+			attribute.String("rpc.service", service),
+			attribute.String("rpc.method", method),
+		),
+	)
+}
+
+func endSpan(span trace.Span, err error) {
+	code := status.Code(err)
+	span.SetAttributes(attribute.Int64("rpc.grpc.status_code", int64(code)))
+	if err != nil {
+		span.SetStatus(otelcodes.Error, code.String())
+	}
+}
+
+func splitMethod(fullMethod string) (string, string) {
+	parts := strings.SplitN(strings.TrimPrefix(fullMethod, "/"), "/", 2)
+	if len(parts) != 2 {
+		return "", fullMethod
+	}
+	return parts[0], parts[1]
+}
+
+// metadataCarrier reads and writes trace context in grpc metadata
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+	values := metadata.MD(c).Get(key)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+func (c metadataCarrier) Set(key, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// tracedStream carries the span's context into a streaming handler
+type tracedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *tracedStream) Context() context.Context {
+	return s.ctx
+}
@@ -0,0 +1,95 @@
+package tracing
+
+import (
+	"context"
+	"io"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/srcabl/users/internal/config"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// The exporters spans can be sent to
+const (
+	ExporterNone   = ""
+	ExporterOTLP   = "otlp"
+	ExporterStdout = "stdout"
+	ExporterFile   = "file"
+)
+
+// Tracing owns the tracer provider spans are exported through
+type Tracing struct {
+	provider *sdktrace.TracerProvider
+	closer   io.Closer
+}
+
+// New news up the configured exporter and installs it as the global tracer
+// provider. With no exporter configured the global no-op provider is left in
+// place so spans cost next to nothing.
+func New(cfg config.Tracing) (*Tracing, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+	if cfg.Exporter == ExporterNone {
+		return &Tracing{}, nil
+	}
+	t := &Tracing{}
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch cfg.Exporter {
+	case ExporterOTLP:
+		opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(cfg.Endpoint)}
+		if cfg.Insecure {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		}
+		exporter, err = otlptracegrpc.New(context.Background(), opts...)
+	case ExporterStdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout), stdouttrace.WithPrettyPrint())
+	case ExporterFile:
+		file, ferr := os.OpenFile(cfg.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if ferr != nil {
+			return nil, errors.Wrapf(ferr, "failed to open trace file %s", cfg.File)
+		}
+		t.closer = file
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(file))
+	default:
+		return nil, errors.Errorf("trace exporter %q is not supported", cfg.Exporter)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to new %s trace exporter", cfg.Exporter)
+	}
+	t.provider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", cfg.ServiceName))),
+	)
+	otel.SetTracerProvider(t.provider)
+	return t, nil
+}
+
+// Run returns the func that flushes the spans still buffered and stops exporting
+func (t *Tracing) Run() (func() error, error) {
+	return func() error {
+		if t.provider == nil {
+			return nil
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := t.provider.Shutdown(ctx); err != nil {
+			return errors.Wrap(err, "failed to flush spans")
+		}
+		if t.closer != nil {
+			return t.closer.Close()
+		}
+		return nil
+	}, nil
+}
@@ -0,0 +1,254 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/srcabl/users/internal/config"
+	"github.com/srcabl/users/internal/metrics"
+	"github.com/srcabl/users/internal/outbox"
+	"github.com/srcabl/users/internal/service"
+	"go.uber.org/zap"
+)
+
+// DeliveryHeader carries the id of the delivery, which stays the same when
+// a delivery is attempted again or redelivered, besides the outbox headers
+const DeliveryHeader = "X-Srcabl-Delivery"
+
+// maxErrorLength bounds the error kept on a delivery to its column
+const maxErrorLength = 1024
+
+// Dispatcher posts the due webhook deliveries to their webhooks, signed with
+// each webhook's secret, and attempts the ones that fail again with backoff
+// until they are given up on as dead. Deliveries are claimed before they are
+// attempted, so dispatchers on every replica can run side by side.
+type Dispatcher struct {
+	cfg      config.Webhooks
+	datarepo service.DataRepositoryWebhooks
+	metrics  *metrics.Metrics
+	logger   *zap.Logger
+	client   *http.Client
+	now      func() time.Time
+}
+
+// NewDispatcher news up a dispatcher
+func NewDispatcher(cfg config.Webhooks, datarepo service.DataRepositoryWebhooks, m *metrics.Metrics, logger *zap.Logger) *Dispatcher {
+	return &Dispatcher{
+		cfg:      cfg,
+		datarepo: datarepo,
+		metrics:  m,
+		logger:   logger,
+		client:   &http.Client{},
+		now:      time.Now,
+	}
+}
+
+// Run dispatches on the poll interval until the returned func is called,
+// which waits for the pass in flight
+func (d *Dispatcher) Run() (func() error, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	ticker := time.NewTicker(d.cfg.PollInterval)
+	go func() {
+		defer close(done)
+		for {
+			if _, err := d.DispatchOnce(ctx); err != nil && ctx.Err() == nil {
+				d.logger.Warn("webhook dispatch failed", zap.Error(err))
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return func() error {
+		ticker.Stop()
+		cancel()
+		<-done
+		d.client.CloseIdleConnections()
+		return nil
+	}, nil
+}
+
+// DispatchOnce attempts the due deliveries batch by batch until none are
+// left, then prunes the deliveries delivered longer ago than the retention.
+// It returns how many it delivered. A delivery that fails is not an error
+// of the pass, only failing to read or record deliveries is.
+func (d *Dispatcher) DispatchOnce(ctx context.Context) (int, error) {
+	webhooks, err := d.datarepo.ListWebhooks(ctx)
+	if err != nil {
+		return 0, err
+	}
+	byUUID := make(map[string]*service.DBWebhook, len(webhooks))
+	for _, webhook := range webhooks {
+		byUUID[webhook.UUID] = webhook
+	}
+	total := 0
+	for {
+		due, err := d.datarepo.ListDueWebhookDeliveries(ctx, d.now().Unix(), d.cfg.BatchSize)
+		if err != nil {
+			return total, err
+		}
+		delivered, err := d.dispatch(ctx, byUUID, due)
+		total += delivered
+		if err != nil {
+			return total, err
+		}
+		if len(due) < d.cfg.BatchSize || ctx.Err() != nil {
+			break
+		}
+	}
+	if _, err := d.datarepo.PruneWebhookDeliveries(ctx, d.now().Add(-d.cfg.Retention).Unix()); err != nil {
+		return total, err
+	}
+	return total, nil
+}
+
+// dispatch attempts the deliveries, the concurrency of them at a time, and
+// returns how many it delivered along with the first error recording one
+func (d *Dispatcher) dispatch(ctx context.Context, webhooks map[string]*service.DBWebhook, deliveries []*service.DBWebhookDelivery) (int, error) {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var firstErr error
+	delivered := 0
+	slots := make(chan struct{}, d.cfg.Concurrency)
+	for _, delivery := range deliveries {
+		webhook, ok := webhooks[delivery.WebhookUUID]
+		if !ok {
+			// created since the webhooks were listed, or being deleted
+			continue
+		}
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(webhook *service.DBWebhook, delivery *service.DBWebhookDelivery) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			ok, err := d.deliver(ctx, webhook, delivery)
+			mu.Lock()
+			defer mu.Unlock()
+			if ok {
+				delivered++
+			}
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}(webhook, delivery)
+	}
+	wg.Wait()
+	return delivered, firstErr
+}
+
+// deliver claims the delivery, attempts it and records how it went. It
+// reports whether the webhook took it. A delivery claimed by another
+// dispatcher since it was listed is left to them.
+func (d *Dispatcher) deliver(ctx context.Context, webhook *service.DBWebhook, delivery *service.DBWebhookDelivery) (bool, error) {
+	now := d.now()
+	// the claim outlasts the attempt, so it is not picked up again meanwhile
+	claimedUntil := now.Add(d.cfg.Timeout).Unix() + 1
+	claimed, err := d.datarepo.ClaimWebhookDelivery(ctx, delivery.UUID, delivery.NextAttemptAt, claimedUntil)
+	if err != nil || !claimed {
+		return false, err
+	}
+
+	statusCode, attemptErr := d.attempt(ctx, webhook, delivery)
+	now = d.now()
+	delivery.Attempts++
+	delivery.LastStatusCode = statusCode
+	result := "failed"
+	switch {
+	case attemptErr == nil:
+		delivery.Status = service.DeliveryDelivered
+		delivery.LastError = ""
+		delivery.DeliveredAt = sql.NullInt64{Valid: true, Int64: now.Unix()}
+		result = service.DeliveryDelivered
+	case delivery.Attempts >= d.cfg.MaxAttempts:
+		delivery.Status = service.DeliveryDead
+		delivery.LastError = truncate(attemptErr.Error())
+		result = service.DeliveryDead
+	default:
+		delivery.LastError = truncate(attemptErr.Error())
+		delivery.NextAttemptAt = now.Add(d.backoff(delivery.Attempts)).Unix()
+	}
+	d.metrics.WebhookAttempt(result)
+	if attemptErr != nil {
+		d.logger.Debug("webhook delivery failed",
+			zap.String("delivery", delivery.UUID),
+			zap.String("webhook", webhook.UUID),
+			zap.Int("attempts", delivery.Attempts),
+			zap.Error(attemptErr),
+		)
+	}
+	if err := d.datarepo.UpdateWebhookDelivery(ctx, delivery); err != nil {
+		return false, err
+	}
+	return attemptErr == nil, nil
+}
+
+// attempt posts the delivery's event to the webhook and returns the status
+// code it answered with, if it answered. Anything but a 2xx fails it.
+func (d *Dispatcher) attempt(ctx context.Context, webhook *service.DBWebhook, delivery *service.DBWebhookDelivery) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.cfg.Timeout)
+	defer cancel()
+	event := &outbox.Event{
+		ID:            delivery.EventUUID,
+		Sequence:      delivery.EventID,
+		Type:          delivery.EventType,
+		AggregateType: delivery.AggregateType,
+		AggregateUUID: delivery.AggregateUUID,
+		CreatedAt:     delivery.EventCreatedAt,
+		Payload:       delivery.Payload,
+	}
+	body, err := event.Marshal()
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to new webhook request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(outbox.EventTypeHeader, event.Type)
+	req.Header.Set(outbox.EventIDHeader, event.ID)
+	req.Header.Set(DeliveryHeader, delivery.UUID)
+	req.Header.Set(outbox.SignatureHeader, outbox.Sign(webhook.Secret, body))
+	res, err := d.client.Do(req)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to post event %s", event.ID)
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, res.Body)
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, errors.Errorf("webhook answered event %s with %s", event.ID, res.Status)
+	}
+	return res.StatusCode, nil
+}
+
+// backoff is how long to wait after the attempts before the next one: the
+// initial backoff doubled for every attempt after the first, up to the max
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	backoff := d.cfg.InitialBackoff
+	for i := 1; i < attempts && backoff < d.cfg.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > d.cfg.MaxBackoff {
+		return d.cfg.MaxBackoff
+	}
+	return backoff
+}
+
+func truncate(s string) string {
+	if len(s) > maxErrorLength {
+		return s[:maxErrorLength]
+	}
+	return s
+}
@@ -0,0 +1,246 @@
+package webhook_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/srcabl/users/internal/config"
+	"github.com/srcabl/users/internal/metrics"
+	"github.com/srcabl/users/internal/outbox"
+	"github.com/srcabl/users/internal/service"
+	"github.com/srcabl/users/internal/webhook"
+	"go.uber.org/zap"
+)
+
+// receiver is a webhook receiver answering with the status it is set to
+type receiver struct {
+	*httptest.Server
+	mu       sync.Mutex
+	status   int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func newReceiver(t *testing.T) *receiver {
+	t.Helper()
+	r := &receiver{status: http.StatusOK}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.requests, r.bodies = append(r.requests, req), append(r.bodies, body)
+		w.WriteHeader(r.status)
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *receiver) answer(status int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.status = status
+}
+
+func (r *receiver) received() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.requests)
+}
+
+func newUUID(t *testing.T) string {
+	t.Helper()
+	id, err := uuid.NewV4()
+	if err != nil {
+		t.Fatalf("failed to generate uuid: %v", err)
+	}
+	return id.String()
+}
+
+func newDispatcher(t *testing.T, datarepo service.DataRepository) *webhook.Dispatcher {
+	t.Helper()
+	m, err := metrics.New()
+	if err != nil {
+		t.Fatalf("failed to new metrics: %v", err)
+	}
+	cfg := config.Default().Webhooks
+	cfg.MaxAttempts = 3
+	cfg.InitialBackoff = time.Minute
+	return webhook.NewDispatcher(cfg, datarepo, m, zap.NewNop())
+}
+
+func createWebhook(t *testing.T, datarepo service.DataRepository, url string, eventTypes ...string) *service.DBWebhook {
+	t.Helper()
+	hook := &service.DBWebhook{
+		UUID:          newUUID(t),
+		URL:           url,
+		Secret:        "secret-" + newUUID(t),
+		EventTypes:    eventTypes,
+		CreatedByUUID: uuid.Nil.String(),
+		CreatedAt:     time.Now().Unix(),
+	}
+	if err := datarepo.CreateWebhook(context.Background(), hook); err != nil {
+		t.Fatalf("failed to create webhook: %v", err)
+	}
+	return hook
+}
+
+func createUser(t *testing.T, datarepo service.DataRepository) string {
+	t.Helper()
+	id := newUUID(t)
+	user := &service.DBUser{
+		UUID:           id,
+		Username:       "user-" + id,
+		Email:          id + "@example.com",
+		HashedPassword: "hash",
+		CreatedByUUID:  id,
+		CreatedAt:      time.Now().Unix(),
+	}
+	if err := datarepo.CreateUser(context.Background(), user); err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	return id
+}
+
+func dispatchOnce(t *testing.T, dispatcher *webhook.Dispatcher) int {
+	t.Helper()
+	n, err := dispatcher.DispatchOnce(context.Background())
+	if err != nil {
+		t.Fatalf("failed to dispatch: %v", err)
+	}
+	return n
+}
+
+func onlyDelivery(t *testing.T, datarepo service.DataRepository, webhookUUID string) *service.DBWebhookDelivery {
+	t.Helper()
+	deliveries, err := datarepo.ListWebhookDeliveries(context.Background(), webhookUUID, "", 10)
+	if err != nil {
+		t.Fatalf("failed to list deliveries: %v", err)
+	}
+	if len(deliveries) != 1 {
+		t.Fatalf("expected a single delivery, got %d", len(deliveries))
+	}
+	return deliveries[0]
+}
+
+// rewind makes the delivery due now instead of after its backoff
+func rewind(t *testing.T, datarepo service.DataRepository, delivery *service.DBWebhookDelivery) {
+	t.Helper()
+	delivery.NextAttemptAt = 0
+	if err := datarepo.UpdateWebhookDelivery(context.Background(), delivery); err != nil {
+		t.Fatalf("failed to rewind delivery: %v", err)
+	}
+}
+
+func TestDispatcherDeliversSigned(t *testing.T) {
+	datarepo := service.NewMemoryDataRepository()
+	recv := newReceiver(t)
+	hook := createWebhook(t, datarepo, recv.URL)
+	follows := createWebhook(t, datarepo, recv.URL, service.EventFollowAdded)
+	follower, followed := createUser(t, datarepo), createUser(t, datarepo)
+	if err := datarepo.AddUserFollower(context.Background(), follower, followed); err != nil {
+		t.Fatalf("failed to follow: %v", err)
+	}
+	dispatcher := newDispatcher(t, datarepo)
+
+	if n := dispatchOnce(t, dispatcher); n != 4 {
+		t.Fatalf("expected three events to one webhook and the follow to the other, got %d", n)
+	}
+	secrets := map[string]string{hook.UUID: hook.Secret, follows.UUID: follows.Secret}
+	for i, req := range recv.requests {
+		var event outbox.Event
+		if err := json.Unmarshal(recv.bodies[i], &event); err != nil {
+			t.Fatalf("failed to unmarshal body: %v", err)
+		}
+		delivery, err := datarepo.GetWebhookDelivery(context.Background(), req.Header.Get(webhook.DeliveryHeader))
+		if err != nil {
+			t.Fatalf("expected the delivery header to name the delivery: %v", err)
+		}
+		if req.Header.Get(outbox.SignatureHeader) != outbox.Sign(secrets[delivery.WebhookUUID], recv.bodies[i]) {
+			t.Fatalf("expected the body signed with the webhook's secret, got %s", req.Header.Get(outbox.SignatureHeader))
+		}
+		if event.ID != delivery.EventUUID || event.Sequence != delivery.EventID || req.Header.Get(outbox.EventTypeHeader) != event.Type {
+			t.Fatalf("expected the delivery's event, got %+v", event)
+		}
+		if delivery.Status != service.DeliveryDelivered || delivery.Attempts != 1 || !delivery.DeliveredAt.Valid || delivery.LastStatusCode != http.StatusOK {
+			t.Fatalf("expected the delivery delivered, got %+v", delivery)
+		}
+	}
+	if got := onlyDelivery(t, datarepo, follows.UUID); got.EventType != service.EventFollowAdded {
+		t.Fatalf("expected only the follow delivered to follows, got %s", got.EventType)
+	}
+	if n := dispatchOnce(t, dispatcher); n != 0 || recv.received() != 4 {
+		t.Fatalf("expected nothing left to deliver, got %d", n)
+	}
+}
+
+func TestDispatcherRetriesUntilDead(t *testing.T) {
+	datarepo := service.NewMemoryDataRepository()
+	recv := newReceiver(t)
+	recv.answer(http.StatusServiceUnavailable)
+	hook := createWebhook(t, datarepo, recv.URL)
+	createUser(t, datarepo)
+	dispatcher := newDispatcher(t, datarepo)
+
+	for attempt, backoff := range []time.Duration{time.Minute, 2 * time.Minute} {
+		before := time.Now().Unix()
+		if n := dispatchOnce(t, dispatcher); n != 0 {
+			t.Fatalf("expected attempt %d to fail, got %d delivered", attempt+1, n)
+		}
+		delivery := onlyDelivery(t, datarepo, hook.UUID)
+		if delivery.Status != service.DeliveryPending || delivery.Attempts != attempt+1 || delivery.LastStatusCode != http.StatusServiceUnavailable || delivery.LastError == "" {
+			t.Fatalf("expected attempt %d recorded, got %+v", attempt+1, delivery)
+		}
+		if wait := delivery.NextAttemptAt - before; wait < int64(backoff.Seconds()) || wait > int64(backoff.Seconds())+1 {
+			t.Fatalf("expected attempt %d to back off %s, got %ds", attempt+1, backoff, wait)
+		}
+		if n := dispatchOnce(t, dispatcher); n != 0 || recv.received() != attempt+1 {
+			t.Fatalf("expected no attempt before the backoff, got %d requests", recv.received())
+		}
+		rewind(t, datarepo, delivery)
+	}
+	dispatchOnce(t, dispatcher)
+	dead := onlyDelivery(t, datarepo, hook.UUID)
+	if dead.Status != service.DeliveryDead || dead.Attempts != 3 {
+		t.Fatalf("expected the delivery dead after 3 attempts, got %+v", dead)
+	}
+	if n := dispatchOnce(t, dispatcher); n != 0 || recv.received() != 3 {
+		t.Fatalf("expected a dead delivery left alone, got %d requests", recv.received())
+	}
+
+	recv.answer(http.StatusNoContent)
+	if err := datarepo.RedeliverWebhookDelivery(context.Background(), dead.UUID, time.Now().Unix()); err != nil {
+		t.Fatalf("failed to redeliver: %v", err)
+	}
+	if n := dispatchOnce(t, dispatcher); n != 1 {
+		t.Fatalf("expected the redelivery delivered, got %d", n)
+	}
+	delivered := onlyDelivery(t, datarepo, hook.UUID)
+	if delivered.Status != service.DeliveryDelivered || delivered.Attempts != 1 || delivered.LastError != "" {
+		t.Fatalf("expected the redelivery delivered on its first attempt, got %+v", delivered)
+	}
+	if recv.requests[3].Header.Get(webhook.DeliveryHeader) != recv.requests[0].Header.Get(webhook.DeliveryHeader) {
+		t.Fatal("expected the redelivery to keep the delivery id")
+	}
+}
+
+func TestDispatcherSkipsClaimed(t *testing.T) {
+	datarepo := service.NewMemoryDataRepository()
+	recv := newReceiver(t)
+	hook := createWebhook(t, datarepo, recv.URL)
+	createUser(t, datarepo)
+	delivery := onlyDelivery(t, datarepo, hook.UUID)
+	claimed, err := datarepo.ClaimWebhookDelivery(context.Background(), delivery.UUID, delivery.NextAttemptAt, time.Now().Unix()+60)
+	if err != nil || !claimed {
+		t.Fatalf("failed to claim delivery: %v", err)
+	}
+	if n := dispatchOnce(t, newDispatcher(t, datarepo)); n != 0 || recv.received() != 0 {
+		t.Fatalf("expected a delivery claimed elsewhere left alone, got %d requests", recv.received())
+	}
+}
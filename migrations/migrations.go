@@ -0,0 +1,10 @@
+package migrations
+
+import "embed"
+
+// FS holds the schema migrations, one directory per storage driver. Every
+// driver has the same versions, each as a {version}_{name}.up.sql and a
+// {version}_{name}.down.sql file.
+//
+//go:embed mysql/*.sql postgres/*.sql sqlite/*.sql
+var FS embed.FS
@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS user_sessions (
+    uuid VARCHAR(36) NOT NULL UNIQUE,
+    user_uuid VARCHAR(36) NOT NULL,
+    refresh_token_hash VARCHAR(64) NOT NULL UNIQUE,
+    previous_refresh_token_hash VARCHAR(64),
+    device VARCHAR(255) NOT NULL,
+    user_agent VARCHAR(512) NOT NULL,
+    created_at INT(11) NOT NULL, -- UNIX time
+    last_used_at INT(11) NOT NULL, -- UNIX time
+    expires_at INT(11) NOT NULL, -- UNIX time
+    revoked_at INT(11), -- UNIX time
+    PRIMARY KEY(uuid),
+    INDEX(user_uuid),
+    INDEX(previous_refresh_token_hash),
+    FOREIGN KEY(user_uuid) REFERENCES srcabl_users.users(uuid)
+);
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS user_identities (
+    provider VARCHAR(64) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    user_uuid VARCHAR(36) NOT NULL,
+    email VARCHAR(255),
+    created_at INT(11) NOT NULL, -- UNIX time
+    created_by_uuid VARCHAR(36) NOT NULL,
+    PRIMARY KEY(provider, subject),
+    INDEX(user_uuid),
+    FOREIGN KEY(user_uuid) REFERENCES srcabl_users.users(uuid)
+);
@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS user_roles (
+    user_uuid VARCHAR(36) NOT NULL,
+    role VARCHAR(32) NOT NULL,
+    created_at INT(11) NOT NULL, -- UNIX time
+    created_by_uuid VARCHAR(36) NOT NULL,
+    PRIMARY KEY(user_uuid, role),
+    FOREIGN KEY(user_uuid) REFERENCES srcabl_users.users(uuid)
+);
+
+ALTER TABLE users
+    ADD COLUMN failed_login_attempts INT(11) NOT NULL DEFAULT 0,
+    ADD COLUMN locked_until INT(11), -- UNIX time
+    ADD COLUMN deleted_at INT(11); -- UNIX time
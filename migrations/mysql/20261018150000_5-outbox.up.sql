@@ -0,0 +1,21 @@
+CREATE TABLE IF NOT EXISTS outbox (
+    id BIGINT NOT NULL AUTO_INCREMENT,
+    uuid VARCHAR(36) NOT NULL UNIQUE,
+    aggregate_type VARCHAR(32) NOT NULL,
+    aggregate_uuid VARCHAR(36) NOT NULL,
+    event_type VARCHAR(64) NOT NULL,
+    payload TEXT NOT NULL, -- JSON
+    created_at INT(11) NOT NULL, -- UNIX time
+    published_at INT(11), -- UNIX time
+    PRIMARY KEY(id),
+    INDEX(published_at, id)
+);
+
+CREATE TABLE IF NOT EXISTS outbox_leases (
+    name VARCHAR(32) NOT NULL,
+    holder VARCHAR(255) NOT NULL,
+    expires_at INT(11) NOT NULL, -- UNIX time
+    PRIMARY KEY(name)
+);
+
+INSERT INTO outbox_leases (name, holder, expires_at) VALUES ('relay', '', 0);
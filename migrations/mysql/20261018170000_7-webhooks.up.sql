@@ -0,0 +1,32 @@
+CREATE TABLE IF NOT EXISTS webhooks (
+    uuid VARCHAR(36) NOT NULL,
+    url VARCHAR(2048) NOT NULL,
+    secret VARCHAR(255) NOT NULL,
+    event_types VARCHAR(512) NOT NULL, -- comma separated, empty for every type
+    created_by_uuid VARCHAR(36) NOT NULL,
+    created_at INT(11) NOT NULL, -- UNIX time
+    PRIMARY KEY(uuid)
+);
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    uuid VARCHAR(36) NOT NULL,
+    webhook_uuid VARCHAR(36) NOT NULL,
+    event_id BIGINT NOT NULL,
+    event_uuid VARCHAR(36) NOT NULL,
+    event_type VARCHAR(64) NOT NULL,
+    aggregate_type VARCHAR(32) NOT NULL,
+    aggregate_uuid VARCHAR(36) NOT NULL,
+    payload TEXT NOT NULL, -- JSON
+    event_created_at INT(11) NOT NULL, -- UNIX time
+    status VARCHAR(16) NOT NULL,
+    attempts INT NOT NULL,
+    next_attempt_at INT(11) NOT NULL, -- UNIX time
+    last_error VARCHAR(1024) NOT NULL,
+    last_status_code INT NOT NULL,
+    created_at INT(11) NOT NULL, -- UNIX time
+    delivered_at INT(11), -- UNIX time
+    PRIMARY KEY(uuid),
+    INDEX(status, next_attempt_at),
+    INDEX(webhook_uuid, created_at),
+    FOREIGN KEY(webhook_uuid) REFERENCES srcabl_users.webhooks(uuid)
+);
@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS user_audit_log (
+    id BIGINT NOT NULL AUTO_INCREMENT,
+    uuid VARCHAR(36) NOT NULL UNIQUE,
+    user_uuid VARCHAR(36) NOT NULL,
+    actor_uuid VARCHAR(36) NOT NULL,
+    action VARCHAR(64) NOT NULL,
+    changes TEXT NOT NULL, -- JSON
+    client_ip VARCHAR(64) NOT NULL,
+    request_id VARCHAR(128) NOT NULL,
+    created_at INT(11) NOT NULL, -- UNIX time
+    PRIMARY KEY(id),
+    INDEX(user_uuid, id),
+    INDEX(actor_uuid, id)
+);
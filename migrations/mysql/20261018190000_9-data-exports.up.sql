@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS data_exports (
+    uuid VARCHAR(36) NOT NULL,
+    user_uuid VARCHAR(36) NOT NULL,
+    requested_by_uuid VARCHAR(36) NOT NULL,
+    format VARCHAR(8) NOT NULL,
+    status VARCHAR(16) NOT NULL,
+    claimed_until INT(11) NOT NULL, -- UNIX time
+    data LONGBLOB,
+    size BIGINT NOT NULL,
+    error VARCHAR(1024) NOT NULL,
+    created_at INT(11) NOT NULL, -- UNIX time
+    completed_at INT(11), -- UNIX time
+    PRIMARY KEY(uuid),
+    INDEX(status, created_at),
+    INDEX(user_uuid, created_at)
+);
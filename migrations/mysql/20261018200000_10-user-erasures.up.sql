@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS user_erasures (
+    uuid VARCHAR(36) NOT NULL,
+    user_uuid VARCHAR(36) NOT NULL UNIQUE,
+    tombstone_uuid VARCHAR(36) NOT NULL,
+    requested_by_uuid VARCHAR(36) NOT NULL,
+    status VARCHAR(16) NOT NULL,
+    erased TEXT NOT NULL, -- JSON
+    created_at INT(11) NOT NULL, -- UNIX time
+    completed_at INT(11), -- UNIX time
+    PRIMARY KEY(uuid)
+);
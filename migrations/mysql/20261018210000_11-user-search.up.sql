@@ -0,0 +1,3 @@
+-- the ngram parser indexes every two characters of usernames and display
+-- names, so searches match inside words and survive typos
+ALTER TABLE users ADD FULLTEXT INDEX users_search (username, display_name) WITH PARSER ngram;
@@ -0,0 +1,7 @@
+ALTER TABLE users
+    DROP INDEX users_active_username,
+    DROP INDEX users_active_email,
+    DROP COLUMN active_username,
+    DROP COLUMN active_email,
+    ADD UNIQUE INDEX username (username),
+    ADD UNIQUE INDEX email (email);
@@ -0,0 +1,12 @@
+-- usernames and emails are only taken by users not deleted, so they can be
+-- signed up with again once their user is deleted. mysql has no partial
+-- indexes, but a unique index takes any number of NULLs, so the unique
+-- indexes are on columns holding the username and email of users not
+-- deleted and NULL for the rest.
+ALTER TABLE users
+    DROP INDEX username,
+    DROP INDEX email,
+    ADD COLUMN active_username VARCHAR(255) AS (IF(deleted_at IS NULL, username, NULL)) STORED,
+    ADD COLUMN active_email VARCHAR(255) AS (IF(deleted_at IS NULL, email, NULL)) STORED,
+    ADD UNIQUE INDEX users_active_username (active_username),
+    ADD UNIQUE INDEX users_active_email (active_email);
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS user_blocks (
+    blocker_uuid VARCHAR(36) NOT NULL,
+    blocked_uuid VARCHAR(36) NOT NULL,
+    created_at INT(11) NOT NULL, -- UNIX time
+    PRIMARY KEY(blocker_uuid, blocked_uuid),
+    INDEX user_blocks_blocked_uuid (blocked_uuid),
+    FOREIGN KEY(blocker_uuid) REFERENCES srcabl_users.users(uuid),
+    FOREIGN KEY(blocked_uuid) REFERENCES srcabl_users.users(uuid)
+);
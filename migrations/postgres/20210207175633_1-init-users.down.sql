@@ -0,0 +1,3 @@
+DROP TABLE user_source_follows;
+DROP TABLE user_user_follows;
+DROP TABLE users;
@@ -0,0 +1,27 @@
+CREATE TABLE IF NOT EXISTS users (
+    uuid UUID NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL,
+    created_by_uuid UUID NOT NULL,
+    updated_at TIMESTAMPTZ,
+    updated_by_uuid UUID,
+    username VARCHAR(255) NOT NULL UNIQUE,
+    email VARCHAR(255) NOT NULL UNIQUE,
+    hashed_password VARCHAR(255) NOT NULL,
+    display_name VARCHAR(255),
+    self_description TEXT,
+    PRIMARY KEY(uuid)
+);
+
+CREATE TABLE IF NOT EXISTS user_user_follows (
+    follower_uuid UUID NOT NULL REFERENCES users(uuid),
+    followed_uuid UUID NOT NULL REFERENCES users(uuid),
+    PRIMARY KEY(follower_uuid, followed_uuid)
+);
+
+-- sources live in the sources service's database, so there is no foreign
+-- key on followed_uuid
+CREATE TABLE IF NOT EXISTS user_source_follows (
+    follower_uuid UUID NOT NULL REFERENCES users(uuid),
+    followed_uuid UUID NOT NULL,
+    PRIMARY KEY(follower_uuid, followed_uuid)
+);
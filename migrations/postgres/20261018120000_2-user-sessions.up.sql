@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS user_sessions (
+    uuid UUID NOT NULL,
+    user_uuid UUID NOT NULL REFERENCES users(uuid),
+    refresh_token_hash VARCHAR(64) NOT NULL UNIQUE,
+    previous_refresh_token_hash VARCHAR(64),
+    device VARCHAR(255) NOT NULL,
+    user_agent VARCHAR(512) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL,
+    last_used_at TIMESTAMPTZ NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    revoked_at TIMESTAMPTZ,
+    PRIMARY KEY(uuid)
+);
+
+CREATE INDEX IF NOT EXISTS user_sessions_user_uuid ON user_sessions(user_uuid);
+CREATE INDEX IF NOT EXISTS user_sessions_previous_refresh_token_hash ON user_sessions(previous_refresh_token_hash);
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS user_identities (
+    provider VARCHAR(64) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    user_uuid UUID NOT NULL REFERENCES users(uuid),
+    email VARCHAR(255),
+    created_at TIMESTAMPTZ NOT NULL,
+    created_by_uuid UUID NOT NULL,
+    PRIMARY KEY(provider, subject)
+);
+
+CREATE INDEX IF NOT EXISTS user_identities_user_uuid ON user_identities(user_uuid);
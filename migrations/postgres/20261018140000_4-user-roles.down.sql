@@ -0,0 +1,6 @@
+ALTER TABLE users
+    DROP COLUMN failed_login_attempts,
+    DROP COLUMN locked_until,
+    DROP COLUMN deleted_at;
+
+DROP TABLE user_roles;
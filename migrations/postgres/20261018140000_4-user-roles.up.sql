@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS user_roles (
+    user_uuid UUID NOT NULL REFERENCES users(uuid),
+    role VARCHAR(32) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL,
+    created_by_uuid UUID NOT NULL,
+    PRIMARY KEY(user_uuid, role)
+);
+
+ALTER TABLE users
+    ADD COLUMN failed_login_attempts INTEGER NOT NULL DEFAULT 0,
+    ADD COLUMN locked_until TIMESTAMPTZ,
+    ADD COLUMN deleted_at TIMESTAMPTZ;
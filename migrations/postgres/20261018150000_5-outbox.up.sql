@@ -0,0 +1,22 @@
+CREATE TABLE IF NOT EXISTS outbox (
+    id BIGSERIAL NOT NULL,
+    uuid UUID NOT NULL UNIQUE,
+    aggregate_type VARCHAR(32) NOT NULL,
+    aggregate_uuid UUID NOT NULL,
+    event_type VARCHAR(64) NOT NULL,
+    payload JSONB NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL,
+    published_at TIMESTAMPTZ,
+    PRIMARY KEY(id)
+);
+
+CREATE INDEX IF NOT EXISTS outbox_published_at ON outbox(published_at, id);
+
+CREATE TABLE IF NOT EXISTS outbox_leases (
+    name VARCHAR(32) NOT NULL,
+    holder VARCHAR(255) NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY(name)
+);
+
+INSERT INTO outbox_leases (name, holder, expires_at) VALUES ('relay', '', to_timestamp(0));
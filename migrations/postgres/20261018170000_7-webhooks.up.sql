@@ -0,0 +1,32 @@
+CREATE TABLE IF NOT EXISTS webhooks (
+    uuid UUID NOT NULL,
+    url VARCHAR(2048) NOT NULL,
+    secret VARCHAR(255) NOT NULL,
+    event_types VARCHAR(512) NOT NULL, -- comma separated, empty for every type
+    created_by_uuid UUID NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY(uuid)
+);
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    uuid UUID NOT NULL,
+    webhook_uuid UUID NOT NULL REFERENCES webhooks(uuid),
+    event_id BIGINT NOT NULL,
+    event_uuid UUID NOT NULL,
+    event_type VARCHAR(64) NOT NULL,
+    aggregate_type VARCHAR(32) NOT NULL,
+    aggregate_uuid UUID NOT NULL,
+    payload JSONB NOT NULL,
+    event_created_at TIMESTAMPTZ NOT NULL,
+    status VARCHAR(16) NOT NULL,
+    attempts INTEGER NOT NULL,
+    next_attempt_at TIMESTAMPTZ NOT NULL,
+    last_error VARCHAR(1024) NOT NULL,
+    last_status_code INTEGER NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL,
+    delivered_at TIMESTAMPTZ,
+    PRIMARY KEY(uuid)
+);
+
+CREATE INDEX IF NOT EXISTS webhook_deliveries_status ON webhook_deliveries(status, next_attempt_at);
+CREATE INDEX IF NOT EXISTS webhook_deliveries_webhook_uuid ON webhook_deliveries(webhook_uuid, created_at);
@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS user_audit_log (
+    id BIGSERIAL NOT NULL,
+    uuid UUID NOT NULL UNIQUE,
+    user_uuid UUID NOT NULL,
+    actor_uuid UUID NOT NULL,
+    action VARCHAR(64) NOT NULL,
+    changes JSONB NOT NULL,
+    client_ip VARCHAR(64) NOT NULL,
+    request_id VARCHAR(128) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY(id)
+);
+
+CREATE INDEX IF NOT EXISTS user_audit_log_user_uuid ON user_audit_log(user_uuid, id);
+CREATE INDEX IF NOT EXISTS user_audit_log_actor_uuid ON user_audit_log(actor_uuid, id);
@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS data_exports (
+    uuid UUID NOT NULL,
+    user_uuid UUID NOT NULL,
+    requested_by_uuid UUID NOT NULL,
+    format VARCHAR(8) NOT NULL,
+    status VARCHAR(16) NOT NULL,
+    claimed_until TIMESTAMPTZ NOT NULL,
+    data BYTEA,
+    size BIGINT NOT NULL,
+    error VARCHAR(1024) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL,
+    completed_at TIMESTAMPTZ,
+    PRIMARY KEY(uuid)
+);
+
+CREATE INDEX IF NOT EXISTS data_exports_status ON data_exports(status, created_at);
+CREATE INDEX IF NOT EXISTS data_exports_user_uuid ON data_exports(user_uuid, created_at);
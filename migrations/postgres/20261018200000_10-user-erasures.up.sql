@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS user_erasures (
+    uuid UUID NOT NULL,
+    user_uuid UUID NOT NULL UNIQUE,
+    tombstone_uuid UUID NOT NULL,
+    requested_by_uuid UUID NOT NULL,
+    status VARCHAR(16) NOT NULL,
+    erased JSONB NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL,
+    completed_at TIMESTAMPTZ,
+    PRIMARY KEY(uuid)
+);
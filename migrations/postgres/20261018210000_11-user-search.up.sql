@@ -0,0 +1,3 @@
+-- searches run on the in memory index, which counts followers when it is
+-- rebuilt
+CREATE INDEX IF NOT EXISTS user_user_follows_followed_uuid ON user_user_follows(followed_uuid);
@@ -0,0 +1,5 @@
+DROP INDEX users_active_username;
+DROP INDEX users_active_email;
+
+ALTER TABLE users ADD CONSTRAINT users_username_key UNIQUE (username);
+ALTER TABLE users ADD CONSTRAINT users_email_key UNIQUE (email);
@@ -0,0 +1,7 @@
+-- usernames and emails are only taken by users not deleted, so they can be
+-- signed up with again once their user is deleted
+ALTER TABLE users DROP CONSTRAINT users_username_key;
+ALTER TABLE users DROP CONSTRAINT users_email_key;
+
+CREATE UNIQUE INDEX IF NOT EXISTS users_active_username ON users(username) WHERE deleted_at IS NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS users_active_email ON users(email) WHERE deleted_at IS NULL;
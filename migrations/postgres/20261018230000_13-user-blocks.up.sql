@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS user_blocks (
+    blocker_uuid UUID NOT NULL REFERENCES users(uuid),
+    blocked_uuid UUID NOT NULL REFERENCES users(uuid),
+    created_at TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY(blocker_uuid, blocked_uuid)
+);
+
+CREATE INDEX IF NOT EXISTS user_blocks_blocked_uuid ON user_blocks(blocked_uuid);
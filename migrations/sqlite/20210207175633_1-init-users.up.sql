@@ -0,0 +1,30 @@
+CREATE TABLE IF NOT EXISTS users (
+    uuid TEXT NOT NULL UNIQUE,
+    created_at INTEGER NOT NULL, -- UNIX time
+    created_by_uuid TEXT NOT NULL,
+    updated_at INTEGER, -- UNIX time
+    updated_by_uuid TEXT,
+    username TEXT NOT NULL UNIQUE,
+    email TEXT NOT NULL UNIQUE,
+    hashed_password TEXT NOT NULL,
+    display_name TEXT,
+    self_description TEXT,
+    PRIMARY KEY(uuid)
+);
+
+CREATE TABLE IF NOT EXISTS user_user_follows (
+    follower_uuid TEXT NOT NULL,
+    followed_uuid TEXT NOT NULL,
+    PRIMARY KEY(follower_uuid, followed_uuid),
+    FOREIGN KEY(follower_uuid) REFERENCES users(uuid),
+    FOREIGN KEY(followed_uuid) REFERENCES users(uuid)
+);
+
+-- sources live in the sources service's database, so unlike mysql there is
+-- no foreign key on followed_uuid
+CREATE TABLE IF NOT EXISTS user_source_follows (
+    follower_uuid TEXT NOT NULL,
+    followed_uuid TEXT NOT NULL,
+    PRIMARY KEY(follower_uuid, followed_uuid),
+    FOREIGN KEY(follower_uuid) REFERENCES users(uuid)
+);
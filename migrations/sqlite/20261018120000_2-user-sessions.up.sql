@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS user_sessions (
+    uuid TEXT NOT NULL UNIQUE,
+    user_uuid TEXT NOT NULL,
+    refresh_token_hash TEXT NOT NULL UNIQUE,
+    previous_refresh_token_hash TEXT,
+    device TEXT NOT NULL,
+    user_agent TEXT NOT NULL,
+    created_at INTEGER NOT NULL, -- UNIX time
+    last_used_at INTEGER NOT NULL, -- UNIX time
+    expires_at INTEGER NOT NULL, -- UNIX time
+    revoked_at INTEGER, -- UNIX time
+    PRIMARY KEY(uuid),
+    FOREIGN KEY(user_uuid) REFERENCES users(uuid)
+);
+
+CREATE INDEX IF NOT EXISTS user_sessions_user_uuid ON user_sessions(user_uuid);
+CREATE INDEX IF NOT EXISTS user_sessions_previous_refresh_token_hash ON user_sessions(previous_refresh_token_hash);
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS user_identities (
+    provider TEXT NOT NULL,
+    subject TEXT NOT NULL,
+    user_uuid TEXT NOT NULL,
+    email TEXT,
+    created_at INTEGER NOT NULL, -- UNIX time
+    created_by_uuid TEXT NOT NULL,
+    PRIMARY KEY(provider, subject),
+    FOREIGN KEY(user_uuid) REFERENCES users(uuid)
+);
+
+CREATE INDEX IF NOT EXISTS user_identities_user_uuid ON user_identities(user_uuid);
@@ -0,0 +1,5 @@
+ALTER TABLE users DROP COLUMN deleted_at;
+ALTER TABLE users DROP COLUMN locked_until;
+ALTER TABLE users DROP COLUMN failed_login_attempts;
+
+DROP TABLE user_roles;
@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS user_roles (
+    user_uuid TEXT NOT NULL,
+    role TEXT NOT NULL,
+    created_at INTEGER NOT NULL, -- UNIX time
+    created_by_uuid TEXT NOT NULL,
+    PRIMARY KEY(user_uuid, role),
+    FOREIGN KEY(user_uuid) REFERENCES users(uuid)
+);
+
+-- sqlite adds one column per statement
+ALTER TABLE users ADD COLUMN failed_login_attempts INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN locked_until INTEGER; -- UNIX time
+ALTER TABLE users ADD COLUMN deleted_at INTEGER; -- UNIX time
@@ -0,0 +1,21 @@
+CREATE TABLE IF NOT EXISTS outbox (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    uuid TEXT NOT NULL UNIQUE,
+    aggregate_type TEXT NOT NULL,
+    aggregate_uuid TEXT NOT NULL,
+    event_type TEXT NOT NULL,
+    payload TEXT NOT NULL, -- JSON
+    created_at INTEGER NOT NULL, -- UNIX time
+    published_at INTEGER -- UNIX time
+);
+
+CREATE INDEX IF NOT EXISTS outbox_published_at ON outbox(published_at, id);
+
+CREATE TABLE IF NOT EXISTS outbox_leases (
+    name TEXT NOT NULL,
+    holder TEXT NOT NULL,
+    expires_at INTEGER NOT NULL, -- UNIX time
+    PRIMARY KEY(name)
+);
+
+INSERT INTO outbox_leases (name, holder, expires_at) VALUES ('relay', '', 0);
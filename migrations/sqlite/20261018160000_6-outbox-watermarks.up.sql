@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS outbox_watermarks (
+    name TEXT NOT NULL,
+    event_id INTEGER NOT NULL,
+    PRIMARY KEY(name)
+);
+
+INSERT INTO outbox_watermarks (name, event_id) VALUES ('pruned', 0);
@@ -0,0 +1,33 @@
+CREATE TABLE IF NOT EXISTS webhooks (
+    uuid TEXT NOT NULL,
+    url TEXT NOT NULL,
+    secret TEXT NOT NULL,
+    event_types TEXT NOT NULL, -- comma separated, empty for every type
+    created_by_uuid TEXT NOT NULL,
+    created_at INTEGER NOT NULL, -- UNIX time
+    PRIMARY KEY(uuid)
+);
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    uuid TEXT NOT NULL,
+    webhook_uuid TEXT NOT NULL,
+    event_id INTEGER NOT NULL,
+    event_uuid TEXT NOT NULL,
+    event_type TEXT NOT NULL,
+    aggregate_type TEXT NOT NULL,
+    aggregate_uuid TEXT NOT NULL,
+    payload TEXT NOT NULL, -- JSON
+    event_created_at INTEGER NOT NULL, -- UNIX time
+    status TEXT NOT NULL,
+    attempts INTEGER NOT NULL,
+    next_attempt_at INTEGER NOT NULL, -- UNIX time
+    last_error TEXT NOT NULL,
+    last_status_code INTEGER NOT NULL,
+    created_at INTEGER NOT NULL, -- UNIX time
+    delivered_at INTEGER, -- UNIX time
+    PRIMARY KEY(uuid),
+    FOREIGN KEY(webhook_uuid) REFERENCES webhooks(uuid)
+);
+
+CREATE INDEX IF NOT EXISTS webhook_deliveries_status ON webhook_deliveries(status, next_attempt_at);
+CREATE INDEX IF NOT EXISTS webhook_deliveries_webhook_uuid ON webhook_deliveries(webhook_uuid, created_at);
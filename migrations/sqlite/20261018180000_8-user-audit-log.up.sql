@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS user_audit_log (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    uuid TEXT NOT NULL UNIQUE,
+    user_uuid TEXT NOT NULL,
+    actor_uuid TEXT NOT NULL,
+    action TEXT NOT NULL,
+    changes TEXT NOT NULL, -- JSON
+    client_ip TEXT NOT NULL,
+    request_id TEXT NOT NULL,
+    created_at INTEGER NOT NULL -- UNIX time
+);
+
+CREATE INDEX IF NOT EXISTS user_audit_log_user_uuid ON user_audit_log(user_uuid, id);
+CREATE INDEX IF NOT EXISTS user_audit_log_actor_uuid ON user_audit_log(actor_uuid, id);
@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS data_exports (
+    uuid TEXT NOT NULL,
+    user_uuid TEXT NOT NULL,
+    requested_by_uuid TEXT NOT NULL,
+    format TEXT NOT NULL,
+    status TEXT NOT NULL,
+    claimed_until INTEGER NOT NULL, -- UNIX time
+    data BLOB,
+    size INTEGER NOT NULL,
+    error TEXT NOT NULL,
+    created_at INTEGER NOT NULL, -- UNIX time
+    completed_at INTEGER, -- UNIX time
+    PRIMARY KEY(uuid)
+);
+
+CREATE INDEX IF NOT EXISTS data_exports_status ON data_exports(status, created_at);
+CREATE INDEX IF NOT EXISTS data_exports_user_uuid ON data_exports(user_uuid, created_at);
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS user_erasures (
+    uuid TEXT NOT NULL,
+    user_uuid TEXT NOT NULL UNIQUE,
+    tombstone_uuid TEXT NOT NULL,
+    requested_by_uuid TEXT NOT NULL,
+    status TEXT NOT NULL,
+    erased TEXT NOT NULL, -- JSON
+    created_at INTEGER NOT NULL, -- UNIX time
+    completed_at INTEGER, -- UNIX time
+    PRIMARY KEY(uuid)
+);
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS user_user_follows_followed_uuid;
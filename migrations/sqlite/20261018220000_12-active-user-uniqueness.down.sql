@@ -0,0 +1,56 @@
+-- the unique constraints are put back by rebuilding users, which fails if
+-- a deleted user shares their username or email with another user
+PRAGMA foreign_keys=OFF;
+
+CREATE TABLE users_rebuilt (
+    uuid TEXT NOT NULL UNIQUE,
+    created_at INTEGER NOT NULL, -- UNIX time
+    created_by_uuid TEXT NOT NULL,
+    updated_at INTEGER, -- UNIX time
+    updated_by_uuid TEXT,
+    username TEXT NOT NULL UNIQUE,
+    email TEXT NOT NULL UNIQUE,
+    hashed_password TEXT NOT NULL,
+    display_name TEXT,
+    self_description TEXT,
+    failed_login_attempts INTEGER NOT NULL DEFAULT 0,
+    locked_until INTEGER, -- UNIX time
+    deleted_at INTEGER, -- UNIX time
+    PRIMARY KEY(uuid)
+);
+
+INSERT INTO users_rebuilt (
+    uuid,
+    created_at,
+    created_by_uuid,
+    updated_at,
+    updated_by_uuid,
+    username,
+    email,
+    hashed_password,
+    display_name,
+    self_description,
+    failed_login_attempts,
+    locked_until,
+    deleted_at
+)
+SELECT
+    uuid,
+    created_at,
+    created_by_uuid,
+    updated_at,
+    updated_by_uuid,
+    username,
+    email,
+    hashed_password,
+    display_name,
+    self_description,
+    failed_login_attempts,
+    locked_until,
+    deleted_at
+FROM users;
+
+DROP TABLE users;
+ALTER TABLE users_rebuilt RENAME TO users;
+
+PRAGMA foreign_keys=ON;
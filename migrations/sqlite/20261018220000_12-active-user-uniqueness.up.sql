@@ -0,0 +1,62 @@
+-- usernames and emails are only taken by users not deleted, so they can be
+-- signed up with again once their user is deleted. sqlite cannot drop the
+-- unique constraints of a column, so users is rebuilt without them the way
+-- https://www.sqlite.org/lang_altertable.html lays out, with the foreign
+-- keys on it off until it is back under its name.
+PRAGMA foreign_keys=OFF;
+
+CREATE TABLE users_rebuilt (
+    uuid TEXT NOT NULL UNIQUE,
+    created_at INTEGER NOT NULL, -- UNIX time
+    created_by_uuid TEXT NOT NULL,
+    updated_at INTEGER, -- UNIX time
+    updated_by_uuid TEXT,
+    username TEXT NOT NULL,
+    email TEXT NOT NULL,
+    hashed_password TEXT NOT NULL,
+    display_name TEXT,
+    self_description TEXT,
+    failed_login_attempts INTEGER NOT NULL DEFAULT 0,
+    locked_until INTEGER, -- UNIX time
+    deleted_at INTEGER, -- UNIX time
+    PRIMARY KEY(uuid)
+);
+
+INSERT INTO users_rebuilt (
+    uuid,
+    created_at,
+    created_by_uuid,
+    updated_at,
+    updated_by_uuid,
+    username,
+    email,
+    hashed_password,
+    display_name,
+    self_description,
+    failed_login_attempts,
+    locked_until,
+    deleted_at
+)
+SELECT
+    uuid,
+    created_at,
+    created_by_uuid,
+    updated_at,
+    updated_by_uuid,
+    username,
+    email,
+    hashed_password,
+    display_name,
+    self_description,
+    failed_login_attempts,
+    locked_until,
+    deleted_at
+FROM users;
+
+DROP TABLE users;
+ALTER TABLE users_rebuilt RENAME TO users;
+
+CREATE UNIQUE INDEX IF NOT EXISTS users_active_username ON users(username) WHERE deleted_at IS NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS users_active_email ON users(email) WHERE deleted_at IS NULL;
+
+PRAGMA foreign_keys=ON;
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS user_blocks (
+    blocker_uuid TEXT NOT NULL,
+    blocked_uuid TEXT NOT NULL,
+    created_at INTEGER NOT NULL, -- UNIX time
+    PRIMARY KEY(blocker_uuid, blocked_uuid),
+    FOREIGN KEY(blocker_uuid) REFERENCES users(uuid),
+    FOREIGN KEY(blocked_uuid) REFERENCES users(uuid)
+);
+
+CREATE INDEX IF NOT EXISTS user_blocks_blocked_uuid ON user_blocks(blocked_uuid);
@@ -1,3 +1,5 @@
 #!/bin/bash
 
-migrate -source file://migrations/ -database mysql://root:password@/srcabl_users up
+# migrates the database in config.yml's storage section with the migrations
+# embedded in the binary, up unless other migrate arguments are given
+go run ./cmd migrate "${@:-up}"
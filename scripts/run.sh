@@ -1,3 +1,3 @@
 #!/bin/bash
 
-go run cmd/main.go
+go run ./cmd serve